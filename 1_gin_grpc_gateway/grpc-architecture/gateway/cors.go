@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// corsGroup is the CORS policy for every path under Prefix. Origins are
+// exact ("https://app.example.com"), "*" for any, or contain one * standing
+// for a part of the host or the port ("https://*.example.com",
+// "http://localhost:*").
+type corsGroup struct {
+	Prefix           string   `json:"prefix"`
+	AllowOrigins     []string `json:"allow_origins"`
+	AllowMethods     []string `json:"allow_methods"`
+	AllowHeaders     []string `json:"allow_headers"`
+	ExposeHeaders    []string `json:"expose_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           int      `json:"max_age"`
+}
+
+// corsConfig is the CORS_FILE format:
+//
+//	{
+//	  "groups": [
+//	    {"prefix": "/user", "allow_origins": ["https://*.example.com"],
+//	     "allow_credentials": true, "max_age": 600},
+//	    {"prefix": "/health", "allow_origins": ["*"]}
+//	  ]
+//	}
+type corsConfig struct {
+	Groups []corsGroup `json:"groups"`
+}
+
+func (g corsGroup) validate() error {
+	if !strings.HasPrefix(g.Prefix, "/") {
+		return fmt.Errorf("prefix %q must start with /", g.Prefix)
+	}
+	if len(g.AllowOrigins) == 0 {
+		return errors.New("needs at least one origin")
+	}
+	for _, o := range g.AllowOrigins {
+		if o == "*" && g.AllowCredentials {
+			// Browsers refuse "*" on credentialed requests, and echoing the
+			// caller's origin instead would let any site read them.
+			return errors.New("origin * cannot be combined with allow_credentials")
+		}
+		if o != "*" && strings.Count(o, "*") > 1 {
+			return fmt.Errorf("origin %q has more than one *", o)
+		}
+	}
+	if g.MaxAge < 0 {
+		return errors.New("max_age must not be negative")
+	}
+	return nil
+}
+
+// loadCORSGroups reads the groups in path, longest prefix first.
+func loadCORSGroups(path string) ([]corsGroup, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg corsConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for i, g := range cfg.Groups {
+		if err := g.validate(); err != nil {
+			return nil, fmt.Errorf("group %d: %w", i, err)
+		}
+		cfg.Groups[i].Prefix = strings.TrimSuffix(g.Prefix, "/")
+	}
+	sort.SliceStable(cfg.Groups, func(i, j int) bool { return len(cfg.Groups[i].Prefix) > len(cfg.Groups[j].Prefix) })
+	return cfg.Groups, nil
+}
+
+func (g corsGroup) allowOrigin(origin string) string {
+	for _, o := range g.AllowOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if origin != "" && matchOrigin(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// matchOrigin reports whether origin matches pattern. A * in pattern matches
+// a non-empty run of characters that does not cross into the path.
+func matchOrigin(pattern, origin string) bool {
+	pattern, origin = strings.ToLower(pattern), strings.ToLower(origin)
+	before, after, ok := strings.Cut(pattern, "*")
+	if !ok {
+		return pattern == origin
+	}
+	if len(origin) <= len(before)+len(after) || !strings.HasPrefix(origin, before) || !strings.HasSuffix(origin, after) {
+		return false
+	}
+	return !strings.Contains(origin[len(before):len(origin)-len(after)], "/")
+}
+
+// corsMiddleware adds the headers of the first group, longest prefix first,
+// that covers the path, and answers CORS preflights itself. Preflights from
+// origins the group does not allow get 403; paths no group covers are left
+// alone.
+func corsMiddleware(groups []corsGroup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		for _, g := range groups {
+			if path != g.Prefix && !strings.HasPrefix(path, g.Prefix+"/") && g.Prefix != "" {
+				continue
+			}
+			origin := g.allowOrigin(c.GetHeader("Origin"))
+			preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Origin") != "" && c.GetHeader("Access-Control-Request-Method") != ""
+			if origin == "" {
+				if preflight {
+					c.AbortWithStatus(http.StatusForbidden)
+					return
+				}
+				break
+			}
+			h := c.Writer.Header()
+			h.Set("Access-Control-Allow-Origin", origin)
+			h.Add("Vary", "Origin")
+			if g.AllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if !preflight {
+				if len(g.ExposeHeaders) > 0 {
+					h.Set("Access-Control-Expose-Headers", strings.Join(g.ExposeHeaders, ", "))
+				}
+				break
+			}
+			methods := g.AllowMethods
+			if len(methods) == 0 {
+				methods = []string{"GET", "POST"}
+			}
+			h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			if len(g.AllowHeaders) > 0 {
+				h.Set("Access-Control-Allow-Headers", strings.Join(g.AllowHeaders, ", "))
+			} else if req := c.GetHeader("Access-Control-Request-Headers"); req != "" {
+				h.Set("Access-Control-Allow-Headers", req)
+			}
+			if g.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(g.MaxAge))
+			}
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadCORSGroups(t *testing.T) {
+	for name, tc := range map[string]struct {
+		config  string
+		wantErr bool
+	}{
+		"ok":               {`{"groups": [{"prefix": "/user/", "allow_origins": ["*"]}, {"prefix": "/", "allow_origins": ["*"]}]}`, false},
+		"no origins":       {`{"groups": [{"prefix": "/user"}]}`, true},
+		"relative prefix":  {`{"groups": [{"prefix": "user", "allow_origins": ["*"]}]}`, true},
+		"two wildcards":    {`{"groups": [{"prefix": "/user", "allow_origins": ["https://*.*.com"]}]}`, true},
+		"any credentialed": {`{"groups": [{"prefix": "/user", "allow_origins": ["*"], "allow_credentials": true}]}`, true},
+	} {
+		path := filepath.Join(t.TempDir(), "cors.json")
+		if err := os.WriteFile(path, []byte(tc.config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		groups, err := loadCORSGroups(path)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: err = %v, want error %v", name, err, tc.wantErr)
+		}
+		if err == nil && groups[0].Prefix != "/user" {
+			t.Errorf("%s: groups not longest prefix first: %+v", name, groups)
+		}
+	}
+}
+
+func TestCORS(t *testing.T) {
+	prev := corsGroups
+	corsGroups = []corsGroup{
+		{Prefix: "/user", AllowOrigins: []string{"https://*.example.com"}, AllowCredentials: true,
+			AllowMethods: []string{"GET", "POST"}, MaxAge: 600},
+		{Prefix: "/health", AllowOrigins: []string{"*"}},
+	}
+	t.Cleanup(func() { corsGroups = prev })
+	h := newHarness(t)
+
+	res, _ := h.do(t, http.MethodOptions, "/user", "", http.Header{
+		"Origin":                         {"https://app.example.com"},
+		"Access-Control-Request-Method":  {"POST"},
+		"Access-Control-Request-Headers": {"Content-Type"},
+	})
+	if res.StatusCode != http.StatusNoContent ||
+		res.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		res.Header.Get("Access-Control-Allow-Methods") != "GET, POST" ||
+		res.Header.Get("Access-Control-Allow-Headers") != "Content-Type" ||
+		res.Header.Get("Access-Control-Allow-Credentials") != "true" ||
+		res.Header.Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("preflight /user = %d %v", res.StatusCode, res.Header)
+	}
+	res, body := h.do(t, http.MethodGet, "/user/123", "", http.Header{"Origin": {"https://app.example.com"}})
+	if res.StatusCode != http.StatusOK || res.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("GET /user/123 = %d %s %v", res.StatusCode, body, res.Header)
+	}
+
+	// Other origins get no CORS headers, and their preflights are refused.
+	res, _ = h.do(t, http.MethodGet, "/user/123", "", http.Header{"Origin": {"https://app.example.com.evil.com"}})
+	if res.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("GET /user/123 from other origin got ACAO %q", res.Header.Get("Access-Control-Allow-Origin"))
+	}
+	res, _ = h.do(t, http.MethodOptions, "/user", "", http.Header{
+		"Origin":                        {"https://evil.test"},
+		"Access-Control-Request-Method": {"POST"},
+	})
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("preflight from other origin = %d, want 403", res.StatusCode)
+	}
+
+	res, _ = h.do(t, http.MethodGet, "/health", "", http.Header{"Origin": {"https://elsewhere.test"}})
+	if res.Header.Get("Access-Control-Allow-Origin") != "*" || res.Header.Get("Access-Control-Allow-Credentials") != "" {
+		t.Errorf("GET /health = %v", res.Header)
+	}
+}
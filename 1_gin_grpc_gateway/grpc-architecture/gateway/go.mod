@@ -3,11 +3,14 @@ module gateway
 go 1.24.3
 
 require (
+	api v1.0.0
 	github.com/gin-gonic/gin v1.9.1
 	google.golang.org/grpc v1.72.0
-	google.golang.org/protobuf v1.36.5
+	user-service v1.0.0
 )
 
+require google.golang.org/protobuf v1.36.5 // indirect
+
 require (
 	github.com/bytedance/sonic v1.9.1 // indirect
 	github.com/chenzhuoyu/base64x v0.0.0-20221115062448-fe3a3abad311 // indirect
@@ -35,3 +38,7 @@ require (
 	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace api => ../../../api
+
+replace user-service => ../user-service
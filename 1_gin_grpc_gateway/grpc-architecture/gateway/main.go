@@ -2,26 +2,68 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
 
-	pb "gateway/proto"
+	orderpb "api/order"
+	pb "api/user"
 )
 
 var (
-	userClient pb.UserServiceClient
-	grpcServer *grpc.Server
+	userClient  pb.UserServiceClient
+	orderClient orderpb.OrderServiceClient
+	grpcServer  *grpc.Server
+	// corsGroups are the CORS policies from CORS_FILE; see corsConfig.
+	corsGroups []corsGroup
 )
 
 func init() {
+	if path := os.Getenv("CORS_FILE"); path != "" {
+		groups, err := loadCORSGroups(path)
+		if err != nil {
+			log.Fatalf("failed to load CORS groups: %v", err)
+		}
+		corsGroups = groups
+	}
+	if err := loadVersionDates(); err != nil {
+		log.Fatalf("failed to read API version dates: %v", err)
+	}
+
+	orderAddr := os.Getenv("ORDER_SERVICE_ADDR")
+	if orderAddr == "" {
+		orderAddr = "localhost:50054"
+	}
+	orderConn, err := grpc.NewClient(orderAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("did not connect to order-service: %v", err)
+	}
+	orderClient = orderpb.NewOrderServiceClient(orderConn)
+
+	// ROUTES_FILE splits traffic across several user-service clusters; see
+	// routesConfig for the format.
+	if path := os.Getenv("ROUTES_FILE"); path != "" {
+		routes, err := newClusterRouter(path, time.Second, nil)
+		if err != nil {
+			log.Fatalf("failed to load routes: %v", err)
+		}
+		userClient = pb.NewUserServiceClient(routes)
+		return
+	}
 	conn, err := grpc.Dial("localhost:50052", grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
 		log.Fatalf("did not connect: %v", err)
@@ -29,6 +71,22 @@ func init() {
 	userClient = pb.NewUserServiceClient(conn)
 }
 
+// dialCluster connects to every address of a routing cluster, balancing
+// round robin.
+func dialCluster(name string, addrs []string, opts []grpc.DialOption) (*grpc.ClientConn, error) {
+	res := manual.NewBuilderWithScheme("cluster")
+	state := resolver.State{}
+	for _, a := range addrs {
+		state.Addresses = append(state.Addresses, resolver.Address{Addr: a})
+	}
+	res.InitialState(state)
+	return grpc.NewClient(res.Scheme()+":///"+name, append([]grpc.DialOption{
+		grpc.WithResolvers(res),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(`{"loadBalancingPolicy": "round_robin"}`),
+	}, opts...)...)
+}
+
 type gatewayServer struct {
 	pb.UnimplementedUserServiceServer
 }
@@ -51,8 +109,7 @@ func startGRPCServer(wg *sync.WaitGroup) {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	grpcServer = grpc.NewServer()
-	pb.RegisterUserServiceServer(grpcServer, &gatewayServer{})
+	grpcServer = newGRPCServer()
 
 	log.Printf("gRPC server listening at %v", lis.Addr())
 	if err := grpcServer.Serve(lis); err != nil {
@@ -60,36 +117,75 @@ func startGRPCServer(wg *sync.WaitGroup) {
 	}
 }
 
-func startHTTPServer(wg *sync.WaitGroup) {
-	defer wg.Done()
+func newGRPCServer() *grpc.Server {
+	s := grpc.NewServer()
+	pb.RegisterUserServiceServer(s, &gatewayServer{})
+	// Reflection lets grpcurl call :8081 without .proto files.
+	reflection.Register(s)
+	return s
+}
 
+func newRouter() *gin.Engine {
 	// Create Gin router
 	router := gin.Default()
+	router.Use(corsMiddleware(corsGroups))
 	// Add health check endpoint
 	router.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"status": "ok"})
 	})
+	// The user API is versioned under /v1; the unversioned paths serve v1
+	// too until their sunset.
+	for _, g := range []*gin.RouterGroup{
+		router.Group("/v1", apiVersionHeaders(false)),
+		router.Group("", apiVersionHeaders(true)),
+	} {
+		g.GET("/user/:id", getUserHandler)
+		g.POST("/user", createUserHandler)
+	}
 
-	router.GET("/user/:id", getUserHandler)
-	router.POST("/user", createUserHandler)
-
-	// Route /orders/* requests to Gin
+	// Route /orders/* requests to order-service
 	orderGroup := router.Group("/orders")
 	{
-		orderGroup.GET("", func(c *gin.Context) {
-			c.JSON(http.StatusOK, gin.H{"data": "order list"})
-		})
-		orderGroup.GET("/:id", func(c *gin.Context) {
-			c.JSON(http.StatusOK, gin.H{"order": c.Param("id")})
-		})
+		orderGroup.POST("", createOrderHandler)
+		orderGroup.GET("", listOrdersHandler)
+		orderGroup.GET("/:id", getOrderHandler)
 	}
 
+	return router
+}
+
+func startHTTPServer(wg *sync.WaitGroup) {
+	defer wg.Done()
+
 	log.Println("HTTP server started on :8080")
-	if err := http.ListenAndServe(":8080", router); err != nil {
+	if err := http.ListenAndServe(":8080", newRouter()); err != nil {
 		log.Fatalf("failed to serve HTTP: %v", err)
 	}
 }
 
+// newAdminHandler serves the per-cluster upstream counters. They describe
+// the deployment and its traffic, so they are kept off the public port.
+func newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// startAdminServer serves newAdminHandler on ADMIN_ADDR, by default
+// localhost:8082 so only the host can read it.
+func startAdminServer(wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	addr := os.Getenv("ADMIN_ADDR")
+	if addr == "" {
+		addr = "localhost:8082"
+	}
+	log.Printf("Admin server started on %s", addr)
+	if err := http.ListenAndServe(addr, newAdminHandler()); err != nil {
+		log.Fatalf("failed to serve admin HTTP: %v", err)
+	}
+}
+
 func getUserHandler(c *gin.Context) {
 	userID := c.Param("id")
 
@@ -124,6 +220,65 @@ func createUserHandler(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 }
 
+func createOrderHandler(c *gin.Context) {
+	var req orderpb.CreateOrderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	md := prepareMetadata(c.Request.Header)
+	ctx := metadata.NewOutgoingContext(c.Request.Context(), md)
+
+	res, err := orderClient.CreateOrder(ctx, &req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+func getOrderHandler(c *gin.Context) {
+	md := prepareMetadata(c.Request.Header)
+	ctx := metadata.NewOutgoingContext(c.Request.Context(), md)
+
+	res, err := orderClient.GetOrder(ctx, &orderpb.GetOrderRequest{OrderId: c.Param("id")})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// listOrdersHandler serves GET /orders?user_id=...&page_size=...&page_token=...
+func listOrdersHandler(c *gin.Context) {
+	req := &orderpb.ListOrdersByUserRequest{
+		UserId:    c.Query("user_id"),
+		PageToken: c.Query("page_token"),
+	}
+	if v := c.Query("page_size"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid page_size"})
+			return
+		}
+		req.PageSize = int32(n)
+	}
+
+	md := prepareMetadata(c.Request.Header)
+	ctx := metadata.NewOutgoingContext(c.Request.Context(), md)
+
+	res, err := orderClient.ListOrdersByUser(ctx, req)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
 func prepareMetadata(header http.Header) metadata.MD {
 	md := metadata.New(make(map[string]string))
 	for k, v := range header {
@@ -134,7 +289,7 @@ func prepareMetadata(header http.Header) metadata.MD {
 
 func main() {
 	var wg sync.WaitGroup
-	wg.Add(2)
+	wg.Add(3)
 
 	// 启动 gRPC 服务
 	go startGRPCServer(&wg)
@@ -142,5 +297,8 @@ func main() {
 	// 启动 HTTP 服务
 	go startHTTPServer(&wg)
 
+	// 启动管理服务（/debug/vars）
+	go startAdminServer(&wg)
+
 	wg.Wait()
 }
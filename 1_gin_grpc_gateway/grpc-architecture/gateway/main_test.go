@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	orderpb "api/order"
+	pb "api/user"
+	"user-service/userserver"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	m.Run()
+}
+
+// mdRecorder keeps the incoming metadata of the last call to a server, to
+// check what the gateway forwarded.
+type mdRecorder struct {
+	mu   sync.Mutex
+	last metadata.MD
+}
+
+func (r *mdRecorder) metadata() metadata.MD {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+func (r *mdRecorder) interceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	r.mu.Lock()
+	r.last = md
+	r.mu.Unlock()
+	return handler(ctx, req)
+}
+
+// fakeOrderService knows a single order, 1001, placed by user 123.
+type fakeOrderService struct {
+	orderpb.UnimplementedOrderServiceServer
+}
+
+var fakeOrder = &orderpb.Order{Id: "1001", UserId: "123", TotalCents: 2500,
+	Items: []*orderpb.OrderItem{{Sku: "book", Quantity: 2, UnitPriceCents: 1250}}}
+
+func (fakeOrderService) CreateOrder(ctx context.Context, req *orderpb.CreateOrderRequest) (*orderpb.Order, error) {
+	if req.UserId != "123" {
+		return nil, status.Errorf(codes.FailedPrecondition, "user %q does not exist", req.UserId)
+	}
+	return fakeOrder, nil
+}
+
+func (fakeOrderService) GetOrder(ctx context.Context, req *orderpb.GetOrderRequest) (*orderpb.Order, error) {
+	if req.OrderId != fakeOrder.Id {
+		return nil, status.Errorf(codes.NotFound, "order %q not found", req.OrderId)
+	}
+	return fakeOrder, nil
+}
+
+func (fakeOrderService) ListOrdersByUser(ctx context.Context, req *orderpb.ListOrdersByUserRequest) (*orderpb.ListOrdersByUserResponse, error) {
+	if req.UserId != "123" || req.PageSize != 5 {
+		return &orderpb.ListOrdersByUserResponse{}, nil
+	}
+	return &orderpb.ListOrdersByUserResponse{Orders: []*orderpb.Order{fakeOrder}}, nil
+}
+
+// harness boots user-service's userServer, gatewayServer and the Gin router
+// on in-memory listeners and points the package-level userClient and
+// orderClient at userServer and a fake order-service served next to it.
+type harness struct {
+	upstream   *mdRecorder
+	upSrv      *grpc.Server
+	grpcClient pb.UserServiceClient
+	grpcServer *grpc.Server
+	grpcDone   chan error
+	http       *httptest.Server
+}
+
+func newHarness(t *testing.T) *harness {
+	t.Helper()
+	h := &harness{upstream: &mdRecorder{}, grpcDone: make(chan error, 1)}
+
+	upLis := bufconn.Listen(1 << 20)
+	upSrv := userserver.NewServer(grpc.ChainUnaryInterceptor(h.upstream.interceptor))
+	orderpb.RegisterOrderServiceServer(upSrv, fakeOrderService{})
+	h.upSrv = upSrv
+	go upSrv.Serve(upLis)
+	upConn := dialBufconn(t, upLis)
+
+	prevClient := userClient
+	userClient = pb.NewUserServiceClient(upConn)
+	prevOrders := orderClient
+	orderClient = orderpb.NewOrderServiceClient(upConn)
+
+	gwLis := bufconn.Listen(1 << 20)
+	h.grpcServer = newGRPCServer()
+	go func() { h.grpcDone <- h.grpcServer.Serve(gwLis) }()
+	gwConn := dialBufconn(t, gwLis)
+	h.grpcClient = pb.NewUserServiceClient(gwConn)
+
+	h.http = httptest.NewServer(newRouter())
+
+	t.Cleanup(func() {
+		h.http.Close()
+		h.grpcServer.Stop()
+		gwConn.Close()
+		upConn.Close()
+		upSrv.Stop()
+		userClient = prevClient
+		orderClient = prevOrders
+	})
+	return h
+}
+
+func dialBufconn(t *testing.T, lis *bufconn.Listener) *grpc.ClientConn {
+	t.Helper()
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dial bufconn: %v", err)
+	}
+	return conn
+}
+
+func (h *harness) do(t *testing.T, method, path, body string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, h.http.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := h.http.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return res, string(b)
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestHealth(t *testing.T) {
+	h := newHarness(t)
+	res, body := h.do(t, http.MethodGet, "/health", "", nil)
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, "ok") {
+		t.Errorf("GET /health = %d %s", res.StatusCode, body)
+	}
+}
+
+func TestDebugVarsOnlyOnAdminPort(t *testing.T) {
+	h := newHarness(t)
+	if res, _ := h.do(t, http.MethodGet, "/debug/vars", "", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /debug/vars on the public port = %d, want 404", res.StatusCode)
+	}
+
+	rec := httptest.NewRecorder()
+	newAdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"upstream_clusters"`) {
+		t.Errorf("GET /debug/vars on the admin port = %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRESTGetUser(t *testing.T) {
+	h := newHarness(t)
+	res, body := h.do(t, http.MethodGet, "/user/123", "", nil)
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `"John Doe"`) {
+		t.Errorf("GET /user/123 = %d %s", res.StatusCode, body)
+	}
+
+	// Every upstream error is reported as a 500 by this gateway.
+	h.upSrv.Stop()
+	res, body = h.do(t, http.MethodGet, "/user/123", "", nil)
+	if res.StatusCode != http.StatusInternalServerError || !strings.Contains(body, "Unavailable") {
+		t.Errorf("GET /user/123 with user-service down = %d %s, want 500", res.StatusCode, body)
+	}
+}
+
+func TestRESTCreateUser(t *testing.T) {
+	h := newHarness(t)
+	res, body := h.do(t, http.MethodPost, "/user", `{"name":"Alice","email":"alice@example.com"}`,
+		http.Header{"Content-Type": {"application/json"}})
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `"Alice"`) {
+		t.Errorf("POST /user = %d %s", res.StatusCode, body)
+	}
+
+	res, body = h.do(t, http.MethodPost, "/user", `{not json`, nil)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST /user with bad JSON = %d %s, want 400", res.StatusCode, body)
+	}
+}
+
+func TestRESTOrders(t *testing.T) {
+	h := newHarness(t)
+	json := http.Header{"Content-Type": {"application/json"}}
+
+	res, body := h.do(t, http.MethodPost, "/orders", `{"user_id":"123","items":[{"sku":"book","quantity":2,"unit_price_cents":1250}]}`, json)
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `"total_cents":2500`) {
+		t.Errorf("POST /orders = %d %s", res.StatusCode, body)
+	}
+	res, body = h.do(t, http.MethodPost, "/orders", `{"user_id":"999","items":[{"sku":"book","quantity":1}]}`, json)
+	if res.StatusCode != http.StatusInternalServerError || !strings.Contains(body, "does not exist") {
+		t.Errorf("POST /orders for unknown user = %d %s, want 500", res.StatusCode, body)
+	}
+
+	res, body = h.do(t, http.MethodGet, "/orders/1001", "", nil)
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `"id":"1001"`) {
+		t.Errorf("GET /orders/1001 = %d %s", res.StatusCode, body)
+	}
+
+	res, body = h.do(t, http.MethodGet, "/orders?user_id=123&page_size=5", "", nil)
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `"id":"1001"`) {
+		t.Errorf("GET /orders?user_id=123 = %d %s", res.StatusCode, body)
+	}
+	res, body = h.do(t, http.MethodGet, "/orders?user_id=123&page_size=x", "", nil)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /orders with bad page_size = %d %s, want 400", res.StatusCode, body)
+	}
+}
+
+func TestRESTMetadataForwarding(t *testing.T) {
+	h := newHarness(t)
+	h.do(t, http.MethodGet, "/user/123", "", http.Header{
+		"Authorization": {"Bearer token"},
+		"X-Request-Id":  {"abc"},
+	})
+	md := h.upstream.metadata()
+	if got := md.Get("authorization"); len(got) != 1 || got[0] != "Bearer token" {
+		t.Errorf("authorization = %v", got)
+	}
+	if got := md.Get("x-request-id"); len(got) != 1 || got[0] != "abc" {
+		t.Errorf("x-request-id = %v", got)
+	}
+}
+
+func TestGRPCGetAndCreateUser(t *testing.T) {
+	h := newHarness(t)
+	ctx := testContext(t)
+
+	got, err := h.grpcClient.GetUser(ctx, &pb.GetUserRequest{UserId: "123"})
+	if err != nil || got.Name != "John Doe" {
+		t.Fatalf("GetUser = %v, %v", got, err)
+	}
+	created, err := h.grpcClient.CreateUser(ctx, &pb.CreateUserRequest{Name: "Alice", Email: "alice@example.com"})
+	if err != nil || created.Name != "Alice" {
+		t.Fatalf("CreateUser = %v, %v", created, err)
+	}
+
+	h.upSrv.Stop()
+	_, err = h.grpcClient.GetUser(ctx, &pb.GetUserRequest{UserId: "123"})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("GetUser with user-service down code = %v, want Unavailable", status.Code(err))
+	}
+}
+
+func TestGracefulStop(t *testing.T) {
+	h := newHarness(t)
+	ctx := testContext(t)
+
+	if _, err := h.grpcClient.GetUser(ctx, &pb.GetUserRequest{UserId: "123"}); err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	h.grpcServer.GracefulStop()
+	select {
+	case err := <-h.grpcDone:
+		if err != nil {
+			t.Errorf("Serve returned %v after GracefulStop", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Serve did not return after GracefulStop")
+	}
+	if _, err := h.grpcClient.GetUser(ctx, &pb.GetUserRequest{UserId: "123"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("GetUser after stop code = %v, want Unavailable", status.Code(err))
+	}
+}
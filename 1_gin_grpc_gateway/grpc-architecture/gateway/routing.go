@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// This file is kept identical in both gateways, and the copy in
+// 2_gin_grpc_ecosystem_gateway is the canonical one: change it there and copy
+// it to 1_gin_grpc_gateway. Each gateway provides dialCluster, which connects
+// to the addresses of one cluster.
+
+// retiredConnGrace is how long a cluster connection removed by a reload stays
+// open for calls that already picked it.
+const retiredConnGrace = 30 * time.Second
+
+// clusterStats holds per-cluster counters, served at /debug/vars under
+// "upstream_clusters".
+var clusterStats = expvar.NewMap("upstream_clusters")
+
+// routesConfig is the JSON routing file:
+//
+//	{
+//	  "clusters": {
+//	    "stable": {"addrs": ["localhost:50052"]},
+//	    "canary": {"addrs": ["localhost:50053"]}
+//	  },
+//	  "rules": [
+//	    {"header": {"name": "X-Canary", "value": "true"}, "cluster": "canary"},
+//	    {"claim": {"name": "beta", "value": "true"}, "cluster": "canary"},
+//	    {"weights": {"stable": 90, "canary": 10}}
+//	  ],
+//	  "default": "stable"
+//	}
+//
+// Rules are tried in order and the first match wins; a weights rule always
+// matches. Requests no rule matches go to the default cluster.
+type routesConfig struct {
+	Clusters map[string]struct {
+		Addrs []string `json:"addrs"`
+	} `json:"clusters"`
+	Rules   []routeRule `json:"rules"`
+	Default string      `json:"default"`
+}
+
+type routeMatch struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type routeRule struct {
+	Header  *routeMatch    `json:"header,omitempty"`
+	Claim   *routeMatch    `json:"claim,omitempty"`
+	Weights map[string]int `json:"weights,omitempty"`
+	Cluster string         `json:"cluster,omitempty"`
+}
+
+func (cfg *routesConfig) validate() error {
+	if len(cfg.Clusters) == 0 {
+		return errors.New("no clusters defined")
+	}
+	known := func(name string) error {
+		if _, ok := cfg.Clusters[name]; !ok {
+			return fmt.Errorf("unknown cluster %q", name)
+		}
+		return nil
+	}
+	if err := known(cfg.Default); err != nil {
+		return fmt.Errorf("default: %w", err)
+	}
+	for name, c := range cfg.Clusters {
+		if len(c.Addrs) == 0 {
+			return fmt.Errorf("cluster %q has no addrs", name)
+		}
+	}
+	for i, r := range cfg.Rules {
+		switch {
+		case r.Weights != nil:
+			total := 0
+			for name, w := range r.Weights {
+				if err := known(name); err != nil {
+					return fmt.Errorf("rule %d: %w", i, err)
+				}
+				if w < 0 {
+					return fmt.Errorf("rule %d: negative weight for %q", i, name)
+				}
+				total += w
+			}
+			if total == 0 {
+				return fmt.Errorf("rule %d: weights sum to zero", i)
+			}
+		case r.Header != nil || r.Claim != nil:
+			if err := known(r.Cluster); err != nil {
+				return fmt.Errorf("rule %d: %w", i, err)
+			}
+		default:
+			return fmt.Errorf("rule %d: needs header, claim or weights", i)
+		}
+	}
+	return nil
+}
+
+type upstreamCluster struct {
+	name  string
+	addrs []string
+	conn  *grpc.ClientConn
+	stats *expvar.Map
+}
+
+type routeTable struct {
+	clusters map[string]*upstreamCluster
+	rules    []routeRule
+	def      *upstreamCluster
+	// headers lists the header names rules look at, lower-cased.
+	headers map[string]bool
+}
+
+// clusterRouter is a grpc.ClientConnInterface that sends each call to one of
+// several named upstream clusters according to routing rules, so it can back
+// any generated client. The rules file is polled and swapped in atomically.
+type clusterRouter struct {
+	path     string
+	dialOpts []grpc.DialOption
+
+	table  atomic.Pointer[routeTable]
+	mu     sync.Mutex // serialises reloads
+	last   []byte
+	cancel context.CancelFunc
+}
+
+// newClusterRouter loads path and dials every cluster with dialOpts. The file
+// is re-read every interval until Close.
+func newClusterRouter(path string, interval time.Duration, dialOpts []grpc.DialOption) (*clusterRouter, error) {
+	r := &clusterRouter{path: path, dialOpts: dialOpts}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := r.reload(); err != nil {
+					log.Printf("[Routing] Keeping previous rules: %v", err)
+				}
+			}
+		}
+	}()
+	return r, nil
+}
+
+// reload re-reads the rules file. Clusters whose address list is unchanged
+// keep their connection; others are dialled afresh and the old connection is
+// closed after a grace period.
+func (r *clusterRouter) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return err
+	}
+	if r.last != nil && bytes.Equal(data, r.last) {
+		return nil
+	}
+	var cfg routesConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("parsing %s: %w", r.path, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return fmt.Errorf("%s: %w", r.path, err)
+	}
+
+	old := r.table.Load()
+	t := &routeTable{
+		clusters: make(map[string]*upstreamCluster, len(cfg.Clusters)),
+		rules:    cfg.Rules,
+		headers:  make(map[string]bool),
+	}
+	for name, c := range cfg.Clusters {
+		if old != nil {
+			if prev, ok := old.clusters[name]; ok && strings.Join(prev.addrs, ",") == strings.Join(c.Addrs, ",") {
+				t.clusters[name] = prev
+				continue
+			}
+		}
+		conn, err := dialCluster(name, c.Addrs, r.dialOpts)
+		if err != nil {
+			for n, uc := range t.clusters {
+				if old == nil || old.clusters[n] != uc {
+					uc.conn.Close()
+				}
+			}
+			return fmt.Errorf("cluster %q: %w", name, err)
+		}
+		stats, _ := clusterStats.Get(name).(*expvar.Map)
+		if stats == nil {
+			stats = new(expvar.Map)
+			for _, key := range []string{"requests", "errors", "latency_us_total"} {
+				stats.Add(key, 0)
+			}
+			clusterStats.Set(name, stats)
+		}
+		t.clusters[name] = &upstreamCluster{name: name, addrs: c.Addrs, conn: conn, stats: stats}
+	}
+	t.def = t.clusters[cfg.Default]
+	for _, rule := range cfg.Rules {
+		if rule.Header != nil {
+			t.headers[strings.ToLower(rule.Header.Name)] = true
+		}
+		if rule.Claim != nil {
+			t.headers["authorization"] = true
+		}
+	}
+
+	r.table.Store(t)
+	r.last = data
+	if old != nil {
+		for name, c := range old.clusters {
+			if t.clusters[name] != c {
+				time.AfterFunc(retiredConnGrace, func() { c.conn.Close() })
+			}
+		}
+	}
+	log.Printf("[Routing] Loaded %d clusters and %d rules from %s", len(t.clusters), len(t.rules), r.path)
+	return nil
+}
+
+// Close stops polling and closes every cluster connection.
+func (r *clusterRouter) Close() {
+	r.cancel()
+	if t := r.table.Load(); t != nil {
+		for _, c := range t.clusters {
+			c.conn.Close()
+		}
+	}
+}
+
+// routesOnHeader reports whether a rule looks at the header key.
+func (r *clusterRouter) routesOnHeader(key string) bool {
+	return r.table.Load().headers[strings.ToLower(key)]
+}
+
+func (r *clusterRouter) pick(ctx context.Context) *upstreamCluster {
+	t := r.table.Load()
+	for _, rule := range t.rules {
+		switch {
+		case rule.Weights != nil:
+			return t.clusters[pickWeighted(rule.Weights)]
+		case rule.Header != nil:
+			if strings.EqualFold(routeHeader(ctx, rule.Header.Name), rule.Header.Value) {
+				return t.clusters[rule.Cluster]
+			}
+		case rule.Claim != nil:
+			if v, ok := bearerClaim(routeHeader(ctx, "Authorization"), rule.Claim.Name); ok && v == rule.Claim.Value {
+				return t.clusters[rule.Cluster]
+			}
+		}
+	}
+	return t.def
+}
+
+func pickWeighted(weights map[string]int) string {
+	total := 0
+	for _, w := range weights {
+		total += w
+	}
+	n := rand.IntN(total)
+	for name, w := range weights {
+		if n < w {
+			return name
+		}
+		n -= w
+	}
+	panic("unreachable")
+}
+
+type pickedClusterKey struct{}
+
+// pickedCluster returns the name of the cluster clusterRouter sent the call
+// on ctx to, or "" for calls that did not go through one. The interceptors of
+// the cluster connections read it, so what one cluster answered is not
+// mistaken for another's.
+func pickedCluster(ctx context.Context) string {
+	name, _ := ctx.Value(pickedClusterKey{}).(string)
+	return name
+}
+
+func (r *clusterRouter) Invoke(ctx context.Context, method string, args, reply any, opts ...grpc.CallOption) error {
+	c := r.pick(ctx)
+	ctx = context.WithValue(ctx, pickedClusterKey{}, c.name)
+	start := time.Now()
+	err := c.conn.Invoke(ctx, method, args, reply, opts...)
+	c.record(err, time.Since(start))
+	return err
+}
+
+func (r *clusterRouter) NewStream(ctx context.Context, desc *grpc.StreamDesc, method string, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	c := r.pick(ctx)
+	ctx = context.WithValue(ctx, pickedClusterKey{}, c.name)
+	cs, err := c.conn.NewStream(ctx, desc, method, opts...)
+	c.record(err, 0)
+	return cs, err
+}
+
+func (c *upstreamCluster) record(err error, d time.Duration) {
+	c.stats.Add("requests", 1)
+	if err != nil {
+		c.stats.Add("errors", 1)
+	}
+	c.stats.Add("latency_us_total", d.Microseconds())
+}
+
+// routeHeadersKey holds the http.Header of the request a call is made for,
+// put on the context by the HTTP front end when its outgoing metadata does
+// not carry every header.
+type routeHeadersKey struct{}
+
+// routeHeader looks a header up in the HTTP headers stored under
+// routeHeadersKey, falling back to outgoing gRPC metadata.
+func routeHeader(ctx context.Context, name string) string {
+	if h, ok := ctx.Value(routeHeadersKey{}).(http.Header); ok {
+		if v := h.Get(name); v != "" {
+			return v
+		}
+	}
+	if md, ok := metadata.FromOutgoingContext(ctx); ok {
+		if v := md.Get(name); len(v) > 0 {
+			return v[0]
+		}
+	}
+	return ""
+}
+
+// bearerClaim returns a string claim from a bearer JWT. The signature is not
+// checked: the result only picks an upstream and grants nothing.
+func bearerClaim(authorization, claim string) (string, bool) {
+	token, ok := strings.CutPrefix(authorization, "Bearer ")
+	if !ok {
+		return "", false
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", false
+	}
+	var claims map[string]any
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", false
+	}
+	switch v := claims[claim].(type) {
+	case string:
+		return v, true
+	case bool, float64:
+		return fmt.Sprint(v), true
+	}
+	return "", false
+}
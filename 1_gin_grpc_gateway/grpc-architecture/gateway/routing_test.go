@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	pb "api/user"
+)
+
+// clusterInstance is one user-service instance that counts its calls.
+type clusterInstance struct {
+	pb.UnimplementedUserServiceServer
+	addr  string
+	calls atomic.Int64
+}
+
+func (s *clusterInstance) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	s.calls.Add(1)
+	return &pb.GetUserResponse{Id: req.UserId, Name: s.addr}, nil
+}
+
+func startClusterInstance(t *testing.T) *clusterInstance {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	svc := &clusterInstance{addr: lis.Addr().String()}
+	srv := grpc.NewServer()
+	pb.RegisterUserServiceServer(srv, svc)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return svc
+}
+
+// newRoutedServer points userClient at a clusterRouter over a stable and a
+// canary instance and serves the Gin router in front of it.
+func newRoutedServer(t *testing.T, rules string) (stable, canary *clusterInstance, write func(string), srv *httptest.Server) {
+	t.Helper()
+	stable, canary = startClusterInstance(t), startClusterInstance(t)
+	path := filepath.Join(t.TempDir(), "routes.json")
+	write = func(rules string) {
+		t.Helper()
+		data := fmt.Sprintf(`{
+  "clusters": {"stable": {"addrs": [%q]}, "canary": {"addrs": [%q]}},
+  "rules": [%s],
+  "default": "stable"
+}`, stable.addr, canary.addr, rules)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(rules)
+
+	routes, err := newClusterRouter(path, 10*time.Millisecond, nil)
+	if err != nil {
+		t.Fatalf("newClusterRouter: %v", err)
+	}
+	prevClient := userClient
+	userClient = pb.NewUserServiceClient(routes)
+	srv = httptest.NewServer(newRouter())
+	t.Cleanup(func() {
+		srv.Close()
+		routes.Close()
+		userClient = prevClient
+	})
+	return stable, canary, write, srv
+}
+
+func getUserFrom(t *testing.T, srv *httptest.Server, header http.Header, stable, canary *clusterInstance) string {
+	t.Helper()
+	s, c := stable.calls.Load(), canary.calls.Load()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/user/1", nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET /user/1: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET /user/1 = %d", res.StatusCode)
+	}
+	switch {
+	case stable.calls.Load() > s && canary.calls.Load() == c:
+		return "stable"
+	case canary.calls.Load() > c && stable.calls.Load() == s:
+		return "canary"
+	}
+	return "both"
+}
+
+func TestRoutingRules(t *testing.T) {
+	stable, canary, _, srv := newRoutedServer(t, `
+    {"header": {"name": "X-Canary", "value": "true"}, "cluster": "canary"},
+    {"claim": {"name": "beta", "value": "true"}, "cluster": "canary"}`)
+	jwt := func(claims string) string {
+		enc := base64.RawURLEncoding.EncodeToString
+		return "Bearer " + enc([]byte(`{"alg":"none"}`)) + "." + enc([]byte(claims)) + ".sig"
+	}
+	cases := []struct {
+		name   string
+		header http.Header
+		want   string
+	}{
+		{"no match", nil, "stable"},
+		{"header", http.Header{"X-Canary": {"true"}}, "canary"},
+		{"claim", http.Header{"Authorization": {jwt(`{"beta":true}`)}}, "canary"},
+		{"claim absent", http.Header{"Authorization": {jwt(`{"sub":"1"}`)}}, "stable"},
+	}
+	for _, tc := range cases {
+		if got := getUserFrom(t, srv, tc.header, stable, canary); got != tc.want {
+			t.Errorf("%s: served by %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestRoutingWeightsReload(t *testing.T) {
+	stable, canary, write, srv := newRoutedServer(t, `{"weights": {"stable": 0, "canary": 1}}`)
+	if got := getUserFrom(t, srv, nil, stable, canary); got != "canary" {
+		t.Fatalf("served by %s with all weight on canary", got)
+	}
+
+	write(`{"weights": {"stable": 1, "canary": 0}}`)
+	deadline := time.Now().Add(3 * time.Second)
+	for getUserFrom(t, srv, nil, stable, canary) != "stable" {
+		if time.Now().After(deadline) {
+			t.Fatal("new weights never applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// userAPIVersion is the only version of the REST user API. It is served
+// under /v1 and, for clients written before the API was versioned, on the
+// unversioned /user paths.
+const userAPIVersion = "v1"
+
+// unversionedDeprecated and unversionedSunset are announced on responses to
+// the unversioned paths, in Deprecation (RFC 9745) and Sunset (RFC 8594)
+// headers.
+var unversionedDeprecated, unversionedSunset time.Time
+
+// loadVersionDates reads API_UNVERSIONED_DEPRECATED and
+// API_UNVERSIONED_SUNSET, dates as YYYY-MM-DD.
+func loadVersionDates() error {
+	for _, d := range []struct {
+		key, def string
+		dst      *time.Time
+	}{
+		{"API_UNVERSIONED_DEPRECATED", "2026-11-01", &unversionedDeprecated},
+		{"API_UNVERSIONED_SUNSET", "2027-05-01", &unversionedSunset},
+	} {
+		v := os.Getenv(d.key)
+		if v == "" {
+			v = d.def
+		}
+		t, err := time.Parse(time.DateOnly, v)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", d.key, err)
+		}
+		*d.dst = t
+	}
+	return nil
+}
+
+// apiVersionHeaders names the version in API-Version on every response. On
+// the unversioned paths it also rejects an Accept-Version header naming
+// anything but v1 ("1" or "v1") and adds the Deprecation and Sunset headers.
+func apiVersionHeaders(unversioned bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if unversioned {
+			c.Writer.Header().Add("Vary", "Accept-Version")
+			if h := c.GetHeader("Accept-Version"); h != "" && "v"+strings.TrimPrefix(strings.TrimSpace(h), "v") != userAPIVersion {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "unsupported Accept-Version " + strconv.Quote(h)})
+				return
+			}
+			c.Header("Deprecation", "@"+strconv.FormatInt(unversionedDeprecated.Unix(), 10))
+			c.Header("Sunset", unversionedSunset.UTC().Format(http.TimeFormat))
+		}
+		c.Header("API-Version", userAPIVersion)
+		c.Next()
+	}
+}
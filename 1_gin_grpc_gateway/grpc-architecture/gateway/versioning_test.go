@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUserAPIVersions(t *testing.T) {
+	h := newHarness(t)
+
+	res, body := h.do(t, http.MethodGet, "/v1/user/123", "", nil)
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `"John Doe"`) ||
+		res.Header.Get("API-Version") != "v1" || res.Header.Get("Deprecation") != "" {
+		t.Errorf("GET /v1/user/123 = %d %s %v", res.StatusCode, body, res.Header)
+	}
+	res, body = h.do(t, http.MethodPost, "/v1/user", `{"name":"Alice","email":"alice@example.com"}`, nil)
+	if res.StatusCode != http.StatusOK || res.Header.Get("API-Version") != "v1" {
+		t.Errorf("POST /v1/user = %d %s", res.StatusCode, body)
+	}
+
+	// The unversioned paths are v1 on the way out.
+	res, _ = h.do(t, http.MethodGet, "/user/123", "", http.Header{"Accept-Version": {"1"}})
+	if res.StatusCode != http.StatusOK || res.Header.Get("API-Version") != "v1" ||
+		res.Header.Get("Deprecation") != "@1793491200" ||
+		res.Header.Get("Sunset") != "Sat, 01 May 2027 00:00:00 GMT" ||
+		res.Header.Get("Vary") != "Accept-Version" {
+		t.Errorf("GET /user/123 = %d %v", res.StatusCode, res.Header)
+	}
+	res, body = h.do(t, http.MethodGet, "/user/123", "", http.Header{"Accept-Version": {"v2"}})
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET /user/123 with Accept-Version v2 = %d %s, want 400", res.StatusCode, body)
+	}
+	if res, _ := h.do(t, http.MethodGet, "/v2/user/123", "", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /v2/user/123 = %d, want 404", res.StatusCode)
+	}
+}
@@ -2,15 +2,17 @@ module user-service
 
 go 1.24.3
 
-require (
-	google.golang.org/grpc v1.72.0
-	google.golang.org/protobuf v1.36.5
-)
+require google.golang.org/grpc v1.72.0
+
+require google.golang.org/protobuf v1.36.5 // indirect
 
 require (
+	api v1.0.0
 	github.com/golang/protobuf v1.5.4 // indirect
 	golang.org/x/net v0.35.0 // indirect
 	golang.org/x/sys v0.30.0 // indirect
 	golang.org/x/text v0.22.0 // indirect
 	google.golang.org/genproto v0.0.0-20200526211855-cb27e3aa2013 // indirect
 )
+
+replace api => ../../../api
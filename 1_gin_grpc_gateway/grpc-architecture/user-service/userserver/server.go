@@ -0,0 +1,49 @@
+// Package userserver implements user.UserService. user-service serves it on
+// its own port; tests elsewhere can link it in and serve it in memory.
+package userserver
+
+import (
+	"context"
+	"log"
+
+	pb "api/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+)
+
+type userServer struct {
+	pb.UnimplementedUserServiceServer
+}
+
+func (s *userServer) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	log.Printf("Received GetUser request for ID: %s", req.UserId)
+	return &pb.GetUserResponse{
+		Id:    req.UserId,
+		Name:  "John Doe",
+		Email: "john@example.com",
+	}, nil
+}
+
+func (s *userServer) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
+	log.Printf("Received CreateUser request: %s, %s", req.Name, req.Email)
+	return &pb.CreateUserResponse{
+		Id:    "123",
+		Name:  req.Name,
+		Email: req.Email,
+	}, nil
+}
+
+// NewServer builds the gRPC server with UserService and server reflection
+// registered, so grpcurl needs no .proto files. opts are added to the
+// server's own, so callers may chain further interceptors.
+func NewServer(opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(append([]grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+			log.Printf("gRPC call: %s", info.FullMethod)
+			return handler(ctx, req)
+		}),
+	}, opts...)...)
+	pb.RegisterUserServiceServer(s, &userServer{})
+	reflection.Register(s)
+	return s
+}
@@ -0,0 +1,108 @@
+package userserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	pb "api/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// startTestServer runs NewServer on an in-memory listener and returns a
+// client for it along with the server itself.
+func startTestServer(t *testing.T) (pb.UserServiceClient, *grpc.Server) {
+	t.Helper()
+	s := NewServer()
+	return pb.NewUserServiceClient(serveTestServer(t, s)), s
+}
+
+// serveTestServer serves s on an in-memory listener and dials it.
+func serveTestServer(t *testing.T, s *grpc.Server) *grpc.ClientConn {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	go s.Serve(lis)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dial bufconn: %v", err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		s.Stop()
+	})
+	return conn
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestGetUser(t *testing.T) {
+	client, _ := startTestServer(t)
+	res, err := client.GetUser(testContext(t), &pb.GetUserRequest{UserId: "42"})
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if res.Id != "42" || res.Name != "John Doe" {
+		t.Errorf("GetUser = %v", res)
+	}
+}
+
+func TestCreateUser(t *testing.T) {
+	client, _ := startTestServer(t)
+	res, err := client.CreateUser(testContext(t), &pb.CreateUserRequest{Name: "Alice", Email: "alice@example.com"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if res.Name != "Alice" || res.Email != "alice@example.com" {
+		t.Errorf("CreateUser = %v", res)
+	}
+}
+
+func TestGracefulStop(t *testing.T) {
+	client, s := startTestServer(t)
+	ctx := testContext(t)
+	if _, err := client.GetUser(ctx, &pb.GetUserRequest{UserId: "1"}); err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	s.GracefulStop()
+	if _, err := client.GetUser(ctx, &pb.GetUserRequest{UserId: "1"}); status.Code(err) != codes.Unavailable {
+		t.Errorf("GetUser after stop code = %v, want Unavailable", status.Code(err))
+	}
+}
+
+func TestReflection(t *testing.T) {
+	conn := serveTestServer(t, NewServer())
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(testContext(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	})
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var services []string
+	for _, s := range resp.GetListServicesResponse().GetService() {
+		services = append(services, s.Name)
+	}
+	if len(services) != 3 || services[2] != "user.UserService" {
+		t.Errorf("services = %v", services)
+	}
+}
@@ -0,0 +1,545 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	apikeypb "api/apikey"
+)
+
+// apiKeyStats counts API key checks, served at /debug/vars under "apikeys":
+// authenticated, unauthenticated (missing, unknown or revoked keys), denied
+// (a scope the key lacks) and rate_limited.
+var apiKeyStats = expvar.NewMap("apikeys")
+
+const (
+	// apiKeyHeader carries the key on the HTTP port, apiKeyMetadata on the
+	// gRPC port. Neither is passed on to the backends.
+	apiKeyHeader   = "X-API-Key"
+	apiKeyMetadata = "x-api-key"
+	// apiKeyPrefix starts every key, which is apiKeyPrefix, the key ID, "_"
+	// and the secret.
+	apiKeyPrefix = "gk_"
+	// adminScope lets a key call ApiKeyAdminService.
+	adminScope = "admin"
+)
+
+var scopePattern = regexp.MustCompile(`^(\*|admin|[a-z][a-z0-9_]*:(read|write|\*))$`)
+
+// storedKey is one key as kept in API_KEYS_FILE.
+type storedKey struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Hash is the hex SHA-256 of the secret. Secrets are 32 random bytes,
+	// too many to guess, so a slow password hash would add nothing.
+	Hash           string    `json:"hash"`
+	Scopes         []string  `json:"scopes"`
+	RateLimitRPS   float64   `json:"rate_limit_rps,omitempty"`
+	RateLimitBurst int       `json:"rate_limit_burst,omitempty"`
+	Created        time.Time `json:"created"`
+	LastUsed       time.Time `json:"last_used,omitzero"`
+	Revoked        time.Time `json:"revoked,omitzero"`
+}
+
+func (k *storedKey) proto() *apikeypb.ApiKey {
+	out := &apikeypb.ApiKey{
+		Id:             k.ID,
+		Name:           k.Name,
+		Scopes:         k.Scopes,
+		RateLimitRps:   k.RateLimitRPS,
+		RateLimitBurst: int32(k.RateLimitBurst),
+		CreateTime:     timestamppb.New(k.Created),
+	}
+	if !k.LastUsed.IsZero() {
+		out.LastUsedTime = timestamppb.New(k.LastUsed)
+	}
+	if !k.Revoked.IsZero() {
+		out.RevokeTime = timestamppb.New(k.Revoked)
+	}
+	return out
+}
+
+// apiKeyCaller is who a request came from, as its API key says.
+type apiKeyCaller struct {
+	id     string
+	scopes []string
+}
+
+type apiKeyContextKey struct{}
+
+func apiKeyCallerFrom(ctx context.Context) *apiKeyCaller {
+	c, _ := ctx.Value(apiKeyContextKey{}).(*apiKeyCaller)
+	return c
+}
+
+// apiKeys holds the API keys of machine clients. It checks them on the HTTP
+// port with middleware and on the gRPC port with interceptors, enforces their
+// scopes on the calls the gateway makes for them, and serves
+// ApiKeyAdminService to manage them.
+type apiKeys struct {
+	apikeypb.UnimplementedApiKeyAdminServiceServer
+
+	path string
+	// adminToken, when set, is accepted as a key with only the admin scope,
+	// to issue the first keys with.
+	adminToken string
+	// required turns away requests without a key; otherwise only requests
+	// that send one are checked.
+	required bool
+	now      func() time.Time
+
+	mu      sync.Mutex
+	keys    map[string]*storedKey
+	buckets map[string]*tokenBucket
+	// dirty is set while last-used times have changed since the file was
+	// last written.
+	dirty bool
+}
+
+// newAPIKeys loads the keys in path, which need not exist yet.
+func newAPIKeys(path, adminToken string, required bool) (*apiKeys, error) {
+	for _, key := range []string{"authenticated", "unauthenticated", "denied", "rate_limited"} {
+		apiKeyStats.Add(key, 0)
+	}
+	k := &apiKeys{
+		path:       path,
+		adminToken: adminToken,
+		required:   required,
+		now:        time.Now,
+		keys:       make(map[string]*storedKey),
+		buckets:    make(map[string]*tokenBucket),
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return k, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Keys []*storedKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for _, key := range file.Keys {
+		k.keys[key.ID] = key
+	}
+	return k, nil
+}
+
+// save writes every key to the file, replacing it in one step. k.mu must be
+// held.
+func (k *apiKeys) save() error {
+	file := struct {
+		Keys []*storedKey `json:"keys"`
+	}{k.sorted(true)}
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, k.path); err != nil {
+		return err
+	}
+	k.dirty = false
+	return nil
+}
+
+// sorted returns the keys oldest first. k.mu must be held.
+func (k *apiKeys) sorted(includeRevoked bool) []*storedKey {
+	out := make([]*storedKey, 0, len(k.keys))
+	for _, key := range k.keys {
+		if includeRevoked || key.Revoked.IsZero() {
+			out = append(out, key)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Created.Equal(out[j].Created) {
+			return out[i].Created.Before(out[j].Created)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out
+}
+
+// saveLastUsed writes the file if last-used times changed since it was last
+// written.
+func (k *apiKeys) saveLastUsed() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if !k.dirty {
+		return
+	}
+	if err := k.save(); err != nil {
+		asyncLogf("Failed to save API key last-used times: %v", err)
+	}
+}
+
+// watch saves last-used times every interval until ctx is done. Using a
+// key only marks it in memory, so busy keys do not write the file on every
+// request.
+func (k *apiKeys) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			k.saveLastUsed()
+		}
+	}
+}
+
+// admit checks a key sent by a client and takes a token from its rate limit.
+// The error is a gRPC status: Unauthenticated for a key that is unknown or
+// revoked, ResourceExhausted with how long to wait when the key is over its
+// limit.
+func (k *apiKeys) admit(secret string) (*apiKeyCaller, time.Duration, error) {
+	if k.adminToken != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(k.adminToken)) == 1 {
+		apiKeyStats.Add("authenticated", 1)
+		return &apiKeyCaller{id: "admin-token", scopes: []string{adminScope}}, 0, nil
+	}
+	id, sum, ok := parseAPIKey(secret)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key := k.keys[id]
+	if !ok || key == nil || subtle.ConstantTimeCompare([]byte(sum), []byte(key.Hash)) != 1 || !key.Revoked.IsZero() {
+		apiKeyStats.Add("unauthenticated", 1)
+		return nil, 0, status.Error(codes.Unauthenticated, "invalid or revoked API key")
+	}
+	now := k.now().UTC()
+	if key.RateLimitRPS > 0 {
+		bucket := k.buckets[id]
+		if bucket == nil {
+			burst := float64(key.RateLimitBurst)
+			if burst < 1 {
+				burst = math.Max(1, key.RateLimitRPS)
+			}
+			bucket = &tokenBucket{rate: key.RateLimitRPS, burst: burst, tokens: burst, last: now}
+			k.buckets[id] = bucket
+		}
+		if ok, wait := bucket.take(now); !ok {
+			apiKeyStats.Add("rate_limited", 1)
+			return nil, wait, status.Errorf(codes.ResourceExhausted, "API key %s is over its rate limit", id)
+		}
+	}
+	key.LastUsed = now
+	k.dirty = true
+	apiKeyStats.Add("authenticated", 1)
+	return &apiKeyCaller{id: id, scopes: key.Scopes}, 0, nil
+}
+
+// parseAPIKey splits a key into its ID and the hash of its secret.
+func parseAPIKey(secret string) (id, hash string, ok bool) {
+	rest, ok := strings.CutPrefix(secret, apiKeyPrefix)
+	if !ok {
+		return "", "", false
+	}
+	id, s, ok := strings.Cut(rest, "_")
+	if !ok || id == "" || s == "" {
+		return "", "", false
+	}
+	return id, hashSecret(s), true
+}
+
+func hashSecret(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// methodScope returns the scope a call to the gRPC method full needs, or ""
+// for methods any caller may use, such as reflection and health checks.
+// Methods that only read need "<service>:read", the rest "<service>:write".
+func methodScope(full string) string {
+	service, method, ok := strings.Cut(strings.TrimPrefix(full, "/"), "/")
+	if !ok {
+		return ""
+	}
+	pkg, _, _ := strings.Cut(service, ".")
+	switch pkg {
+	case "grpc":
+		return ""
+	case "apikey":
+		return adminScope
+	}
+	for _, verb := range []string{"Get", "BatchGet", "List", "Export", "Watch"} {
+		if strings.HasPrefix(method, verb) {
+			return pkg + ":read"
+		}
+	}
+	return pkg + ":write"
+}
+
+// hasScope reports whether scopes grant need. "*" grants everything but
+// the admin scope.
+func hasScope(scopes []string, need string) bool {
+	if need == "" {
+		return true
+	}
+	service, _, _ := strings.Cut(need, ":")
+	for _, s := range scopes {
+		if s == need || (need != adminScope && (s == "*" || s == service+":*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize fails calls to method that the caller in ctx, if any, has no
+// scope for.
+func authorize(ctx context.Context, method string) error {
+	caller := apiKeyCallerFrom(ctx)
+	if caller == nil {
+		return nil
+	}
+	need := methodScope(method)
+	if hasScope(caller.scopes, need) {
+		return nil
+	}
+	apiKeyStats.Add("denied", 1)
+	return status.Errorf(codes.PermissionDenied, "API key %s lacks scope %q", caller.id, need)
+}
+
+// dialOptions enforce key scopes on the gateway's own calls to the backends
+// and to its in-process gRPC server, which HTTP requests are served through.
+func (k *apiKeys) dialOptions() []grpc.DialOption {
+	if k == nil {
+		return nil
+	}
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			if err := authorize(ctx, method); err != nil {
+				return err
+			}
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}),
+		grpc.WithChainStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			if err := authorize(ctx, method); err != nil {
+				return nil, err
+			}
+			return streamer(ctx, desc, cc, method, opts...)
+		}),
+	}
+}
+
+// middleware checks the X-API-Key header of HTTP requests. Preflights and
+// /health pass without one.
+func (k *apiKeys) middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if isPreflight(c.Request) || c.Request.URL.Path == "/health" {
+			c.Next()
+			return
+		}
+		secret := c.GetHeader(apiKeyHeader)
+		if secret == "" {
+			if k.required {
+				apiKeyStats.Add("unauthenticated", 1)
+				c.Header("WWW-Authenticate", "ApiKey")
+				writeJSONError(c.Writer, http.StatusUnauthorized, "missing "+apiKeyHeader+" header")
+				c.Abort()
+				return
+			}
+			c.Next()
+			return
+		}
+		caller, wait, err := k.admit(secret)
+		if err != nil {
+			if wait > 0 {
+				c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			}
+			if status.Code(err) == codes.Unauthenticated {
+				c.Header("WWW-Authenticate", "ApiKey")
+			}
+			writeJSONError(c.Writer, runtime.HTTPStatusFromCode(status.Code(err)), status.Convert(err).Message())
+			c.Abort()
+			return
+		}
+		// Proxied routes must not see the key either.
+		c.Request.Header.Del(apiKeyHeader)
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), apiKeyContextKey{}, caller))
+		c.Next()
+	}
+}
+
+// check admits a call on the gRPC port and returns the context to serve it
+// with: the caller added and the key removed from the incoming metadata, so
+// the proxy does not forward it.
+func (k *apiKeys) check(ctx context.Context, method string) (context.Context, error) {
+	need := methodScope(method)
+	if p, ok := peer.FromContext(ctx); ok && p.Addr.Network() == "bufconn" {
+		// Calls from this process's HTTP side were admitted there, and
+		// their scopes are checked as they are made. The admin service is
+		// only for callers on the gRPC port itself.
+		if need == adminScope {
+			return nil, status.Error(codes.PermissionDenied, "ApiKeyAdminService is only served on the gRPC port")
+		}
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	secrets := md.Get(apiKeyMetadata)
+	if len(secrets) == 0 {
+		if need != "" && (k.required || need == adminScope) {
+			apiKeyStats.Add("unauthenticated", 1)
+			return nil, status.Error(codes.Unauthenticated, "missing x-api-key metadata")
+		}
+		return ctx, nil
+	}
+	caller, wait, err := k.admit(secrets[0])
+	if err != nil {
+		if wait > 0 {
+			grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(int(math.Ceil(wait.Seconds())))))
+		}
+		return nil, err
+	}
+	md = md.Copy()
+	delete(md, apiKeyMetadata)
+	ctx = context.WithValue(metadata.NewIncomingContext(ctx, md), apiKeyContextKey{}, caller)
+	if err := authorize(ctx, method); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+func (k *apiKeys) unaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := k.check(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (k *apiKeys) streamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := k.check(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &forwardingServerStream{ss, ctx})
+}
+
+// IssueKey creates a key and returns its secret, which is not stored.
+func (k *apiKeys) IssueKey(ctx context.Context, req *apikeypb.IssueKeyRequest) (*apikeypb.IssueKeyResponse, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	if len(req.Scopes) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "at least one scope is required")
+	}
+	for _, s := range req.Scopes {
+		if !scopePattern.MatchString(s) {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid scope %q (want <service>:read, <service>:write, <service>:*, * or admin)", s)
+		}
+	}
+	if req.RateLimitRps < 0 || req.RateLimitBurst < 0 {
+		return nil, status.Error(codes.InvalidArgument, "rate limits must not be negative")
+	}
+	idBytes, secretBytes := make([]byte, 6), make([]byte, 32)
+	if _, err := rand.Read(idBytes); err != nil {
+		return nil, status.Errorf(codes.Internal, "generating key: %v", err)
+	}
+	if _, err := rand.Read(secretBytes); err != nil {
+		return nil, status.Errorf(codes.Internal, "generating key: %v", err)
+	}
+	id, secret := hex.EncodeToString(idBytes), base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.keys[id] != nil {
+		return nil, status.Error(codes.Aborted, "key ID collision; try again")
+	}
+	key := &storedKey{
+		ID:             id,
+		Name:           req.Name,
+		Hash:           hashSecret(secret),
+		Scopes:         req.Scopes,
+		RateLimitRPS:   req.RateLimitRps,
+		RateLimitBurst: int(req.RateLimitBurst),
+		Created:        k.now().UTC(),
+	}
+	k.keys[id] = key
+	if err := k.save(); err != nil {
+		delete(k.keys, id)
+		return nil, status.Errorf(codes.Internal, "saving keys: %v", err)
+	}
+	asyncLogf("API key %s (%s) issued with scopes %v by %s", id, key.Name, key.Scopes, adminName(ctx))
+	return &apikeypb.IssueKeyResponse{Key: key.proto(), Secret: apiKeyPrefix + id + "_" + secret}, nil
+}
+
+func (k *apiKeys) GetKey(ctx context.Context, req *apikeypb.GetKeyRequest) (*apikeypb.ApiKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key := k.keys[req.Id]
+	if key == nil {
+		return nil, status.Errorf(codes.NotFound, "no API key %q", req.Id)
+	}
+	return key.proto(), nil
+}
+
+func (k *apiKeys) ListKeys(ctx context.Context, req *apikeypb.ListKeysRequest) (*apikeypb.ListKeysResponse, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	resp := &apikeypb.ListKeysResponse{}
+	for _, key := range k.sorted(req.IncludeRevoked) {
+		resp.Keys = append(resp.Keys, key.proto())
+	}
+	return resp, nil
+}
+
+// RevokeKey stops a key working. Revoking it again changes nothing.
+func (k *apiKeys) RevokeKey(ctx context.Context, req *apikeypb.RevokeKeyRequest) (*apikeypb.ApiKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key := k.keys[req.Id]
+	if key == nil {
+		return nil, status.Errorf(codes.NotFound, "no API key %q", req.Id)
+	}
+	if key.Revoked.IsZero() {
+		key.Revoked = k.now().UTC()
+		if err := k.save(); err != nil {
+			key.Revoked = time.Time{}
+			return nil, status.Errorf(codes.Internal, "saving keys: %v", err)
+		}
+		delete(k.buckets, key.ID)
+		asyncLogf("API key %s (%s) revoked by %s", key.ID, key.Name, adminName(ctx))
+	}
+	return key.proto(), nil
+}
+
+// adminName names the caller of an admin method for the log.
+func adminName(ctx context.Context) string {
+	if c := apiKeyCallerFrom(ctx); c != nil {
+		return c.id
+	}
+	return "unknown"
+}
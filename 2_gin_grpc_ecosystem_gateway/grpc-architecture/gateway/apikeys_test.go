@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	apikeypb "api/apikey"
+	pb "api/user"
+	"user-service/userserver"
+)
+
+func TestMethodScope(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		want   string
+		grants []string
+		denies []string
+	}{
+		{pb.UserService_GetUser_FullMethodName, "user:read", []string{"user:read", "user:*", "*"}, []string{"user:write", "order:read", "admin"}},
+		{pb.UserService_WatchUsers_FullMethodName, "user:read", []string{"user:read"}, []string{"order:*"}},
+		{pb.UserService_BatchGetUsers_FullMethodName, "user:read", []string{"user:read"}, []string{"order:read"}},
+		{pb.UserService_BatchCreateUsers_FullMethodName, "user:write", []string{"user:write", "*"}, []string{"user:read"}},
+		{"/order.OrderService/ListOrdersByUser", "order:read", []string{"order:read"}, []string{"user:read"}},
+		{apikeypb.ApiKeyAdminService_RevokeKey_FullMethodName, "admin", []string{"admin"}, []string{"*", "apikey:*"}},
+		{"/grpc.health.v1.Health/Check", "", []string{"user:read"}, nil},
+	} {
+		if got := methodScope(tc.method); got != tc.want {
+			t.Errorf("methodScope(%s) = %q, want %q", tc.method, got, tc.want)
+		}
+		for _, s := range tc.grants {
+			if !hasScope([]string{s}, tc.want) {
+				t.Errorf("scope %q does not grant %s", s, tc.method)
+			}
+		}
+		for _, s := range tc.denies {
+			if hasScope([]string{s}, tc.want) {
+				t.Errorf("scope %q grants %s", s, tc.method)
+			}
+		}
+	}
+}
+
+// newKeyBackend serves userServer in memory and returns a client for it
+// that enforces the scopes of keys.
+func newKeyBackend(t *testing.T, keys *apiKeys) (*mdRecorder, *grpc.ClientConn) {
+	t.Helper()
+	backend := &mdRecorder{}
+	lis := bufconn.Listen(1 << 20)
+	srv := userserver.NewServer(nil, backend.serverOptions()...)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := newInProcessConn(lis, keys.dialOptions()...)
+	if err != nil {
+		t.Fatalf("dial bufconn: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return backend, conn
+}
+
+func TestAPIKeysGRPC(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	keys, err := newAPIKeys(path, "b00tstrap", true)
+	if err != nil {
+		t.Fatalf("newAPIKeys: %v", err)
+	}
+	backend, upConn := newKeyBackend(t, keys)
+
+	// Keys are only checked for callers on the port itself, not bufconn.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(testContext(t))
+	defer cancel()
+	go startGRPCServer(ctx, pb.NewUserServiceClient(upConn), nil, keys, lis)
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	users, admin := pb.NewUserServiceClient(conn), apikeypb.NewApiKeyAdminServiceClient(conn)
+	withKey := func(key string) context.Context {
+		return metadata.AppendToOutgoingContext(ctx, apiKeyMetadata, key)
+	}
+	expect := func(what string, err error, want codes.Code) {
+		t.Helper()
+		if status.Code(err) != want {
+			t.Errorf("%s: %v, want %v", what, err, want)
+		}
+	}
+
+	_, err = admin.IssueKey(ctx, &apikeypb.IssueKeyRequest{Name: "batch", Scopes: []string{"user:read"}})
+	expect("IssueKey without a key", err, codes.Unauthenticated)
+	_, err = admin.IssueKey(withKey("b00tstrap"), &apikeypb.IssueKeyRequest{Name: "batch", Scopes: []string{"users"}})
+	expect("IssueKey with a bad scope", err, codes.InvalidArgument)
+	issued, err := admin.IssueKey(withKey("b00tstrap"), &apikeypb.IssueKeyRequest{
+		Name: "batch", Scopes: []string{"user:read"}, RateLimitRps: 0.001, RateLimitBurst: 3,
+	})
+	if err != nil {
+		t.Fatalf("IssueKey: %v", err)
+	}
+	secret := issued.Secret
+
+	_, err = users.GetUser(ctx, &pb.GetUserRequest{UserId: "123"})
+	expect("GetUser without a key", err, codes.Unauthenticated)
+	_, err = users.GetUser(withKey(secret+"x"), &pb.GetUserRequest{UserId: "123"})
+	expect("GetUser with a wrong key", err, codes.Unauthenticated)
+	_, err = users.GetUser(withKey("b00tstrap"), &pb.GetUserRequest{UserId: "123"})
+	expect("GetUser with the admin token", err, codes.PermissionDenied)
+	_, err = users.GetUser(withKey(secret), &pb.GetUserRequest{UserId: "123"})
+	expect("GetUser", err, codes.OK)
+	if md := backend.metadata(); len(md.Get(apiKeyMetadata)) > 0 {
+		t.Errorf("backend saw the key: %v", md)
+	}
+	_, err = users.CreateUser(withKey(secret), &pb.CreateUserRequest{Name: "n", Email: "e@example.com"})
+	expect("CreateUser with a read-only key", err, codes.PermissionDenied)
+	_, err = admin.ListKeys(withKey(secret), &apikeypb.ListKeysRequest{})
+	expect("ListKeys with a user key", err, codes.PermissionDenied)
+	_, err = users.GetUser(withKey(secret), &pb.GetUserRequest{UserId: "123"})
+	expect("GetUser over the rate limit", err, codes.ResourceExhausted)
+
+	list, err := admin.ListKeys(withKey("b00tstrap"), &apikeypb.ListKeysRequest{})
+	if err != nil || len(list.Keys) != 1 || list.Keys[0].LastUsedTime == nil {
+		t.Fatalf("ListKeys = %v, %v; want one key with a last-used time", list, err)
+	}
+	if _, err := admin.RevokeKey(withKey("b00tstrap"), &apikeypb.RevokeKeyRequest{Id: issued.Key.Id}); err != nil {
+		t.Fatalf("RevokeKey: %v", err)
+	}
+	_, err = users.GetUser(withKey(secret), &pb.GetUserRequest{UserId: "123"})
+	expect("GetUser with a revoked key", err, codes.Unauthenticated)
+	if list, _ := admin.ListKeys(withKey("b00tstrap"), &apikeypb.ListKeysRequest{}); len(list.Keys) != 0 {
+		t.Errorf("ListKeys lists revoked keys: %v", list.Keys)
+	}
+
+	// The file keeps the key, revoked, but not its secret.
+	keys.saveLastUsed()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, s, _ := strings.Cut(strings.TrimPrefix(secret, apiKeyPrefix), "_"); strings.Contains(string(data), s) {
+		t.Error("key file contains the secret")
+	}
+	reloaded, err := newAPIKeys(path, "", false)
+	if err != nil {
+		t.Fatalf("reloading keys: %v", err)
+	}
+	got, err := reloaded.GetKey(ctx, &apikeypb.GetKeyRequest{Id: issued.Key.Id})
+	if err != nil || got.RevokeTime == nil || got.LastUsedTime == nil {
+		t.Errorf("reloaded key = %v, %v; want revoked and used", got, err)
+	}
+}
+
+func TestAPIKeysHTTP(t *testing.T) {
+	keys, err := newAPIKeys(filepath.Join(t.TempDir(), "keys.json"), "", false)
+	if err != nil {
+		t.Fatalf("newAPIKeys: %v", err)
+	}
+	ctx := testContext(t)
+	issued, err := keys.IssueKey(ctx, &apikeypb.IssueKeyRequest{Name: "reader", Scopes: []string{"user:read"}})
+	if err != nil {
+		t.Fatalf("IssueKey: %v", err)
+	}
+	_, conn := newKeyBackend(t, keys)
+	gwMux, err := newGatewayMux(ctx, conn, pb.NewUserServiceClient(conn))
+	if err != nil {
+		t.Fatalf("newGatewayMux: %v", err)
+	}
+	table, err := newDynamicRoutes("", map[string]http.Handler{"user": gwMux})
+	if err != nil {
+		t.Fatalf("newDynamicRoutes: %v", err)
+	}
+	srv := httptest.NewServer(newRouter(ctx, table, nil, nil, nil, nil, keys))
+	defer srv.Close()
+	s := &tableServer{http: srv}
+	key := http.Header{"X-Api-Key": {issued.Secret}}
+
+	for _, tc := range []struct {
+		method, path string
+		header       http.Header
+		status       int
+	}{
+		{http.MethodGet, "/api/user/123", nil, http.StatusOK},
+		{http.MethodGet, "/api/user/123", key, http.StatusOK},
+		{http.MethodGet, "/api/user/123", http.Header{"X-Api-Key": {"gk_nope_nope"}}, http.StatusUnauthorized},
+		{http.MethodPost, "/api/user", key, http.StatusForbidden},
+	} {
+		if res, body := s.do(t, tc.method, tc.path, tc.header); res.StatusCode != tc.status {
+			t.Errorf("%s %s = %d %s, want %d", tc.method, tc.path, res.StatusCode, body, tc.status)
+		}
+	}
+
+	keys.required = true
+	if res, _ := s.do(t, http.MethodGet, "/api/user/123", nil); res.StatusCode != http.StatusUnauthorized || res.Header.Get("WWW-Authenticate") != "ApiKey" {
+		t.Errorf("no key when required = %d %v, want 401", res.StatusCode, res.Header)
+	}
+	if res, _ := s.do(t, http.MethodGet, "/health", nil); res.StatusCode != http.StatusOK {
+		t.Errorf("GET /health = %d, want 200 without a key", res.StatusCode)
+	}
+}
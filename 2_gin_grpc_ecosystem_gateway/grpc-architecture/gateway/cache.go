@@ -0,0 +1,357 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	pb "api/user"
+	pbv2 "api/user/v2"
+)
+
+// cacheStats counts GetUser cache activity, served at /debug/vars under
+// "user_cache": hits, misses, bypassed (the caller sent no-cache or
+// no-store), evictions (entries dropped for room) and invalidations.
+var cacheStats = expvar.NewMap("user_cache")
+
+// cachedReads are the methods answered from the cache. cacheWrites drop the
+// cached answers for the user they change.
+var (
+	cachedReads = map[string]bool{
+		pb.UserService_GetUser_FullMethodName:   true,
+		pbv2.UserService_GetUser_FullMethodName: true,
+	}
+	cacheWrites = map[string]bool{
+		pb.UserService_CreateUser_FullMethodName:       true,
+		pb.UserService_UpdateUser_FullMethodName:       true,
+		pb.UserService_DeleteUser_FullMethodName:       true,
+		pb.UserService_BatchCreateUsers_FullMethodName: true,
+		pbv2.UserService_CreateUser_FullMethodName:     true,
+		pbv2.UserService_UpdateUser_FullMethodName:     true,
+		pbv2.UserService_DeleteUser_FullMethodName:     true,
+	}
+)
+
+// cacheKey identifies one cached response. variant tells apart the answers
+// for the same user that callers must not share: the upstream cluster that
+// gave it, the method (and so the API version), the caller's credentials and
+// the requested field mask.
+type cacheKey struct {
+	userID  string
+	variant string
+}
+
+// responseCache stores marshalled responses. Implementations must be safe
+// for concurrent use; lruCache is the in-memory one.
+type responseCache interface {
+	Get(key cacheKey) ([]byte, bool)
+	Set(key cacheKey, value []byte)
+	// InvalidateUser drops every entry for userID.
+	InvalidateUser(userID string)
+	// Purge drops every entry.
+	Purge()
+}
+
+// lruCache is a responseCache holding up to size entries, each for at most
+// ttl; the least recently used entry makes room for a new one.
+type lruCache struct {
+	size int
+	ttl  time.Duration
+	now  func() time.Time
+
+	mu      sync.Mutex
+	order   *list.List // of *lruEntry, most recently used first
+	entries map[cacheKey]*list.Element
+	byUser  map[string]map[cacheKey]bool
+}
+
+type lruEntry struct {
+	key     cacheKey
+	value   []byte
+	expires time.Time
+}
+
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	c := &lruCache{size: size, ttl: ttl, now: time.Now}
+	c.Purge()
+	return c
+}
+
+func (c *lruCache) Get(key cacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if !c.now().Before(e.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e.value, true
+}
+
+func (c *lruCache) Set(key cacheKey, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expires := c.now().Add(c.ttl)
+	if el, ok := c.entries[key]; ok {
+		e := el.Value.(*lruEntry)
+		e.value, e.expires = value, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	if c.byUser[key.userID] == nil {
+		c.byUser[key.userID] = make(map[cacheKey]bool)
+	}
+	c.byUser[key.userID][key] = true
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		cacheStats.Add("evictions", 1)
+	}
+}
+
+func (c *lruCache) InvalidateUser(userID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.byUser[userID] {
+		c.remove(c.entries[key])
+	}
+}
+
+func (c *lruCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.order = list.New()
+	c.entries = make(map[cacheKey]*list.Element)
+	c.byUser = make(map[string]map[cacheKey]bool)
+}
+
+func (c *lruCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// remove drops el; c.mu must be held.
+func (c *lruCache) remove(el *list.Element) {
+	e := c.order.Remove(el).(*lruEntry)
+	delete(c.entries, e.key)
+	if keys := c.byUser[e.key.userID]; keys != nil {
+		delete(keys, e.key)
+		if len(keys) == 0 {
+			delete(c.byUser, e.key.userID)
+		}
+	}
+}
+
+// userCache answers GetUser calls from a responseCache and drops a user's
+// entries when a write for them passes through the gateway. Writes that reach
+// user-service some other way are only seen once the entries expire.
+type userCache struct {
+	cache responseCache
+	ttl   time.Duration
+	// generation counts invalidations, so a GetUser answer that raced with
+	// a write is not stored after the write dropped the user's entries.
+	generation atomic.Uint64
+}
+
+func newUserCache(cache responseCache, ttl time.Duration) *userCache {
+	for _, key := range []string{"hits", "misses", "bypassed", "evictions", "invalidations"} {
+		cacheStats.Add(key, 0)
+	}
+	return &userCache{cache: cache, ttl: ttl}
+}
+
+// unaryInterceptor serves cached reads and invalidates after writes.
+func (c *userCache) unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	switch {
+	case cachedReads[method]:
+		return c.read(ctx, method, req, reply, func() error {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		})
+	case cacheWrites[method]:
+		err := invoker(ctx, method, req, reply, cc, opts...)
+		// A failed write may still have been applied, so drop the user
+		// either way; created users take their id from the reply.
+		id := userIDOf(req)
+		if id == "" && err == nil {
+			id = userIDOf(reply)
+		}
+		c.invalidate(id)
+		return err
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// streamInterceptor invalidates after writes made over a stream: the
+// client-streaming BatchCreateUsers and user.v2 calls relayed by the gRPC
+// proxy, whose raw frames carry no user id, so they drop every entry.
+func (c *userCache) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil || !cacheWrites[method] {
+		return cs, err
+	}
+	return &invalidatingStream{ClientStream: cs, cache: c}, nil
+}
+
+type invalidatingStream struct {
+	grpc.ClientStream
+	cache   *userCache
+	userIDs []string
+	raw     bool
+	done    bool
+}
+
+func (s *invalidatingStream) SendMsg(m interface{}) error {
+	if id := userIDOf(m); id != "" {
+		s.userIDs = append(s.userIDs, id)
+	} else if _, ok := m.(proto.Message); !ok {
+		s.raw = true
+	}
+	return s.ClientStream.SendMsg(m)
+}
+
+func (s *invalidatingStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if s.done {
+		return err
+	}
+	s.done = true
+	if s.raw {
+		s.cache.invalidate("")
+		return err
+	}
+	for _, id := range s.userIDs {
+		s.cache.invalidate(id)
+	}
+	return err
+}
+
+func (c *userCache) read(ctx context.Context, method string, req, reply interface{}, invoke func() error) error {
+	id := userIDOf(req)
+	msg, ok := reply.(proto.Message)
+	if id == "" || !ok {
+		return invoke()
+	}
+	directives := requestCacheControl(ctx)
+	key := cacheKey{userID: id, variant: pickedCluster(ctx) + " " + method + " " + callerScope(ctx)}
+	if directives["no-cache"] || directives["no-store"] {
+		cacheStats.Add("bypassed", 1)
+	} else if b, ok := c.cache.Get(key); ok {
+		if err := proto.Unmarshal(b, msg); err == nil {
+			cacheStats.Add("hits", 1)
+			return nil
+		}
+	} else {
+		cacheStats.Add("misses", 1)
+	}
+
+	gen := c.generation.Load()
+	if err := invoke(); err != nil {
+		return err
+	}
+	if directives["no-store"] || c.generation.Load() != gen {
+		return nil
+	}
+	if b, err := proto.Marshal(msg); err == nil {
+		c.cache.Set(key, b)
+	}
+	return nil
+}
+
+// invalidate drops userID's entries, or every entry when the user is unknown.
+func (c *userCache) invalidate(userID string) {
+	c.generation.Add(1)
+	cacheStats.Add("invalidations", 1)
+	if userID == "" {
+		c.cache.Purge()
+		return
+	}
+	c.cache.InvalidateUser(userID)
+}
+
+// forwardResponse marks REST GetUser responses as cacheable by the caller for
+// as long as the gateway keeps them, unless the caller asked for no-store.
+// It is a grpc-gateway forward response option.
+func (c *userCache) forwardResponse(ctx context.Context, w http.ResponseWriter, _ proto.Message) error {
+	method, ok := runtime.RPCMethod(ctx)
+	if !ok || !cachedReads[method] {
+		return nil
+	}
+	if requestCacheControl(ctx)["no-store"] {
+		w.Header().Set("Cache-Control", "no-store")
+		return nil
+	}
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(c.ttl/time.Second)))
+	return nil
+}
+
+// userIDOf returns the user_id field of a request, or the id field of a
+// response, or "" when m has neither.
+func userIDOf(m interface{}) string {
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return ""
+	}
+	r := msg.ProtoReflect()
+	for _, name := range []protoreflect.Name{"user_id", "id"} {
+		if fd := r.Descriptor().Fields().ByName(name); fd != nil && fd.Kind() == protoreflect.StringKind && !fd.IsList() {
+			if id := r.Get(fd).String(); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
+
+// callerScope identifies what a caller may see and asked to be sent: its
+// credentials and its field mask. Credentials are hashed so neither the cache
+// nor the coalescer holds them.
+func callerScope(ctx context.Context) string {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	h := sha256.New()
+	for _, key := range []string{"authorization", fieldMaskKey} {
+		for _, v := range md.Get(key) {
+			h.Write([]byte(key + "\x00" + v + "\x00"))
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// requestCacheControl returns the caller's Cache-Control directives, sent as
+// gRPC metadata or, from REST, as the header grpc-gateway forwards. max-age=0
+// counts as no-cache.
+func requestCacheControl(ctx context.Context) map[string]bool {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	directives := make(map[string]bool)
+	for _, key := range []string{"cache-control", runtime.MetadataPrefix + "cache-control"} {
+		for _, v := range md.Get(key) {
+			for _, d := range strings.Split(v, ",") {
+				d = strings.ToLower(strings.TrimSpace(d))
+				if d == "max-age=0" {
+					d = "no-cache"
+				}
+				directives[d] = true
+			}
+		}
+	}
+	return directives
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	pb "api/user"
+)
+
+func TestLRUCache(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := newLRUCache(2, time.Minute)
+	c.now = func() time.Time { return now }
+	a1, a2, b := cacheKey{"a", "1"}, cacheKey{"a", "2"}, cacheKey{"b", "1"}
+
+	c.Set(a1, []byte("a1"))
+	c.Set(b, []byte("b"))
+	c.Get(a1) // b is now the least recently used
+	c.Set(a2, []byte("a2"))
+	if _, ok := c.Get(b); ok {
+		t.Error("b was not evicted")
+	}
+	if v, ok := c.Get(a1); !ok || string(v) != "a1" {
+		t.Errorf("Get(a1) = %q, %v", v, ok)
+	}
+
+	c.InvalidateUser("a")
+	if c.Len() != 0 {
+		t.Errorf("%d entries left after invalidating the only user", c.Len())
+	}
+
+	c.Set(b, []byte("b"))
+	now = now.Add(time.Minute)
+	if _, ok := c.Get(b); ok {
+		t.Error("expired entry was served")
+	}
+	if c.Len() != 0 {
+		t.Errorf("expired entry was kept")
+	}
+}
+
+// cachedClient dials a shadowBackend through a userCache.
+func cachedClient(t *testing.T) (*shadowBackend, pb.UserServiceClient) {
+	t.Helper()
+	backend, lis := startShadowBackend(t, "primary")
+	c := newUserCache(newLRUCache(10, time.Minute), time.Minute)
+	conn, err := newInProcessConn(lis,
+		grpc.WithChainUnaryInterceptor(c.unaryInterceptor),
+		grpc.WithChainStreamInterceptor(c.streamInterceptor))
+	if err != nil {
+		t.Fatalf("dial bufconn: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return backend, pb.NewUserServiceClient(conn)
+}
+
+func TestUserCache(t *testing.T) {
+	backend, client := cachedClient(t)
+	ctx := testContext(t)
+	hits, misses, bypassed := statCount(cacheStats, "hits"), statCount(cacheStats, "misses"), statCount(cacheStats, "bypassed")
+
+	get := func(ctx context.Context, id string, wantCalls int) {
+		t.Helper()
+		got, err := client.GetUser(ctx, &pb.GetUserRequest{UserId: id})
+		if err != nil || got.Id != id {
+			t.Fatalf("GetUser(%s) = %v, %v", id, got, err)
+		}
+		if n := backend.callCount("GetUser"); n != wantCalls {
+			t.Fatalf("backend GetUser calls = %d, want %d", n, wantCalls)
+		}
+	}
+	get(ctx, "2", 1)
+	get(ctx, "2", 1)
+	if statCount(cacheStats, "hits") != hits+1 || statCount(cacheStats, "misses") != misses+1 {
+		t.Errorf("hits/misses grew by %d/%d, want 1/1", statCount(cacheStats, "hits")-hits, statCount(cacheStats, "misses")-misses)
+	}
+
+	// Other credentials are a different scope.
+	bob := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer bob")
+	get(bob, "2", 2)
+	get(bob, "2", 2)
+
+	// Cache-Control: no-cache goes to the backend and refreshes the entry.
+	get(metadata.AppendToOutgoingContext(ctx, "grpcgateway-cache-control", "no-cache"), "2", 3)
+	if statCount(cacheStats, "bypassed") != bypassed+1 {
+		t.Errorf("bypassed grew by %d, want 1", statCount(cacheStats, "bypassed")-bypassed)
+	}
+	get(ctx, "2", 3)
+
+	// Creating user 2 drops both of its entries.
+	if _, err := client.CreateUser(ctx, &pb.CreateUserRequest{Name: "Alice"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	get(ctx, "2", 4)
+	get(bob, "2", 5)
+}
+
+func TestUserCacheKeepsClustersApart(t *testing.T) {
+	instances := startInstances(t, 2)
+	stable, canary := instances[0], instances[1]
+	path := filepath.Join(t.TempDir(), "routes.json")
+	data := fmt.Sprintf(`{
+  "clusters": {"stable": {"addrs": [%q]}, "canary": {"addrs": [%q]}},
+  "rules": [{"header": {"name": "X-Canary", "value": "true"}, "cluster": "canary"}],
+  "default": "stable"
+}`, stable.addr, canary.addr)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// As in main, the cache sits on each cluster's connection.
+	c := newUserCache(newLRUCache(10, time.Minute), time.Minute)
+	routes, err := newClusterRouter(path, time.Hour, []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(c.unaryInterceptor),
+		grpc.WithChainStreamInterceptor(c.streamInterceptor),
+	})
+	if err != nil {
+		t.Fatalf("newClusterRouter: %v", err)
+	}
+	t.Cleanup(routes.Close)
+	client := pb.NewUserServiceClient(routes)
+
+	ctx := testContext(t)
+	// Each cluster's answer is cached apart: the canary call is a miss
+	// although stable's answer is cached, and the last call is a hit.
+	for _, tc := range []struct {
+		ctx                      context.Context
+		stableCalls, canaryCalls int64
+	}{
+		{ctx, 1, 0},
+		{metadata.AppendToOutgoingContext(ctx, "x-canary", "true"), 1, 1},
+		{ctx, 1, 1},
+	} {
+		if _, err := client.GetUser(tc.ctx, &pb.GetUserRequest{UserId: "123"}); err != nil {
+			t.Fatalf("GetUser: %v", err)
+		}
+		if s, c := stable.calls.Load(), canary.calls.Load(); s != tc.stableCalls || c != tc.canaryCalls {
+			t.Fatalf("calls stable/canary = %d/%d, want %d/%d", s, c, tc.stableCalls, tc.canaryCalls)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	orderpb "api/order"
+	pb "api/user"
+	pbv2 "api/user/v2"
+)
+
+// coalesceStats counts calls to coalesced methods, served at /debug/vars
+// under "coalesce": calls, and coalesced (calls answered by another caller's
+// identical call instead of their own).
+var coalesceStats = expvar.NewMap("coalesce")
+
+// coalescedMethods are idempotent, so one call can answer every caller that
+// asked the same thing at the same time.
+var coalescedMethods = map[string]bool{
+	pb.UserService_GetUser_FullMethodName:                true,
+	pb.UserService_ListUsers_FullMethodName:              true,
+	pbv2.UserService_GetUser_FullMethodName:              true,
+	pbv2.UserService_ListUsers_FullMethodName:            true,
+	orderpb.OrderService_GetOrder_FullMethodName:         true,
+	orderpb.OrderService_ListOrdersByUser_FullMethodName: true,
+}
+
+// coalescer merges identical unary calls that are in flight together: same
+// method, same serialized request and same caller scope. The first caller's
+// call goes out; the others wait for its answer.
+type coalescer struct {
+	group singleflight.Group
+}
+
+func newCoalescer() *coalescer {
+	for _, key := range []string{"calls", "coalesced"} {
+		coalesceStats.Add(key, 0)
+	}
+	return &coalescer{}
+}
+
+// coalescedResult is one call's answer, marshalled so every caller can
+// decode its own copy.
+type coalescedResult struct {
+	reply   []byte
+	header  metadata.MD
+	trailer metadata.MD
+}
+
+func (c *coalescer) unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	in, inOK := req.(proto.Message)
+	out, outOK := reply.(proto.Message)
+	if !coalescedMethods[method] || !inOK || !outOK {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(in)
+	if err != nil {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	sum := sha256.Sum256(b)
+	key := pickedCluster(ctx) + " " + method + " " + callerScope(ctx) + " " + hex.EncodeToString(sum[:])
+
+	led := false
+	ch := c.group.DoChan(key, func() (interface{}, error) {
+		led = true
+		return c.call(ctx, method, in, b, out, cc, invoker, opts)
+	})
+	coalesceStats.Add("calls", 1)
+	var res singleflight.Result
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+	if !led {
+		coalesceStats.Add("coalesced", 1)
+	}
+
+	r, _ := res.Val.(*coalescedResult)
+	if r != nil {
+		for _, o := range opts {
+			switch o := o.(type) {
+			case grpc.HeaderCallOption:
+				*o.HeaderAddr = r.header.Copy()
+			case grpc.TrailerCallOption:
+				*o.TrailerAddr = r.trailer.Copy()
+			}
+		}
+	}
+	if res.Err != nil {
+		return res.Err
+	}
+	return proto.Unmarshal(r.reply, out)
+}
+
+// call makes the shared call, sending a copy of in decoded from its marshalled
+// form req, since the first caller owns in. The call outlives that caller
+// giving up, so the others still get an answer, but keeps its deadline.
+func (c *coalescer) call(ctx context.Context, method string, in proto.Message, req []byte, out proto.Message, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts []grpc.CallOption) (*coalescedResult, error) {
+	callCtx := context.WithoutCancel(ctx)
+	if deadline, ok := ctx.Deadline(); ok {
+		var cancel context.CancelFunc
+		callCtx, cancel = context.WithDeadline(callCtx, deadline)
+		defer cancel()
+	}
+	// Header and trailer go to every caller from r, not to the first
+	// caller's variables, which it may have stopped reading.
+	var r coalescedResult
+	callOpts := []grpc.CallOption{grpc.Header(&r.header), grpc.Trailer(&r.trailer)}
+	for _, o := range opts {
+		switch o.(type) {
+		case grpc.HeaderCallOption, grpc.TrailerCallOption:
+		default:
+			callOpts = append(callOpts, o)
+		}
+	}
+	reqCopy := in.ProtoReflect().New().Interface()
+	if err := proto.Unmarshal(req, reqCopy); err != nil {
+		return &r, err
+	}
+	resp := out.ProtoReflect().New().Interface()
+	if err := invoker(callCtx, method, reqCopy, resp, cc, callOpts...); err != nil {
+		return &r, err
+	}
+	b, err := proto.Marshal(resp)
+	if err != nil {
+		return &r, err
+	}
+	r.reply = b
+	return &r, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "api/user"
+)
+
+// slowBackend holds GetUser calls until release is closed.
+type slowBackend struct {
+	pb.UnimplementedUserServiceServer
+	calls   atomic.Int32
+	arrived chan struct{}
+	release chan struct{}
+}
+
+func (b *slowBackend) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	b.calls.Add(1)
+	b.arrived <- struct{}{}
+	<-b.release
+	return &pb.GetUserResponse{Id: req.UserId, Name: "n" + req.UserId}, nil
+}
+
+func TestCoalescer(t *testing.T) {
+	b := &slowBackend{arrived: make(chan struct{}, 10), release: make(chan struct{})}
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterUserServiceServer(srv, b)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := newInProcessConn(lis, grpc.WithChainUnaryInterceptor(newCoalescer().unaryInterceptor))
+	if err != nil {
+		t.Fatalf("dial bufconn: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client := pb.NewUserServiceClient(conn)
+	ctx := testContext(t)
+	before, coalesced := statCount(coalesceStats, "calls"), statCount(coalesceStats, "coalesced")
+
+	// Five identical calls, one for another user and one with other
+	// credentials.
+	calls := []struct {
+		ctx context.Context
+		id  string
+	}{
+		{ctx, "1"}, {ctx, "1"}, {ctx, "1"}, {ctx, "1"}, {ctx, "1"},
+		{ctx, "2"},
+		{metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer bob"), "1"},
+	}
+	// The first call of each kind goes out and waits at the backend; let it
+	// arrive before starting the rest, so they find it in flight.
+	var wg sync.WaitGroup
+	errs := make(chan error, len(calls))
+	for i, c := range calls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			got, err := client.GetUser(c.ctx, &pb.GetUserRequest{UserId: c.id})
+			if err == nil && got.Name != "n"+c.id {
+				t.Errorf("GetUser(%s) = %v", c.id, got)
+			}
+			errs <- err
+		}()
+		if i == 0 || i >= 5 {
+			<-b.arrived
+		}
+	}
+	waitUntil(t, "the duplicates join the call in flight", func() bool {
+		return statCount(coalesceStats, "calls") == before+int64(len(calls))
+	})
+	close(b.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("GetUser: %v", err)
+		}
+	}
+	if n := b.calls.Load(); n != 3 {
+		t.Errorf("backend got %d calls, want 3", n)
+	}
+	if n := statCount(coalesceStats, "coalesced") - coalesced; n != 4 {
+		t.Errorf("coalesced = %d, want 4", n)
+	}
+}
+
+func TestCoalescerKeepsClustersApart(t *testing.T) {
+	var backends [2]*slowBackend
+	var addrs [2]string
+	for i := range backends {
+		backends[i] = &slowBackend{arrived: make(chan struct{}, 1), release: make(chan struct{})}
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := grpc.NewServer()
+		pb.RegisterUserServiceServer(srv, backends[i])
+		go srv.Serve(lis)
+		t.Cleanup(srv.Stop)
+		t.Cleanup(func() { close(backends[i].release) })
+		addrs[i] = lis.Addr().String()
+	}
+	stable, canary := backends[0], backends[1]
+	path := filepath.Join(t.TempDir(), "routes.json")
+	data := fmt.Sprintf(`{
+  "clusters": {"stable": {"addrs": [%q]}, "canary": {"addrs": [%q]}},
+  "rules": [{"header": {"name": "X-Canary", "value": "true"}, "cluster": "canary"}],
+  "default": "stable"
+}`, addrs[0], addrs[1])
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := newClusterRouter(path, time.Hour, []grpc.DialOption{grpc.WithChainUnaryInterceptor(newCoalescer().unaryInterceptor)})
+	if err != nil {
+		t.Fatalf("newClusterRouter: %v", err)
+	}
+	t.Cleanup(routes.Close)
+	client := pb.NewUserServiceClient(routes)
+	ctx := testContext(t)
+
+	// The same call for each cluster while the other's is in flight must
+	// reach its own backend.
+	for _, c := range []struct {
+		ctx     context.Context
+		backend *slowBackend
+	}{
+		{ctx, stable},
+		{metadata.AppendToOutgoingContext(ctx, "x-canary", "true"), canary},
+	} {
+		go client.GetUser(c.ctx, &pb.GetUserRequest{UserId: "1"})
+		select {
+		case <-c.backend.arrived:
+		case <-time.After(5 * time.Second):
+			t.Fatal("call joined another cluster's call in flight")
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// maxDecompressedBody caps how large a compressed request body may grow, so
+// a small upload cannot expand without bound. Streamed uploads are exempt.
+const maxDecompressedBody = 32 << 20
+
+// streamedUpload reports whether r goes to a route that reads its body a
+// row at a time and so holds no more than a row in memory however large the
+// body grows: /users/import, or users:batchCreate under any REST prefix.
+func streamedUpload(r *http.Request) bool {
+	return r.URL.Path == "/users/import" || strings.HasSuffix(r.URL.Path, "/users:batchCreate")
+}
+
+// compressor is an encoder for one Content-Encoding that can be reused.
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// compressors holds a pool of encoders per supported Content-Encoding.
+var compressors = map[string]*sync.Pool{
+	"gzip": {New: func() interface{} { return gzip.NewWriter(io.Discard) }},
+	"br":   {New: func() interface{} { return brotli.NewWriterLevel(io.Discard, 4) }},
+	"zstd": {New: func() interface{} {
+		// One goroutine per encoder keeps flushes of streamed responses
+		// prompt.
+		enc, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderConcurrency(1))
+		return enc
+	}},
+}
+
+// checkEncodings reports an error for an encoding compressors has no entry
+// for.
+func checkEncodings(encodings []string) error {
+	for _, e := range encodings {
+		if compressors[e] == nil {
+			return fmt.Errorf("unsupported encoding %q (want zstd, br or gzip)", e)
+		}
+	}
+	return nil
+}
+
+// compressResponses compresses responses of at least minSize bytes with the
+// first of encodings, in the server's order of preference, that the client
+// accepts with the highest q-value. Smaller responses are sent as they are.
+// Only text-like content types are compressed: not images, gRPC-Web, which
+// frames its own messages, or Server-Sent Events. Streamed responses are
+// compressed from their first flush, whatever their size, and every flush
+// pushes what is compressed so far. WebSocket upgrades pass straight through.
+func compressResponses(encodings []string, minSize int, next http.Handler) http.Handler {
+	if len(encodings) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       chooseEncoding(r.Header.Values("Accept-Encoding"), encodings),
+			minSize:        minSize,
+			status:         http.StatusOK,
+		}
+		defer cw.finish()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// chooseEncoding returns the encoding to use for an Accept-Encoding header,
+// or "" to send the response uncompressed. The client's q-values rank the
+// encodings; ties go to the first in encodings.
+func chooseEncoding(accept []string, encodings []string) string {
+	accepted := parseAccept(strings.Join(accept, ","))
+	best, bestQ := "", 0.0
+	for _, e := range encodings {
+		q, wildcard := 0.0, 0.0
+		for _, a := range accepted {
+			switch a.value {
+			case e:
+				q = a.q
+			case "*":
+				wildcard = a.q
+			}
+		}
+		if q == 0 {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+// compressWriter holds a response back until it knows whether to compress
+// it: once it reaches minSize, the handler flushes, or it ends.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     compressor // nil once decided means uncompressed
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if status < 200 {
+		// Informational responses such as 103 Early Hints go out now.
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if !cw.decided {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.minSize {
+			return len(b), nil
+		}
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if cw.enc != nil {
+		cw.enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets a handler take over the connection when it was not an upgrade
+// request compressResponses already let through.
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	cw.decided = true
+	return h.Hijack()
+}
+
+// CloseNotify is used by gin's Context.Stream. A writer that cannot report
+// the client going away gets a channel that never fires.
+func (cw *compressWriter) CloseNotify() <-chan bool {
+	cn, ok := cw.ResponseWriter.(http.CloseNotifier)
+	if !ok {
+		return make(chan bool)
+	}
+	return cn.CloseNotify()
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter { return cw.ResponseWriter }
+
+// decide writes the header, compressing the body if big is set and the
+// response is eligible, then whatever was buffered.
+func (cw *compressWriter) decide(big bool) error {
+	cw.decided = true
+	h := cw.Header()
+	eligible := compressible(h.Get("Content-Type")) && h.Get("Content-Encoding") == "" && h.Get("Content-Range") == "" &&
+		cw.status != http.StatusNoContent && cw.status != http.StatusNotModified && cw.status != http.StatusPartialContent
+	if eligible {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if eligible && big && cw.encoding != "" {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		cw.enc = compressors[cw.encoding].Get().(compressor)
+		cw.enc.Reset(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.enc != nil {
+		_, err = cw.enc.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (cw *compressWriter) finish() {
+	if !cw.decided {
+		cw.decide(false)
+	}
+	if cw.enc != nil {
+		cw.enc.Close()
+		cw.enc.Reset(io.Discard)
+		compressors[cw.encoding].Put(cw.enc)
+		cw.enc = nil
+	}
+}
+
+// compressible reports whether a Content-Type is worth compressing.
+func compressible(contentType string) bool {
+	t, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	t = strings.TrimSpace(t)
+	switch {
+	case t == "text/event-stream":
+		return false
+	case strings.HasPrefix(t, "text/"),
+		strings.HasSuffix(t, "+json"), strings.HasSuffix(t, "+xml"):
+		return true
+	}
+	switch t {
+	case "application/json", "application/x-ndjson", "application/javascript",
+		"application/xml", mimeYAML, mimeProtobuf:
+		return true
+	}
+	return false
+}
+
+// decompressRequests decodes request bodies sent with a Content-Encoding of
+// gzip, br or zstd, so handlers read them as if they were sent plain, up to
+// maxDecompressedBody unless they are streamed uploads. Other encodings are
+// refused with 415.
+func decompressRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+		if encoding == "" || encoding == "identity" || r.Body == nil || r.Body == http.NoBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var body io.Reader
+		var closeBody func()
+		switch encoding {
+		case "gzip":
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid gzip body: "+err.Error())
+				return
+			}
+			body, closeBody = zr, func() { zr.Close() }
+		case "br":
+			body = brotli.NewReader(r.Body)
+		case "zstd":
+			zr, err := zstd.NewReader(r.Body, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid zstd body: "+err.Error())
+				return
+			}
+			body, closeBody = zr, zr.Close
+		default:
+			w.Header().Set("Accept-Encoding", "zstd, br, gzip")
+			writeJSONError(w, http.StatusUnsupportedMediaType, "unsupported Content-Encoding "+encoding)
+			return
+		}
+		if closeBody != nil {
+			defer closeBody()
+		}
+		r = r.Clone(r.Context())
+		r.Body = io.NopCloser(body)
+		if !streamedUpload(r) {
+			r.Body = http.MaxBytesReader(w, r.Body, maxDecompressedBody)
+		}
+		r.ContentLength = -1
+		r.Header.Del("Content-Encoding")
+		r.Header.Del("Content-Length")
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+func decompress(t *testing.T, encoding string, body []byte) string {
+	t.Helper()
+	var r io.Reader
+	switch encoding {
+	case "":
+		return string(body)
+	case "gzip":
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(body))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("decoding %s: %v", encoding, err)
+	}
+	return string(b)
+}
+
+func TestCompressResponses(t *testing.T) {
+	big := `{"users":[` + strings.Repeat(`{"name":"John Doe"},`, 100) + `{}]}`
+	h := compressResponses([]string{"zstd", "br", "gzip"}, 1024, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.URL.Query().Get("type"))
+		body := big
+		if r.URL.Query().Has("small") {
+			body = `{"name":"John Doe"}`
+		}
+		if r.URL.Query().Has("stream") {
+			io.WriteString(w, body[:10])
+			w.(http.Flusher).Flush()
+			body = body[10:]
+		}
+		io.WriteString(w, body)
+	}))
+
+	for _, c := range []struct {
+		query, accept, want string
+	}{
+		{"type=application/json", "gzip, deflate, br, zstd", "zstd"},
+		{"type=application/json", "gzip;q=0.5, br", "br"},
+		{"type=application/json", "gzip", "gzip"},
+		{"type=application/json", "*", "zstd"},
+		{"type=application/json", "", ""},
+		{"type=application/json", "deflate", ""},
+		{"type=application/json&small", "gzip", ""},
+		{"type=image/png", "gzip", ""},
+		{"type=application/x-ndjson&small&stream", "gzip", "gzip"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/?"+c.query, nil)
+		if c.accept != "" {
+			req.Header.Set("Accept-Encoding", c.accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		got := rec.Header().Get("Content-Encoding")
+		if got != c.want {
+			t.Errorf("%s with %q: Content-Encoding %q, want %q", c.query, c.accept, got, c.want)
+			continue
+		}
+		want := big
+		if strings.Contains(c.query, "small") {
+			want = `{"name":"John Doe"}`
+		}
+		if body := decompress(t, got, rec.Body.Bytes()); body != want {
+			t.Errorf("%s with %q: body %q", c.query, c.accept, body)
+		}
+		if vary := rec.Header().Get("Vary"); (vary == "Accept-Encoding") != !strings.Contains(c.query, "image") {
+			t.Errorf("%s: Vary %q", c.query, vary)
+		}
+	}
+}
+
+func TestCompressWriterCloseNotifyWithoutNotifier(t *testing.T) {
+	// httptest.ResponseRecorder does not implement http.CloseNotifier.
+	cw := &compressWriter{ResponseWriter: httptest.NewRecorder(), status: http.StatusOK}
+	select {
+	case <-cw.CloseNotify():
+		t.Error("CloseNotify fired without a client going away")
+	default:
+	}
+}
+
+func TestDecompressRequests(t *testing.T) {
+	const body = `{"name":"Alice"}`
+	h := decompressRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		w.Write(b)
+	}))
+	var gz, br, zs bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write([]byte(body))
+	zw.Close()
+	bw := brotli.NewWriter(&br)
+	bw.Write([]byte(body))
+	bw.Close()
+	sw, _ := zstd.NewWriter(&zs)
+	sw.Write([]byte(body))
+	sw.Close()
+
+	for _, c := range []struct {
+		encoding string
+		body     []byte
+		status   int
+	}{
+		{"", []byte(body), http.StatusOK},
+		{"gzip", gz.Bytes(), http.StatusOK},
+		{"br", br.Bytes(), http.StatusOK},
+		{"zstd", zs.Bytes(), http.StatusOK},
+		{"gzip", []byte(body), http.StatusBadRequest},
+		{"compress", []byte(body), http.StatusUnsupportedMediaType},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(c.body))
+		req.Header.Set("Content-Encoding", c.encoding)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != c.status || (c.status == http.StatusOK && rec.Body.String() != body) {
+			t.Errorf("%q body: %d %q, want %d", c.encoding, rec.Code, rec.Body, c.status)
+		}
+	}
+}
+
+func TestDecompressedBodyLimit(t *testing.T) {
+	h := decompressRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := io.Copy(io.Discard, r.Body)
+		fmt.Fprintf(w, "%d %v", n, err)
+	}))
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(make([]byte, maxDecompressedBody+1))
+	zw.Close()
+
+	for path, want := range map[string]string{
+		"/api/user":              fmt.Sprintf("%d http: request body too large", maxDecompressedBody),
+		"/users/import":          fmt.Sprintf("%d <nil>", maxDecompressedBody+1),
+		"/api/users:batchCreate": fmt.Sprintf("%d <nil>", maxDecompressedBody+1),
+	} {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(gz.Bytes()))
+		req.Header.Set("Content-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if got := rec.Body.String(); got != want {
+			t.Errorf("%s read %q, want %q", path, got, want)
+		}
+	}
+}
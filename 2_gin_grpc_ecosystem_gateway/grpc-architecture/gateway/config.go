@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/encoding/gzip"
+)
+
+const (
+	// modeRemote points the grpc-gateway mux at user-service over the network.
+	modeRemote = "remote"
+	// modeInProcess links userServer into this binary and serves it on an
+	// in-memory bufconn listener, which the grpc-gateway mux and gatewayServer
+	// call instead of user-service, so user calls never leave the process.
+	modeInProcess = "inprocess"
+)
+
+type config struct {
+	mode            string
+	userServiceAddr string
+	// userServiceAddrs and userServiceFile list several user-service
+	// instances to balance across; userServiceFile is re-read while running.
+	userServiceAddrs []string
+	userServiceFile  string
+	grpcAddr         string
+	httpAddr         string
+	// adminAddr serves /debug/vars apart from the public HTTP port.
+	adminAddr string
+	// routesFile holds cluster routing rules; when set it replaces the
+	// user-service settings above.
+	routesFile string
+	// shadowAddr receives a copy of shadowPercent of read calls, and of
+	// writes too when shadowWrites is set.
+	shadowAddr    string
+	shadowPercent float64
+	shadowWrites  bool
+	// grpcProxyRoutes are "prefix=addr" rules for calls on grpcAddr that
+	// gatewayServer does not implement.
+	grpcProxyRoutes  []string
+	orderServiceAddr string
+	// routeTableFile replaces the built-in HTTP route table.
+	routeTableFile string
+	// corsFile sets CORS policies per route group.
+	corsFile string
+	// apiKeysFile, when set, turns on API keys for machine clients and
+	// stores them; apiKeysAdminToken is accepted as a key for the admin
+	// service only; apiKeysRequired turns away calls without a key.
+	apiKeysFile       string
+	apiKeysAdminToken string
+	apiKeysRequired   bool
+	// grpcWebOrigins may call the gateway with gRPC-Web from a browser.
+	grpcWebOrigins []string
+	// profileTimeout caps how long /profiles waits for its backends.
+	profileTimeout time.Duration
+	// transcodeDescriptors, when set, builds the REST routes from the
+	// google.api.http rules of these descriptors instead of generated code:
+	// "reflection" or a descriptor set file.
+	transcodeDescriptors string
+	// apiV1Deprecated and apiV1Sunset are announced on v1 REST responses.
+	apiV1Deprecated time.Time
+	apiV1Sunset     time.Time
+	// userCacheTTL, when set, keeps GetUser answers for that long, up to
+	// userCacheSize of them.
+	userCacheTTL  time.Duration
+	userCacheSize int
+	// coalesceReads merges identical concurrent read calls into one.
+	coalesceReads bool
+	// httpCompression lists the Content-Encodings responses may use, most
+	// preferred first, for those of at least httpCompressionMinSize bytes.
+	httpCompression        []string
+	httpCompressionMinSize int
+	// grpcCompression names the compressor for calls to the backends.
+	grpcCompression string
+}
+
+// loadConfig reads the gateway configuration from the environment:
+//
+//	GATEWAY_MODE       remote (default) or inprocess, which serves userServer
+//	                   inside the gateway in place of user-service
+//	USER_SERVICE_ADDR  user-service endpoint, default localhost:50052
+//	USER_SERVICE_ADDRS comma-separated user-service instances (overrides ADDR)
+//	USER_SERVICE_FILE  file listing user-service instances, one per line,
+//	                   watched for changes (overrides ADDRS)
+//	ORDER_SERVICE_ADDR order-service endpoint, default localhost:50054
+//	ROUTES_FILE        JSON file of user-service clusters and canary/header
+//	                   routing rules, watched for changes (overrides the above)
+//	SHADOW_ADDR        user-service to mirror GetUser/ListUsers calls to
+//	SHADOW_PERCENT     share of calls mirrored, 0-100, default 100
+//	SHADOW_WRITES      also mirror CreateUser/UpdateUser/DeleteUser if true
+//	GRPC_PROXY_ROUTES  comma-separated /package.Service/[Method]=host:port
+//	                   backends for gRPC calls the gateway has no code for;
+//	                   unmatched calls go to user-service
+//	ROUTE_TABLE_FILE   JSON HTTP route table, watched for changes; default
+//	                   serves the user grpc-gateway mux under /api
+//	CORS_FILE          JSON CORS policies per route group, for Gin routes
+//	                   and the route table; a group overrides an entry's cors
+//	GRPC_WEB_ORIGINS   comma-separated origins allowed to make gRPC-Web calls,
+//	                   default *
+//	PROFILE_TIMEOUT    longest a /profiles call waits on user-service and
+//	                   order-service, default 2s; 0 leaves it to the caller
+//	TRANSCODE_DESCRIPTORS
+//	                   "reflection" to build the REST routes from the
+//	                   google.api.http rules user-service reports through
+//	                   server reflection, or a protoc descriptor set file to
+//	                   read them from; unset uses the generated handlers
+//	API_V1_DEPRECATED  date (YYYY-MM-DD) sent in the Deprecation header of v1
+//	                   REST responses, default 2026-11-01
+//	API_V1_SUNSET      date sent in their Sunset header, default 2027-05-01
+//	USER_CACHE_TTL     how long the gateway caches GetUser answers, e.g. 30s;
+//	                   default 0 turns the cache off
+//	USER_CACHE_SIZE    most GetUser answers cached, default 10000
+//	COALESCE_READS     merge identical concurrent GetUser, ListUsers, GetOrder
+//	                   and ListOrdersByUser calls into one, default true
+//	HTTP_COMPRESSION   comma-separated response encodings, most preferred
+//	                   first, default zstd,br,gzip; off sends responses as
+//	                   they are
+//	HTTP_COMPRESSION_MIN_SIZE
+//	                   smallest response compressed, in bytes, default 1024
+//	GRPC_COMPRESSION   gzip to compress calls to user-service and
+//	                   order-service; default none
+//	API_KEYS_FILE      JSON file API keys are stored in, hashed; set to
+//	                   check X-API-Key on :8080 and x-api-key on :8081 and
+//	                   serve apikey.ApiKeyAdminService on :8081
+//	API_KEYS_ADMIN_TOKEN
+//	                   secret accepted as a key with only the admin scope,
+//	                   to issue the first keys with
+//	API_KEYS_REQUIRED  turn away calls without a key if true, default false
+//	GRPC_ADDR          gRPC listen address, default :8081
+//	HTTP_ADDR          HTTP listen address, default :8080
+//	ADMIN_ADDR         listen address of /debug/vars, default
+//	                   localhost:8082 so only the host can read the counters
+func loadConfig() (config, error) {
+	cfg := config{
+		mode:                 getenv("GATEWAY_MODE", modeRemote),
+		userServiceAddr:      getenv("USER_SERVICE_ADDR", "localhost:50052"),
+		grpcAddr:             getenv("GRPC_ADDR", ":8081"),
+		httpAddr:             getenv("HTTP_ADDR", ":8080"),
+		adminAddr:            getenv("ADMIN_ADDR", "localhost:8082"),
+		userServiceFile:      os.Getenv("USER_SERVICE_FILE"),
+		routesFile:           os.Getenv("ROUTES_FILE"),
+		shadowAddr:           os.Getenv("SHADOW_ADDR"),
+		routeTableFile:       os.Getenv("ROUTE_TABLE_FILE"),
+		corsFile:             os.Getenv("CORS_FILE"),
+		apiKeysFile:          os.Getenv("API_KEYS_FILE"),
+		apiKeysAdminToken:    os.Getenv("API_KEYS_ADMIN_TOKEN"),
+		orderServiceAddr:     getenv("ORDER_SERVICE_ADDR", "localhost:50054"),
+		transcodeDescriptors: os.Getenv("TRANSCODE_DESCRIPTORS"),
+	}
+	var err error
+	if cfg.shadowPercent, err = strconv.ParseFloat(getenv("SHADOW_PERCENT", "100"), 64); err != nil || cfg.shadowPercent < 0 || cfg.shadowPercent > 100 {
+		return cfg, fmt.Errorf("invalid SHADOW_PERCENT %q (want 0-100)", os.Getenv("SHADOW_PERCENT"))
+	}
+	if cfg.shadowWrites, err = strconv.ParseBool(getenv("SHADOW_WRITES", "false")); err != nil {
+		return cfg, fmt.Errorf("invalid SHADOW_WRITES: %w", err)
+	}
+	if cfg.profileTimeout, err = time.ParseDuration(getenv("PROFILE_TIMEOUT", "2s")); err != nil || cfg.profileTimeout < 0 {
+		return cfg, fmt.Errorf("invalid PROFILE_TIMEOUT %q", os.Getenv("PROFILE_TIMEOUT"))
+	}
+	if cfg.apiV1Deprecated, err = time.Parse(time.DateOnly, getenv("API_V1_DEPRECATED", "2026-11-01")); err != nil {
+		return cfg, fmt.Errorf("invalid API_V1_DEPRECATED: %w", err)
+	}
+	if cfg.apiV1Sunset, err = time.Parse(time.DateOnly, getenv("API_V1_SUNSET", "2027-05-01")); err != nil {
+		return cfg, fmt.Errorf("invalid API_V1_SUNSET: %w", err)
+	}
+	if cfg.userCacheTTL, err = time.ParseDuration(getenv("USER_CACHE_TTL", "0")); err != nil || cfg.userCacheTTL < 0 {
+		return cfg, fmt.Errorf("invalid USER_CACHE_TTL %q", os.Getenv("USER_CACHE_TTL"))
+	}
+	if cfg.userCacheSize, err = strconv.Atoi(getenv("USER_CACHE_SIZE", "10000")); err != nil || cfg.userCacheSize < 1 {
+		return cfg, fmt.Errorf("invalid USER_CACHE_SIZE %q (want at least 1)", os.Getenv("USER_CACHE_SIZE"))
+	}
+	if cfg.coalesceReads, err = strconv.ParseBool(getenv("COALESCE_READS", "true")); err != nil {
+		return cfg, fmt.Errorf("invalid COALESCE_READS: %w", err)
+	}
+	if cfg.apiKeysRequired, err = strconv.ParseBool(getenv("API_KEYS_REQUIRED", "false")); err != nil {
+		return cfg, fmt.Errorf("invalid API_KEYS_REQUIRED: %w", err)
+	}
+	if cfg.apiKeysFile == "" && (cfg.apiKeysRequired || cfg.apiKeysAdminToken != "") {
+		return cfg, fmt.Errorf("API_KEYS_REQUIRED and API_KEYS_ADMIN_TOKEN need API_KEYS_FILE")
+	}
+	if v := getenv("HTTP_COMPRESSION", "zstd,br,gzip"); v != "off" {
+		cfg.httpCompression = splitList(v)
+		if err := checkEncodings(cfg.httpCompression); err != nil {
+			return cfg, fmt.Errorf("invalid HTTP_COMPRESSION: %w", err)
+		}
+	}
+	if cfg.httpCompressionMinSize, err = strconv.Atoi(getenv("HTTP_COMPRESSION_MIN_SIZE", "1024")); err != nil || cfg.httpCompressionMinSize < 0 {
+		return cfg, fmt.Errorf("invalid HTTP_COMPRESSION_MIN_SIZE %q", os.Getenv("HTTP_COMPRESSION_MIN_SIZE"))
+	}
+	switch cfg.grpcCompression = getenv("GRPC_COMPRESSION", "none"); cfg.grpcCompression {
+	case "none":
+		cfg.grpcCompression = ""
+	case gzip.Name:
+	default:
+		return cfg, fmt.Errorf("unknown GRPC_COMPRESSION %q (want gzip or none)", cfg.grpcCompression)
+	}
+	cfg.userServiceAddrs = splitList(os.Getenv("USER_SERVICE_ADDRS"))
+	cfg.grpcProxyRoutes = splitList(os.Getenv("GRPC_PROXY_ROUTES"))
+	cfg.grpcWebOrigins = splitList(getenv("GRPC_WEB_ORIGINS", "*"))
+	switch cfg.mode {
+	case modeRemote:
+	case modeInProcess:
+		if cfg.routesFile != "" {
+			return cfg, fmt.Errorf("ROUTES_FILE routes to remote clusters and cannot be used with GATEWAY_MODE=%s", modeInProcess)
+		}
+	default:
+		return cfg, fmt.Errorf("unknown GATEWAY_MODE %q (want %s or %s)", cfg.mode, modeRemote, modeInProcess)
+	}
+	return cfg, nil
+}
+
+// userServiceRegistry returns where to discover user-service instances, or
+// nil when a single fixed address is configured.
+func (c config) userServiceRegistry() registry {
+	switch {
+	case c.userServiceFile != "":
+		return &fileRegistry{path: c.userServiceFile, interval: time.Second}
+	case len(c.userServiceAddrs) > 0:
+		return staticRegistry(c.userServiceAddrs)
+	}
+	return nil
+}
+
+// splitList splits a comma-separated value, dropping empty entries.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// corsSpec is a CORS policy. Origins are exact ("https://app.example.com"),
+// "*" for any, or contain one * standing for a part of the host or the port
+// ("https://*.example.com", "http://localhost:*").
+type corsSpec struct {
+	AllowOrigins     []string `json:"allow_origins"`
+	AllowMethods     []string `json:"allow_methods"`
+	AllowHeaders     []string `json:"allow_headers"`
+	ExposeHeaders    []string `json:"expose_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	MaxAge           int      `json:"max_age"`
+}
+
+func (c corsSpec) validate() error {
+	if len(c.AllowOrigins) == 0 {
+		return errors.New("cors needs at least one origin")
+	}
+	for _, o := range c.AllowOrigins {
+		if o == "*" && c.AllowCredentials {
+			// Browsers refuse "*" on credentialed requests, and echoing the
+			// caller's origin instead would let any site read them.
+			return errors.New("cors origin * cannot be combined with allow_credentials")
+		}
+		if o != "*" && strings.Count(o, "*") > 1 {
+			return fmt.Errorf("cors origin %q has more than one *", o)
+		}
+	}
+	if c.MaxAge < 0 {
+		return errors.New("cors max_age must not be negative")
+	}
+	return nil
+}
+
+func (c corsSpec) allowOrigin(origin string) string {
+	for _, o := range c.AllowOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if origin != "" && matchOrigin(o, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// matchOrigin reports whether origin matches pattern. A * in pattern matches
+// a non-empty run of characters that does not cross into the path, so
+// "https://*.example.com" matches "https://a.b.example.com" but not
+// "https://example.com" or "https://evil.com/.example.com".
+func matchOrigin(pattern, origin string) bool {
+	if pattern == "*" {
+		return true
+	}
+	pattern, origin = strings.ToLower(pattern), strings.ToLower(origin)
+	before, after, ok := strings.Cut(pattern, "*")
+	if !ok {
+		return pattern == origin
+	}
+	if len(origin) <= len(before)+len(after) || !strings.HasPrefix(origin, before) || !strings.HasSuffix(origin, after) {
+		return false
+	}
+	return !strings.Contains(origin[len(before):len(origin)-len(after)], "/")
+}
+
+// isPreflight reports whether r is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" && r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func (c corsSpec) writePreflight(w http.ResponseWriter, r *http.Request) {
+	origin := c.allowOrigin(r.Header.Get("Origin"))
+	if origin == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Add("Vary", "Origin")
+	methods := c.AllowMethods
+	if len(methods) == 0 {
+		methods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(c.AllowHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowHeaders, ", "))
+	} else if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+		h.Set("Access-Control-Allow-Headers", req)
+	}
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeHeaders adds the headers of an allowed cross-origin response.
+func (c corsSpec) writeHeaders(w http.ResponseWriter, r *http.Request) {
+	origin := c.allowOrigin(r.Header.Get("Origin"))
+	if origin == "" {
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Add("Vary", "Origin")
+	if c.AllowCredentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(c.ExposeHeaders) > 0 {
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+	}
+}
+
+func corsHandler(spec corsSpec, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(corsHandledKey{}) != nil {
+			// A route group's policy already applies.
+			next.ServeHTTP(w, r)
+			return
+		}
+		if isPreflight(r) {
+			spec.writePreflight(w, r)
+			return
+		}
+		spec.writeHeaders(w, r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// corsHandledKey marks requests whose CORS headers a route group set, so a
+// route table entry's own cors block leaves them alone.
+type corsHandledKey struct{}
+
+// corsGroup applies a CORS policy to every path under Prefix.
+type corsGroup struct {
+	Prefix string `json:"prefix"`
+	corsSpec
+}
+
+// corsGroupsConfig is the CORS_FILE format:
+//
+//	{
+//	  "groups": [
+//	    {"prefix": "/api", "allow_origins": ["https://*.example.com"],
+//	     "allow_credentials": true, "max_age": 600},
+//	    {"prefix": "/graphql", "allow_origins": ["*"],
+//	     "allow_methods": ["GET", "POST"], "allow_headers": ["Content-Type"]}
+//	  ]
+//	}
+type corsGroupsConfig struct {
+	Groups []corsGroup `json:"groups"`
+}
+
+// loadCORSGroups reads the CORS route groups in path.
+func loadCORSGroups(path string) ([]corsGroup, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg corsGroupsConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	seen := make(map[string]bool)
+	for i, g := range cfg.Groups {
+		if !strings.HasPrefix(g.Prefix, "/") {
+			return nil, fmt.Errorf("group %d: prefix %q must start with /", i, g.Prefix)
+		}
+		g.Prefix = strings.TrimSuffix(g.Prefix, "/")
+		if seen[g.Prefix] {
+			return nil, fmt.Errorf("group %d: duplicate prefix %q", i, g.Prefix)
+		}
+		seen[g.Prefix] = true
+		if err := g.validate(); err != nil {
+			return nil, fmt.Errorf("group %d (%s): %w", i, g.Prefix, err)
+		}
+		cfg.Groups[i] = g
+	}
+	sort.SliceStable(cfg.Groups, func(i, j int) bool { return len(cfg.Groups[i].Prefix) > len(cfg.Groups[j].Prefix) })
+	return cfg.Groups, nil
+}
+
+// corsMiddleware applies the policy of the first group, in the longest-first
+// order loadCORSGroups returns, whose prefix matches the path. It covers
+// native Gin routes and the route table alike and answers preflights itself.
+// Paths no group covers are left alone.
+func corsMiddleware(groups []corsGroup) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		for _, g := range groups {
+			if path != g.Prefix && !strings.HasPrefix(path, g.Prefix+"/") && g.Prefix != "" {
+				continue
+			}
+			if isPreflight(c.Request) {
+				g.writePreflight(c.Writer, c.Request)
+				c.Abort()
+				return
+			}
+			g.writeHeaders(c.Writer, c.Request)
+			c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), corsHandledKey{}, g.Prefix))
+			break
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, origin string
+		want            bool
+	}{
+		{"*", "https://anything.example", true},
+		{"https://app.example.com", "https://app.example.com", true},
+		{"https://app.example.com", "HTTPS://App.Example.com", true},
+		{"https://app.example.com", "http://app.example.com", false},
+		{"https://*.example.com", "https://a.example.com", true},
+		{"https://*.example.com", "https://a.b.example.com", true},
+		{"https://*.example.com", "https://example.com", false},
+		{"https://*.example.com", "https://.example.com", false},
+		{"https://*.example.com", "https://evil.com/.example.com", false},
+		{"https://*.example.com", "https://a.example.com.evil.com", false},
+		{"http://localhost:*", "http://localhost:3000", true},
+		{"http://localhost:*", "http://localhost", false},
+	} {
+		if got := matchOrigin(tc.pattern, tc.origin); got != tc.want {
+			t.Errorf("matchOrigin(%q, %q) = %v, want %v", tc.pattern, tc.origin, got, tc.want)
+		}
+	}
+}
+
+func TestLoadCORSGroups(t *testing.T) {
+	for name, tc := range map[string]struct {
+		config  string
+		wantErr bool
+	}{
+		"ok":               {`{"groups": [{"prefix": "/api/", "allow_origins": ["*"]}, {"prefix": "/api/v2", "allow_origins": ["*"]}]}`, false},
+		"no origins":       {`{"groups": [{"prefix": "/api"}]}`, true},
+		"relative prefix":  {`{"groups": [{"prefix": "api", "allow_origins": ["*"]}]}`, true},
+		"duplicate prefix": {`{"groups": [{"prefix": "/api", "allow_origins": ["*"]}, {"prefix": "/api/", "allow_origins": ["*"]}]}`, true},
+		"two wildcards":    {`{"groups": [{"prefix": "/api", "allow_origins": ["https://*.*.com"]}]}`, true},
+		"any credentialed": {`{"groups": [{"prefix": "/api", "allow_origins": ["*"], "allow_credentials": true}]}`, true},
+	} {
+		path := filepath.Join(t.TempDir(), "cors.json")
+		if err := os.WriteFile(path, []byte(tc.config), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		groups, err := loadCORSGroups(path)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: err = %v, want error %v", name, err, tc.wantErr)
+		}
+		if err == nil && groups[0].Prefix != "/api/v2" {
+			t.Errorf("%s: groups not longest prefix first: %+v", name, groups)
+		}
+	}
+}
+
+func TestCORSGroups(t *testing.T) {
+	table := filepath.Join(t.TempDir(), "routes.json")
+	if err := os.WriteFile(table, []byte(`{"routes": [
+		{"prefix": "/api", "static": {"body": "api"},
+		 "cors": {"allow_origins": ["https://old.example.com"]}},
+		{"prefix": "/open", "static": {"body": "open"},
+		 "cors": {"allow_origins": ["https://old.example.com"]}}
+	]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	routes, err := newDynamicRoutes(table, nil)
+	if err != nil {
+		t.Fatalf("newDynamicRoutes: %v", err)
+	}
+	groups := []corsGroup{
+		{Prefix: "/api", corsSpec: corsSpec{
+			AllowOrigins: []string{"https://*.example.com"}, AllowCredentials: true,
+			AllowMethods: []string{"GET", "PATCH"}, ExposeHeaders: []string{"X-Request-Id"}, MaxAge: 600,
+		}},
+		{Prefix: "/health", corsSpec: corsSpec{AllowOrigins: []string{"*"}}},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := httptest.NewServer(newRouter(ctx, routes, nil, nil, nil, groups, nil))
+	defer srv.Close()
+	s := &tableServer{http: srv}
+
+	// Preflight on the route table passthrough: the group wins over the
+	// entry's own cors block.
+	res, _ := s.do(t, http.MethodOptions, "/api/v1/user/1", http.Header{
+		"Origin":                         {"https://app.example.com"},
+		"Access-Control-Request-Method":  {"PATCH"},
+		"Access-Control-Request-Headers": {"Content-Type"},
+	})
+	if res.StatusCode != http.StatusNoContent ||
+		res.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		res.Header.Get("Access-Control-Allow-Methods") != "GET, PATCH" ||
+		res.Header.Get("Access-Control-Allow-Headers") != "Content-Type" ||
+		res.Header.Get("Access-Control-Allow-Credentials") != "true" ||
+		res.Header.Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("preflight /api = %d %v", res.StatusCode, res.Header)
+	}
+	res, body := s.do(t, http.MethodGet, "/api/v1/user/1", http.Header{"Origin": {"https://app.example.com"}})
+	if body != "api" || res.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		res.Header.Get("Access-Control-Expose-Headers") != "X-Request-Id" {
+		t.Errorf("GET /api = %q %v", body, res.Header)
+	}
+	res, _ = s.do(t, http.MethodGet, "/api/v1/user/1", http.Header{"Origin": {"https://old.example.com.evil.com"}})
+	if res.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("GET /api from other origin got ACAO %q", res.Header.Get("Access-Control-Allow-Origin"))
+	}
+
+	// Preflight on a native Gin route.
+	res, _ = s.do(t, http.MethodOptions, "/health", http.Header{
+		"Origin":                        {"https://elsewhere.test"},
+		"Access-Control-Request-Method": {"GET"},
+	})
+	if res.StatusCode != http.StatusNoContent || res.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("preflight /health = %d %v", res.StatusCode, res.Header)
+	}
+	res, _ = s.do(t, http.MethodGet, "/health", http.Header{"Origin": {"https://elsewhere.test"}})
+	if res.StatusCode != http.StatusOK || res.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("GET /health = %d %v", res.StatusCode, res.Header)
+	}
+
+	// No group covers /open, so the route table entry's policy applies.
+	res, _ = s.do(t, http.MethodGet, "/open", http.Header{"Origin": {"https://old.example.com"}})
+	if res.Header.Get("Access-Control-Allow-Origin") != "https://old.example.com" {
+		t.Errorf("GET /open ACAO = %q, want the route's own policy", res.Header.Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestCORSOnRejectedKeys(t *testing.T) {
+	keys, err := newAPIKeys(filepath.Join(t.TempDir(), "keys.json"), "", true)
+	if err != nil {
+		t.Fatalf("newAPIKeys: %v", err)
+	}
+	routes, err := newDynamicRoutes("", nil)
+	if err != nil {
+		t.Fatalf("newDynamicRoutes: %v", err)
+	}
+	groups := []corsGroup{{Prefix: "/api", corsSpec: corsSpec{AllowOrigins: []string{"https://app.example.com"}}}}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := httptest.NewServer(newRouter(ctx, routes, nil, nil, nil, groups, keys))
+	defer srv.Close()
+	s := &tableServer{http: srv}
+
+	res, _ := s.do(t, http.MethodOptions, "/api/v1/user/1", http.Header{
+		"Origin":                         {"https://app.example.com"},
+		"Access-Control-Request-Method":  {"GET"},
+		"Access-Control-Request-Headers": {"X-API-Key"},
+	})
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("preflight without a key = %d, want 204", res.StatusCode)
+	}
+	res, _ = s.do(t, http.MethodGet, "/api/v1/user/1", http.Header{"Origin": {"https://app.example.com"}})
+	if res.StatusCode != http.StatusUnauthorized || res.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("GET without a key = %d %v, want 401 with CORS headers", res.StatusCode, res.Header)
+	}
+}
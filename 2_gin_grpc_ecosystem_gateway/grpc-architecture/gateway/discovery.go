@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/resolver"
+)
+
+// discoveryScheme is the target scheme handled by discoveryBuilder, e.g.
+// "discovery:///user-service".
+const discoveryScheme = "discovery"
+
+// registry is a source of backend addresses. Implementations can wrap Consul,
+// etcd or anything else that can report membership changes.
+type registry interface {
+	// Watch sends the current address set for service and then every change
+	// to it, until ctx is cancelled. The channel is closed when Watch stops.
+	Watch(ctx context.Context, service string) (<-chan []string, error)
+}
+
+// staticRegistry always reports the same addresses for every service.
+type staticRegistry []string
+
+func (r staticRegistry) Watch(ctx context.Context, _ string) (<-chan []string, error) {
+	ch := make(chan []string, 1)
+	ch <- slices.Clone(r)
+	go func() {
+		<-ctx.Done()
+		close(ch)
+	}()
+	return ch, nil
+}
+
+// fileRegistry reads addresses from a file, one per line, ignoring blank lines
+// and # comments. The file is polled so edits take effect without a restart;
+// if it disappears or can't be read the last good set is kept.
+type fileRegistry struct {
+	path     string
+	interval time.Duration
+}
+
+func (r *fileRegistry) read() ([]string, []byte, error) {
+	data, err := os.ReadFile(r.path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var addrs []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			addrs = append(addrs, line)
+		}
+	}
+	return addrs, data, sc.Err()
+}
+
+func (r *fileRegistry) Watch(ctx context.Context, _ string) (<-chan []string, error) {
+	addrs, last, err := r.read()
+	if err != nil {
+		return nil, err
+	}
+	interval := r.interval
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	ch := make(chan []string, 1)
+	ch <- addrs
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			addrs, data, err := r.read()
+			if err != nil {
+				asyncLogf("[Discovery] Keeping previous backends, cannot read %s: %v", r.path, err)
+				continue
+			}
+			if bytes.Equal(data, last) {
+				continue
+			}
+			last = data
+			asyncLogf("[Discovery] %s changed: %v", r.path, addrs)
+			select {
+			case ch <- addrs:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// discoveryBuilder is a gRPC resolver.Builder backed by a registry. The
+// target's endpoint names the service to look up.
+type discoveryBuilder struct {
+	registry registry
+}
+
+func (b *discoveryBuilder) Scheme() string { return discoveryScheme }
+
+func (b *discoveryBuilder) Build(target resolver.Target, cc resolver.ClientConn, _ resolver.BuildOptions) (resolver.Resolver, error) {
+	service := target.Endpoint()
+	ctx, cancel := context.WithCancel(context.Background())
+	updates, err := b.registry.Watch(ctx, service)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	r := &discoveryResolver{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(r.done)
+		for addrs := range updates {
+			if len(addrs) == 0 {
+				cc.ReportError(errors.New("no backends registered for " + service))
+				continue
+			}
+			state := resolver.State{}
+			for _, a := range addrs {
+				state.Addresses = append(state.Addresses, resolver.Address{Addr: a})
+			}
+			if err := cc.UpdateState(state); err != nil {
+				asyncLogf("[Discovery] %s: update rejected: %v", service, err)
+			}
+		}
+	}()
+	return r, nil
+}
+
+type discoveryResolver struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// ResolveNow is a no-op: registries push changes as they happen.
+func (r *discoveryResolver) ResolveNow(resolver.ResolveNowOptions) {}
+
+func (r *discoveryResolver) Close() {
+	r.cancel()
+	<-r.done
+}
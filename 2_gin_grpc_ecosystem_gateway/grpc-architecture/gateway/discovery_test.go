@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+
+	pb "api/user"
+	"user-service/userserver"
+)
+
+// userInstance is one user-service instance: the real userServer on a
+// loopback TCP port, counting the calls it serves.
+type userInstance struct {
+	addr  string
+	calls atomic.Int64
+}
+
+func (s *userInstance) count(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	s.calls.Add(1)
+	return handler(ctx, req)
+}
+
+// startInstances runs n user-service instances.
+func startInstances(t *testing.T, n int) []*userInstance {
+	t.Helper()
+	var out []*userInstance
+	for i := 0; i < n; i++ {
+		lis, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		inst := &userInstance{addr: lis.Addr().String()}
+		srv := userserver.NewServer(nil, grpc.ChainUnaryInterceptor(inst.count))
+		go srv.Serve(lis)
+		t.Cleanup(srv.Stop)
+		out = append(out, inst)
+	}
+	return out
+}
+
+// memoryRegistry is an in-process registry that instances register with and
+// deregister from directly, standing in for an external service catalogue.
+type memoryRegistry struct {
+	mu       sync.Mutex
+	services map[string][]string
+	watchers map[string][]chan []string
+}
+
+func newMemoryRegistry() *memoryRegistry {
+	return &memoryRegistry{
+		services: make(map[string][]string),
+		watchers: make(map[string][]chan []string),
+	}
+}
+
+func (r *memoryRegistry) Register(service, addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !slices.Contains(r.services[service], addr) {
+		r.services[service] = append(r.services[service], addr)
+		r.notify(service)
+	}
+}
+
+func (r *memoryRegistry) Deregister(service, addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i := slices.Index(r.services[service], addr); i >= 0 {
+		r.services[service] = slices.Delete(r.services[service], i, i+1)
+		r.notify(service)
+	}
+}
+
+// notify must be called with r.mu held. Each watcher channel holds at most
+// the latest set; a stale undelivered set is replaced.
+func (r *memoryRegistry) notify(service string) {
+	addrs := r.services[service]
+	for _, ch := range r.watchers[service] {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- slices.Clone(addrs)
+	}
+}
+
+func (r *memoryRegistry) Watch(ctx context.Context, service string) (<-chan []string, error) {
+	in := make(chan []string, 1)
+	r.mu.Lock()
+	in <- slices.Clone(r.services[service])
+	r.watchers[service] = append(r.watchers[service], in)
+	r.mu.Unlock()
+
+	out := make(chan []string)
+	go func() {
+		defer close(out)
+		defer func() {
+			r.mu.Lock()
+			r.watchers[service] = slices.DeleteFunc(r.watchers[service], func(c chan []string) bool { return c == in })
+			r.mu.Unlock()
+		}()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case addrs := <-in:
+				select {
+				case out <- addrs:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out, nil
+}
+
+func dialRegistry(t *testing.T, reg registry) pb.UserServiceClient {
+	t.Helper()
+	target, opts := userServiceDialOptions(reg, "")
+	conn, err := grpc.NewClient(target, opts...)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return pb.NewUserServiceClient(conn)
+}
+
+func snapshot(instances []*userInstance) []int64 {
+	out := make([]int64, len(instances))
+	for i, s := range instances {
+		out[i] = s.calls.Load()
+	}
+	return out
+}
+
+func TestStaticRegistryRoundRobin(t *testing.T) {
+	instances := startInstances(t, 3)
+	var addrs []string
+	for _, s := range instances {
+		addrs = append(addrs, s.addr)
+	}
+	client := dialRegistry(t, staticRegistry(addrs))
+
+	// Wait for every subchannel to be ready, then check the spread.
+	callUntil(t, client, "all instances are reached", func() bool {
+		for _, s := range instances {
+			if s.calls.Load() == 0 {
+				return false
+			}
+		}
+		return true
+	})
+	before := snapshot(instances)
+	ctx := testContext(t)
+	for i := 0; i < 30; i++ {
+		if _, err := client.GetUser(ctx, &pb.GetUserRequest{UserId: "123"}); err != nil {
+			t.Fatalf("GetUser: %v", err)
+		}
+	}
+	after := snapshot(instances)
+	for i := range instances {
+		if got := after[i] - before[i]; got != 10 {
+			t.Errorf("instance %d got %d of 30 calls, want 10", i, got)
+		}
+	}
+}
+
+func TestMemoryRegistryLiveUpdates(t *testing.T) {
+	instances := startInstances(t, 3)
+	reg := newMemoryRegistry()
+	reg.Register("user-service", instances[0].addr)
+	reg.Register("user-service", instances[1].addr)
+	client := dialRegistry(t, reg)
+
+	callUntil(t, client, "the first two instances are reached", func() bool {
+		return instances[0].calls.Load() > 0 && instances[1].calls.Load() > 0
+	})
+	if n := instances[2].calls.Load(); n != 0 {
+		t.Fatalf("unregistered instance got %d calls", n)
+	}
+
+	reg.Register("user-service", instances[2].addr)
+	callUntil(t, client, "the new instance is reached", func() bool {
+		return instances[2].calls.Load() > 0
+	})
+
+	reg.Deregister("user-service", instances[0].addr)
+	// Let in-flight picks drain before sampling.
+	callUntil(t, client, "traffic moves off the removed instance", func() bool {
+		before := instances[0].calls.Load()
+		ctx := testContext(t)
+		for i := 0; i < 10; i++ {
+			client.GetUser(ctx, &pb.GetUserRequest{UserId: "123"})
+		}
+		return instances[0].calls.Load() == before
+	})
+}
+
+func TestFileRegistryWatchesChanges(t *testing.T) {
+	instances := startInstances(t, 2)
+	path := filepath.Join(t.TempDir(), "user-service.txt")
+	write := func(addrs ...string) {
+		t.Helper()
+		data := "# user-service instances\n" + strings.Join(addrs, "\n") + "\n"
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(instances[0].addr)
+	client := dialRegistry(t, &fileRegistry{path: path, interval: 10 * time.Millisecond})
+
+	callUntil(t, client, "the listed instance is reached", func() bool {
+		return instances[0].calls.Load() > 0
+	})
+	if n := instances[1].calls.Load(); n != 0 {
+		t.Fatalf("unlisted instance got %d calls", n)
+	}
+
+	write(instances[0].addr, instances[1].addr)
+	callUntil(t, client, "the added instance is reached", func() bool {
+		return instances[1].calls.Load() > 0
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/utilities"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "api/user"
+)
+
+// exportFlushEvery is how many rows are written between flushes.
+const exportFlushEvery = 100
+
+// exportContentTypes lists the supported formats in order of preference.
+var exportContentTypes = []string{"application/x-ndjson", "text/csv", "application/json"}
+
+// negotiateExportType picks a response type from ?format= or the Accept
+// header. It returns "" when nothing acceptable is supported.
+func negotiateExportType(r *http.Request) string {
+	switch strings.ToLower(r.URL.Query().Get("format")) {
+	case "csv":
+		return "text/csv"
+	case "ndjson", "jsonl":
+		return "application/x-ndjson"
+	case "json":
+		return "application/json"
+	}
+
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return exportContentTypes[0]
+	}
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		for _, ct := range exportContentTypes {
+			if (mt == ct || mt == "*/*" || mt == strings.SplitN(ct, "/", 2)[0]+"/*") && q > bestQ {
+				best, bestQ = ct, q
+				break
+			}
+		}
+	}
+	return best
+}
+
+// exportWriter writes users in one output format.
+type exportWriter interface {
+	begin() error
+	write(u *pb.User) error
+	end() error
+}
+
+type csvExportWriter struct{ w *csv.Writer }
+
+func (e *csvExportWriter) begin() error { return e.w.Write([]string{"id", "name", "email"}) }
+func (e *csvExportWriter) write(u *pb.User) error {
+	return e.w.Write([]string{u.Id, u.Name, u.Email})
+}
+func (e *csvExportWriter) end() error { e.w.Flush(); return e.w.Error() }
+
+type ndjsonExportWriter struct{ w io.Writer }
+
+func (e *ndjsonExportWriter) begin() error { return nil }
+func (e *ndjsonExportWriter) write(u *pb.User) error {
+	b, err := protojson.Marshal(u)
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
+func (e *ndjsonExportWriter) end() error { return nil }
+
+// jsonExportWriter streams a single JSON array element by element.
+type jsonExportWriter struct {
+	w     io.Writer
+	first bool
+}
+
+func (e *jsonExportWriter) begin() error {
+	e.first = true
+	_, err := io.WriteString(e.w, "[")
+	return err
+}
+func (e *jsonExportWriter) write(u *pb.User) error {
+	b, err := protojson.Marshal(u)
+	if err != nil {
+		return err
+	}
+	if !e.first {
+		if _, err := io.WriteString(e.w, ","); err != nil {
+			return err
+		}
+	}
+	e.first = false
+	_, err = e.w.Write(b)
+	return err
+}
+func (e *jsonExportWriter) end() error {
+	_, err := io.WriteString(e.w, "]\n")
+	return err
+}
+
+// exportUsersHandler serves GET /users:export on the grpc-gateway mux. It
+// accepts the same query filters as GET /users and relays ExportUsers row by
+// row, flushing as it goes, so memory use does not grow with the result set.
+func exportUsersHandler(client pb.UserServiceClient) runtime.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, _ map[string]string) {
+		contentType := negotiateExportType(r)
+		if contentType == "" {
+			http.Error(w, "supported types: "+strings.Join(exportContentTypes, ", "), http.StatusNotAcceptable)
+			return
+		}
+
+		var req pb.ExportUsersRequest
+		if err := runtime.PopulateQueryParameters(&req, r.URL.Query(), utilities.NewDoubleArray(nil)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		stream, err := client.ExportUsers(r.Context(), &req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		// Pull the first row before committing to a 200 so an upstream
+		// failure can still be reported as an error status.
+		first, err := stream.Recv()
+		if err != nil && err != io.EOF {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		var ew exportWriter
+		switch contentType {
+		case "text/csv":
+			ew = &csvExportWriter{w: csv.NewWriter(w)}
+			w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+		case "application/json":
+			ew = &jsonExportWriter{w: w}
+		default:
+			ew = &ndjsonExportWriter{w: w}
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Vary", "Accept")
+		w.WriteHeader(http.StatusOK)
+
+		rc := http.NewResponseController(w)
+		rows := 0
+		fail := func(err error) {
+			// Headers are gone; truncating the body is the only signal left.
+			asyncLogf("[Export] Aborted after %d rows: %v", rows, err)
+		}
+		if err := ew.begin(); err != nil {
+			fail(err)
+			return
+		}
+		for u := first; u != nil; {
+			if err := ew.write(u); err != nil {
+				fail(err)
+				return
+			}
+			rows++
+			if rows%exportFlushEvery == 0 {
+				if cw, ok := ew.(*csvExportWriter); ok {
+					cw.w.Flush()
+				}
+				rc.Flush()
+			}
+			u, err = stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				fail(err)
+				return
+			}
+		}
+		if err := ew.end(); err != nil {
+			fail(err)
+			return
+		}
+		rc.Flush()
+		asyncLogf("[Export] Streamed %d users as %s", rows, contentType)
+	}
+}
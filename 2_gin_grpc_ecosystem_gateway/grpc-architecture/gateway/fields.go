@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// fieldMaskHeader carries the FieldMask to user-service. grpc-gateway turns
+// it into x-goog-fieldmask-bin metadata.
+const fieldMaskHeader = runtime.MetadataHeaderPrefix + "X-Goog-Fieldmask-Bin"
+
+// fieldMaskKey is the metadata key fieldMaskHeader arrives as.
+const fieldMaskKey = "x-goog-fieldmask-bin"
+
+var fieldPathSegment = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// fieldTree is a parsed field selection: each key selects a field, and a
+// non-empty subtree selects only those fields within it.
+type fieldTree map[string]fieldTree
+
+// parseFields parses a selection such as "id,displayName" or
+// "users.email,next_page_token". Segments may use JSON or proto names; the
+// tree is keyed by JSON names and paths lists the proto names.
+func parseFields(v string) (fieldTree, []string, error) {
+	tree := fieldTree{}
+	var paths []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		segs := strings.Split(p, ".")
+		for i, seg := range segs {
+			if !fieldPathSegment.MatchString(seg) {
+				return nil, nil, fmt.Errorf("invalid field path %q", p)
+			}
+			segs[i] = protoFieldName(seg)
+		}
+		paths = append(paths, strings.Join(segs, "."))
+
+		node := tree
+		for i, seg := range segs {
+			name := jsonFieldName(seg)
+			sub, ok := node[name]
+			if ok && len(sub) == 0 {
+				// The whole field is already selected.
+				break
+			}
+			if i == len(segs)-1 {
+				node[name] = fieldTree{}
+				break
+			}
+			if !ok {
+				sub = fieldTree{}
+				node[name] = sub
+			}
+			node = sub
+		}
+	}
+	return tree, paths, nil
+}
+
+// jsonFieldName is the protojson name of a field named name: display_name
+// becomes displayName.
+func jsonFieldName(name string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range name {
+		switch {
+		case r == '_':
+			upper = true
+		case upper:
+			b.WriteRune(unicode.ToUpper(r))
+			upper = false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// protoFieldName turns a JSON name such as displayName back into
+// display_name; proto names are returned unchanged.
+func protoFieldName(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// partialResponses lets callers select response fields with a fields query
+// parameter or an X-Goog-FieldMask header (the parameter wins). The selection
+// is sent to user-service as a FieldMask, so it can leave the rest out, and
+// successful JSON responses are pruned to it here, since grpc-gateway writes
+// unpopulated fields. Nested paths select within messages and within each
+// element of a list. Streamed responses are passed through whole.
+func partialResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header.Del(fieldMaskHeader)
+		selection := r.Header.Get("X-Goog-FieldMask")
+		q := r.URL.Query()
+		if q.Has("fields") {
+			selection = q.Get("fields")
+			q.Del("fields")
+			r = r.Clone(r.Context())
+			r.URL.RawQuery = q.Encode()
+		}
+		if selection == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		tree, paths, err := parseFields(selection)
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		mask, err := proto.Marshal(&fieldmaskpb.FieldMask{Paths: paths})
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		r.Header.Set(fieldMaskHeader, base64.StdEncoding.EncodeToString(mask))
+
+		pw := &partialResponseWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(pw, r)
+		pw.finish(tree)
+	})
+}
+
+// partialResponseWriter holds the response back until it can be pruned, or
+// until the handler flushes, which means it is streaming.
+type partialResponseWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	buf         bytes.Buffer
+	streaming   bool
+}
+
+func (pw *partialResponseWriter) WriteHeader(status int) {
+	if !pw.wroteHeader {
+		pw.status, pw.wroteHeader = status, true
+	}
+}
+
+func (pw *partialResponseWriter) Write(b []byte) (int, error) {
+	pw.wroteHeader = true
+	if pw.streaming {
+		return pw.ResponseWriter.Write(b)
+	}
+	return pw.buf.Write(b)
+}
+
+func (pw *partialResponseWriter) Flush() {
+	if !pw.streaming {
+		pw.streaming = true
+		pw.ResponseWriter.WriteHeader(pw.status)
+		pw.ResponseWriter.Write(pw.buf.Bytes())
+		pw.buf.Reset()
+	}
+	if f, ok := pw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (pw *partialResponseWriter) finish(tree fieldTree) {
+	if pw.streaming {
+		return
+	}
+	body := pw.buf.Bytes()
+	if pw.status/100 == 2 && strings.HasPrefix(pw.Header().Get("Content-Type"), "application/json") {
+		if pruned, err := pruneJSON(body, tree); err == nil {
+			body = pruned
+			pw.Header().Del("Content-Length")
+		}
+	}
+	pw.ResponseWriter.WriteHeader(pw.status)
+	pw.ResponseWriter.Write(body)
+}
+
+// pruneJSON keeps the members of the JSON object in data that tree selects,
+// in their original order. Arrays are pruned element by element.
+func pruneJSON(data []byte, tree fieldTree) ([]byte, error) {
+	data = bytes.TrimSpace(data)
+	if len(tree) == 0 {
+		return data, nil
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("[")):
+		var elems []json.RawMessage
+		if err := json.Unmarshal(data, &elems); err != nil {
+			return nil, err
+		}
+		var out bytes.Buffer
+		out.WriteByte('[')
+		for i, e := range elems {
+			pe, err := pruneJSON(e, tree)
+			if err != nil {
+				return nil, err
+			}
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			out.Write(pe)
+		}
+		out.WriteByte(']')
+		return out.Bytes(), nil
+	case !bytes.HasPrefix(data, []byte("{")):
+		// A scalar cannot have the subfields asked for.
+		return data, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.Token() // {
+	var out bytes.Buffer
+	out.WriteByte('{')
+	first := true
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		sub, ok := tree[key]
+		if !ok {
+			sub, ok = tree[jsonFieldName(key)]
+		}
+		if !ok {
+			continue
+		}
+		if value, err = pruneJSON(value, sub); err != nil {
+			return nil, err
+		}
+		if !first {
+			out.WriteByte(',')
+		}
+		first = false
+		k, _ := json.Marshal(key)
+		out.Write(k)
+		out.WriteByte(':')
+		out.Write(value)
+	}
+	out.WriteByte('}')
+	return out.Bytes(), nil
+}
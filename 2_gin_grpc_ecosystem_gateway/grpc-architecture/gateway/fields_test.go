@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+func TestParseFields(t *testing.T) {
+	tree, paths, err := parseFields("id, displayName,users.email,users,next_page_token.x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantTree := fieldTree{"id": {}, "displayName": {}, "users": {}, "nextPageToken": {"x": {}}}
+	if !reflect.DeepEqual(tree, wantTree) {
+		t.Errorf("tree = %v, want %v", tree, wantTree)
+	}
+	wantPaths := []string{"id", "display_name", "users.email", "users", "next_page_token.x"}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Errorf("paths = %v, want %v", paths, wantPaths)
+	}
+	if _, _, err := parseFields("id,name-x"); err == nil {
+		t.Error("invalid path accepted")
+	}
+}
+
+func TestPruneJSON(t *testing.T) {
+	tree, _, _ := parseFields("nextPageToken,users.email")
+	got, err := pruneJSON([]byte(`{"users":[{"id":"1","email":"a@x"},{"id":"2","email":"b@x"}],"total":2,"nextPageToken":"2"}`), tree)
+	if want := `{"users":[{"email":"a@x"},{"email":"b@x"}],"nextPageToken":"2"}`; err != nil || string(got) != want {
+		t.Errorf("pruneJSON = %s, %v\nwant %s", got, err, want)
+	}
+}
+
+func TestPartialResponses(t *testing.T) {
+	forEachMode(t, func(t *testing.T, h *harness) {
+		for _, c := range []struct {
+			path   string
+			header http.Header
+			want   string
+		}{
+			{"/api/user/123?fields=name", nil, `{"name":"John Doe"}`},
+			{"/api/user/123?fields=email,id", nil, `{"id":"123","email":"john@example.com"}`},
+			{"/api/user/123", http.Header{"X-Goog-Fieldmask": {"name"}}, `{"name":"John Doe"}`},
+			// The parameter wins over the header.
+			{"/api/user/123?fields=id", http.Header{"X-Goog-Fieldmask": {"name"}}, `{"id":"123"}`},
+			{"/api/v2/users/123?fields=display_name", nil, `{"displayName":"John Doe"}`},
+		} {
+			res, body := h.do(t, http.MethodGet, c.path, "", c.header)
+			if res.StatusCode != http.StatusOK || body != c.want {
+				t.Errorf("GET %s %v = %d %s, want %s", c.path, c.header, res.StatusCode, body, c.want)
+			}
+		}
+
+		// user-service receives the selection as a FieldMask.
+		h.do(t, http.MethodGet, "/api/v2/users/123?fields=displayName,email", "", nil)
+		var mask fieldmaskpb.FieldMask
+		if md := h.upstream.metadata().Get("x-goog-fieldmask-bin"); len(md) != 1 || proto.Unmarshal([]byte(md[0]), &mask) != nil {
+			t.Fatalf("user-service saw x-goog-fieldmask-bin %q", md)
+		}
+		if !reflect.DeepEqual(mask.Paths, []string{"display_name", "email"}) {
+			t.Errorf("mask paths = %v", mask.Paths)
+		}
+
+		// Errors are not pruned.
+		res, body := h.do(t, http.MethodGet, "/api/user/999?fields=name", "", nil)
+		if res.StatusCode != http.StatusNotFound || body == `{}` {
+			t.Errorf("GET unknown user = %d %s", res.StatusCode, body)
+		}
+		res, body = h.do(t, http.MethodGet, "/api/user/123?fields=a..b", "", nil)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("GET with bad fields = %d %s", res.StatusCode, body)
+		}
+	})
+}
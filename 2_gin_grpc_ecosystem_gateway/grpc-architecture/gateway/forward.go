@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Calls on :8081 are answered with a second call to user-service or a
+// proxied backend, and gRPC does not carry a server call's incoming metadata
+// over to the calls its handler makes. REST callers get theirs forwarded by
+// grpc-gateway, which turns headers into metadata; the interceptors here do
+// the same for gRPC callers, so that the authorization user-service checks,
+// request ids and the X-Canary header clusterRouter picks a cluster by reach
+// the backend whichever port the call came in on.
+
+// forwardedContext copies the caller's metadata onto the outgoing context.
+// Transport-level keys are left for gRPC to set.
+func forwardedContext(ctx context.Context) context.Context {
+	in, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	out := metadata.MD{}
+	for k, v := range in {
+		if strings.HasPrefix(k, ":") || strings.HasPrefix(k, "grpc-") || k == "content-type" || k == "user-agent" {
+			continue
+		}
+		out[k] = v
+	}
+	return metadata.NewOutgoingContext(ctx, out)
+}
+
+// forwardingServerStream overrides Context so stream handlers see forwarded
+// metadata.
+type forwardingServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *forwardingServerStream) Context() context.Context { return s.ctx }
+
+func forwardingUnaryInterceptor(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	return handler(forwardedContext(ctx), req)
+}
+
+func forwardingStreamInterceptor(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &forwardingServerStream{ss, forwardedContext(ss.Context())})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	pb "api/user"
+
+	"google.golang.org/grpc/metadata"
+)
+
+func TestGRPCMetadataForwarding(t *testing.T) {
+	h := newHarness(t, modeRemote)
+	ctx := metadata.AppendToOutgoingContext(testContext(t), "x-request-id", "abc")
+
+	if _, err := h.grpcClient.GetUser(ctx, &pb.GetUserRequest{UserId: "123"}); err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	md := h.upstream.metadata()
+	if got := md.Get("x-request-id"); len(got) != 1 || got[0] != "abc" {
+		t.Errorf("x-request-id = %v", got)
+	}
+	if got := md.Get("content-type"); len(got) != 1 {
+		t.Errorf("content-type = %v, want exactly the one set by gRPC", got)
+	}
+}
+
+func TestForwardedContextDropsTransportKeys(t *testing.T) {
+	in := metadata.Pairs(
+		"authorization", "Bearer token",
+		"x-canary", "1",
+		":authority", "localhost:8081",
+		"content-type", "application/grpc",
+		"user-agent", "grpc-go",
+		"grpc-timeout", "1S",
+	)
+	out, _ := metadata.FromOutgoingContext(forwardedContext(metadata.NewIncomingContext(context.Background(), in)))
+	if len(out) != 2 || out.Get("authorization")[0] != "Bearer token" || out.Get("x-canary")[0] != "1" {
+		t.Errorf("forwarded = %v, want authorization and x-canary only", out)
+	}
+
+	ctx := context.Background()
+	if got := forwardedContext(ctx); got != ctx {
+		t.Error("context without incoming metadata was replaced")
+	}
+}
@@ -0,0 +1,724 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/graphql-go/graphql/language/source"
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	pb "api/user"
+)
+
+const (
+	// defaultGraphQLDepth bounds how deeply fields may nest, counting the
+	// root field as 1, so a query cannot fan out without limit.
+	defaultGraphQLDepth = 8
+	// maxGraphQLUserBatch is user-service's limit on the IDs one
+	// BatchGetUsers call may ask for.
+	maxGraphQLUserBatch = 500
+	// maxGraphQLUserFetches bounds the GetUser calls one request runs at once
+	// against a user-service without BatchGetUsers.
+	maxGraphQLUserFetches = 8
+	maxGraphQLBody        = 1 << 20
+)
+
+// graphqlStats counts GraphQL traffic for /debug/vars. user_fetches are
+// users asked of user-service and user_batches the BatchGetUsers calls that
+// asked for them; user_dedups are lookups answered by an earlier fetch in
+// the same request.
+var graphqlStats = expvar.NewMap("graphql")
+
+func init() {
+	for _, k := range []string{"requests", "errors", "user_fetches", "user_batches", "user_dedups"} {
+		graphqlStats.Add(k, 0)
+	}
+}
+
+// gqlCall is what resolvers need from the HTTP request they run for.
+type gqlCall struct {
+	client pb.UserServiceClient
+	users  *userLoader
+}
+
+type gqlCallKey struct{}
+
+func callFrom(ctx context.Context) *gqlCall {
+	return ctx.Value(gqlCallKey{}).(*gqlCall)
+}
+
+// gqlStatusError carries a gRPC status into the response, with its code as
+// extensions.code.
+type gqlStatusError struct{ st *status.Status }
+
+func (e gqlStatusError) Error() string { return e.st.Message() }
+
+func (e gqlStatusError) Extensions() map[string]any {
+	return map[string]any{"code": code.Code(e.st.Code()).String()}
+}
+
+// gqlError turns err into a resolver error, keeping the gRPC code of status
+// errors.
+func gqlError(err error) error {
+	if st, ok := status.FromError(err); ok {
+		return gqlStatusError{st}
+	}
+	return err
+}
+
+// errorExtensions digs the extensions out of a response error. graphql-go
+// keeps them for errors resolvers return but drops them for errors from
+// thunks, such as userLoader's, after wrapping those twice.
+func errorExtensions(err error) map[string]any {
+	for err != nil {
+		switch e := err.(type) {
+		case gqlerrors.ExtendedError:
+			return e.Extensions()
+		case gqlerrors.FormattedError:
+			err = e.OriginalError()
+		case *gqlerrors.Error:
+			err = e.OriginalError
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+// gqlSchemaBuilder derives GraphQL types from proto messages. User and
+// CreateUserInput come from user.proto, so new proto fields show up without
+// changes here.
+type gqlSchemaBuilder struct {
+	objects map[protoreflect.FullName]*graphql.Object
+	inputs  map[protoreflect.FullName]*graphql.InputObject
+	enums   map[protoreflect.FullName]*graphql.Enum
+}
+
+func newGraphQLSchema() (graphql.Schema, error) {
+	b := &gqlSchemaBuilder{
+		objects: make(map[protoreflect.FullName]*graphql.Object),
+		inputs:  make(map[protoreflect.FullName]*graphql.InputObject),
+		enums:   make(map[protoreflect.FullName]*graphql.Enum),
+	}
+	user := b.object((&pb.User{}).ProtoReflect().Descriptor(), "User")
+	createUserInput := b.input((&pb.CreateUserRequest{}).ProtoReflect().Descriptor(), "CreateUserInput")
+
+	pageInfo := graphql.NewObject(graphql.ObjectConfig{Name: "PageInfo", Fields: graphql.Fields{
+		"hasNextPage": {Type: graphql.NewNonNull(graphql.Boolean), Resolve: func(p graphql.ResolveParams) (any, error) {
+			return p.Source.(*pb.ListUsersResponse).NextPageToken != "", nil
+		}},
+		"endCursor": {Type: graphql.String, Resolve: func(p graphql.ResolveParams) (any, error) {
+			if t := p.Source.(*pb.ListUsersResponse).NextPageToken; t != "" {
+				return t, nil
+			}
+			return nil, nil
+		}},
+	}})
+	userEdge := graphql.NewObject(graphql.ObjectConfig{Name: "UserEdge", Fields: graphql.Fields{
+		"node": {Type: graphql.NewNonNull(user), Resolve: func(p graphql.ResolveParams) (any, error) {
+			return p.Source, nil
+		}},
+	}})
+	listUsers := func(p graphql.ResolveParams) (any, error) {
+		return p.Source.(*pb.ListUsersResponse).Users, nil
+	}
+	userConnection := graphql.NewObject(graphql.ObjectConfig{Name: "UserConnection", Fields: graphql.Fields{
+		"nodes":    {Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(user))), Resolve: listUsers},
+		"edges":    {Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userEdge))), Resolve: listUsers},
+		"pageInfo": {Type: graphql.NewNonNull(pageInfo), Resolve: func(p graphql.ResolveParams) (any, error) { return p.Source, nil }},
+	}})
+
+	return graphql.NewSchema(graphql.SchemaConfig{
+		Query: graphql.NewObject(graphql.ObjectConfig{Name: "Query", Fields: graphql.Fields{
+			"user": {
+				Type:    user,
+				Args:    graphql.FieldConfigArgument{"id": {Type: graphql.NewNonNull(graphql.ID)}},
+				Resolve: resolveUser,
+			},
+			"users": {
+				Type: graphql.NewNonNull(userConnection),
+				Args: graphql.FieldConfigArgument{
+					"first":        {Type: graphql.Int},
+					"after":        {Type: graphql.String},
+					"nameContains": {Type: graphql.String},
+					"emailDomain":  {Type: graphql.String},
+				},
+				Resolve: resolveUsers,
+			},
+		}}),
+		Mutation: graphql.NewObject(graphql.ObjectConfig{Name: "Mutation", Fields: graphql.Fields{
+			"createUser": {
+				Type:    graphql.NewNonNull(user),
+				Args:    graphql.FieldConfigArgument{"input": {Type: graphql.NewNonNull(createUserInput)}},
+				Resolve: resolveCreateUser,
+			},
+		}}),
+	})
+}
+
+// object returns the object type for md, with one field per proto field
+// named as in proto JSON.
+func (b *gqlSchemaBuilder) object(md protoreflect.MessageDescriptor, name string) *graphql.Object {
+	if o, ok := b.objects[md.FullName()]; ok {
+		return o
+	}
+	o := graphql.NewObject(graphql.ObjectConfig{Name: name, Fields: graphql.FieldsThunk(func() graphql.Fields {
+		out := graphql.Fields{}
+		fields := md.Fields()
+		for i := 0; i < fields.Len(); i++ {
+			fd := fields.Get(i)
+			out[fd.JSONName()] = &graphql.Field{Type: b.outputType(fd), Resolve: func(p graphql.ResolveParams) (any, error) {
+				m := p.Source.(proto.Message).ProtoReflect()
+				if fd.Message() != nil && !fd.IsList() && !m.Has(fd) {
+					return nil, nil
+				}
+				v := m.Get(fd)
+				if !fd.IsList() {
+					return protoFieldValue(fd, v), nil
+				}
+				out := make([]any, v.List().Len())
+				for i := range out {
+					out[i] = protoFieldValue(fd, v.List().Get(i))
+				}
+				return out, nil
+			}}
+		}
+		return out
+	})})
+	b.objects[md.FullName()] = o
+	return o
+}
+
+// input returns the input type for md. Its fields are all optional, as in
+// proto3; user-service checks what it needs.
+func (b *gqlSchemaBuilder) input(md protoreflect.MessageDescriptor, name string) *graphql.InputObject {
+	if in, ok := b.inputs[md.FullName()]; ok {
+		return in
+	}
+	in := graphql.NewInputObject(graphql.InputObjectConfig{Name: name, Fields: graphql.InputObjectConfigFieldMapThunk(func() graphql.InputObjectConfigFieldMap {
+		out := graphql.InputObjectConfigFieldMap{}
+		fields := md.Fields()
+		for i := 0; i < fields.Len(); i++ {
+			fd := fields.Get(i)
+			var t graphql.Input
+			if fd.Message() != nil {
+				t = b.input(fd.Message(), string(fd.Message().Name())+"Input")
+			} else {
+				t = b.scalarType(fd)
+			}
+			if fd.IsList() {
+				t = graphql.NewList(graphql.NewNonNull(t))
+			}
+			out[fd.JSONName()] = &graphql.InputObjectFieldConfig{Type: t}
+		}
+		return out
+	})})
+	b.inputs[md.FullName()] = in
+	return in
+}
+
+// outputType maps a proto field to a GraphQL type. Scalars and lists are
+// never null in proto3; 64-bit integers are strings, as in proto JSON.
+func (b *gqlSchemaBuilder) outputType(fd protoreflect.FieldDescriptor) graphql.Output {
+	var t graphql.Output
+	if fd.Message() != nil {
+		t = b.object(fd.Message(), string(fd.Message().Name()))
+	} else {
+		t = graphql.NewNonNull(b.scalarType(fd))
+	}
+	if fd.IsList() {
+		if fd.Message() != nil {
+			t = graphql.NewNonNull(t)
+		}
+		t = graphql.NewNonNull(graphql.NewList(t))
+	}
+	return t
+}
+
+func (b *gqlSchemaBuilder) scalarType(fd protoreflect.FieldDescriptor) graphql.Type {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return graphql.Boolean
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return graphql.Int
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return graphql.Float
+	case protoreflect.EnumKind:
+		return b.enum(fd.Enum())
+	case protoreflect.StringKind:
+		if fd.Name() == "id" {
+			return graphql.ID
+		}
+	}
+	return graphql.String
+}
+
+func (b *gqlSchemaBuilder) enum(ed protoreflect.EnumDescriptor) *graphql.Enum {
+	if e, ok := b.enums[ed.FullName()]; ok {
+		return e
+	}
+	values := graphql.EnumValueConfigMap{}
+	for i := 0; i < ed.Values().Len(); i++ {
+		name := string(ed.Values().Get(i).Name())
+		values[name] = &graphql.EnumValueConfig{Value: name}
+	}
+	e := graphql.NewEnum(graphql.EnumConfig{Name: string(ed.Name()), Values: values})
+	b.enums[ed.FullName()] = e
+	return e
+}
+
+func protoFieldValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) any {
+	switch fd.Kind() {
+	case protoreflect.BoolKind:
+		return v.Bool()
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		return v.Int()
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		return v.Uint()
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		return strconv.FormatInt(v.Int(), 10)
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		return strconv.FormatUint(v.Uint(), 10)
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		return v.Float()
+	case protoreflect.BytesKind:
+		return base64.StdEncoding.EncodeToString(v.Bytes())
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByNumber(v.Enum()); ev != nil {
+			return string(ev.Name())
+		}
+		return nil
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return v.Message().Interface()
+	}
+	return v.String()
+}
+
+// printSDL renders the named types of schema in GraphQL schema definition
+// language, leaving out introspection types and built-in scalars.
+func printSDL(schema graphql.Schema) string {
+	var names []string
+	for name, t := range schema.TypeMap() {
+		if _, scalar := t.(*graphql.Scalar); !scalar && !strings.HasPrefix(name, "__") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("schema {\n  query: Query\n  mutation: Mutation\n}\n")
+	for _, name := range names {
+		switch t := schema.Type(name).(type) {
+		case *graphql.Object:
+			fmt.Fprintf(&b, "\ntype %s {\n", name)
+			fields := t.Fields()
+			for _, f := range sortedKeys(fields) {
+				b.WriteString("  " + f)
+				if args := fields[f].Args; len(args) > 0 {
+					var list []string
+					for _, a := range args {
+						list = append(list, a.Name()+": "+a.Type.String())
+					}
+					sort.Strings(list)
+					b.WriteString("(" + strings.Join(list, ", ") + ")")
+				}
+				b.WriteString(": " + fields[f].Type.String() + "\n")
+			}
+			b.WriteString("}\n")
+		case *graphql.InputObject:
+			fmt.Fprintf(&b, "\ninput %s {\n", name)
+			fields := t.Fields()
+			for _, f := range sortedKeys(fields) {
+				fmt.Fprintf(&b, "  %s: %s\n", f, fields[f].Type)
+			}
+			b.WriteString("}\n")
+		case *graphql.Enum:
+			fmt.Fprintf(&b, "\nenum %s {\n", name)
+			for _, v := range t.Values() {
+				fmt.Fprintf(&b, "  %s\n", v.Name)
+			}
+			b.WriteString("}\n")
+		}
+	}
+	return b.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func resolveUser(p graphql.ResolveParams) (any, error) {
+	return callFrom(p.Context).users.load(p.Context, p.Args["id"].(string)), nil
+}
+
+func resolveUsers(p graphql.ResolveParams) (any, error) {
+	req := &pb.ListUsersRequest{}
+	if v, ok := p.Args["first"].(int); ok {
+		if v < 0 {
+			return nil, gqlError(status.Error(codes.InvalidArgument, "first must not be negative"))
+		}
+		req.PageSize = int32(v)
+	}
+	req.PageToken, _ = p.Args["after"].(string)
+	req.NameContains, _ = p.Args["nameContains"].(string)
+	req.EmailDomain, _ = p.Args["emailDomain"].(string)
+	resp, err := callFrom(p.Context).client.ListUsers(p.Context, req)
+	if err != nil {
+		return nil, gqlError(err)
+	}
+	return resp, nil
+}
+
+func resolveCreateUser(p graphql.ResolveParams) (any, error) {
+	b, _ := json.Marshal(p.Args["input"])
+	req := &pb.CreateUserRequest{}
+	if err := protojson.Unmarshal(b, req); err != nil {
+		return nil, gqlError(status.Errorf(codes.InvalidArgument, "input: %v", err))
+	}
+	resp, err := callFrom(p.Context).client.CreateUser(p.Context, req)
+	if err != nil {
+		return nil, gqlError(err)
+	}
+	return userFromMessage(resp), nil
+}
+
+// userFromMessage copies the fields of a GetUser or CreateUser response that
+// User shares by name.
+func userFromMessage(m proto.Message) *pb.User {
+	u := &pb.User{}
+	src, dst := m.ProtoReflect(), u.ProtoReflect()
+	src.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		if df := dst.Descriptor().Fields().ByName(fd.Name()); df != nil && df.Kind() == fd.Kind() && df.Cardinality() == fd.Cardinality() && fd.Message() == nil {
+			dst.Set(df, v)
+		}
+		return true
+	})
+	return u
+}
+
+// userLoader looks up each user at most once per GraphQL request, however
+// many fields ask for it, and the users one level of a query asks for
+// together. load queues the ID and returns a thunk, which graphql-go only
+// calls once every field at the same level has been resolved; the first of
+// those thunks sends every queued ID in one BatchGetUsers call. Against a
+// user-service without BatchGetUsers it falls back to GetUser,
+// maxGraphQLUserFetches calls at a time.
+type userLoader struct {
+	client pb.UserServiceClient
+
+	mu      sync.Mutex
+	loads   map[string]*userLoad
+	queued  []*userLoad
+	noBatch bool // user-service answered BatchGetUsers with Unimplemented
+}
+
+// userLoad is one user's lookup. Once done is closed, user is nil if
+// user-service does not know the ID.
+type userLoad struct {
+	id   string
+	done chan struct{}
+	user *pb.User
+	err  error
+}
+
+func newUserLoader(client pb.UserServiceClient) *userLoader {
+	return &userLoader{client: client, loads: make(map[string]*userLoad)}
+}
+
+func (l *userLoader) load(ctx context.Context, id string) func() (any, error) {
+	l.mu.Lock()
+	ld, ok := l.loads[id]
+	if !ok {
+		ld = &userLoad{id: id, done: make(chan struct{})}
+		l.loads[id] = ld
+		l.queued = append(l.queued, ld)
+	}
+	l.mu.Unlock()
+	if ok {
+		graphqlStats.Add("user_dedups", 1)
+	} else {
+		graphqlStats.Add("user_fetches", 1)
+	}
+	return func() (any, error) {
+		l.flush(ctx)
+		<-ld.done
+		if ld.err != nil {
+			return nil, gqlError(ld.err)
+		}
+		if ld.user == nil {
+			return nil, nil
+		}
+		return ld.user, nil
+	}
+}
+
+// flush fetches every queued user.
+func (l *userLoader) flush(ctx context.Context) {
+	l.mu.Lock()
+	queued, noBatch := l.queued, l.noBatch
+	l.queued = nil
+	l.mu.Unlock()
+	for len(queued) > 0 {
+		batch := queued[:min(len(queued), maxGraphQLUserBatch)]
+		queued = queued[len(batch):]
+		if !noBatch && l.fetchBatch(ctx, batch) {
+			continue
+		}
+		noBatch = true
+		l.fetchEach(ctx, batch)
+	}
+}
+
+// fetchBatch looks batch up with one BatchGetUsers call. It reports false,
+// leaving batch untouched, if user-service does not implement the call.
+func (l *userLoader) fetchBatch(ctx context.Context, batch []*userLoad) bool {
+	ids := make([]string, len(batch))
+	for i, ld := range batch {
+		ids[i] = ld.id
+	}
+	graphqlStats.Add("user_batches", 1)
+	resp, err := l.client.BatchGetUsers(ctx, &pb.BatchGetUsersRequest{UserIds: ids})
+	if status.Code(err) == codes.Unimplemented {
+		l.mu.Lock()
+		l.noBatch = true
+		l.mu.Unlock()
+		return false
+	}
+	found := make(map[string]*pb.User, len(resp.GetUsers()))
+	for _, u := range resp.GetUsers() {
+		found[u.Id] = u
+	}
+	for _, ld := range batch {
+		ld.user, ld.err = found[ld.id], err
+		close(ld.done)
+	}
+	return true
+}
+
+// fetchEach looks batch up with a GetUser call per user.
+func (l *userLoader) fetchEach(ctx context.Context, batch []*userLoad) {
+	sem := make(chan struct{}, maxGraphQLUserFetches)
+	var wg sync.WaitGroup
+	for _, ld := range batch {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() {
+				close(ld.done)
+				<-sem
+				wg.Done()
+			}()
+			resp, err := l.client.GetUser(ctx, &pb.GetUserRequest{UserId: ld.id})
+			switch {
+			case err == nil:
+				ld.user = userFromMessage(resp)
+			case status.Code(err) != codes.NotFound:
+				ld.err = err
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+type gqlRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// gqlFailure is a response to a request that failed before execution.
+func gqlFailure(format string, args ...any) *graphql.Result {
+	return &graphql.Result{Errors: []gqlerrors.FormattedError{gqlerrors.NewFormattedError(fmt.Sprintf(format, args...))}}
+}
+
+// graphqlServer answers GraphQL requests against UserService with
+// graphql-go, which also answers introspection queries.
+type graphqlServer struct {
+	schema   graphql.Schema
+	sdl      string
+	client   pb.UserServiceClient
+	maxDepth int
+}
+
+func newGraphQLServer(client pb.UserServiceClient) *graphqlServer {
+	schema, err := newGraphQLSchema()
+	if err != nil {
+		// The schema only depends on the compiled-in protos.
+		panic(fmt.Sprintf("building GraphQL schema: %v", err))
+	}
+	return &graphqlServer{schema: schema, sdl: printSDL(schema), client: client, maxDepth: defaultGraphQLDepth}
+}
+
+// schemaHandler serves the schema as SDL.
+func (g *graphqlServer) schemaHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.String(http.StatusOK, g.sdl)
+	}
+}
+
+// handler serves POST with a JSON request, or an array of them that share
+// one user loader, and GET with query, operationName and variables
+// parameters. GET only runs queries.
+func (g *graphqlServer) handler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var reqs []gqlRequest
+		batch := false
+		switch c.Request.Method {
+		case http.MethodGet:
+			req := gqlRequest{Query: c.Query("query"), OperationName: c.Query("operationName")}
+			if v := c.Query("variables"); v != "" {
+				if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+					c.JSON(http.StatusBadRequest, gqlFailure("variables must be a JSON object"))
+					return
+				}
+			}
+			reqs = append(reqs, req)
+		default:
+			body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxGraphQLBody+1))
+			if err != nil || len(body) > maxGraphQLBody {
+				c.JSON(http.StatusRequestEntityTooLarge, gqlFailure("request body too large"))
+				return
+			}
+			trimmed := strings.TrimSpace(string(body))
+			batch = strings.HasPrefix(trimmed, "[")
+			if batch {
+				err = json.Unmarshal(body, &reqs)
+			} else {
+				reqs = make([]gqlRequest, 1)
+				err = json.Unmarshal(body, &reqs[0])
+			}
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gqlFailure("malformed GraphQL request: %v", err))
+				return
+			}
+		}
+
+		ctx := c.Request.Context()
+		if auth := c.GetHeader("Authorization"); auth != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", auth)
+		}
+		ctx = context.WithValue(ctx, gqlCallKey{}, &gqlCall{client: g.client, users: newUserLoader(g.client)})
+		resps := make([]*graphql.Result, len(reqs))
+		for i, req := range reqs {
+			resps[i] = g.execute(ctx, req, c.Request.Method == http.MethodGet)
+		}
+		if batch {
+			c.JSON(http.StatusOK, resps)
+			return
+		}
+		c.JSON(http.StatusOK, resps[0])
+	}
+}
+
+func (g *graphqlServer) execute(ctx context.Context, req gqlRequest, readOnly bool) *graphql.Result {
+	graphqlStats.Add("requests", 1)
+	resp := g.run(ctx, req, readOnly)
+	if resp.HasErrors() {
+		graphqlStats.Add("errors", 1)
+	}
+	return resp
+}
+
+// run is graphql.Do with two checks between validation and execution, the
+// nesting limit and that GET requests only query, and with extensions kept
+// on every field error.
+func (g *graphqlServer) run(ctx context.Context, req gqlRequest, readOnly bool) *graphql.Result {
+	doc, err := parser.Parse(parser.ParseParams{Source: source.NewSource(&source.Source{Body: []byte(req.Query), Name: "GraphQL request"})})
+	if err != nil {
+		return &graphql.Result{Errors: gqlerrors.FormatErrors(err)}
+	}
+	// Fragment cycles go first: the overlapping-fields rule recurses through
+	// them without end.
+	for _, rules := range [][]graphql.ValidationRuleFn{{graphql.NoFragmentCyclesRule}, graphql.SpecifiedRules} {
+		if v := graphql.ValidateDocument(&g.schema, doc, rules); !v.IsValid {
+			return &graphql.Result{Errors: v.Errors}
+		}
+	}
+	fragments := map[string]*ast.FragmentDefinition{}
+	var op *ast.OperationDefinition
+	for _, d := range doc.Definitions {
+		switch d := d.(type) {
+		case *ast.FragmentDefinition:
+			fragments[d.Name.Value] = d
+		case *ast.OperationDefinition:
+			if req.OperationName == "" || (d.Name != nil && d.Name.Value == req.OperationName) {
+				op = d
+			}
+		}
+	}
+	if op != nil {
+		if readOnly && op.Operation != ast.OperationTypeQuery {
+			return gqlFailure("%s operations must be sent with POST", op.Operation)
+		}
+		if depth := selectionDepth(op.SelectionSet, fragments); depth > g.maxDepth {
+			return gqlFailure("query is nested %d deep, deeper than the limit of %d", depth, g.maxDepth)
+		}
+	}
+	resp := graphql.Execute(graphql.ExecuteParams{
+		Schema:        g.schema,
+		AST:           doc,
+		OperationName: req.OperationName,
+		Args:          req.Variables,
+		Context:       ctx,
+	})
+	for i, e := range resp.Errors {
+		if e.Extensions == nil {
+			resp.Errors[i].Extensions = errorExtensions(e)
+		}
+	}
+	return resp
+}
+
+// selectionDepth returns how deeply set nests fields, through fragments.
+// Introspection fields do not count: the schema bounds them, and the query
+// GraphiQL sends nests deeper than any user query needs to. Validation has
+// already ruled out fragment cycles.
+func selectionDepth(set *ast.SelectionSet, fragments map[string]*ast.FragmentDefinition) int {
+	if set == nil {
+		return 0
+	}
+	depth := 0
+	for _, s := range set.Selections {
+		d := 0
+		switch s := s.(type) {
+		case *ast.Field:
+			if !strings.HasPrefix(s.Name.Value, "__") {
+				d = 1 + selectionDepth(s.SelectionSet, fragments)
+			}
+		case *ast.InlineFragment:
+			d = selectionDepth(s.SelectionSet, fragments)
+		case *ast.FragmentSpread:
+			if f := fragments[s.Name.Value]; f != nil {
+				d = selectionDepth(f.SelectionSet, fragments)
+			}
+		}
+		depth = max(depth, d)
+	}
+	return depth
+}
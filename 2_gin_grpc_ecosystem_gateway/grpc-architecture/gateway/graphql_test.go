@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"maps"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "api/user"
+)
+
+// graphqlUsers knows users 123 and 124, fails lookups of "down", lists
+// users one per page and counts lookups per ID and BatchGetUsers calls.
+// With noBatch set it has no BatchGetUsers.
+type graphqlUsers struct {
+	stubUserService
+
+	mu      sync.Mutex
+	calls   map[string]int
+	batches int
+	noBatch bool
+}
+
+func (g *graphqlUsers) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	g.mu.Lock()
+	g.calls[req.UserId]++
+	g.mu.Unlock()
+	switch req.UserId {
+	case "124":
+		return &pb.GetUserResponse{Id: "124", Name: "Alice", Email: "alice@example.com"}, nil
+	case "down":
+		return nil, status.Error(codes.Unavailable, "user-service unavailable")
+	}
+	return g.stubUserService.GetUser(ctx, req)
+}
+
+func (g *graphqlUsers) BatchGetUsers(ctx context.Context, req *pb.BatchGetUsersRequest) (*pb.BatchGetUsersResponse, error) {
+	g.mu.Lock()
+	noBatch := g.noBatch
+	if !noBatch {
+		g.batches++
+	}
+	g.mu.Unlock()
+	if noBatch {
+		return g.stubUserService.BatchGetUsers(ctx, req)
+	}
+	resp := &pb.BatchGetUsersResponse{}
+	for _, id := range req.UserIds {
+		u, err := g.GetUser(ctx, &pb.GetUserRequest{UserId: id})
+		switch status.Code(err) {
+		case codes.OK:
+			resp.Users = append(resp.Users, &pb.User{Id: u.Id, Name: u.Name, Email: u.Email})
+		case codes.NotFound:
+		default:
+			return nil, err
+		}
+	}
+	return resp, nil
+}
+
+func (g *graphqlUsers) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
+	if req.Name == "" {
+		return nil, status.Error(codes.InvalidArgument, "name is required")
+	}
+	return &pb.CreateUserResponse{Id: "124", Name: req.Name, Email: req.Email}, nil
+}
+
+func (g *graphqlUsers) getCalls() (calls map[string]int, batches int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return maps.Clone(g.calls), g.batches
+}
+
+func (g *graphqlUsers) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	if req.PageToken == "" {
+		return &pb.ListUsersResponse{Users: []*pb.User{{Id: "123", Name: "John Doe"}}, NextPageToken: "p2"}, nil
+	}
+	return &pb.ListUsersResponse{Users: []*pb.User{{Id: "124", Name: "Alice"}}}, nil
+}
+
+type graphqlHarness struct {
+	users *graphqlUsers
+	gql   *graphqlServer
+	http  *httptest.Server
+}
+
+func newGraphQLTestServer(t *testing.T) *graphqlHarness {
+	t.Helper()
+	s := &graphqlHarness{users: &graphqlUsers{calls: make(map[string]int)}}
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterUserServiceServer(srv, s.users)
+	go srv.Serve(lis)
+	conn := dialBufconn(t, lis)
+
+	s.gql = newGraphQLServer(pb.NewUserServiceClient(conn))
+	router := gin.New()
+	router.GET("/graphql", s.gql.handler())
+	router.POST("/graphql", s.gql.handler())
+	router.GET("/graphql/schema", s.gql.schemaHandler())
+	s.http = httptest.NewServer(router)
+	t.Cleanup(func() {
+		s.http.Close()
+		conn.Close()
+		srv.Stop()
+	})
+	return s
+}
+
+func (s *graphqlHarness) post(t *testing.T, body any) string {
+	t.Helper()
+	b, _ := json.Marshal(body)
+	res, err := s.http.Client().Post(s.http.URL+"/graphql", "application/json", strings.NewReader(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var out json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&out); err != nil {
+		t.Fatalf("decoding response: %v", err)
+	}
+	return string(out)
+}
+
+// gqlResult is a decoded GraphQL response.
+type gqlResult struct {
+	Data   map[string]any `json:"data"`
+	Errors []struct {
+		Message    string         `json:"message"`
+		Path       []any          `json:"path"`
+		Extensions map[string]any `json:"extensions"`
+	} `json:"errors"`
+}
+
+func decodeResult(t *testing.T, body string) gqlResult {
+	t.Helper()
+	var r gqlResult
+	if err := json.Unmarshal([]byte(body), &r); err != nil {
+		t.Fatalf("decoding %s: %v", body, err)
+	}
+	return r
+}
+
+// jsonEqual reports whether a and b hold the same JSON value; graphql-go
+// does not keep fields in query order.
+func jsonEqual(t *testing.T, a, b string) bool {
+	t.Helper()
+	var x, y any
+	if err := json.Unmarshal([]byte(a), &x); err != nil {
+		t.Fatalf("decoding %s: %v", a, err)
+	}
+	if err := json.Unmarshal([]byte(b), &y); err != nil {
+		t.Fatalf("decoding %s: %v", b, err)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+func (s *graphqlHarness) get(t *testing.T, query string) string {
+	t.Helper()
+	res, err := s.http.Client().Get(s.http.URL + "/graphql?" + url.Values{"query": {query}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return string(b)
+}
+
+func TestGraphQLQuery(t *testing.T) {
+	s := newGraphQLTestServer(t)
+	got := s.post(t, gqlRequest{
+		Query: `query Profile($id: ID!, $withEmail: Boolean = true) {
+			me: user(id: $id) { __typename ...Basics email @include(if: $withEmail) }
+			nobody: user(id: "999") { id }
+			users(first: 1) {
+				nodes { id }
+				edges { node { ... on User { name } } }
+				pageInfo { hasNextPage endCursor }
+			}
+		}
+		fragment Basics on User { id name }`,
+		Variables: map[string]any{"id": "123"},
+	})
+	want := `{"data":{"me":{"__typename":"User","id":"123","name":"John Doe","email":"john@example.com"},"nobody":null,` +
+		`"users":{"nodes":[{"id":"123"}],"edges":[{"node":{"name":"John Doe"}}],"pageInfo":{"hasNextPage":true,"endCursor":"p2"}}}}`
+	if !jsonEqual(t, got, want) {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+
+	// GET works for queries, with @skip.
+	if got := s.get(t, `{ user(id: "124") { name email @skip(if: true) } }`); !jsonEqual(t, got, `{"data":{"user":{"name":"Alice"}}}`) {
+		t.Errorf("GET = %s", got)
+	}
+}
+
+func TestGraphQLBatchesUserLookups(t *testing.T) {
+	s := newGraphQLTestServer(t)
+	s.post(t, gqlRequest{Query: `{
+		a: user(id: "123") { name }
+		b: user(id: "123") { email }
+		c: user(id: "124") { id }
+		d: user(id: "124") { name }
+	}`})
+	// A batched POST shares one loader across its operations.
+	got := s.post(t, []gqlRequest{
+		{Query: `{ user(id: "999") { id } }`},
+		{Query: `query($id: ID!) { user(id: $id) { name } }`, Variables: map[string]any{"id": "999"}},
+	})
+	if got != `[{"data":{"user":null}},{"data":{"user":null}}]` {
+		t.Errorf("batched response = %s", got)
+	}
+	// One BatchGetUsers call per operation, and none for 999 the second time.
+	if calls, batches := s.users.getCalls(); calls["123"] != 1 || calls["124"] != 1 || calls["999"] != 1 || batches != 2 {
+		t.Errorf("lookups = %v in %d batches, want one per ID in 2", calls, batches)
+	}
+}
+
+func TestGraphQLWithoutBatchGetUsers(t *testing.T) {
+	s := newGraphQLTestServer(t)
+	s.users.mu.Lock()
+	s.users.noBatch = true
+	s.users.mu.Unlock()
+	// Each user is fetched on its own, so a failed lookup fails only its
+	// field.
+	r := decodeResult(t, s.post(t, gqlRequest{Query: `{ a: user(id: "down") { id } b: user(id: "123") { id } c: user(id: "123") { name } d: user(id: "999") { id } }`}))
+	if r.Data["a"] != nil || !reflect.DeepEqual(r.Data["b"], map[string]any{"id": "123"}) || r.Data["d"] != nil ||
+		len(r.Errors) != 1 || !reflect.DeepEqual(r.Errors[0].Path, []any{"a"}) || r.Errors[0].Extensions["code"] != "UNAVAILABLE" {
+		t.Errorf("result = %+v", r)
+	}
+	if calls, _ := s.users.getCalls(); calls["123"] != 1 || calls["down"] != 1 || calls["999"] != 1 {
+		t.Errorf("GetUser calls = %v, want one per ID", calls)
+	}
+}
+
+func TestGraphQLMutation(t *testing.T) {
+	s := newGraphQLTestServer(t)
+	got := s.post(t, gqlRequest{
+		Query:     `mutation Add($in: CreateUserInput!) { createUser(input: $in) { id name } }`,
+		Variables: map[string]any{"in": map[string]any{"name": "Bob", "email": "bob@example.com"}},
+	})
+	if !jsonEqual(t, got, `{"data":{"createUser":{"id":"124","name":"Bob"}}}`) {
+		t.Errorf("createUser = %s", got)
+	}
+
+	// createUser is non-null, so its failure nulls the whole result.
+	r := decodeResult(t, s.post(t, gqlRequest{Query: `mutation { createUser(input: {email: "x@example.com"}) { id } }`}))
+	if r.Data != nil || len(r.Errors) != 1 || r.Errors[0].Message != "name is required" ||
+		!reflect.DeepEqual(r.Errors[0].Path, []any{"createUser"}) || r.Errors[0].Extensions["code"] != "INVALID_ARGUMENT" {
+		t.Errorf("failed createUser = %+v", r)
+	}
+
+	r = decodeResult(t, s.get(t, `mutation { createUser(input: {name: "Bob"}) { id } }`))
+	if len(r.Errors) != 1 || !strings.Contains(r.Errors[0].Message, "POST") {
+		t.Errorf("mutation over GET = %+v", r)
+	}
+}
+
+func TestGraphQLRejectsInvalidQueries(t *testing.T) {
+	s := newGraphQLTestServer(t)
+	s.gql.maxDepth = 3
+	cases := map[string]string{
+		`{ user(id: "1") { nickname } }`:                               `Cannot query field "nickname" on type "User"`,
+		`{ user { id } }`:                                              `argument "id" of type "ID!" is required`,
+		`{ user(id: "1") }`:                                            `must have a sub selection`,
+		`{ users { nodes { id } } `:                                    `Syntax Error`,
+		`{ users { edges { node { id } } } }`:                          `deeper than the limit of 3`,
+		`{ ...A } fragment A on Query { ...A }`:                        `Cannot spread fragment "A" within itself`,
+		`query($first: Int) { users(first: $after) { nodes { id } } }`: `Variable "$after" is not defined`,
+		`subscription { user(id: "1") { id } }`:                        `Schema is not configured for subscriptions`,
+	}
+	for query, want := range cases {
+		r := decodeResult(t, s.post(t, gqlRequest{Query: query}))
+		if r.Data != nil || len(r.Errors) == 0 || !strings.Contains(r.Errors[0].Message, want) {
+			t.Errorf("%s\n  = %+v, want error containing %q", query, r, want)
+		}
+	}
+	if calls, _ := s.users.getCalls(); len(calls) != 0 {
+		t.Errorf("invalid queries reached user-service: %v", calls)
+	}
+}
+
+func TestGraphQLFieldErrors(t *testing.T) {
+	s := newGraphQLTestServer(t)
+	// A failed lookup nulls the nullable fields looked up with it, and only
+	// those.
+	r := decodeResult(t, s.post(t, gqlRequest{Query: `{ a: user(id: "down") { id } b: user(id: "123") { id } users(first: 1) { nodes { id } } }`}))
+	if r.Data["a"] != nil || r.Data["b"] != nil || r.Data["users"] == nil || len(r.Errors) != 2 ||
+		r.Errors[0].Message != "user-service unavailable" || r.Errors[0].Extensions["code"] != "UNAVAILABLE" {
+		t.Errorf("failed lookup = %+v", r)
+	}
+	// users is non-null, so its failure nulls the whole result.
+	r = decodeResult(t, s.post(t, gqlRequest{Query: `{ users(first: -1) { nodes { id } } user(id: "123") { id } }`}))
+	if r.Data != nil || len(r.Errors) != 1 || r.Errors[0].Message != "first must not be negative" {
+		t.Errorf("negative first = %+v", r)
+	}
+}
+
+func TestGraphQLIntrospection(t *testing.T) {
+	s := newGraphQLTestServer(t)
+	// Introspection nests deeper than the depth limit allows user fields to.
+	s.gql.maxDepth = 2
+	r := decodeResult(t, s.post(t, gqlRequest{Query: `{
+		__schema { queryType { name } mutationType { name } }
+		__type(name: "User") { fields { name type { kind ofType { name } } } }
+	}`}))
+	if len(r.Errors) > 0 {
+		t.Fatalf("introspection errors: %+v", r.Errors)
+	}
+	schema := r.Data["__schema"].(map[string]any)
+	if schema["queryType"].(map[string]any)["name"] != "Query" || schema["mutationType"].(map[string]any)["name"] != "Mutation" {
+		t.Errorf("__schema = %v", schema)
+	}
+	fields := map[string]any{}
+	for _, f := range r.Data["__type"].(map[string]any)["fields"].([]any) {
+		f := f.(map[string]any)
+		fields[f["name"].(string)] = f["type"].(map[string]any)["ofType"].(map[string]any)["name"]
+	}
+	if !reflect.DeepEqual(fields, map[string]any{"id": "ID", "name": "String", "email": "String"}) {
+		t.Errorf("User fields = %v", fields)
+	}
+}
+
+func TestGraphQLSchema(t *testing.T) {
+	s := newGraphQLTestServer(t)
+	res, err := s.http.Client().Get(s.http.URL + "/graphql/schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	for _, want := range []string{
+		"type User {\n  email: String!\n  id: ID!\n  name: String!\n}",
+		"input CreateUserInput {\n  email: String\n  name: String\n}",
+		"users(after: String, emailDomain: String, first: Int, nameContains: String): UserConnection!",
+	} {
+		if !strings.Contains(string(b), want) {
+			t.Errorf("schema lacks %q:\n%s", want, b)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	grpcWebContentType     = "application/grpc-web"
+	grpcWebTextContentType = "application/grpc-web-text"
+	// grpcWebTrailerFlag marks the frame carrying the status and trailers.
+	grpcWebTrailerFlag = 0x80
+	maxGRPCWebMessage  = 4 << 20
+)
+
+// grpcWebHandler translates gRPC-Web calls from browsers into native gRPC on
+// conn, normally the gateway's own gRPC server, so gatewayServer and the
+// transparent proxy behind it answer them. Messages are relayed as rawFrames.
+// Unary and server-streaming calls are supported; browsers cannot stream
+// requests.
+type grpcWebHandler struct {
+	conn grpc.ClientConnInterface
+}
+
+// isGRPCWebRequest reports whether r is a gRPC-Web call, or the CORS
+// preflight for one, which grpc-web clients mark with x-grpc-web.
+func isGRPCWebRequest(r *http.Request) bool {
+	if isPreflight(r) {
+		return strings.Contains(strings.ToLower(r.Header.Get("Access-Control-Request-Headers")), "x-grpc-web")
+	}
+	return r.Method == http.MethodPost && strings.HasPrefix(r.Header.Get("Content-Type"), grpcWebContentType)
+}
+
+// grpcWebMiddleware hands gRPC-Web calls to h and lets everything else
+// through to the Gin routes and the route table.
+func grpcWebMiddleware(h http.Handler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isGRPCWebRequest(c.Request) {
+			c.Next()
+			return
+		}
+		h.ServeHTTP(c.Writer, c.Request)
+		c.Abort()
+	}
+}
+
+// grpcWebCORS allows browsers on origins to call h and read the status
+// headers of trailers-only responses.
+func grpcWebCORS(origins []string, h http.Handler) http.Handler {
+	return corsHandler(corsSpec{
+		AllowOrigins:  origins,
+		AllowMethods:  []string{http.MethodPost},
+		ExposeHeaders: []string{"grpc-status", "grpc-message"},
+		MaxAge:        600,
+	}, h)
+}
+
+func (h *grpcWebHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	contentType := r.Header.Get("Content-Type")
+	text := strings.HasPrefix(contentType, grpcWebTextContentType)
+	method := r.URL.Path
+	if strings.Count(method, "/") != 2 || strings.HasSuffix(method, "/") {
+		http.Error(w, "gRPC-Web path must be /package.Service/Method", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel, err := outgoingCallContext(r)
+	if err != nil {
+		writeGRPCWebTrailersOnly(w, contentType, status.Convert(err))
+		return
+	}
+	defer cancel()
+	asyncLogf("[gRPC-Web] %s (text: %v)", method, text)
+
+	var body io.Reader = r.Body
+	if text {
+		body = base64.NewDecoder(base64.StdEncoding, r.Body)
+	}
+	cs, err := h.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, method, grpc.ForceCodec(proxyCodec{}))
+	if err != nil {
+		writeGRPCWebTrailersOnly(w, contentType, status.Convert(err))
+		return
+	}
+	if err := sendGRPCWebRequest(cs, bufio.NewReader(body)); err != nil {
+		cancel()
+		writeGRPCWebTrailersOnly(w, contentType, status.Convert(err))
+		return
+	}
+
+	out := &grpcWebWriter{w: w, text: text}
+	var f rawFrame
+	err = cs.RecvMsg(&f)
+	if md, herr := cs.Header(); herr == nil {
+		copyMetadataToHeader(w.Header(), md)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	for err == nil {
+		if werr := out.frame(0, f); werr != nil {
+			// The browser went away; cancel the call.
+			return
+		}
+		err = cs.RecvMsg(&f)
+	}
+	st := status.New(codes.OK, "")
+	if !errors.Is(err, io.EOF) {
+		st = status.Convert(err)
+	}
+	out.frame(grpcWebTrailerFlag, grpcWebTrailer(st, cs.Trailer()))
+}
+
+// outgoingCallContext carries the request headers to a call made for it as
+// metadata and applies the caller's grpc-timeout.
+func outgoingCallContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	md := metadata.MD{}
+	for k, vs := range r.Header {
+		k = strings.ToLower(k)
+		switch k {
+		case "content-type", "content-length", "accept", "accept-encoding", "accept-language",
+			"connection", "host", "origin", "referer", "user-agent", "x-grpc-web", "x-user-agent",
+			"te", "grpc-timeout", "grpc-encoding", "grpc-accept-encoding":
+			continue
+		}
+		if strings.HasPrefix(k, "sec-") {
+			continue
+		}
+		for _, v := range vs {
+			if strings.HasSuffix(k, "-bin") {
+				b, err := base64.StdEncoding.DecodeString(v)
+				if err != nil {
+					return nil, nil, status.Errorf(codes.InvalidArgument, "malformed binary header %s", k)
+				}
+				v = string(b)
+			}
+			md.Append(k, v)
+		}
+	}
+	ctx := metadata.NewOutgoingContext(r.Context(), md)
+	if v := r.Header.Get("Grpc-Timeout"); v != "" {
+		d, err := parseGRPCTimeout(v)
+		if err != nil {
+			return nil, nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		ctx, cancel := context.WithTimeout(ctx, d)
+		return ctx, cancel, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, cancel, nil
+}
+
+// parseGRPCTimeout decodes a grpc-timeout value such as "500m" or "3S".
+func parseGRPCTimeout(v string) (time.Duration, error) {
+	if len(v) < 2 || len(v) > 9 {
+		return 0, fmt.Errorf("malformed grpc-timeout %q", v)
+	}
+	n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("malformed grpc-timeout %q", v)
+	}
+	unit := map[byte]time.Duration{
+		'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+	}[v[len(v)-1]]
+	if unit == 0 {
+		return 0, fmt.Errorf("malformed grpc-timeout %q", v)
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// sendGRPCWebRequest relays every length-prefixed message in body to cs and
+// closes the send side.
+func sendGRPCWebRequest(cs grpc.ClientStream, body *bufio.Reader) error {
+	for {
+		var prefix [5]byte
+		if _, err := io.ReadFull(body, prefix[:]); err != nil {
+			if err == io.EOF {
+				return cs.CloseSend()
+			}
+			return status.Errorf(codes.InvalidArgument, "reading gRPC-Web frame: %v", err)
+		}
+		if prefix[0] != 0 {
+			return status.Error(codes.Unimplemented, "compressed gRPC-Web requests are not supported")
+		}
+		n := binary.BigEndian.Uint32(prefix[1:])
+		if n > maxGRPCWebMessage {
+			return status.Errorf(codes.ResourceExhausted, "gRPC-Web message of %d bytes exceeds %d", n, maxGRPCWebMessage)
+		}
+		f := make(rawFrame, n)
+		if _, err := io.ReadFull(body, f); err != nil {
+			return status.Errorf(codes.InvalidArgument, "reading gRPC-Web message: %v", err)
+		}
+		if err := cs.SendMsg(&f); err != nil {
+			// The real error comes back from RecvMsg.
+			return cs.CloseSend()
+		}
+	}
+}
+
+// grpcWebWriter writes length-prefixed frames, base64 encoding each one for
+// grpc-web-text, and flushes so streamed messages reach the browser at once.
+type grpcWebWriter struct {
+	w    http.ResponseWriter
+	text bool
+}
+
+func (g *grpcWebWriter) frame(flag byte, payload []byte) error {
+	buf := make([]byte, 5+len(payload))
+	buf[0] = flag
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(payload)))
+	copy(buf[5:], payload)
+	if g.text {
+		buf = []byte(base64.StdEncoding.EncodeToString(buf))
+	}
+	if _, err := g.w.Write(buf); err != nil {
+		return err
+	}
+	if f, ok := g.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// grpcWebTrailer encodes the final status and trailers as HTTP/1 header
+// lines, the body of the trailer frame.
+func grpcWebTrailer(st *status.Status, md metadata.MD) []byte {
+	h := http.Header{}
+	copyMetadataToHeader(h, md)
+	h.Set("grpc-status", strconv.Itoa(int(st.Code())))
+	if st.Message() != "" {
+		h.Set("grpc-message", url.PathEscape(st.Message()))
+	}
+	var b strings.Builder
+	for k, vs := range h {
+		for _, v := range vs {
+			fmt.Fprintf(&b, "%s: %s\r\n", strings.ToLower(k), v)
+		}
+	}
+	return []byte(b.String())
+}
+
+// writeGRPCWebTrailersOnly reports a call that failed before reaching the
+// backend with the status in the response headers and no body.
+func writeGRPCWebTrailersOnly(w http.ResponseWriter, contentType string, st *status.Status) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("grpc-status", strconv.Itoa(int(st.Code())))
+	w.Header().Set("grpc-message", url.PathEscape(st.Message()))
+	w.WriteHeader(http.StatusOK)
+}
+
+// copyMetadataToHeader adds md to h, base64 encoding binary values.
+func copyMetadataToHeader(h http.Header, md metadata.MD) {
+	for k, vs := range md {
+		for _, v := range vs {
+			if strings.HasSuffix(k, "-bin") {
+				v = base64.StdEncoding.EncodeToString([]byte(v))
+			}
+			h.Add(k, v)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/protobuf/proto"
+
+	pb "api/user"
+)
+
+// grpcWebServer serves the Gin router with gRPC-Web calls sent to the
+// harness's gatewayServer, as main wires it.
+func grpcWebServer(t *testing.T, h *harness) *httptest.Server {
+	t.Helper()
+	table, err := newDynamicRoutes("", nil)
+	if err != nil {
+		t.Fatalf("newDynamicRoutes: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	web := grpcWebCORS([]string{"https://app.example.com"}, &grpcWebHandler{conn: h.grpcConn})
+	s := httptest.NewServer(newRouter(ctx, table, web, nil, nil, nil, nil))
+	t.Cleanup(func() {
+		s.Close()
+		cancel()
+	})
+	return s
+}
+
+func grpcWebFrame(t *testing.T, msg proto.Message) []byte {
+	t.Helper()
+	b, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, 5, 5+len(b))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(b)))
+	return append(frame, b...)
+}
+
+type grpcWebReply struct {
+	header   http.Header
+	messages [][]byte
+	trailer  string
+}
+
+// callGRPCWeb posts req to method the way a browser client does and splits
+// the reply into messages and the trailer frame.
+func callGRPCWeb(t *testing.T, s *httptest.Server, method string, req proto.Message, text bool, header http.Header) grpcWebReply {
+	t.Helper()
+	body, contentType := grpcWebFrame(t, req), "application/grpc-web+proto"
+	if text {
+		body, contentType = []byte(base64.StdEncoding.EncodeToString(body)), "application/grpc-web-text"
+	}
+	r, _ := http.NewRequest(http.MethodPost, s.URL+method, bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Set("X-Grpc-Web", "1")
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	res, err := s.Client().Do(r)
+	if err != nil {
+		t.Fatalf("POST %s: %v", method, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != contentType {
+		t.Fatalf("POST %s = %d %s", method, res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	raw, _ := io.ReadAll(res.Body)
+	if text {
+		// Each frame is encoded on its own, padding included.
+		var decoded []byte
+		for len(raw) > 0 {
+			n := bytes.IndexByte(raw, '=')
+			end := len(raw)
+			if n >= 0 {
+				for end = n; end < len(raw) && raw[end] == '='; end++ {
+				}
+			}
+			chunk, err := base64.StdEncoding.DecodeString(string(raw[:end]))
+			if err != nil {
+				t.Fatalf("decoding grpc-web-text: %v", err)
+			}
+			decoded, raw = append(decoded, chunk...), raw[end:]
+		}
+		raw = decoded
+	}
+
+	reply := grpcWebReply{header: res.Header}
+	for len(raw) >= 5 {
+		n := binary.BigEndian.Uint32(raw[1:5])
+		payload := raw[5 : 5+n]
+		if raw[0]&grpcWebTrailerFlag != 0 {
+			reply.trailer = string(payload)
+		} else {
+			reply.messages = append(reply.messages, payload)
+		}
+		raw = raw[5+n:]
+	}
+	return reply
+}
+
+func TestGRPCWebUnary(t *testing.T) {
+	h := newHarness(t, modeRemote)
+	s := grpcWebServer(t, h)
+
+	reply := callGRPCWeb(t, s, "/user.UserService/GetUser", &pb.GetUserRequest{UserId: "123"}, false,
+		http.Header{"Authorization": {"Bearer token"}, "Origin": {"https://app.example.com"}})
+	var user pb.GetUserResponse
+	if len(reply.messages) != 1 || proto.Unmarshal(reply.messages[0], &user) != nil || user.Name != "John Doe" {
+		t.Fatalf("GetUser messages = %q", reply.messages)
+	}
+	if !strings.Contains(reply.trailer, "grpc-status: 0\r\n") {
+		t.Errorf("trailer = %q", reply.trailer)
+	}
+	if got := reply.header.Get("Access-Control-Expose-Headers"); !strings.Contains(got, "grpc-status") {
+		t.Errorf("Access-Control-Expose-Headers = %q", got)
+	}
+	if got := h.upstream.metadata().Get("authorization"); len(got) != 1 || got[0] != "Bearer token" {
+		t.Errorf("user-service saw authorization %v", got)
+	}
+
+	// grpc-web-text, with an error status.
+	reply = callGRPCWeb(t, s, "/user.UserService/GetUser", &pb.GetUserRequest{UserId: "999"}, true, nil)
+	if len(reply.messages) != 0 || !strings.Contains(reply.trailer, "grpc-status: 5\r\n") || !strings.Contains(reply.trailer, "not%20found") {
+		t.Errorf("GetUser(999) = %q, trailer %q", reply.messages, reply.trailer)
+	}
+
+	// Services the gateway only proxies work too.
+	h.health.SetServingStatus("user.UserService", healthpb.HealthCheckResponse_SERVING)
+	reply = callGRPCWeb(t, s, "/grpc.health.v1.Health/Check", &healthpb.HealthCheckRequest{Service: "user.UserService"}, false, nil)
+	var hc healthpb.HealthCheckResponse
+	if len(reply.messages) != 1 || proto.Unmarshal(reply.messages[0], &hc) != nil || hc.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Errorf("Health/Check = %q, trailer %q", reply.messages, reply.trailer)
+	}
+}
+
+func TestGRPCWebServerStreaming(t *testing.T) {
+	h := newHarness(t, modeRemote)
+	s := grpcWebServer(t, h)
+
+	// WatchUsers never ends on its own; the caller's timeout closes it.
+	stop := h.keepCreatingUsers(t)
+	start := time.Now()
+	reply := callGRPCWeb(t, s, "/user.UserService/WatchUsers", &pb.WatchUsersRequest{}, true,
+		http.Header{"Grpc-Timeout": {"300m"}})
+	stop()
+	var ev pb.UserEvent
+	if len(reply.messages) == 0 || proto.Unmarshal(reply.messages[0], &ev) != nil || ev.User.GetName() != "Watched" {
+		t.Fatalf("WatchUsers messages = %q", reply.messages)
+	}
+	if !strings.Contains(reply.trailer, "grpc-status: 4\r\n") {
+		t.Errorf("trailer = %q, want DEADLINE_EXCEEDED", reply.trailer)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("stream took %v despite a 300ms grpc-timeout", d)
+	}
+}
+
+func TestGRPCWebPreflight(t *testing.T) {
+	h := newHarness(t, modeRemote)
+	s := grpcWebServer(t, h)
+
+	preflight := func(origin, headers string) *http.Response {
+		r, _ := http.NewRequest(http.MethodOptions, s.URL+"/user.UserService/GetUser", nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", "POST")
+		r.Header.Set("Access-Control-Request-Headers", headers)
+		res, err := s.Client().Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+	res := preflight("https://app.example.com", "content-type,x-grpc-web,x-user-agent")
+	if res.StatusCode != http.StatusNoContent || res.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		res.Header.Get("Access-Control-Allow-Methods") != "POST" {
+		t.Errorf("preflight = %d %v", res.StatusCode, res.Header)
+	}
+	if res := preflight("https://evil.example.com", "content-type,x-grpc-web"); res.StatusCode != http.StatusForbidden {
+		t.Errorf("preflight from other origin = %d, want 403", res.StatusCode)
+	}
+	// Preflights without x-grpc-web are left to the route table.
+	if res := preflight("https://app.example.com", "content-type"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("plain preflight = %d, want 404 from the empty route table", res.StatusCode)
+	}
+}
+
+func TestParseGRPCTimeout(t *testing.T) {
+	for v, want := range map[string]time.Duration{"1H": time.Hour, "500m": 500 * time.Millisecond, "3S": 3 * time.Second, "10u": 10 * time.Microsecond} {
+		if got, err := parseGRPCTimeout(v); err != nil || got != want {
+			t.Errorf("parseGRPCTimeout(%q) = %v, %v; want %v", v, got, err, want)
+		}
+	}
+	for _, v := range []string{"", "5", "5x", "-1S", "123456789S"} {
+		if _, err := parseGRPCTimeout(v); err == nil {
+			t.Errorf("parseGRPCTimeout(%q) accepted", v)
+		}
+	}
+}
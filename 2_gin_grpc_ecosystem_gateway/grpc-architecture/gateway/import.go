@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "api/user"
+)
+
+// maxImportLine bounds a single NDJSON line so one bad row can't exhaust memory.
+const maxImportLine = 1 << 20
+
+// importRow is one parsed row of an upload. A non-nil err means the row could
+// not be parsed and is reported without being sent upstream.
+type importRow struct {
+	row   int64
+	name  string
+	email string
+	err   error
+}
+
+// rowReader yields rows until it returns io.EOF.
+type rowReader func() (importRow, error)
+
+// importFormat picks csv or ndjson from ?format=, the content type or the
+// file name, in that order.
+func importFormat(query, contentType, filename string) (string, error) {
+	if query != "" {
+		switch strings.ToLower(query) {
+		case "csv":
+			return "csv", nil
+		case "ndjson", "jsonl":
+			return "ndjson", nil
+		}
+		return "", fmt.Errorf("unsupported format %q", query)
+	}
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil {
+		switch mt {
+		case "text/csv":
+			return "csv", nil
+		case "application/x-ndjson", "application/jsonl", "application/json":
+			return "ndjson", nil
+		}
+	}
+	switch strings.ToLower(path.Ext(filename)) {
+	case ".csv":
+		return "csv", nil
+	case ".ndjson", ".jsonl":
+		return "ndjson", nil
+	}
+	return "", errors.New("cannot determine upload format; use ?format=csv|ndjson or a text/csv or application/x-ndjson content type")
+}
+
+// newCSVRowReader expects a header row naming the name and email columns in
+// any order. Row numbers count data rows from 1.
+func newCSVRowReader(r io.Reader) (rowReader, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.ReuseRecord = true
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+	nameCol, emailCol := -1, -1
+	for i, h := range header {
+		switch strings.ToLower(strings.TrimSpace(h)) {
+		case "name":
+			nameCol = i
+		case "email":
+			emailCol = i
+		}
+	}
+	if nameCol < 0 || emailCol < 0 {
+		return nil, errors.New("CSV header must contain name and email columns")
+	}
+
+	var row int64
+	return func() (importRow, error) {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return importRow{}, io.EOF
+		}
+		row++
+		if err != nil {
+			var perr *csv.ParseError
+			if errors.As(err, &perr) && perr.Err != csv.ErrQuote {
+				return importRow{row: row, err: err}, nil
+			}
+			// A broken quote desynchronises the reader; stop here.
+			return importRow{}, err
+		}
+		if nameCol >= len(rec) || emailCol >= len(rec) {
+			return importRow{row: row, err: fmt.Errorf("expected at least %d fields, got %d", max(nameCol, emailCol)+1, len(rec))}, nil
+		}
+		return importRow{row: row, name: rec[nameCol], email: rec[emailCol]}, nil
+	}, nil
+}
+
+// newNDJSONRowReader reads one {"name": ..., "email": ...} object per line.
+// Blank lines are skipped but still counted.
+func newNDJSONRowReader(r io.Reader) rowReader {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), maxImportLine)
+
+	var row int64
+	return func() (importRow, error) {
+		for sc.Scan() {
+			row++
+			line := strings.TrimSpace(sc.Text())
+			if line == "" {
+				continue
+			}
+			var item struct {
+				Name  string `json:"name"`
+				Email string `json:"email"`
+			}
+			if err := json.Unmarshal([]byte(line), &item); err != nil {
+				return importRow{row: row, err: err}, nil
+			}
+			return importRow{row: row, name: item.Name, email: item.Email}, nil
+		}
+		if err := sc.Err(); err != nil {
+			return importRow{}, err
+		}
+		return importRow{}, io.EOF
+	}
+}
+
+// importUploadBody returns the upload stream: the "file" part of a multipart
+// form, or the raw request body otherwise. Neither is buffered in full.
+func importUploadBody(c *gin.Context) (io.Reader, string, string, error) {
+	contentType := c.GetHeader("Content-Type")
+	if mt, _, _ := mime.ParseMediaType(contentType); mt != "multipart/form-data" {
+		return c.Request.Body, contentType, "", nil
+	}
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, "", "", err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, "", "", errors.New(`multipart upload has no "file" part`)
+		}
+		if err != nil {
+			return nil, "", "", err
+		}
+		if part.FormName() == "file" {
+			return part, part.Header.Get("Content-Type"), part.FileName(), nil
+		}
+	}
+}
+
+// importUsersHandler streams an uploaded CSV or NDJSON file into
+// BatchCreateUsers row by row and replies with a per-row report.
+func importUsersHandler(client pb.UserServiceClient) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, contentType, filename, err := importUploadBody(c)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		format, err := importFormat(c.Query("format"), contentType, filename)
+		if err != nil {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+			return
+		}
+
+		var next rowReader
+		if format == "csv" {
+			if next, err = newCSVRowReader(body); err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+		} else {
+			next = newNDJSONRowReader(body)
+		}
+
+		stream, err := client.BatchCreateUsers(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+
+		var rejected []*pb.BatchCreateUserResult
+		var readErr error
+		for {
+			r, err := next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				readErr = err
+				break
+			}
+			if r.err != nil {
+				rejected = append(rejected, &pb.BatchCreateUserResult{Row: r.row, Error: r.err.Error()})
+				continue
+			}
+			if err := stream.Send(&pb.BatchCreateUsersRequest{Row: r.row, Name: r.name, Email: r.email}); err != nil {
+				// The upstream error is surfaced by CloseAndRecv below.
+				break
+			}
+		}
+
+		resp, err := stream.CloseAndRecv()
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		if len(rejected) > 0 {
+			resp.Results = append(resp.Results, rejected...)
+			resp.Failed += int32(len(rejected))
+			sort.SliceStable(resp.Results, func(i, j int) bool {
+				return resp.Results[i].Row < resp.Results[j].Row
+			})
+		}
+		asyncLogf("[Import] %s upload: %d created, %d failed", format, resp.Created, resp.Failed)
+
+		data, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(resp)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		code := http.StatusOK
+		if readErr != nil {
+			// Rows before the parse failure were imported; tell the caller
+			// where the file stopped being readable.
+			code = http.StatusUnprocessableEntity
+			c.Header("X-Import-Error", readErr.Error())
+		}
+		c.Data(code, "application/json", data)
+	}
+}
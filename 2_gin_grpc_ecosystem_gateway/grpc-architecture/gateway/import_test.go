@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "api/user"
+)
+
+func TestImportFormat(t *testing.T) {
+	for _, tc := range []struct {
+		query, contentType, filename string
+		want                         string
+	}{
+		{"CSV", "application/x-ndjson", "", "csv"},
+		{"jsonl", "", "", "ndjson"},
+		{"", "text/csv; charset=utf-8", "users.ndjson", "csv"},
+		{"", "application/x-ndjson", "", "ndjson"},
+		{"", "application/octet-stream", "users.JSONL", "ndjson"},
+		{"", "", "users.csv", "csv"},
+		{"xml", "", "", ""},
+		{"", "application/octet-stream", "users.txt", ""},
+	} {
+		got, err := importFormat(tc.query, tc.contentType, tc.filename)
+		if got != tc.want || (err != nil) != (tc.want == "") {
+			t.Errorf("importFormat(%q, %q, %q) = %q, %v, want %q", tc.query, tc.contentType, tc.filename, got, err, tc.want)
+		}
+	}
+}
+
+// readRows drains next, failing on anything but a clean end.
+func readRows(t *testing.T, next rowReader) []importRow {
+	t.Helper()
+	var rows []importRow
+	for {
+		r, err := next()
+		if err == io.EOF {
+			return rows
+		}
+		if err != nil {
+			t.Fatalf("after %d rows: %v", len(rows), err)
+		}
+		rows = append(rows, r)
+	}
+}
+
+func TestCSVRowReader(t *testing.T) {
+	next, err := newCSVRowReader(strings.NewReader("email, Name,team\nann@example.com,Ann,a\nbob@example.com\nbo\"b,Bob,b\ncy@example.com,Cy,c\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := readRows(t, next)
+	if len(rows) != 4 {
+		t.Fatalf("rows = %+v, want 4", rows)
+	}
+	if r := rows[0]; r.row != 1 || r.name != "Ann" || r.email != "ann@example.com" || r.err != nil {
+		t.Errorf("row 1 = %+v", r)
+	}
+	// A short row and a stray quote inside a field are reported, and reading
+	// carries on.
+	if r := rows[1]; r.row != 2 || r.err == nil {
+		t.Errorf("short row = %+v, want an error", r)
+	}
+	if r := rows[2]; r.row != 3 || r.err == nil {
+		t.Errorf("bare quote row = %+v, want an error", r)
+	}
+	if r := rows[3]; r.row != 4 || r.name != "Cy" {
+		t.Errorf("row 4 = %+v", r)
+	}
+
+	// An unterminated quote leaves the rest of the file unreadable.
+	next, err = newCSVRowReader(strings.NewReader("name,email\nAnn,ann@example.com\n\"Bob,bob@example.com\nCy,cy@example.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err := next(); err != nil || r.name != "Ann" {
+		t.Fatalf("row 1 = %+v, %v", r, err)
+	}
+	if _, err := next(); err == nil || err == io.EOF {
+		t.Errorf("unterminated quote: err = %v, want a read error", err)
+	}
+
+	for _, header := range []string{"", "name,mail\n"} {
+		if _, err := newCSVRowReader(strings.NewReader(header)); err == nil {
+			t.Errorf("header %q accepted", header)
+		}
+	}
+}
+
+func TestNDJSONRowReader(t *testing.T) {
+	rows := readRows(t, newNDJSONRowReader(strings.NewReader(
+		"{\"name\":\"Ann\",\"email\":\"ann@example.com\"}\n\n  \n{\"name\":\n{\"email\":\"cy@example.com\",\"name\":\"Cy\"}")))
+	if len(rows) != 3 {
+		t.Fatalf("rows = %+v, want 3", rows)
+	}
+	if r := rows[0]; r.row != 1 || r.name != "Ann" || r.email != "ann@example.com" {
+		t.Errorf("row 1 = %+v", r)
+	}
+	// Blank lines are skipped but keep their row numbers.
+	if r := rows[1]; r.row != 4 || r.err == nil {
+		t.Errorf("row 4 = %+v, want an error", r)
+	}
+	if r := rows[2]; r.row != 5 || r.name != "Cy" || r.email != "cy@example.com" {
+		t.Errorf("row 5 = %+v", r)
+	}
+
+	long := `{"name":"` + strings.Repeat("x", maxImportLine) + `"}`
+	next := newNDJSONRowReader(strings.NewReader(long))
+	if _, err := next(); err == nil || err == io.EOF {
+		t.Errorf("line over maxImportLine: err = %v, want a read error", err)
+	}
+}
+
+// importReport posts body to /users/import and decodes the report.
+func importReport(t *testing.T, h *harness, query, body string, header http.Header) (*http.Response, *pb.BatchCreateUsersResponse) {
+	t.Helper()
+	res, data := h.do(t, http.MethodPost, "/users/import"+query, body, header)
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusUnprocessableEntity {
+		return res, nil
+	}
+	report := &pb.BatchCreateUsersResponse{}
+	if err := protojson.Unmarshal([]byte(data), report); err != nil {
+		t.Fatalf("report %s: %v", data, err)
+	}
+	return res, report
+}
+
+// failedRows lists the rows of report that carry an error.
+func failedRows(report *pb.BatchCreateUsersResponse) []int64 {
+	var rows []int64
+	for _, r := range report.Results {
+		if r.Error != "" {
+			rows = append(rows, r.Row)
+		}
+	}
+	return rows
+}
+
+func TestImportUsers(t *testing.T) {
+	forEachMode(t, func(t *testing.T, h *harness) {
+		// Row 2 is rejected by the gateway, which cannot parse it, and row 3
+		// by user-service; both end up in one report, in row order.
+		res, report := importReport(t, h, "", "name,email\nAnn,ann@example.com\nBob\nCy,not-an-email\nDee,dee@example.com\n",
+			http.Header{"Content-Type": {"text/csv"}})
+		if res.StatusCode != http.StatusOK || report == nil {
+			t.Fatalf("CSV import = %d", res.StatusCode)
+		}
+		if report.Created != 2 || report.Failed != 2 || len(report.Results) != 4 {
+			t.Errorf("CSV import report = %v", report)
+		}
+		for i, r := range report.Results {
+			if r.Row != int64(i+1) {
+				t.Errorf("result %d is row %d", i, r.Row)
+			}
+		}
+		if got := failedRows(report); len(got) != 2 || got[0] != 2 || got[1] != 3 {
+			t.Errorf("failed rows = %v, want [2 3]", got)
+		}
+		if u := report.Results[3].User; u.GetName() != "Dee" || u.GetId() == "" {
+			t.Errorf("row 4 user = %v", u)
+		}
+		if got, err := h.users.GetUser(testContext(t), &pb.GetUserRequest{UserId: report.Results[0].User.GetId()}); err != nil || got.Name != "Ann" {
+			t.Errorf("imported user = %v, %v", got, err)
+		}
+
+		// The same goes for an NDJSON file part of a multipart form.
+		var form bytes.Buffer
+		mw := multipart.NewWriter(&form)
+		mw.WriteField("note", "ignored")
+		fw, _ := mw.CreateFormFile("file", "users.ndjson")
+		io.WriteString(fw, "{\"name\":\"Eve\",\"email\":\"eve@example.com\"}\nnot json\n")
+		mw.Close()
+		res, report = importReport(t, h, "", form.String(), http.Header{"Content-Type": {mw.FormDataContentType()}})
+		if res.StatusCode != http.StatusOK || report == nil || report.Created != 1 || report.Failed != 1 {
+			t.Errorf("multipart NDJSON import = %d %v", res.StatusCode, report)
+		}
+	})
+}
+
+func TestImportUsersErrors(t *testing.T) {
+	h := newHarness(t, modeRemote)
+
+	// Rows before an unreadable part of the file are imported, and the
+	// caller is told where reading stopped.
+	res, report := importReport(t, h, "?format=csv", "name,email\nAnn,ann@example.com\n\"Bob,bob@example.com\n", nil)
+	if res.StatusCode != http.StatusUnprocessableEntity || res.Header.Get("X-Import-Error") == "" {
+		t.Errorf("truncated CSV = %d, X-Import-Error %q", res.StatusCode, res.Header.Get("X-Import-Error"))
+	}
+	if report == nil || report.Created != 1 {
+		t.Errorf("truncated CSV report = %v", report)
+	}
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("note", "no file")
+	mw.Close()
+	for name, tc := range map[string]struct {
+		query, body string
+		header      http.Header
+		want        int
+	}{
+		"no file part":   {"", form.String(), http.Header{"Content-Type": {mw.FormDataContentType()}}, http.StatusBadRequest},
+		"unknown format": {"", "name,email\n", http.Header{"Content-Type": {"text/plain"}}, http.StatusUnsupportedMediaType},
+		"bad CSV header": {"?format=csv", "id,email\n", nil, http.StatusBadRequest},
+	} {
+		if res, body := h.do(t, http.MethodPost, "/users/import"+tc.query, tc.body, tc.header); res.StatusCode != tc.want {
+			t.Errorf("%s = %d %s, want %d", name, res.StatusCode, body, tc.want)
+		}
+	}
+}
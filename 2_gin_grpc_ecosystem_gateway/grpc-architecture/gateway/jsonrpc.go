@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"google.golang.org/genproto/googleapis/rpc/code"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// JSON-RPC 2.0 error codes. Other gRPC failures use -32000 minus their
+// status code, inside the range the spec reserves for server errors.
+const (
+	jsonrpcParseError     = -32700
+	jsonrpcInvalidRequest = -32600
+	jsonrpcMethodNotFound = -32601
+	jsonrpcInvalidParams  = -32602
+	jsonrpcInternalError  = -32603
+	jsonrpcServerError    = -32000
+
+	maxJSONRPCBody  = 1 << 20
+	maxJSONRPCBatch = 100
+	// jsonrpcParallelism bounds the calls of one batch in flight at once.
+	jsonrpcParallelism = 8
+)
+
+// jsonrpcStats counts JSON-RPC traffic for /debug/vars.
+var jsonrpcStats = expvar.NewMap("jsonrpc")
+
+func init() {
+	for _, k := range []string{"requests", "batches", "notifications", "errors"} {
+		jsonrpcStats.Add(k, 0)
+	}
+}
+
+type jsonrpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	// ID is nil for notifications, which get no response.
+	ID json.RawMessage `json:"id,omitempty"`
+}
+
+type jsonrpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    any    `json:"data,omitempty"`
+}
+
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonrpcError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+// jsonrpcHandler answers JSON-RPC 2.0 over HTTP POST. A method such as
+// "user.UserService.GetUser" is looked up in the linked-in proto registry,
+// its params decoded with protojson and the call made on conn, normally the
+// gateway's own gRPC server. Only unary methods can be called.
+type jsonrpcHandler struct {
+	conn  grpc.ClientConnInterface
+	files *protoregistry.Files
+	types *protoregistry.Types
+}
+
+func newJSONRPCHandler(conn grpc.ClientConnInterface) *jsonrpcHandler {
+	return &jsonrpcHandler{conn: conn, files: protoregistry.GlobalFiles, types: protoregistry.GlobalTypes}
+}
+
+func (h *jsonrpcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "JSON-RPC requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxJSONRPCBody+1))
+	if err != nil || len(body) > maxJSONRPCBody {
+		writeJSONRPC(w, http.StatusRequestEntityTooLarge, jsonrpcFailure(nil, jsonrpcInvalidRequest, "request body too large"))
+		return
+	}
+	body = bytes.TrimSpace(body)
+	if !json.Valid(body) {
+		writeJSONRPC(w, http.StatusOK, jsonrpcFailure(nil, jsonrpcParseError, "parse error"))
+		return
+	}
+
+	ctx, cancel, err := outgoingCallContext(r)
+	if err != nil {
+		writeJSONRPC(w, http.StatusOK, jsonrpcFailure(nil, jsonrpcInvalidRequest, status.Convert(err).Message()))
+		return
+	}
+	defer cancel()
+
+	if body[0] != '[' {
+		jsonrpcStats.Add("requests", 1)
+		if resp := h.call(ctx, body); resp != nil {
+			writeJSONRPC(w, http.StatusOK, resp)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var batch []json.RawMessage
+	json.Unmarshal(body, &batch)
+	switch {
+	case len(batch) == 0:
+		writeJSONRPC(w, http.StatusOK, jsonrpcFailure(nil, jsonrpcInvalidRequest, "empty batch"))
+		return
+	case len(batch) > maxJSONRPCBatch:
+		writeJSONRPC(w, http.StatusOK, jsonrpcFailure(nil, jsonrpcInvalidRequest, "batch exceeds the limit of 100 calls"))
+		return
+	}
+	jsonrpcStats.Add("batches", 1)
+	jsonrpcStats.Add("requests", int64(len(batch)))
+
+	results := make([]*jsonrpcResponse, len(batch))
+	sem := make(chan struct{}, jsonrpcParallelism)
+	var wg sync.WaitGroup
+	for i, raw := range batch {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, raw json.RawMessage) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = h.call(ctx, raw)
+		}(i, raw)
+	}
+	wg.Wait()
+
+	// Notifications are left out; a batch of nothing else gets no body.
+	var resps []*jsonrpcResponse
+	for _, resp := range results {
+		if resp != nil {
+			resps = append(resps, resp)
+		}
+	}
+	if len(resps) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSONRPC(w, http.StatusOK, resps)
+}
+
+// call runs one request and returns its response, or nil for a notification.
+func (h *jsonrpcHandler) call(ctx context.Context, raw json.RawMessage) *jsonrpcResponse {
+	var req jsonrpcRequest
+	if err := json.Unmarshal(raw, &req); err != nil || req.JSONRPC != "2.0" || req.Method == "" {
+		return jsonrpcFailure(nil, jsonrpcInvalidRequest, "invalid request")
+	}
+	if req.ID != nil && !validJSONRPCID(req.ID) {
+		return jsonrpcFailure(nil, jsonrpcInvalidRequest, "id must be a string, number or null")
+	}
+	notification := req.ID == nil
+	if notification {
+		jsonrpcStats.Add("notifications", 1)
+	}
+
+	result, rpcErr := h.invoke(ctx, req.Method, req.Params)
+	if rpcErr != nil {
+		jsonrpcStats.Add("errors", 1)
+		asyncLogf("[JSON-RPC] %s failed: %s", req.Method, rpcErr.Message)
+	}
+	if notification {
+		return nil
+	}
+	if rpcErr != nil {
+		return &jsonrpcResponse{JSONRPC: "2.0", Error: rpcErr, ID: req.ID}
+	}
+	return &jsonrpcResponse{JSONRPC: "2.0", Result: result, ID: req.ID}
+}
+
+// invoke calls method with params decoded into its request message and
+// returns the response as JSON.
+func (h *jsonrpcHandler) invoke(ctx context.Context, method string, params json.RawMessage) (json.RawMessage, *jsonrpcError) {
+	md, err := h.lookup(method)
+	if err != nil {
+		return nil, &jsonrpcError{Code: jsonrpcMethodNotFound, Message: err.Error()}
+	}
+
+	in, out := h.newMessage(md.Input()), h.newMessage(md.Output())
+	switch p := bytes.TrimSpace(params); {
+	case len(p) == 0 || string(p) == "null":
+	case p[0] == '{':
+		if err := protojson.Unmarshal(p, in); err != nil {
+			return nil, &jsonrpcError{Code: jsonrpcInvalidParams, Message: "invalid params: " + err.Error()}
+		}
+	default:
+		return nil, &jsonrpcError{Code: jsonrpcInvalidParams, Message: "params must be an object of " + string(md.Input().FullName()) + " fields"}
+	}
+
+	fullMethod := "/" + string(md.Parent().FullName()) + "/" + string(md.Name())
+	asyncLogf("[JSON-RPC] %s", fullMethod)
+	if err := h.conn.Invoke(ctx, fullMethod, in, out); err != nil {
+		return nil, jsonrpcStatusError(status.Convert(err))
+	}
+	result, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(out)
+	if err != nil {
+		return nil, &jsonrpcError{Code: jsonrpcInternalError, Message: err.Error()}
+	}
+	return result, nil
+}
+
+// lookup resolves a name such as "user.UserService.GetUser" to a unary method.
+func (h *jsonrpcHandler) lookup(method string) (protoreflect.MethodDescriptor, error) {
+	d, err := h.files.FindDescriptorByName(protoreflect.FullName(method))
+	if err != nil {
+		return nil, fmt.Errorf("method %q not found", method)
+	}
+	md, ok := d.(protoreflect.MethodDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%q is not a method", method)
+	}
+	if md.IsStreamingClient() || md.IsStreamingServer() {
+		return nil, fmt.Errorf("streaming method %q cannot be called over JSON-RPC", method)
+	}
+	return md, nil
+}
+
+// newMessage returns an empty message of type d, using the generated type
+// when one is linked in.
+func (h *jsonrpcHandler) newMessage(d protoreflect.MessageDescriptor) proto.Message {
+	if mt, err := h.types.FindMessageByName(d.FullName()); err == nil {
+		return mt.New().Interface()
+	}
+	return dynamicpb.NewMessage(d)
+}
+
+// jsonrpcStatusError maps a gRPC status onto a JSON-RPC error; data carries
+// the gRPC code name.
+func jsonrpcStatusError(st *status.Status) *jsonrpcError {
+	c := jsonrpcServerError - int(st.Code())
+	switch st.Code() {
+	case codes.InvalidArgument:
+		c = jsonrpcInvalidParams
+	case codes.Unimplemented:
+		c = jsonrpcMethodNotFound
+	case codes.Internal, codes.Unknown, codes.DataLoss:
+		c = jsonrpcInternalError
+	}
+	return &jsonrpcError{Code: c, Message: st.Message(), Data: map[string]string{"code": code.Code(st.Code()).String()}}
+}
+
+func jsonrpcFailure(id json.RawMessage, c int, msg string) *jsonrpcResponse {
+	return &jsonrpcResponse{JSONRPC: "2.0", Error: &jsonrpcError{Code: c, Message: msg}, ID: id}
+}
+
+// validJSONRPCID reports whether id is a string, number or null.
+func validJSONRPCID(id json.RawMessage) bool {
+	switch s := strings.TrimSpace(string(id)); {
+	case s == "null":
+		return true
+	case strings.HasPrefix(s, `"`):
+		return true
+	default:
+		var n json.Number
+		return json.Unmarshal(id, &n) == nil
+	}
+}
+
+func writeJSONRPC(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// jsonrpcServer serves the Gin router with /jsonrpc calling the harness's
+// gatewayServer, as main wires it.
+func jsonrpcServer(t *testing.T, h *harness) *httptest.Server {
+	t.Helper()
+	table, err := newDynamicRoutes("", nil)
+	if err != nil {
+		t.Fatalf("newDynamicRoutes: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s := httptest.NewServer(newRouter(ctx, table, nil, newJSONRPCHandler(h.grpcConn), nil, nil, nil))
+	t.Cleanup(func() {
+		s.Close()
+		cancel()
+	})
+	return s
+}
+
+func postJSONRPC(t *testing.T, s *httptest.Server, body string, header http.Header) (int, string) {
+	t.Helper()
+	r, _ := http.NewRequest(http.MethodPost, s.URL+"/jsonrpc", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	res, err := s.Client().Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return res.StatusCode, strings.TrimSpace(string(b))
+}
+
+func TestJSONRPCCall(t *testing.T) {
+	h := newHarness(t, modeRemote)
+	s := jsonrpcServer(t, h)
+
+	code, got := postJSONRPC(t, s, `{"jsonrpc":"2.0","method":"user.UserService.GetUser","params":{"userId":"123"},"id":1}`,
+		http.Header{"Authorization": {"Bearer token"}})
+	if want := `{"jsonrpc":"2.0","result":{"id":"123","name":"John Doe","email":"john@example.com"},"id":1}`; code != http.StatusOK || got != want {
+		t.Errorf("GetUser = %d %s\nwant %s", code, got, want)
+	}
+	if md := h.upstream.metadata().Get("authorization"); len(md) != 1 || md[0] != "Bearer token" {
+		t.Errorf("user-service saw authorization %v", md)
+	}
+
+	// Proxied services resolve the same way.
+	h.health.SetServingStatus("user.UserService", healthpb.HealthCheckResponse_SERVING)
+	_, got = postJSONRPC(t, s, `{"jsonrpc":"2.0","method":"grpc.health.v1.Health.Check","params":{"service":"user.UserService"},"id":"h"}`, nil)
+	if want := `{"jsonrpc":"2.0","result":{"status":"SERVING"},"id":"h"}`; got != want {
+		t.Errorf("Health.Check = %s\nwant %s", got, want)
+	}
+
+	// A notification runs but gets no response.
+	code, got = postJSONRPC(t, s, `{"jsonrpc":"2.0","method":"user.UserService.CreateUser","params":{"name":"Quiet"}}`, nil)
+	if code != http.StatusNoContent || got != "" {
+		t.Errorf("notification = %d %q", code, got)
+	}
+}
+
+func TestJSONRPCErrors(t *testing.T) {
+	h := newHarness(t, modeRemote)
+	s := jsonrpcServer(t, h)
+
+	cases := []struct{ body, want string }{
+		{`{"jsonrpc":"2.0","method":"user.UserService.GetUser","params":{"userId":"999"},"id":1}`,
+			`{"jsonrpc":"2.0","error":{"code":-32005,"message":"user \"999\" not found","data":{"code":"NOT_FOUND"}},"id":1}`},
+		{`{"jsonrpc":"2.0","method":"user.UserService.CreateUser","params":{},"id":2}`,
+			`{"jsonrpc":"2.0","error":{"code":-32602,"message":"name is required","data":{"code":"INVALID_ARGUMENT"}},"id":2}`},
+		{`{"jsonrpc":"2.0","method":"order.OrderService.CreateOrder","params":{"userId":"9"},"id":3}`,
+			`{"jsonrpc":"2.0","error":{"code":-32009,"message":"user \"9\" does not exist","data":{"code":"FAILED_PRECONDITION"}},"id":3}`},
+		{`{"jsonrpc":"2.0","method":"user.UserService.Nope","id":4}`,
+			`{"jsonrpc":"2.0","error":{"code":-32601,"message":"method \"user.UserService.Nope\" not found"},"id":4}`},
+		{`{"jsonrpc":"2.0","method":"user.UserService.WatchUsers","id":5}`,
+			`{"jsonrpc":"2.0","error":{"code":-32601,"message":"streaming method \"user.UserService.WatchUsers\" cannot be called over JSON-RPC"},"id":5}`},
+		{`{"jsonrpc":"2.0","method":"user.UserService.GetUser","params":["123"],"id":null}`,
+			`{"jsonrpc":"2.0","error":{"code":-32602,"message":"params must be an object of user.GetUserRequest fields"},"id":null}`},
+		{`{"jsonrpc":"1.0","method":"user.UserService.GetUser","id":6}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request"},"id":null}`},
+		{`{"jsonrpc":"2.0","method":"user.UserService.GetUser","id":{}}`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"id must be a string, number or null"},"id":null}`},
+		{`{"jsonrpc":"2.0",`,
+			`{"jsonrpc":"2.0","error":{"code":-32700,"message":"parse error"},"id":null}`},
+		{`[]`,
+			`{"jsonrpc":"2.0","error":{"code":-32600,"message":"empty batch"},"id":null}`},
+	}
+	for _, c := range cases {
+		if _, got := postJSONRPC(t, s, c.body, nil); got != c.want {
+			t.Errorf("%s\n  = %s\nwant %s", c.body, got, c.want)
+		}
+	}
+
+	// protojson rejects unknown fields as invalid params.
+	_, got := postJSONRPC(t, s, `{"jsonrpc":"2.0","method":"user.UserService.GetUser","params":{"nickname":"x"},"id":7}`, nil)
+	var resp jsonrpcResponse
+	if json.Unmarshal([]byte(got), &resp) != nil || resp.Error == nil || resp.Error.Code != jsonrpcInvalidParams {
+		t.Errorf("unknown param = %s", got)
+	}
+}
+
+func TestJSONRPCBatch(t *testing.T) {
+	h := newHarness(t, modeRemote)
+	s := jsonrpcServer(t, h)
+
+	code, got := postJSONRPC(t, s, `[
+		{"jsonrpc":"2.0","method":"user.UserService.GetUser","params":{"userId":"123"},"id":"a"},
+		{"jsonrpc":"2.0","method":"user.UserService.CreateUser","params":{"name":"Quiet"}},
+		1,
+		{"jsonrpc":"2.0","method":"order.OrderService.GetOrder","params":{"orderId":"1001"},"id":"b"}
+	]`, nil)
+	want := `[{"jsonrpc":"2.0","result":{"id":"123","name":"John Doe","email":"john@example.com"},"id":"a"},` +
+		`{"jsonrpc":"2.0","error":{"code":-32600,"message":"invalid request"},"id":null},` +
+		`{"jsonrpc":"2.0","result":{"id":"1001","userId":"123","items":[],"totalCents":"0","createdAt":null},"id":"b"}]`
+	if code != http.StatusOK || got != want {
+		t.Errorf("batch = %d %s\nwant %s", code, got, want)
+	}
+
+	// A batch of notifications only gets no body.
+	code, got = postJSONRPC(t, s, `[{"jsonrpc":"2.0","method":"user.UserService.GetUser","params":{"userId":"123"}}]`, nil)
+	if code != http.StatusNoContent || got != "" {
+		t.Errorf("notification batch = %d %q", code, got)
+	}
+}
@@ -3,13 +3,14 @@ package main
 import (
 	"context"
 	"errors"
+	"expvar"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -19,13 +20,57 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/status"
-
-	pb "gateway/proto"
+	"google.golang.org/grpc/test/bufconn"
+
+	apikeypb "api/apikey"
+	ordergw "api/gateway/order"
+	usergw "api/gateway/user"
+	usergwv2 "api/gateway/user/v2"
+	orderpb "api/order"
+	pb "api/user"
+	pbv2 "api/user/v2"
+	"user-service/userserver"
 )
 
 type gatewayServer struct {
 	pb.UnimplementedUserServiceServer
 	userClient pb.UserServiceClient
+	// shutdown ends proxied watch streams so GracefulStop does not block on them.
+	shutdown <-chan struct{}
+}
+
+// gatewayMethods are the UserService methods gatewayServer implements.
+// Listing a method here without implementing it makes :8081 answer it with
+// Unimplemented; leaving one out, as happens when an RPC is added to
+// user.proto, sends it to the proxy instead.
+var gatewayMethods = map[string]bool{
+	"GetUser":          true,
+	"CreateUser":       true,
+	"UpdateUser":       true,
+	"DeleteUser":       true,
+	"ListUsers":        true,
+	"ExportUsers":      true,
+	"WatchUsers":       true,
+	"BatchCreateUsers": true,
+}
+
+// partialServiceDesc returns desc with only the named methods and streams.
+// grpc.Server hands calls to any other method of the service to its
+// UnknownServiceHandler, as it does for unknown services.
+func partialServiceDesc(desc grpc.ServiceDesc, names map[string]bool) *grpc.ServiceDesc {
+	methods, streams := desc.Methods, desc.Streams
+	desc.Methods, desc.Streams = nil, nil
+	for _, m := range methods {
+		if names[m.MethodName] {
+			desc.Methods = append(desc.Methods, m)
+		}
+	}
+	for _, st := range streams {
+		if names[st.StreamName] {
+			desc.Streams = append(desc.Streams, st)
+		}
+	}
+	return &desc
 }
 
 var logCh = make(chan string, 10000)
@@ -62,6 +107,90 @@ func (s *gatewayServer) CreateUser(ctx context.Context, req *pb.CreateUserReques
 	return s.userClient.CreateUser(ctx, req)
 }
 
+func (s *gatewayServer) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.UpdateUserResponse, error) {
+	asyncLogf("[Gateway] Processing gRPC request UpdateUser: %v", req)
+	return s.userClient.UpdateUser(ctx, req)
+}
+
+func (s *gatewayServer) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
+	asyncLogf("[Gateway] Processing gRPC request DeleteUser: %v", req)
+	return s.userClient.DeleteUser(ctx, req)
+}
+
+func (s *gatewayServer) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	asyncLogf("[Gateway] Processing gRPC request ListUsers: %v", req)
+	return s.userClient.ListUsers(ctx, req)
+}
+
+func (s *gatewayServer) ExportUsers(req *pb.ExportUsersRequest, stream pb.UserService_ExportUsersServer) error {
+	asyncLogf("[Gateway] Processing gRPC stream ExportUsers: %v", req)
+	upstream, err := s.userClient.ExportUsers(stream.Context(), req)
+	if err != nil {
+		return err
+	}
+	for {
+		u, err := upstream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(u); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *gatewayServer) WatchUsers(req *pb.WatchUsersRequest, stream pb.UserService_WatchUsersServer) error {
+	asyncLogf("[Gateway] Processing gRPC stream WatchUsers: %v", req)
+	ctx, cancel := watchContext(stream.Context(), s.shutdown)
+	defer cancel()
+
+	upstream, err := s.userClient.WatchUsers(ctx, req)
+	if err != nil {
+		return err
+	}
+	for {
+		ev, err := upstream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(ev); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *gatewayServer) BatchCreateUsers(stream pb.UserService_BatchCreateUsersServer) error {
+	asyncLog("[Gateway] Processing gRPC stream BatchCreateUsers")
+	upstream, err := s.userClient.BatchCreateUsers(stream.Context())
+	if err != nil {
+		return err
+	}
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := upstream.Send(req); err != nil {
+			// The real cause is reported by CloseAndRecv.
+			break
+		}
+	}
+	resp, err := upstream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+	return stream.SendAndClose(resp)
+}
+
 func loggingInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
 	start := time.Now()
 	err := invoker(ctx, method, req, reply, cc, opts...)
@@ -81,24 +210,62 @@ func loggingInterceptor(ctx context.Context, method string, req, reply interface
 	return err
 }
 
-func startGRPCServer(ctx context.Context, client pb.UserServiceClient) error {
-	lis, err := net.Listen("tcp", ":8081")
+func streamLoggingInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	cs, err := streamer(ctx, desc, cc, method, opts...)
 	if err != nil {
-		return fmt.Errorf("failed to listen on port 8081: %w", err)
-	}
-
-	s := grpc.NewServer(
-		grpc.ChainUnaryInterceptor(
-			func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
-				start := time.Now()
-				defer func() {
-					asyncLogf("gRPC server processing completed | Method: %s | Duration: %v", info.FullMethod, time.Since(start))
-				}()
-				return handler(ctx, req)
-			},
-		),
-	)
-	pb.RegisterUserServiceServer(s, &gatewayServer{userClient: client})
+		asyncLogf("gRPC stream failed to open | Method: %s | Error: %v", method, err)
+		return nil, err
+	}
+	asyncLogf("gRPC stream opened | Method: %s", method)
+	return cs, nil
+}
+
+// startGRPCServer serves gatewayServer and server reflection on every given
+// listener until ctx is cancelled or one of them fails. Calls to any other
+// service or method are passed to proxy, if set. With keys, callers' API
+// keys are checked and ApiKeyAdminService is served too.
+func startGRPCServer(ctx context.Context, client pb.UserServiceClient, proxy *grpcProxy, keys *apiKeys, listeners ...net.Listener) error {
+	var opts []grpc.ServerOption
+	if proxy != nil {
+		opts = append(opts, grpc.ForceServerCodec(proxyCodec{}), grpc.UnknownServiceHandler(proxy.handler))
+	}
+	unary := []grpc.UnaryServerInterceptor{
+		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+			start := time.Now()
+			defer func() {
+				asyncLogf("gRPC server processing completed | Method: %s | Duration: %v", info.FullMethod, time.Since(start))
+			}()
+			return handler(ctx, req)
+		},
+	}
+	stream := []grpc.StreamServerInterceptor{
+		func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			start := time.Now()
+			defer func() {
+				asyncLogf("gRPC server stream completed | Method: %s | Duration: %v", info.FullMethod, time.Since(start))
+			}()
+			return handler(srv, ss)
+		},
+	}
+	// Keys are checked, and taken out of the metadata, before it is
+	// forwarded.
+	if keys != nil {
+		unary = append(unary, keys.unaryServerInterceptor)
+		stream = append(stream, keys.streamServerInterceptor)
+	}
+	unary = append(unary, forwardingUnaryInterceptor)
+	stream = append(stream, forwardingStreamInterceptor)
+	s := grpc.NewServer(append(opts, grpc.ChainUnaryInterceptor(unary...), grpc.ChainStreamInterceptor(stream...))...)
+	s.RegisterService(partialServiceDesc(pb.UserService_ServiceDesc, gatewayMethods), &gatewayServer{userClient: client, shutdown: ctx.Done()})
+	if keys != nil {
+		apikeypb.RegisterApiKeyAdminServiceServer(s, keys)
+	}
+	// Reflection lets grpcurl and other tools call :8081 without .proto files.
+	var proxied []string
+	if proxy != nil {
+		proxied = proxy.services()
+	}
+	registerReflection(s, proxied)
 
 	go func() {
 		<-ctx.Done()
@@ -106,8 +273,75 @@ func startGRPCServer(ctx context.Context, client pb.UserServiceClient) error {
 		s.GracefulStop()
 	}()
 
-	asyncLog("gRPC server started on :8081")
-	return s.Serve(lis)
+	errs := make(chan error, len(listeners))
+	for _, lis := range listeners {
+		asyncLogf("gRPC server started on %s", lis.Addr())
+		go func(lis net.Listener) {
+			errs <- s.Serve(lis)
+		}(lis)
+	}
+	var firstErr error
+	for range listeners {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+			s.Stop()
+		}
+	}
+	return firstErr
+}
+
+// userServiceDialOptions returns the dial target and options for
+// user-service. With a registry, the target resolves through it and calls are
+// spread over every instance it reports; otherwise addr is dialled directly.
+func userServiceDialOptions(reg registry, addr string) (string, []grpc.DialOption) {
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(`{
+        "loadBalancingPolicy": "round_robin",
+        "healthCheckConfig": {
+            "serviceName": "user.UserService"
+        }
+    	}`),
+	}
+	if reg == nil {
+		return addr, opts
+	}
+	return discoveryScheme + ":///user-service", append(opts, grpc.WithResolvers(&discoveryBuilder{registry: reg}))
+}
+
+// inProcessTarget is the dial target of a bufconn listener; the listener
+// itself is reached through inProcessDialOptions.
+const inProcessTarget = "passthrough:///bufconn"
+
+// inProcessDialOptions dial lis, a bufconn listener served in this process.
+func inProcessDialOptions(lis *bufconn.Listener) []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}
+}
+
+// newInProcessConn returns a client connection to lis, a bufconn listener
+// served by this process's own gRPC server.
+func newInProcessConn(lis *bufconn.Listener, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	return grpc.NewClient(inProcessTarget, append(inProcessDialOptions(lis), opts...)...)
+}
+
+// serveUsersInProcess links user-service into the gateway: it serves
+// userServer, with opts, on an in-memory listener until ctx is done and
+// returns the target and dial options that reach it, in place of
+// user-service's address.
+func serveUsersInProcess(ctx context.Context, opts ...grpc.ServerOption) (string, []grpc.DialOption) {
+	lis := bufconn.Listen(1 << 20)
+	s := userserver.NewServer(ctx.Done(), opts...)
+	go func() {
+		<-ctx.Done()
+		s.GracefulStop()
+	}()
+	go s.Serve(lis)
+	return inProcessTarget, inProcessDialOptions(lis)
 }
 
 type responseWriter struct {
@@ -115,27 +349,58 @@ type responseWriter struct {
 	status int
 }
 
-func newPrefixHandler(gwMux *runtime.ServeMux, prefix string) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-
-		// remove the specified prefix
-		r.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
-		rw := &responseWriter{w, 0}
-		gwMux.ServeHTTP(rw, r)
-
-		asyncLogf("[%s] Upstream latency: %v | Status: %d | Path: %s",
-			time.Now().Format("2006-01-02 15:04:05"),
-			time.Since(start),
-			rw.status,
-			r.URL.Path,
-		)
-	})
+// Flush lets grpc-gateway push each message of a server-streaming RPC to the
+// client as soon as it arrives.
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// newGatewayMux builds the grpc-gateway mux for both versions of the user
+// API; versionedAPI picks one per request. REST calls are sent over conn;
+// hand-written routes use client.
+func newGatewayMux(ctx context.Context, conn grpc.ClientConnInterface, client pb.UserServiceClient, opts ...runtime.ServeMuxOption) (*runtime.ServeMux, error) {
+	gwMux := runtime.NewServeMux(opts...)
+	if err := usergw.RegisterUserServiceHandlerClient(ctx, gwMux, pb.NewUserServiceClient(conn)); err != nil {
+		return nil, err
+	}
+	if err := usergwv2.RegisterUserServiceHandlerClient(ctx, gwMux, pbv2.NewUserServiceClient(conn)); err != nil {
+		return nil, err
+	}
+	if err := gwMux.HandlePath(http.MethodGet, "/users:export", exportUsersHandler(client)); err != nil {
+		return nil, fmt.Errorf("registering export handler: %w", err)
+	}
+	return gwMux, nil
 }
 
-func startHTTPServer(ctx context.Context, gwMux *runtime.ServeMux) error {
+// newOrderMux builds the grpc-gateway mux for order-service, whose REST paths
+// already start with /orders.
+func newOrderMux(ctx context.Context, conn grpc.ClientConnInterface, opts ...runtime.ServeMuxOption) (*runtime.ServeMux, error) {
+	mux := runtime.NewServeMux(opts...)
+	if err := ordergw.RegisterOrderServiceHandlerClient(ctx, mux, orderpb.NewOrderServiceClient(conn)); err != nil {
+		return nil, err
+	}
+	return mux, nil
+}
+
+// newRouter builds the Gin engine. Paths without a fixed route below are
+// served from routes; gRPC-Web calls go to web and /jsonrpc to rpc, if set.
+// cors sets the CORS policy per route group; keys, if set, checks API keys.
+func newRouter(ctx context.Context, routes, web, rpc http.Handler, client pb.UserServiceClient, cors []corsGroup, keys *apiKeys) *gin.Engine {
 	router := gin.Default()
-	router.Use(gin.Recovery())
+	router.Use(gin.Recovery(), routingHeaders())
+	// CORS comes first so preflights, which carry no key, are answered and
+	// the 401s and 429s of the key check can be read by the browser.
+	if len(cors) > 0 {
+		router.Use(corsMiddleware(cors))
+	}
+	if keys != nil {
+		router.Use(keys.middleware())
+	}
+	if web != nil {
+		router.Use(grpcWebMiddleware(web))
+	}
 
 	// Health check endpoint
 	router.GET("/health", func(c *gin.Context) {
@@ -144,25 +409,46 @@ func startHTTPServer(ctx context.Context, gwMux *runtime.ServeMux) error {
 		})
 	})
 
-	// API routing group
-	apiPrefix := "/api"
-	apiGroup := router.Group(apiPrefix)
-	apiGroup.Any("/*any", gin.WrapH(newPrefixHandler(gwMux, apiPrefix)))
+	// Everything else, including /api, comes from the route table
+	router.NoRoute(func(c *gin.Context) {
+		// Gin presets 404 for NoRoute; let the route decide.
+		c.Status(http.StatusOK)
+		routes.ServeHTTP(c.Writer, c.Request)
+	})
 
-	// orders group
-	orderGroup := router.Group("/orders")
-	{
-		orderGroup.GET("", func(c *gin.Context) {
-			c.JSON(http.StatusOK, gin.H{"data": "order list"})
-		})
-		orderGroup.GET("/:id", func(c *gin.Context) {
-			c.JSON(http.StatusOK, gin.H{"order": c.Param("id")})
-		})
+	// User change notifications for dashboards
+	router.GET("/events/users", watchUsersSSEHandler(client, ctx.Done()))
+	router.GET("/ws/users", watchUsersWSHandler(client, ctx.Done()))
+
+	// Bulk import from CSV or NDJSON uploads
+	router.POST("/users/import", importUsersHandler(client))
+
+	// GraphQL facade over UserService
+	gql := newGraphQLServer(client)
+	router.GET("/graphql", gql.handler())
+	router.POST("/graphql", gql.handler())
+	router.GET("/graphql/schema", gql.schemaHandler())
+
+	// JSON-RPC 2.0 onto any unary gRPC method the gateway serves
+	if rpc != nil {
+		router.POST("/jsonrpc", gin.WrapH(rpc))
 	}
 
+	return router
+}
+
+// newAdminHandler serves the expvar counters: upstream clusters, cache,
+// coalescing, shadowing, API keys and the rest. They describe the deployment
+// and its traffic, so they are kept off the public port.
+func newAdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+func startHTTPServer(ctx context.Context, lis net.Listener, handler http.Handler) error {
 	srv := &http.Server{
-		Addr:    ":8080",
-		Handler: router,
+		Handler: handler,
 	}
 
 	go func() {
@@ -174,8 +460,8 @@ func startHTTPServer(ctx context.Context, gwMux *runtime.ServeMux) error {
 		}
 	}()
 
-	asyncLog("HTTP server started on :8080")
-	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+	asyncLogf("HTTP server started on %s", lis.Addr())
+	if err := srv.Serve(lis); !errors.Is(err, http.ErrServerClosed) {
 		return fmt.Errorf("HTTP server error: %w", err)
 	}
 	return nil
@@ -190,49 +476,228 @@ func main() {
 		cancel()
 	}()
 
-	// Connect to user service
-	userConn, err := grpc.DialContext(ctx, "localhost:50052",
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithDefaultServiceConfig(`{
-        "loadBalancingPolicy": "round_robin",
-        "healthCheckConfig": {
-            "serviceName": "user.UserService"
-        }
-    	}`),
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	// Connect to user service, either directly or through routed clusters
+	interceptors := []grpc.DialOption{
 		grpc.WithUnaryInterceptor(loggingInterceptor),
-	)
+		grpc.WithStreamInterceptor(streamLoggingInterceptor),
+	}
+	target, dialOpts := userServiceDialOptions(cfg.userServiceRegistry(), cfg.userServiceAddr)
+	if cfg.mode == modeInProcess {
+		target, dialOpts = serveUsersInProcess(ctx)
+	}
+	// callOpts are the interceptors that change how calls are made rather
+	// than log them; the REST mux's own connection needs them too.
+	var callOpts []grpc.DialOption
+	// Machine clients may send an API key instead of a JWT; its scopes
+	// decide which of the calls made for them may go out.
+	var keys *apiKeys
+	if cfg.apiKeysFile != "" {
+		if keys, err = newAPIKeys(cfg.apiKeysFile, cfg.apiKeysAdminToken, cfg.apiKeysRequired); err != nil {
+			log.Fatalf("Failed to load API keys: %v", err)
+		}
+		defer keys.saveLastUsed()
+		go keys.watch(ctx, 10*time.Second)
+		callOpts = append(callOpts, keys.dialOptions()...)
+		asyncLogf("API keys from %s (required: %v)", cfg.apiKeysFile, cfg.apiKeysRequired)
+	}
+	// Mirror a share of reads to a candidate backend; callers only see the
+	// primary's answers.
+	if cfg.shadowAddr != "" {
+		shadowConn, err := grpc.NewClient(cfg.shadowAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		if err != nil {
+			log.Fatalf("Failed to create shadow connection: %v", err)
+		}
+		defer shadowConn.Close()
+		shadow := newShadower(shadowConn, cfg.shadowPercent, cfg.shadowWrites)
+		callOpts = append(callOpts, grpc.WithChainUnaryInterceptor(shadow.unaryInterceptor))
+		asyncLogf("Shadowing %v%% of calls to %s (writes: %v)", cfg.shadowPercent, cfg.shadowAddr, cfg.shadowWrites)
+	}
+	// Answer repeated GetUser calls from memory; writes through the gateway
+	// drop what they change.
+	var muxOpts []runtime.ServeMuxOption
+	if cfg.userCacheTTL > 0 {
+		cache := newUserCache(newLRUCache(cfg.userCacheSize, cfg.userCacheTTL), cfg.userCacheTTL)
+		callOpts = append(callOpts,
+			grpc.WithChainUnaryInterceptor(cache.unaryInterceptor),
+			grpc.WithChainStreamInterceptor(cache.streamInterceptor))
+		muxOpts = append(muxOpts, runtime.WithForwardResponseOption(cache.forwardResponse))
+		asyncLogf("Caching up to %d GetUser answers for %s", cfg.userCacheSize, cfg.userCacheTTL)
+	}
+	// Compress calls to the backends; they answer in kind.
+	if cfg.grpcCompression != "" {
+		callOpts = append(callOpts, grpc.WithDefaultCallOptions(grpc.UseCompressor(cfg.grpcCompression)))
+	}
+	// Merge identical reads in flight together into one call; on a cache
+	// miss only one of them reaches the backend.
+	if cfg.coalesceReads {
+		callOpts = append(callOpts, grpc.WithChainUnaryInterceptor(newCoalescer().unaryInterceptor))
+	}
+	interceptors = append(interceptors, callOpts...)
+	var upstream grpc.ClientConnInterface
+	var routes *clusterRouter
+	if cfg.routesFile != "" {
+		routes, err = newClusterRouter(cfg.routesFile, time.Second, interceptors)
+		if err != nil {
+			log.Fatalf("Failed to load routes: %v", err)
+		}
+		defer routes.Close()
+		upstream, target = routes, "routes from "+cfg.routesFile
+	} else {
+		userConn, err := grpc.DialContext(ctx, target, append(dialOpts, interceptors...)...)
+		if err != nil {
+			log.Fatalf("Failed to connect to user service: %v", err)
+		}
+		defer userConn.Close()
+		upstream = userConn
+	}
+
+	userClient := pb.NewUserServiceClient(upstream)
+
+	grpcLis, err := net.Listen("tcp", cfg.grpcAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", cfg.grpcAddr, err)
+	}
+	httpLis, err := net.Listen("tcp", cfg.httpAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", cfg.httpAddr, err)
+	}
+	adminLis, err := net.Listen("tcp", cfg.adminAddr)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", cfg.adminAddr, err)
+	}
+	grpcListeners := []net.Listener{grpcLis}
+
+	// gRPC-Web calls from browsers and JSON-RPC calls reach this process's own
+	// gRPC server over an in-memory pipe, so they see the same services as
+	// :8081.
+	webLis := bufconn.Listen(1 << 20)
+	grpcListeners = append(grpcListeners, webLis)
+	webConn, err := newInProcessConn(webLis, keys.dialOptions()...)
 	if err != nil {
-		log.Fatalf("Failed to connect to user service: %v", err)
+		log.Fatalf("Failed to create gRPC-Web connection: %v", err)
 	}
-	defer userConn.Close()
+	defer webConn.Close()
+	web := grpcWebCORS(cfg.grpcWebOrigins, &grpcWebHandler{conn: webConn})
+	rpc := newJSONRPCHandler(webConn)
 
 	// Initialize gRPC gateway
-	gwMux := runtime.NewServeMux()
-	if err := pb.RegisterUserServiceHandlerFromEndpoint(ctx, gwMux, "localhost:50052", []grpc.DialOption{
+	var muxConn grpc.ClientConnInterface
+	if routes != nil {
+		muxConn = routes
+		muxOpts = append(muxOpts, runtime.WithIncomingHeaderMatcher(routes.headerMatcher))
+	} else {
+		// In inprocess mode this is the in-memory pipe to userServer rather
+		// than RegisterUserServiceHandlerServer, whose local transport does
+		// not support the streaming RPCs.
+		conn, err := grpc.NewClient(target, append(dialOpts, callOpts...)...)
+		if err != nil {
+			log.Fatalf("Failed to create gateway connection: %v", err)
+		}
+		defer conn.Close()
+		muxConn = conn
+	}
+	// The user API also speaks protobuf and YAML; negotiateContent picks one
+	// per request.
+	userMuxOpts := append(marshalerOptions(), muxOpts...)
+	var gwMux *runtime.ServeMux
+	if cfg.transcodeDescriptors != "" {
+		// Build REST routes from descriptors rather than generated code.
+		loadCtx, cancelLoad := context.WithTimeout(ctx, 10*time.Second)
+		files, err := loadDescriptors(loadCtx, cfg.transcodeDescriptors, muxConn)
+		cancelLoad()
+		if err != nil {
+			log.Fatalf("Failed to load descriptors from %s: %v", cfg.transcodeDescriptors, err)
+		}
+		gwMux, err = newTranscodingMux(muxConn, files, userClient, userMuxOpts...)
+		if err != nil {
+			log.Fatalf("Failed to register transcoding handlers: %v", err)
+		}
+	} else {
+		gwMux, err = newGatewayMux(ctx, muxConn, userClient, userMuxOpts...)
+		if err != nil {
+			log.Fatalf("Failed to register gateway handler: %v", err)
+		}
+	}
+	asyncLogf("Gateway mode: %s | User service: %s", cfg.mode, target)
+
+	// Connect to order service
+	orderConn, err := grpc.NewClient(cfg.orderServiceAddr, append([]grpc.DialOption{
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
-	}); err != nil {
-		log.Fatalf("Failed to register gateway handler: %v", err)
+	}, interceptors...)...)
+	if err != nil {
+		log.Fatalf("Failed to create order service connection: %v", err)
 	}
+	defer orderConn.Close()
+	orderMux, err := newOrderMux(ctx, orderConn, muxOpts...)
+	if err != nil {
+		log.Fatalf("Failed to register order gateway handler: %v", err)
+	}
+
+	// User profile with recent orders, composed from both services
+	profileMux, err := newProfileMux(pb.NewUserServiceClient(muxConn), orderpb.NewOrderServiceClient(orderConn), cfg.profileTimeout, muxOpts...)
+	if err != nil {
+		log.Fatalf("Failed to register profile handler: %v", err)
+	}
+
+	table, err := newDynamicRoutes(cfg.routeTableFile, map[string]http.Handler{"user": negotiateContent(versionedAPI(userAPIVersions(cfg), partialResponses(gwMux))), "order": orderMux, "profile": profileMux})
+	if err != nil {
+		log.Fatalf("Failed to load route table: %v", err)
+	}
+	go table.watch(ctx, time.Second)
+
+	var cors []corsGroup
+	if cfg.corsFile != "" {
+		if cors, err = loadCORSGroups(cfg.corsFile); err != nil {
+			log.Fatalf("Failed to load CORS groups: %v", err)
+		}
+	}
+
+	// Methods gatewayServer does not implement are proxied as raw bytes:
+	// OrderService to order-service, anything else to user-service unless
+	// GRPC_PROXY_ROUTES names another backend.
+	proxy, err := newGRPCProxy(cfg.grpcProxyRoutes, upstream)
+	if err != nil {
+		log.Fatalf("Failed to set up gRPC proxy: %v", err)
+	}
+	defer proxy.Close()
+	proxy.addRoute("/"+orderpb.OrderService_ServiceDesc.ServiceName+"/", orderConn)
+	proxy.addRoute("/"+pbv2.UserService_ServiceDesc.ServiceName+"/", upstream)
+
+	// Request bodies may arrive compressed; responses are compressed when
+	// the client allows it.
+	handler := decompressRequests(compressResponses(cfg.httpCompression, cfg.httpCompressionMinSize, newRouter(ctx, table, web, rpc, userClient, cors, keys)))
 
 	// Dual-protocol server startup
 	var wg sync.WaitGroup
-	wg.Add(2)
-	errChan := make(chan error, 2)
+	wg.Add(3)
+	errChan := make(chan error, 3)
 
 	go func() {
 		defer wg.Done()
-		if err := startGRPCServer(ctx, pb.NewUserServiceClient(userConn)); err != nil {
+		if err := startGRPCServer(ctx, userClient, proxy, keys, grpcListeners...); err != nil {
 			errChan <- fmt.Errorf("gRPC server: %w", err)
 		}
 	}()
 
 	go func() {
 		defer wg.Done()
-		if err := startHTTPServer(ctx, gwMux); err != nil {
+		if err := startHTTPServer(ctx, httpLis, handler); err != nil {
 			errChan <- fmt.Errorf("HTTP server: %w", err)
 		}
 	}()
 
+	go func() {
+		defer wg.Done()
+		if err := startHTTPServer(ctx, adminLis, newAdminHandler()); err != nil {
+			errChan <- fmt.Errorf("admin server: %w", err)
+		}
+	}()
+
 	// Signal handling
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	orderpb "api/order"
+	pb "api/user"
+	"user-service/userserver"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	m.Run()
+}
+
+// mdRecorder keeps the incoming metadata of the last call to a server, to
+// check what the gateway forwarded.
+type mdRecorder struct {
+	mu   sync.Mutex
+	last metadata.MD
+}
+
+func (r *mdRecorder) record(ctx context.Context) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	r.mu.Lock()
+	r.last = md
+	r.mu.Unlock()
+}
+
+func (r *mdRecorder) metadata() metadata.MD {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// serverOptions install the recorder on a server.
+func (r *mdRecorder) serverOptions() []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			r.record(ctx)
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			r.record(ss.Context())
+			return handler(srv, ss)
+		}),
+	}
+}
+
+// stubUserService answers GetUser for user 123 only. Tests that need to
+// control single answers wrap it; the harness serves the real userServer.
+type stubUserService struct {
+	pb.UnimplementedUserServiceServer
+}
+
+func (stubUserService) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	if req.UserId != "123" {
+		return nil, status.Errorf(codes.NotFound, "user %q not found", req.UserId)
+	}
+	return &pb.GetUserResponse{Id: "123", Name: "John Doe", Email: "john@example.com"}, nil
+}
+
+// fakeOrderService stands in for order-service, served next to the fake
+// user-service.
+type fakeOrderService struct {
+	orderpb.UnimplementedOrderServiceServer
+}
+
+func (fakeOrderService) CreateOrder(ctx context.Context, req *orderpb.CreateOrderRequest) (*orderpb.Order, error) {
+	if req.UserId != "123" {
+		return nil, status.Errorf(codes.FailedPrecondition, "user %q does not exist", req.UserId)
+	}
+	return &orderpb.Order{Id: "1001", UserId: req.UserId, Items: req.Items}, nil
+}
+
+func (fakeOrderService) GetOrder(ctx context.Context, req *orderpb.GetOrderRequest) (*orderpb.Order, error) {
+	if req.OrderId != "1001" {
+		return nil, status.Errorf(codes.NotFound, "order %q not found", req.OrderId)
+	}
+	return &orderpb.Order{Id: "1001", UserId: "123"}, nil
+}
+
+func (fakeOrderService) ListOrdersByUser(ctx context.Context, req *orderpb.ListOrdersByUserRequest) (*orderpb.ListOrdersByUserResponse, error) {
+	return &orderpb.ListOrdersByUserResponse{Orders: []*orderpb.Order{{Id: "1001", UserId: req.UserId}}}, nil
+}
+
+// harness wires the gateway the way main does, with every listener in memory:
+// userServer <- gatewayServer (gRPC) <- grpc-gateway mux <- Gin router.
+type harness struct {
+	// upstream records what user-service received.
+	upstream *mdRecorder
+	// users calls user-service directly, around the gateway.
+	users pb.UserServiceClient
+	// grpcClient talks to gatewayServer, i.e. the :8081 path.
+	grpcClient pb.UserServiceClient
+	grpcConn   *grpc.ClientConn
+	http       *httptest.Server
+	health     *health.Server
+
+	cancel   context.CancelFunc
+	grpcDone chan error
+	stopOnce sync.Once
+}
+
+func newHarness(t *testing.T, mode string) *harness {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &harness{
+		upstream: &mdRecorder{},
+		cancel:   cancel,
+		grpcDone: make(chan error, 1),
+	}
+
+	// user-service runs on a server of its own, as if remote, or linked in
+	// the way main does in inprocess mode.
+	var upConn *grpc.ClientConn
+	if mode == modeInProcess {
+		target, opts := serveUsersInProcess(ctx, h.upstream.serverOptions()...)
+		conn, err := grpc.NewClient(target, opts...)
+		if err != nil {
+			t.Fatalf("dial in-process user-service: %v", err)
+		}
+		upConn = conn
+	} else {
+		upLis := bufconn.Listen(1 << 20)
+		upShutdown := make(chan struct{})
+		upSrv := userserver.NewServer(upShutdown, h.upstream.serverOptions()...)
+		go upSrv.Serve(upLis)
+		t.Cleanup(func() {
+			close(upShutdown)
+			upSrv.Stop()
+		})
+		upConn = dialBufconn(t, upLis)
+	}
+	h.users = pb.NewUserServiceClient(upConn)
+	userClient := pb.NewUserServiceClient(upConn)
+
+	// order-service and a service the gateway has no generated code for,
+	// reached via the proxy.
+	sideLis := bufconn.Listen(1 << 20)
+	sideSrv := grpc.NewServer()
+	orderpb.RegisterOrderServiceServer(sideSrv, &fakeOrderService{})
+	h.health = health.NewServer()
+	healthpb.RegisterHealthServer(sideSrv, h.health)
+	go sideSrv.Serve(sideLis)
+	sideConn := dialBufconn(t, sideLis)
+	proxy, err := newGRPCProxy(nil, upConn)
+	if err != nil {
+		t.Fatalf("newGRPCProxy: %v", err)
+	}
+	proxy.addRoute("/"+orderpb.OrderService_ServiceDesc.ServiceName+"/", sideConn)
+	proxy.addRoute("/"+healthpb.Health_ServiceDesc.ServiceName+"/", sideConn)
+
+	gwLis := bufconn.Listen(1 << 20)
+	go func() { h.grpcDone <- startGRPCServer(ctx, userClient, proxy, nil, gwLis) }()
+	gwConn := dialBufconn(t, gwLis)
+	h.grpcClient = pb.NewUserServiceClient(gwConn)
+	h.grpcConn = gwConn
+
+	gwMux, err := newGatewayMux(ctx, upConn, userClient, marshalerOptions()...)
+	if err != nil {
+		t.Fatalf("newGatewayMux: %v", err)
+	}
+	orderMux, err := newOrderMux(ctx, sideConn)
+	if err != nil {
+		t.Fatalf("newOrderMux: %v", err)
+	}
+	h.http = httptest.NewServer(newTestRouter(t, ctx, map[string]http.Handler{"user": negotiateContent(versionedAPI(testAPIVersions, partialResponses(gwMux))), "order": orderMux}, userClient))
+
+	t.Cleanup(func() {
+		h.http.Close()
+		h.shutdown(t)
+		gwConn.Close()
+		sideConn.Close()
+		sideSrv.Stop()
+		upConn.Close()
+	})
+	return h
+}
+
+// keepCreatingUsers creates a user on user-service every few milliseconds
+// until the returned func is called. A watch only sees changes made after
+// user-service registered it, which its caller cannot tell.
+func (h *harness) keepCreatingUsers(t *testing.T) (stop func()) {
+	t.Helper()
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			h.users.CreateUser(context.Background(), &pb.CreateUserRequest{Name: "Watched", Email: "watched@example.com"})
+			select {
+			case <-done:
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// newTestRouter builds the Gin router with the built-in route table.
+func newTestRouter(t *testing.T, ctx context.Context, muxes map[string]http.Handler, client pb.UserServiceClient) *gin.Engine {
+	t.Helper()
+	table, err := newDynamicRoutes("", muxes)
+	if err != nil {
+		t.Fatalf("newDynamicRoutes: %v", err)
+	}
+	return newRouter(ctx, table, nil, nil, client, nil, nil)
+}
+
+func dialBufconn(t *testing.T, lis *bufconn.Listener) *grpc.ClientConn {
+	t.Helper()
+	conn, err := newInProcessConn(lis)
+	if err != nil {
+		t.Fatalf("dial bufconn: %v", err)
+	}
+	return conn
+}
+
+// shutdown cancels the gateway context and waits for the gRPC server to stop.
+// It is safe to call more than once.
+func (h *harness) shutdown(t *testing.T) {
+	t.Helper()
+	h.stopOnce.Do(func() {
+		h.cancel()
+		select {
+		case err := <-h.grpcDone:
+			if err != nil {
+				t.Errorf("startGRPCServer returned %v", err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Error("gRPC server did not stop after shutdown")
+		}
+	})
+}
+
+func (h *harness) do(t *testing.T, method, path, body string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, h.http.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := h.http.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return res, string(b)
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// statCount reads counter key of m, 0 while it is unset.
+func statCount(m *expvar.Map, key string) int64 {
+	v, _ := m.Get(key).(*expvar.Int)
+	if v == nil {
+		return 0
+	}
+	return v.Value()
+}
+
+// waitUntil polls cond until it holds, failing the test once testContext's
+// deadline passes.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	ctx := testContext(t)
+	for !cond() {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting until %s", what)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+// callUntil keeps calling GetUser through client until cond holds, for
+// conditions on where calls are sent.
+func callUntil(t *testing.T, client pb.UserServiceClient, what string, cond func() bool) {
+	t.Helper()
+	ctx := testContext(t)
+	waitUntil(t, what, func() bool {
+		if _, err := client.GetUser(ctx, &pb.GetUserRequest{UserId: "123"}); err != nil && ctx.Err() == nil {
+			t.Logf("GetUser: %v", err)
+		}
+		return cond()
+	})
+}
+
+func forEachMode(t *testing.T, fn func(t *testing.T, h *harness)) {
+	for _, mode := range []string{modeRemote, modeInProcess} {
+		t.Run(mode, func(t *testing.T) {
+			fn(t, newHarness(t, mode))
+		})
+	}
+}
+
+func TestHealth(t *testing.T) {
+	h := newHarness(t, modeRemote)
+	res, body := h.do(t, http.MethodGet, "/health", "", nil)
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, "healthy") {
+		t.Errorf("GET /health = %d %s", res.StatusCode, body)
+	}
+}
+
+func TestDebugVarsOnlyOnAdminPort(t *testing.T) {
+	h := newHarness(t, modeRemote)
+	if res, _ := h.do(t, http.MethodGet, "/debug/vars", "", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /debug/vars on the public port = %d, want 404", res.StatusCode)
+	}
+
+	rec := httptest.NewRecorder()
+	newAdminHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/vars", nil))
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"user_cache"`) {
+		t.Errorf("GET /debug/vars on the admin port = %d %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRESTGetUser(t *testing.T) {
+	forEachMode(t, func(t *testing.T, h *harness) {
+		res, body := h.do(t, http.MethodGet, "/api/user/123", "", nil)
+		if res.StatusCode != http.StatusOK || !strings.Contains(body, `"John Doe"`) {
+			t.Errorf("GET /api/user/123 = %d %s", res.StatusCode, body)
+		}
+
+		res, body = h.do(t, http.MethodGet, "/api/user/999", "", nil)
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("GET /api/user/999 = %d %s, want 404", res.StatusCode, body)
+		}
+	})
+}
+
+func TestRESTCreateUser(t *testing.T) {
+	forEachMode(t, func(t *testing.T, h *harness) {
+		res, body := h.do(t, http.MethodPost, "/api/user", `{"name":"Alice","email":"alice@example.com"}`,
+			http.Header{"Content-Type": {"application/json"}})
+		if res.StatusCode != http.StatusOK || !strings.Contains(body, `"Alice"`) {
+			t.Errorf("POST /api/user = %d %s", res.StatusCode, body)
+		}
+
+		res, body = h.do(t, http.MethodPost, "/api/user", `{"email":"anon@example.com"}`, nil)
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("POST /api/user without name = %d %s, want 400", res.StatusCode, body)
+		}
+	})
+}
+
+func TestRESTMetadataForwarding(t *testing.T) {
+	forEachMode(t, func(t *testing.T, h *harness) {
+		h.do(t, http.MethodGet, "/api/user/123", "", http.Header{
+			"Authorization":        {"Bearer token"},
+			"Grpc-Metadata-Tenant": {"acme"},
+		})
+		md := h.upstream.metadata()
+		if got := md.Get("authorization"); len(got) != 1 || got[0] != "Bearer token" {
+			t.Errorf("authorization = %v", got)
+		}
+		if got := md.Get("tenant"); len(got) != 1 || got[0] != "acme" {
+			t.Errorf("tenant = %v", got)
+		}
+	})
+}
+
+func TestGRPCGetAndCreateUser(t *testing.T) {
+	h := newHarness(t, modeRemote)
+	ctx := testContext(t)
+
+	got, err := h.grpcClient.GetUser(ctx, &pb.GetUserRequest{UserId: "123"})
+	if err != nil || got.Name != "John Doe" {
+		t.Fatalf("GetUser = %v, %v", got, err)
+	}
+	_, err = h.grpcClient.GetUser(ctx, &pb.GetUserRequest{UserId: "999"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("GetUser(999) code = %v, want NotFound", status.Code(err))
+	}
+
+	created, err := h.grpcClient.CreateUser(ctx, &pb.CreateUserRequest{Name: "Alice", Email: "alice@example.com"})
+	if err != nil || created.Id != "124" {
+		t.Fatalf("CreateUser = %v, %v", created, err)
+	}
+	_, err = h.grpcClient.CreateUser(ctx, &pb.CreateUserRequest{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateUser(empty) code = %v, want InvalidArgument", status.Code(err))
+	}
+}
+
+func TestShutdownEndsWatchStreams(t *testing.T) {
+	h := newHarness(t, modeRemote)
+	ctx := testContext(t)
+
+	stream, err := h.grpcClient.WatchUsers(ctx, &pb.WatchUsersRequest{})
+	if err != nil {
+		t.Fatalf("WatchUsers: %v", err)
+	}
+	stop := h.keepCreatingUsers(t)
+	ev, err := stream.Recv()
+	stop()
+	if err != nil || ev.Type != pb.UserEventType_USER_CREATED || ev.User.GetName() != "Watched" {
+		t.Fatalf("Recv = %v, %v", ev, err)
+	}
+
+	h.shutdown(t)
+	if _, err := stream.Recv(); err == nil {
+		t.Error("watch stream still open after shutdown")
+	}
+}
+
+func TestRESTOrders(t *testing.T) {
+	h := newHarness(t, modeRemote)
+	res, body := h.do(t, http.MethodPost, "/orders", `{"userId":"123","items":[{"sku":"book","quantity":1}]}`, nil)
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `"id":"1001"`) {
+		t.Errorf("POST /orders = %d %s", res.StatusCode, body)
+	}
+	res, body = h.do(t, http.MethodPost, "/orders", `{"userId":"999","items":[{"sku":"book","quantity":1}]}`, nil)
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST /orders for unknown user = %d %s, want 400", res.StatusCode, body)
+	}
+
+	res, body = h.do(t, http.MethodGet, "/orders/1001", "", nil)
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `"userId":"123"`) {
+		t.Errorf("GET /orders/1001 = %d %s", res.StatusCode, body)
+	}
+	res, body = h.do(t, http.MethodGet, "/orders/1", "", nil)
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /orders/1 = %d %s, want 404", res.StatusCode, body)
+	}
+
+	res, body = h.do(t, http.MethodGet, "/orders?user_id=123", "", nil)
+	if res.StatusCode != http.StatusOK || !strings.Contains(body, `"orders":[`) {
+		t.Errorf("GET /orders?user_id=123 = %d %s", res.StatusCode, body)
+	}
+}
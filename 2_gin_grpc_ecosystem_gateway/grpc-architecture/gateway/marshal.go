@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"gopkg.in/yaml.v3"
+)
+
+// Media types the user API speaks, besides JSON.
+const (
+	mimeProtobuf = "application/x-protobuf"
+	mimeYAML     = "application/yaml"
+)
+
+// mediaTypeAliases maps each media type a client may name in Accept or
+// Content-Type to the one it is served as.
+var mediaTypeAliases = map[string]string{
+	"application/json":     "application/json",
+	"application/*":        "application/json",
+	"*/*":                  "application/json",
+	mimeProtobuf:           mimeProtobuf,
+	"application/protobuf": mimeProtobuf,
+	mimeYAML:               mimeYAML,
+	"application/x-yaml":   mimeYAML,
+	"text/yaml":            mimeYAML,
+}
+
+// jsonMarshaler is grpc-gateway's own default, registered by name so an
+// explicit Accept: application/json gets what a missing one does.
+func jsonMarshaler() runtime.Marshaler {
+	return &runtime.HTTPBodyMarshaler{Marshaler: &runtime.JSONPb{
+		MarshalOptions:   protojson.MarshalOptions{EmitUnpopulated: true},
+		UnmarshalOptions: protojson.UnmarshalOptions{DiscardUnknown: true},
+	}}
+}
+
+// marshalerOptions registers the protobuf and YAML marshalers under every
+// name mediaTypeAliases knows them by, for both request and response bodies.
+func marshalerOptions() []runtime.ServeMuxOption {
+	byType := map[string]runtime.Marshaler{
+		"application/json": jsonMarshaler(),
+		mimeProtobuf:       protobufMarshaler{ProtoMarshaller: &runtime.ProtoMarshaller{}, json: jsonMarshaler()},
+		mimeYAML:           yamlMarshaler{json: &runtime.JSONPb{MarshalOptions: protojson.MarshalOptions{EmitUnpopulated: true}, UnmarshalOptions: protojson.UnmarshalOptions{DiscardUnknown: true}}},
+	}
+	var opts []runtime.ServeMuxOption
+	for alias, served := range mediaTypeAliases {
+		if !strings.Contains(alias, "*") {
+			opts = append(opts, runtime.WithMarshalerOption(alias, byType[served]))
+		}
+	}
+	return opts
+}
+
+// ownNegotiation lists the path suffixes of custom handlers on the mux that
+// pick their own response type from Accept, such as CSV or NDJSON.
+var ownNegotiation = []string{"/users:export"}
+
+// negotiateContent picks the response media type from Accept, honouring
+// q-values and wildcards, and hands grpc-gateway the exact type to look up,
+// since it only matches whole header values. Requests that accept none of
+// JSON, protobuf and YAML get 406. Paths in ownNegotiation are passed on
+// untouched.
+func negotiateContent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		accept := r.Header.Values("Accept")
+		if len(accept) == 0 || slices.ContainsFunc(ownNegotiation, func(p string) bool { return strings.HasSuffix(r.URL.Path, p) }) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		chosen := ""
+		best := 0.0
+		for _, a := range parseAccept(strings.Join(accept, ",")) {
+			if served, ok := mediaTypeAliases[a.value]; ok && a.q > best {
+				chosen, best = served, a.q
+			}
+		}
+		if chosen == "" {
+			writeJSONError(w, http.StatusNotAcceptable, "supported media types: application/json, "+mimeProtobuf+", "+mimeYAML)
+			return
+		}
+		r = r.Clone(r.Context())
+		r.Header.Set("Accept", chosen)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// weighted is one entry of an Accept or Accept-Encoding header.
+type weighted struct {
+	value string
+	q     float64
+}
+
+// parseAccept splits an Accept-style header into its values, lowercased and
+// without parameters other than q, most preferred first. Equal q-values keep
+// the header's order. Values with q=0 are dropped.
+func parseAccept(h string) []weighted {
+	var out []weighted
+	for _, part := range strings.Split(h, ",") {
+		value, params, _ := strings.Cut(part, ";")
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+			if strings.EqualFold(k, "q") {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > 0 {
+			out = append(out, weighted{value, q})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].q > out[j].q })
+	return out
+}
+
+// protobufMarshaler writes messages in the binary wire format. Streamed
+// responses have no framing in it and are sent as JSON instead.
+type protobufMarshaler struct {
+	*runtime.ProtoMarshaller
+	json runtime.Marshaler
+}
+
+func (protobufMarshaler) ContentType(interface{}) string { return mimeProtobuf }
+
+func (m protobufMarshaler) StreamContentType(v interface{}) string {
+	return m.json.ContentType(v)
+}
+
+func (m protobufMarshaler) Marshal(v interface{}) ([]byte, error) {
+	if _, ok := v.(proto.Message); !ok {
+		return m.json.Marshal(v)
+	}
+	return m.ProtoMarshaller.Marshal(v)
+}
+
+// yamlMarshaler converts to and from the JSON mapping, so YAML bodies use the
+// same field names and value formats as JSON ones. Streamed responses are a
+// stream of YAML documents.
+type yamlMarshaler struct {
+	json runtime.Marshaler
+}
+
+func (yamlMarshaler) ContentType(interface{}) string { return mimeYAML }
+
+func (yamlMarshaler) Delimiter() []byte { return []byte("---\n") }
+
+func (m yamlMarshaler) Marshal(v interface{}) ([]byte, error) {
+	b, err := m.json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	// JSON is YAML, so this keeps the field order; clearing the styles
+	// writes it back out in block style.
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	clearYAMLStyle(&doc)
+	return yaml.Marshal(&doc)
+}
+
+func clearYAMLStyle(n *yaml.Node) {
+	n.Style = 0
+	for _, c := range n.Content {
+		clearYAMLStyle(c)
+	}
+}
+
+func (m yamlMarshaler) Unmarshal(data []byte, v interface{}) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	return m.unmarshalNode(&doc, v)
+}
+
+func (m yamlMarshaler) unmarshalNode(doc *yaml.Node, v interface{}) error {
+	generic, err := yamlValue(doc)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return m.json.Unmarshal(b, v)
+}
+
+// yamlValue converts a YAML node to the value json.Marshal should write for
+// it. Numbers become JSON strings, which protojson reads into numeric fields
+// and string fields alike, so an unquoted id: 123 still fills a string id.
+func yamlValue(n *yaml.Node) (interface{}, error) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return map[string]interface{}{}, nil
+		}
+		return yamlValue(n.Content[0])
+	case yaml.AliasNode:
+		return yamlValue(n.Alias)
+	case yaml.MappingNode:
+		out := make(map[string]interface{}, len(n.Content)/2)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			v, err := yamlValue(n.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			out[n.Content[i].Value] = v
+		}
+		return out, nil
+	case yaml.SequenceNode:
+		out := make([]interface{}, 0, len(n.Content))
+		for _, c := range n.Content {
+			v, err := yamlValue(c)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	}
+	switch n.ShortTag() {
+	case "!!null":
+		return nil, nil
+	case "!!bool":
+		var b bool
+		err := n.Decode(&b)
+		return b, err
+	}
+	return n.Value, nil
+}
+
+func (m yamlMarshaler) NewDecoder(r io.Reader) runtime.Decoder {
+	dec := yaml.NewDecoder(r)
+	return runtime.DecoderFunc(func(v interface{}) error {
+		var doc yaml.Node
+		if err := dec.Decode(&doc); err != nil {
+			return err
+		}
+		return m.unmarshalNode(&doc, v)
+	})
+}
+
+func (m yamlMarshaler) NewEncoder(w io.Writer) runtime.Encoder {
+	return runtime.EncoderFunc(func(v interface{}) error {
+		b, err := m.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+
+	pb "api/user"
+)
+
+func TestParseAccept(t *testing.T) {
+	got := parseAccept("text/html, application/yaml;q=0.9, */*;q=0.1, application/json;q=0, Application/X-Protobuf;level=1")
+	want := []weighted{{"text/html", 1}, {"application/x-protobuf", 1}, {"application/yaml", 0.9}, {"*/*", 0.1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseAccept = %v, want %v", got, want)
+	}
+}
+
+func TestContentNegotiation(t *testing.T) {
+	forEachMode(t, func(t *testing.T, h *harness) {
+		res, body := h.do(t, http.MethodGet, "/api/user/123", "", http.Header{"Accept": {"application/x-protobuf"}})
+		var u pb.GetUserResponse
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != mimeProtobuf || proto.Unmarshal([]byte(body), &u) != nil || u.Name != "John Doe" {
+			t.Errorf("GET as protobuf = %d %s %q", res.StatusCode, res.Header.Get("Content-Type"), body)
+		}
+
+		res, body = h.do(t, http.MethodGet, "/api/user/123", "", http.Header{"Accept": {"text/html, application/yaml;q=0.9, */*;q=0.1"}})
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != mimeYAML || body != "id: \"123\"\nname: John Doe\nemail: john@example.com\n" {
+			t.Errorf("GET as YAML = %d %s %q", res.StatusCode, res.Header.Get("Content-Type"), body)
+		}
+
+		res, body = h.do(t, http.MethodGet, "/api/user/123", "", http.Header{"Accept": {"application/*"}})
+		if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+			t.Errorf("GET as application/* = %d %s %s", res.StatusCode, res.Header.Get("Content-Type"), body)
+		}
+
+		res, body = h.do(t, http.MethodGet, "/api/user/123", "", http.Header{"Accept": {"application/xml"}})
+		if res.StatusCode != http.StatusNotAcceptable {
+			t.Errorf("GET as XML = %d %s, want 406", res.StatusCode, body)
+		}
+
+		// A YAML body, with an id-like name left unquoted.
+		res, body = h.do(t, http.MethodPost, "/api/user", "name: 42\nemail: a@example.com\n", http.Header{
+			"Content-Type": {"application/x-yaml"},
+			"Accept":       {"application/json"},
+		})
+		if res.StatusCode != http.StatusOK || !strings.Contains(body, `"42"`) {
+			t.Errorf("POST YAML = %d %s", res.StatusCode, body)
+		}
+	})
+}
+
+func TestExportNegotiatesItsOwnContentType(t *testing.T) {
+	forEachMode(t, func(t *testing.T, h *harness) {
+		// protojson varies its spacing, so only the shape of JSON bodies is
+		// checked.
+		for accept, want := range map[string]string{
+			"text/csv":             "id,name,email\n123,John Doe,john@example.com\n",
+			"application/x-ndjson": "{",
+			"application/json":     "[{",
+		} {
+			res, body := h.do(t, http.MethodGet, "/api/users:export", "", http.Header{"Accept": {accept}})
+			if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != accept ||
+				!strings.HasPrefix(body, want) || !strings.Contains(body, "John Doe") {
+				t.Errorf("export as %s = %d %s %q", accept, res.StatusCode, res.Header.Get("Content-Type"), body)
+			}
+		}
+	})
+}
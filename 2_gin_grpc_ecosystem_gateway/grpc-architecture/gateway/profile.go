@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	orderpb "api/order"
+	pb "api/user"
+)
+
+const defaultProfileOrders = 5
+
+// profileSection is one backend's part of a profile. Exactly one of Data and
+// Error is set, so a failing backend only blanks its own section.
+type profileSection struct {
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error json.RawMessage `json:"error,omitempty"`
+}
+
+type profileResponse struct {
+	User   profileSection `json:"user"`
+	Orders profileSection `json:"orders"`
+}
+
+// profileHandler composes a user and their most recent orders into one
+// response. Both backends are called at once under the caller's deadline,
+// taken from Grpc-Timeout or the client going away, and capped at timeout
+// when that is positive.
+type profileHandler struct {
+	mux     *runtime.ServeMux
+	users   pb.UserServiceClient
+	orders  orderpb.OrderServiceClient
+	timeout time.Duration
+}
+
+// newProfileMux serves GET /profiles/{user_id}?orders=N, where N is the
+// number of recent orders to include (default 5).
+func newProfileMux(users pb.UserServiceClient, orders orderpb.OrderServiceClient, timeout time.Duration, opts ...runtime.ServeMuxOption) (*runtime.ServeMux, error) {
+	mux := runtime.NewServeMux(opts...)
+	h := &profileHandler{mux: mux, users: users, orders: orders, timeout: timeout}
+	if err := mux.HandlePath(http.MethodGet, "/profiles/{user_id}", h.serve); err != nil {
+		return nil, err
+	}
+	return mux, nil
+}
+
+func (h *profileHandler) serve(w http.ResponseWriter, r *http.Request, params map[string]string) {
+	_, outbound := runtime.MarshalerForRequest(h.mux, r)
+	limit := defaultProfileOrders
+	if v := r.URL.Query().Get("orders"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			runtime.HTTPError(r.Context(), h.mux, outbound, w, r, status.Errorf(codes.InvalidArgument, "invalid orders %q", v))
+			return
+		}
+		limit = n
+	}
+
+	// AnnotateContext forwards the caller's headers as metadata and applies
+	// Grpc-Timeout, just as the generated /api handlers do.
+	ctx, err := runtime.AnnotateContext(r.Context(), h.mux, r, "/gateway.Profile/GetProfile")
+	if err != nil {
+		runtime.HTTPError(r.Context(), h.mux, outbound, w, r, err)
+		return
+	}
+	if h.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.timeout)
+		defer cancel()
+	}
+
+	userID := params["user_id"]
+	start := time.Now()
+	var (
+		wg       sync.WaitGroup
+		user     *pb.GetUserResponse
+		orders   *orderpb.ListOrdersByUserResponse
+		userErr  error
+		orderErr error
+	)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		user, userErr = h.users.GetUser(ctx, &pb.GetUserRequest{UserId: userID})
+	}()
+	go func() {
+		defer wg.Done()
+		if limit == 0 {
+			orders = &orderpb.ListOrdersByUserResponse{}
+			return
+		}
+		orders, orderErr = h.orders.ListOrdersByUser(ctx, &orderpb.ListOrdersByUserRequest{UserId: userID, PageSize: int32(limit)})
+	}()
+	wg.Wait()
+	asyncLogf("[Profile] user %s | Duration: %v | user: %v | orders: %v", userID, time.Since(start), status.Code(userErr), status.Code(orderErr))
+
+	resp := profileResponse{
+		User:   profileSectionOf(outbound, user, userErr),
+		Orders: profileSectionOf(outbound, orders, orderErr),
+	}
+	// The profile stands or falls with the user; failed orders only leave
+	// their section empty.
+	code := http.StatusOK
+	if userErr != nil {
+		code = runtime.HTTPStatusFromCode(status.Code(userErr))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		asyncLogf("[Profile] writing response: %v", err)
+	}
+}
+
+// profileSectionOf marshals msg, or err as a google.rpc.Status like
+// grpc-gateway's own error bodies.
+func profileSectionOf(m runtime.Marshaler, msg proto.Message, err error) profileSection {
+	if err == nil {
+		data, merr := m.Marshal(msg)
+		if merr == nil {
+			return profileSection{Data: data}
+		}
+		err = status.Errorf(codes.Internal, "marshalling response: %v", merr)
+	}
+	data, merr := m.Marshal(status.Convert(err).Proto())
+	if merr != nil {
+		data, _ = json.Marshal(map[string]string{"message": err.Error()})
+	}
+	return profileSection{Error: data}
+}
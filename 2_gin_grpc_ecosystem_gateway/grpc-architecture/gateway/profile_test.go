@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	orderpb "api/order"
+	pb "api/user"
+)
+
+// rendezvousUsers and rendezvousOrders each wait for the other to be called
+// before answering, so a profile only completes if both calls overlap.
+type rendezvousUsers struct {
+	stubUserService
+	mine, other chan struct{}
+}
+
+func (u *rendezvousUsers) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	close(u.mine)
+	select {
+	case <-u.other:
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	return u.stubUserService.GetUser(ctx, req)
+}
+
+type rendezvousOrders struct {
+	fakeOrderService
+	mine, other chan struct{}
+	// fail, when set, is returned instead of orders.
+	fail error
+}
+
+func (o *rendezvousOrders) ListOrdersByUser(ctx context.Context, req *orderpb.ListOrdersByUserRequest) (*orderpb.ListOrdersByUserResponse, error) {
+	close(o.mine)
+	select {
+	case <-o.other:
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+	if o.fail != nil {
+		return nil, o.fail
+	}
+	if req.PageSize != 3 {
+		return nil, status.Errorf(codes.InvalidArgument, "page_size = %d, want 3", req.PageSize)
+	}
+	return o.fakeOrderService.ListOrdersByUser(ctx, req)
+}
+
+type profileReply struct {
+	User struct {
+		Data  *struct{ Id, Name string }
+		Error *struct {
+			Code    codes.Code
+			Message string
+		}
+	}
+	Orders struct {
+		Data *struct {
+			Orders []struct{ Id string }
+		}
+		Error *struct {
+			Code    codes.Code
+			Message string
+		}
+	}
+}
+
+// getProfile serves /profiles from fresh fakes. With never set, neither
+// backend answers before the request's deadline.
+func getProfile(t *testing.T, path string, header http.Header, ordersErr error, never bool, timeout time.Duration) (int, profileReply) {
+	t.Helper()
+	userCalled, ordersCalled := make(chan struct{}), make(chan struct{})
+	userGate, ordersGate := ordersCalled, userCalled
+	if never {
+		userGate, ordersGate = make(chan struct{}), make(chan struct{})
+	}
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterUserServiceServer(srv, &rendezvousUsers{stubUserService{}, userCalled, userGate})
+	orderpb.RegisterOrderServiceServer(srv, &rendezvousOrders{mine: ordersCalled, other: ordersGate, fail: ordersErr})
+	go srv.Serve(lis)
+	conn := dialBufconn(t, lis)
+	t.Cleanup(func() {
+		conn.Close()
+		srv.Stop()
+	})
+
+	mux, err := newProfileMux(pb.NewUserServiceClient(conn), orderpb.NewOrderServiceClient(conn), timeout)
+	if err != nil {
+		t.Fatalf("newProfileMux: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	ts := httptest.NewServer(newTestRouter(t, ctx, map[string]http.Handler{"profile": mux}, nil))
+	t.Cleanup(ts.Close)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer res.Body.Close()
+	var reply profileReply
+	if err := json.NewDecoder(res.Body).Decode(&reply); err != nil {
+		t.Fatalf("decoding profile: %v", err)
+	}
+	return res.StatusCode, reply
+}
+
+func TestProfileComposesBothServices(t *testing.T) {
+	code, p := getProfile(t, "/profiles/123?orders=3", nil, nil, false, 5*time.Second)
+	if code != http.StatusOK || p.User.Data == nil || p.User.Data.Name != "John Doe" || p.User.Error != nil {
+		t.Errorf("user section = %d %+v", code, p.User)
+	}
+	if p.Orders.Data == nil || len(p.Orders.Data.Orders) != 1 || p.Orders.Data.Orders[0].Id != "1001" || p.Orders.Error != nil {
+		t.Errorf("orders section = %+v", p.Orders)
+	}
+}
+
+func TestProfilePartialFailure(t *testing.T) {
+	code, p := getProfile(t, "/profiles/123?orders=3", nil, status.Error(codes.Unavailable, "order-service down"), false, 5*time.Second)
+	if code != http.StatusOK || p.User.Data == nil {
+		t.Errorf("user section with orders down = %d %+v", code, p.User)
+	}
+	if p.Orders.Data != nil || p.Orders.Error == nil || p.Orders.Error.Code != codes.Unavailable {
+		t.Errorf("orders section = %+v, want Unavailable error", p.Orders)
+	}
+
+	// Without the user there is no profile, but the orders still come back.
+	code, p = getProfile(t, "/profiles/999?orders=3", nil, nil, false, 5*time.Second)
+	if code != http.StatusNotFound || p.User.Error == nil || p.User.Error.Code != codes.NotFound {
+		t.Errorf("unknown user = %d %+v, want 404", code, p.User)
+	}
+	if p.Orders.Data == nil {
+		t.Errorf("orders section for unknown user = %+v", p.Orders)
+	}
+}
+
+func TestProfileDeadline(t *testing.T) {
+	start := time.Now()
+	code, p := getProfile(t, "/profiles/123", http.Header{"Grpc-Timeout": {"100m"}}, nil, true, 5*time.Second)
+	if code != http.StatusGatewayTimeout || p.User.Error == nil || p.User.Error.Code != codes.DeadlineExceeded ||
+		p.Orders.Error == nil || p.Orders.Error.Code != codes.DeadlineExceeded {
+		t.Errorf("caller deadline = %d %+v", code, p)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Errorf("took %v despite a 100ms Grpc-Timeout", d)
+	}
+
+	// The gateway's own cap applies when the caller sets none.
+	code, _ = getProfile(t, "/profiles/123", nil, nil, true, 100*time.Millisecond)
+	if code != http.StatusGatewayTimeout {
+		t.Errorf("gateway cap = %d, want 504", code)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// rawFrame is a gRPC message passed through without being decoded.
+type rawFrame []byte
+
+// proxyCodec is the gateway's wire codec. Proxied calls carry rawFrames that
+// are copied byte for byte; everything else, such as the requests and
+// replies of gatewayServer, is ordinary protobuf. It keeps the name "proto" so
+// callers see no difference on the wire.
+type proxyCodec struct{}
+
+func (proxyCodec) Name() string { return "proto" }
+
+func (proxyCodec) Marshal(v any) ([]byte, error) {
+	switch m := v.(type) {
+	case *rawFrame:
+		return *m, nil
+	case proto.Message:
+		return proto.Marshal(m)
+	}
+	return nil, fmt.Errorf("proxyCodec: cannot marshal %T", v)
+}
+
+func (proxyCodec) Unmarshal(data []byte, v any) error {
+	switch m := v.(type) {
+	case *rawFrame:
+		// data is only valid for this call.
+		*m = append((*m)[:0], data...)
+		return nil
+	case proto.Message:
+		return proto.Unmarshal(data, m)
+	}
+	return fmt.Errorf("proxyCodec: cannot unmarshal into %T", v)
+}
+
+// proxyRoute sends every method whose full name starts with prefix, e.g.
+// "/order.OrderService/" or "/user.UserService/GetUser", to conn.
+type proxyRoute struct {
+	prefix string
+	conn   grpc.ClientConnInterface
+}
+
+// grpcProxy forwards calls for services and methods this binary has no
+// generated code for. Routes are matched by longest prefix of the full method
+// name; anything unmatched goes to the fallback backend.
+type grpcProxy struct {
+	routes   []proxyRoute
+	fallback grpc.ClientConnInterface
+	closers  []io.Closer
+}
+
+// newGRPCProxy dials the backend of every "prefix=addr" rule. fallback, which
+// may be nil, handles methods no rule matches.
+func newGRPCProxy(rules []string, fallback grpc.ClientConnInterface) (*grpcProxy, error) {
+	p := &grpcProxy{fallback: fallback}
+	conns := make(map[string]*grpc.ClientConn)
+	for _, rule := range rules {
+		prefix, addr, ok := strings.Cut(rule, "=")
+		if !ok || !strings.HasPrefix(prefix, "/") || addr == "" {
+			p.Close()
+			return nil, fmt.Errorf("invalid proxy route %q (want /package.Service/[Method]=host:port)", rule)
+		}
+		conn, ok := conns[addr]
+		if !ok {
+			var err error
+			conn, err = grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+			if err != nil {
+				p.Close()
+				return nil, fmt.Errorf("proxy route %q: %w", rule, err)
+			}
+			conns[addr] = conn
+			p.closers = append(p.closers, conn)
+		}
+		p.routes = append(p.routes, proxyRoute{prefix: prefix, conn: conn})
+	}
+	p.sortRoutes()
+	return p, nil
+}
+
+// addRoute sends prefix to conn, which stays owned by the caller. Routes
+// from rules given to newGRPCProxy win over an equal prefix added here.
+func (p *grpcProxy) addRoute(prefix string, conn grpc.ClientConnInterface) {
+	p.routes = append(p.routes, proxyRoute{prefix: prefix, conn: conn})
+	p.sortRoutes()
+}
+
+// services lists the services routed as a whole, such as
+// "order.OrderService".
+func (p *grpcProxy) services() []string {
+	var names []string
+	for _, r := range p.routes {
+		name := strings.Trim(r.prefix, "/")
+		if strings.HasSuffix(r.prefix, "/") && !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (p *grpcProxy) sortRoutes() {
+	sort.SliceStable(p.routes, func(i, j int) bool { return len(p.routes[i].prefix) > len(p.routes[j].prefix) })
+}
+
+// Close closes the connections dialled for routes; the fallback belongs to
+// the caller.
+func (p *grpcProxy) Close() {
+	for _, c := range p.closers {
+		c.Close()
+	}
+}
+
+func (p *grpcProxy) backend(method string) grpc.ClientConnInterface {
+	for _, r := range p.routes {
+		if strings.HasPrefix(method, r.prefix) {
+			return r.conn
+		}
+	}
+	return p.fallback
+}
+
+// handler is a grpc.UnknownServiceHandler. Every call is treated as
+// bidirectional streaming, which covers the other three shapes: messages are
+// pumped both ways until each side finishes, and headers, trailers and the
+// final status are passed back unchanged.
+func (p *grpcProxy) handler(_ any, ss grpc.ServerStream) error {
+	method, ok := grpc.MethodFromServerStream(ss)
+	if !ok {
+		return status.Error(codes.Internal, "proxy: no method in stream context")
+	}
+	conn := p.backend(method)
+	if conn == nil {
+		return status.Errorf(codes.Unimplemented, "unknown method %s", method)
+	}
+	asyncLogf("[Proxy] Forwarding %s", method)
+
+	// ss.Context carries the caller's metadata as outgoing metadata, see
+	// forwardedContext.
+	ctx, cancel := context.WithCancel(ss.Context())
+	defer cancel()
+	cs, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}, method, grpc.ForceCodec(proxyCodec{}))
+	if err != nil {
+		return err
+	}
+
+	// Client to backend. Errors here surface through the backend's status,
+	// so the goroutine only needs to stop.
+	go func() {
+		for {
+			var f rawFrame
+			if err := ss.RecvMsg(&f); err != nil {
+				if err == io.EOF {
+					cs.CloseSend()
+				} else {
+					cancel()
+				}
+				return
+			}
+			if err := cs.SendMsg(&f); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Backend to client.
+	headerSent := false
+	for {
+		var f rawFrame
+		err := cs.RecvMsg(&f)
+		if !headerSent {
+			// Header blocks until the backend sends headers or fails, which
+			// RecvMsg has already waited for.
+			if md, herr := cs.Header(); herr == nil {
+				if err := ss.SendHeader(md); err != nil {
+					return err
+				}
+			}
+			headerSent = true
+		}
+		if err != nil {
+			ss.SetTrailer(cs.Trailer())
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if err := ss.SendMsg(&f); err != nil {
+			return err
+		}
+	}
+}
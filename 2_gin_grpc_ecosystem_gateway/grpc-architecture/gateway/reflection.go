@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	// Compiled in so reflection can describe user-service's health checks,
+	// which :8081 proxies.
+	_ "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	reflectionalphapb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// reflectionServices lists the services registered on srv plus the proxied
+// services whose protos are compiled into the gateway, so reflection clients
+// can see everything :8081 answers for.
+type reflectionServices struct {
+	srv     *grpc.Server
+	proxied []string
+}
+
+func (r reflectionServices) GetServiceInfo() map[string]grpc.ServiceInfo {
+	info := r.srv.GetServiceInfo()
+	for _, name := range r.proxied {
+		if _, ok := info[name]; ok {
+			continue
+		}
+		d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name))
+		if err != nil {
+			continue
+		}
+		sd, ok := d.(protoreflect.ServiceDescriptor)
+		if !ok {
+			continue
+		}
+		var si grpc.ServiceInfo
+		for i := 0; i < sd.Methods().Len(); i++ {
+			md := sd.Methods().Get(i)
+			si.Methods = append(si.Methods, grpc.MethodInfo{
+				Name:           string(md.Name()),
+				IsClientStream: md.IsStreamingClient(),
+				IsServerStream: md.IsStreamingServer(),
+			})
+		}
+		info[name] = si
+	}
+	return info
+}
+
+// registerReflection serves both versions of the reflection API on srv.
+func registerReflection(srv *grpc.Server, proxied []string) {
+	opts := reflection.ServerOptions{Services: reflectionServices{srv: srv, proxied: proxied}}
+	reflectionpb.RegisterServerReflectionServer(srv, reflection.NewServerV1(opts))
+	reflectionalphapb.RegisterServerReflectionServer(srv, reflection.NewServer(opts))
+}
+
+// loadDescriptors returns the proto files to transcode: from server
+// reflection on conn when source is "reflection", otherwise from the
+// FileDescriptorSet file at source, as written by
+// protoc --include_imports --descriptor_set_out.
+func loadDescriptors(ctx context.Context, source string, conn grpc.ClientConnInterface) (*protoregistry.Files, error) {
+	if source == "reflection" {
+		return reflectDescriptors(ctx, conn)
+	}
+	b, err := os.ReadFile(source)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("parsing descriptor set %s: %w", source, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor set %s: %w", source, err)
+	}
+	return files, nil
+}
+
+// reflectDescriptors asks the server behind conn for every service it lists
+// and the files they need. Dependencies the server cannot supply, such as
+// well-known types, are taken from the protos compiled into the gateway.
+func reflectDescriptors(ctx context.Context, conn grpc.ClientConnInterface) (*protoregistry.Files, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := reflectionpb.NewServerReflectionClient(conn).ServerReflectionInfo(ctx, grpc.WaitForReady(true))
+	if err != nil {
+		return nil, fmt.Errorf("opening reflection stream: %w", err)
+	}
+	ask := func(req *reflectionpb.ServerReflectionRequest) (*reflectionpb.ServerReflectionResponse, error) {
+		if err := stream.Send(req); err != nil {
+			return nil, err
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if e := resp.GetErrorResponse(); e != nil {
+			return nil, status.Error(codes.Code(e.ErrorCode), e.ErrorMessage)
+		}
+		return resp, nil
+	}
+
+	files := make(map[string]*descriptorpb.FileDescriptorProto)
+	add := func(resp *reflectionpb.ServerReflectionResponse) error {
+		for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			fd := new(descriptorpb.FileDescriptorProto)
+			if err := proto.Unmarshal(b, fd); err != nil {
+				return fmt.Errorf("parsing reflected descriptor: %w", err)
+			}
+			files[fd.GetName()] = fd
+		}
+		return nil
+	}
+
+	resp, err := ask(&reflectionpb.ServerReflectionRequest{MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{}})
+	if err != nil {
+		return nil, fmt.Errorf("listing services: %w", err)
+	}
+	for _, svc := range resp.GetListServicesResponse().GetService() {
+		if strings.HasPrefix(svc.Name, "grpc.reflection.") {
+			continue
+		}
+		resp, err := ask(&reflectionpb.ServerReflectionRequest{
+			MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: svc.Name},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("describing %s: %w", svc.Name, err)
+		}
+		if err := add(resp); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		var missing []string
+		for _, fd := range files {
+			for _, dep := range fd.GetDependency() {
+				if files[dep] == nil {
+					missing = append(missing, dep)
+				}
+			}
+		}
+		if len(missing) == 0 {
+			break
+		}
+		for _, name := range missing {
+			if files[name] != nil {
+				continue
+			}
+			resp, err := ask(&reflectionpb.ServerReflectionRequest{
+				MessageRequest: &reflectionpb.ServerReflectionRequest_FileByFilename{FileByFilename: name},
+			})
+			if err == nil {
+				if err := add(resp); err != nil {
+					return nil, err
+				}
+			}
+			if files[name] != nil {
+				continue
+			}
+			local, lerr := protoregistry.GlobalFiles.FindFileByPath(name)
+			if lerr != nil {
+				return nil, fmt.Errorf("dependency %s: not served by reflection (%v) nor compiled in", name, err)
+			}
+			files[name] = protodesc.ToFileDescriptorProto(local)
+		}
+	}
+
+	set := new(descriptorpb.FileDescriptorSet)
+	for _, fd := range files {
+		set.File = append(set.File, fd)
+	}
+	sort.Slice(set.File, func(i, j int) bool { return set.File[i].GetName() < set.File[j].GetName() })
+	return protodesc.NewFiles(set)
+}
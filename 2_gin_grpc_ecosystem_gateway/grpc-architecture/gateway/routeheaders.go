@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+)
+
+// dialCluster connects to every address of a routing cluster, balanced and
+// health-checked like a single user-service.
+func dialCluster(_ string, addrs []string, opts []grpc.DialOption) (*grpc.ClientConn, error) {
+	target, dialOpts := userServiceDialOptions(staticRegistry(addrs), "")
+	return grpc.NewClient(target, append(dialOpts, opts...)...)
+}
+
+// headerMatcher is a grpc-gateway incoming header matcher that also passes
+// through the headers rules look at, so REST calls carry them as metadata
+// when a cluster is picked.
+func (r *clusterRouter) headerMatcher(key string) (string, bool) {
+	if r.routesOnHeader(key) {
+		return key, true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// routingHeaders stores the HTTP request headers on the request context so
+// routing rules can see them after grpc-gateway has replaced the outgoing
+// metadata.
+func routingHeaders() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := context.WithValue(c.Request.Context(), routeHeadersKey{}, c.Request.Header)
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// routeTableConfig is the JSON route table file:
+//
+//	{
+//	  "routes": [
+//	    {"prefix": "/api", "strip_prefix": true, "mux": "user",
+//	     "cors": {"allow_origins": ["https://app.example.com"]},
+//	     "rate_limit": {"rps": 50, "burst": 100}},
+//	    {"prefix": "/legacy", "strip_prefix": true, "proxy": "http://localhost:9000",
+//	     "auth": {"tokens": ["s3cret"]}},
+//	    {"prefix": "/status", "static": {"status": 200, "body": {"ok": true}}}
+//	  ]
+//	}
+//
+// The longest matching prefix wins. Each route has exactly one backend: a
+// named grpc-gateway mux, an HTTP reverse proxy or a static response.
+type routeTableConfig struct {
+	Routes []routeSpec `json:"routes"`
+}
+
+type routeSpec struct {
+	Prefix      string `json:"prefix"`
+	StripPrefix bool   `json:"strip_prefix"`
+
+	Mux    string      `json:"mux,omitempty"`
+	Proxy  string      `json:"proxy,omitempty"`
+	Static *staticSpec `json:"static,omitempty"`
+
+	// Middleware, applied from the outside in as CORS, auth, rate limit, so
+	// rejections still carry CORS headers and preflights need no token.
+	Auth      *authSpec      `json:"auth,omitempty"`
+	RateLimit *rateLimitSpec `json:"rate_limit,omitempty"`
+	CORS      *corsSpec      `json:"cors,omitempty"`
+}
+
+type staticSpec struct {
+	Status      int               `json:"status"`
+	ContentType string            `json:"content_type"`
+	Headers     map[string]string `json:"headers"`
+	Body        json.RawMessage   `json:"body"`
+}
+
+// authSpec accepts requests bearing one of the listed bearer tokens.
+type authSpec struct {
+	Tokens []string `json:"tokens"`
+}
+
+// rateLimitSpec is a token bucket shared by every caller of the route.
+type rateLimitSpec struct {
+	RPS   float64 `json:"rps"`
+	Burst int     `json:"burst"`
+}
+
+type compiledRoute struct {
+	prefix  string
+	handler http.Handler
+}
+
+// dynamicRoutes serves requests from a route table that can be swapped while
+// running. A request keeps the table it started with, so replacing the table
+// never interrupts requests already in flight.
+type dynamicRoutes struct {
+	muxes map[string]http.Handler
+	path  string
+
+	routes atomic.Pointer[[]compiledRoute]
+	mu     sync.Mutex // serialises reloads
+	last   []byte
+	// buckets holds each route's rate limiter by prefix, so a reload keeps
+	// the tokens already spent unless the route's limit itself changed.
+	buckets map[string]*routeBucket
+}
+
+// routeBucket is a route's rate limiter and the limit it was built for.
+type routeBucket struct {
+	spec   rateLimitSpec
+	bucket *tokenBucket
+}
+
+// newDynamicRoutes serves the table in path, or the built-in table when path
+// is empty. muxes names the grpc-gateway muxes routes may refer to.
+func newDynamicRoutes(path string, muxes map[string]http.Handler) (*dynamicRoutes, error) {
+	d := &dynamicRoutes{muxes: muxes, path: path}
+	if path == "" {
+		return d, d.apply(defaultRouteTable(muxes))
+	}
+	return d, d.reload()
+}
+
+// defaultRouteTable serves the user API under /api, orders under /orders and
+// composed profiles under /profiles, skipping any mux that was not provided.
+func defaultRouteTable(muxes map[string]http.Handler) routeTableConfig {
+	var cfg routeTableConfig
+	for _, r := range []routeSpec{
+		{Prefix: "/api", StripPrefix: true, Mux: "user"},
+		{Prefix: "/orders", Mux: "order"},
+		{Prefix: "/profiles", Mux: "profile"},
+	} {
+		if _, ok := muxes[r.Mux]; ok {
+			cfg.Routes = append(cfg.Routes, r)
+		}
+	}
+	return cfg
+}
+
+// watch re-reads the table file every interval until ctx is done.
+func (d *dynamicRoutes) watch(ctx context.Context, interval time.Duration) {
+	if d.path == "" {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := d.reload(); err != nil {
+				asyncLogf("[Routes] Keeping previous route table: %v", err)
+			}
+		}
+	}
+}
+
+func (d *dynamicRoutes) reload() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return err
+	}
+	if d.last != nil && bytes.Equal(data, d.last) {
+		return nil
+	}
+	var cfg routeTableConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return fmt.Errorf("parsing %s: %w", d.path, err)
+	}
+	if err := d.apply(cfg); err != nil {
+		return fmt.Errorf("%s: %w", d.path, err)
+	}
+	d.last = data
+	asyncLogf("[Routes] Loaded %d routes from %s", len(cfg.Routes), d.path)
+	return nil
+}
+
+func (d *dynamicRoutes) apply(cfg routeTableConfig) error {
+	routes := make([]compiledRoute, 0, len(cfg.Routes))
+	buckets := make(map[string]*routeBucket)
+	seen := make(map[string]bool)
+	for i, spec := range cfg.Routes {
+		if !strings.HasPrefix(spec.Prefix, "/") {
+			return fmt.Errorf("route %d: prefix %q must start with /", i, spec.Prefix)
+		}
+		spec.Prefix = strings.TrimSuffix(spec.Prefix, "/")
+		if seen[spec.Prefix] {
+			return fmt.Errorf("route %d: duplicate prefix %q", i, spec.Prefix)
+		}
+		seen[spec.Prefix] = true
+		h, err := d.compile(spec, buckets)
+		if err != nil {
+			return fmt.Errorf("route %d (%s): %w", i, spec.Prefix, err)
+		}
+		routes = append(routes, compiledRoute{prefix: spec.Prefix, handler: h})
+	}
+	sort.SliceStable(routes, func(i, j int) bool { return len(routes[i].prefix) > len(routes[j].prefix) })
+	d.routes.Store(&routes)
+	d.buckets = buckets
+	return nil
+}
+
+// compile builds the handler for spec, adding its rate limiter, if any, to
+// buckets.
+func (d *dynamicRoutes) compile(spec routeSpec, buckets map[string]*routeBucket) (http.Handler, error) {
+	var h http.Handler
+	backends := 0
+	if spec.Mux != "" {
+		backends++
+		mux, ok := d.muxes[spec.Mux]
+		if !ok {
+			return nil, fmt.Errorf("unknown mux %q", spec.Mux)
+		}
+		h = mux
+	}
+	if spec.Proxy != "" {
+		backends++
+		target, err := url.Parse(spec.Proxy)
+		if err != nil || target.Scheme == "" || target.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q", spec.Proxy)
+		}
+		h = &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(target)
+				r.SetXForwarded()
+			},
+		}
+	}
+	if spec.Static != nil {
+		backends++
+		h = staticHandler(*spec.Static)
+	}
+	if backends != 1 {
+		return nil, errors.New("needs exactly one of mux, proxy or static")
+	}
+
+	if spec.StripPrefix {
+		h = stripPrefixHandler(spec.Prefix, h)
+	}
+	if spec.RateLimit != nil {
+		if spec.RateLimit.RPS <= 0 {
+			return nil, errors.New("rate_limit.rps must be positive")
+		}
+		rb := d.buckets[spec.Prefix]
+		if rb == nil || rb.spec != *spec.RateLimit {
+			rb = &routeBucket{spec: *spec.RateLimit, bucket: newTokenBucket(*spec.RateLimit)}
+		}
+		buckets[spec.Prefix] = rb
+		h = rateLimitHandler(rb.bucket, h)
+	}
+	if spec.Auth != nil {
+		if len(spec.Auth.Tokens) == 0 {
+			return nil, errors.New("auth needs at least one token")
+		}
+		h = authHandler(*spec.Auth, h)
+	}
+	if spec.CORS != nil {
+		if err := spec.CORS.validate(); err != nil {
+			return nil, err
+		}
+		h = corsHandler(*spec.CORS, h)
+	}
+	return h, nil
+}
+
+func (d *dynamicRoutes) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, route := range *d.routes.Load() {
+		if r.URL.Path == route.prefix || strings.HasPrefix(r.URL.Path, route.prefix+"/") || route.prefix == "" {
+			route.handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	writeJSONError(w, http.StatusNotFound, "no route for "+r.URL.Path)
+}
+
+// stripPrefixHandler removes prefix from the path before calling next and
+// logs the upstream latency.
+func stripPrefixHandler(prefix string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		r2 := r.Clone(r.Context())
+		r2.URL.Path = strings.TrimPrefix(r.URL.Path, prefix)
+		r2.URL.RawPath = ""
+		if r2.URL.Path == "" {
+			r2.URL.Path = "/"
+		}
+		rw := &responseWriter{w, 0}
+		next.ServeHTTP(rw, r2)
+
+		asyncLogf("[%s] Upstream latency: %v | Status: %d | Path: %s",
+			time.Now().Format("2006-01-02 15:04:05"),
+			time.Since(start),
+			rw.status,
+			r2.URL.Path,
+		)
+	})
+}
+
+func staticHandler(spec staticSpec) http.Handler {
+	status := spec.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	contentType := spec.ContentType
+	body := []byte(spec.Body)
+	// A JSON string body is sent as its text, anything else as JSON.
+	var text string
+	if json.Unmarshal(spec.Body, &text) == nil {
+		body = []byte(text)
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+	} else if contentType == "" {
+		contentType = "application/json"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range spec.Headers {
+			w.Header().Set(k, v)
+		}
+		if len(body) > 0 {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.WriteHeader(status)
+		w.Write(body)
+	})
+}
+
+func authHandler(spec authSpec, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && slices.ContainsFunc(spec.Tokens, func(t string) bool {
+			return subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1
+		}) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJSONError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+	})
+}
+
+// tokenBucket refills at rate tokens per second up to burst.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// take reports whether a token was available and, if not, how long until
+// one will be.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// newTokenBucket returns a full bucket for spec. A burst below 1 defaults to
+// one second's worth of tokens.
+func newTokenBucket(spec rateLimitSpec) *tokenBucket {
+	burst := float64(spec.Burst)
+	if burst < 1 {
+		burst = math.Max(1, spec.RPS)
+	}
+	return &tokenBucket{rate: spec.RPS, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func rateLimitHandler(bucket *tokenBucket, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := bucket.take(time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeJSONError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tableServer serves the Gin router with a route table read from a file.
+type tableServer struct {
+	table *dynamicRoutes
+	path  string
+	http  *httptest.Server
+}
+
+func newTableServer(t *testing.T, table string, muxes map[string]http.Handler) *tableServer {
+	t.Helper()
+	s := &tableServer{path: filepath.Join(t.TempDir(), "routes.json")}
+	s.write(t, table)
+	var err error
+	if s.table, err = newDynamicRoutes(s.path, muxes); err != nil {
+		t.Fatalf("newDynamicRoutes: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.http = httptest.NewServer(newRouter(ctx, s.table, nil, nil, nil, nil, nil))
+	t.Cleanup(func() {
+		s.http.Close()
+		cancel()
+	})
+	return s
+}
+
+func (s *tableServer) write(t *testing.T, table string) {
+	t.Helper()
+	if err := os.WriteFile(s.path, []byte(table), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (s *tableServer) do(t *testing.T, method, path string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, s.http.URL+path, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := s.http.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return res, string(b)
+}
+
+// echoPath answers with the path and forwarded host it was called with.
+var echoPath = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintf(w, "path=%s forwarded=%v", r.URL.Path, r.Header.Get("X-Forwarded-Host") != "")
+})
+
+func TestRouteTableBackends(t *testing.T) {
+	backend := httptest.NewServer(echoPath)
+	t.Cleanup(backend.Close)
+	s := newTableServer(t, fmt.Sprintf(`{"routes": [
+		{"prefix": "/api", "strip_prefix": true, "mux": "user"},
+		{"prefix": "/api/v2", "mux": "user"},
+		{"prefix": "/legacy", "strip_prefix": true, "proxy": %q},
+		{"prefix": "/status", "static": {"status": 203, "headers": {"X-Static": "1"}, "body": {"ok": true}}},
+		{"prefix": "/motd", "static": {"body": "hello"}}
+	]}`, backend.URL), map[string]http.Handler{"user": echoPath})
+
+	cases := []struct {
+		path, want string
+		status     int
+	}{
+		{"/api/user/1", "path=/user/1 forwarded=false", 200},
+		{"/api/v2/user/1", "path=/api/v2/user/1 forwarded=false", 200},
+		{"/legacy/a/b", "path=/a/b forwarded=true", 200},
+		{"/status", `{"ok": true}`, 203},
+		{"/motd", "hello", 200},
+		{"/apix", `{"error":"no route for /apix"}` + "\n", 404},
+	}
+	for _, tc := range cases {
+		res, body := s.do(t, http.MethodGet, tc.path, nil)
+		if res.StatusCode != tc.status || body != tc.want {
+			t.Errorf("GET %s = %d %q, want %d %q", tc.path, res.StatusCode, body, tc.status, tc.want)
+		}
+	}
+	if res, _ := s.do(t, http.MethodGet, "/status", nil); res.Header.Get("X-Static") != "1" {
+		t.Error("static route headers missing")
+	}
+	// Fixed Gin routes still win over the table.
+	if res, body := s.do(t, http.MethodGet, "/health", nil); res.StatusCode != 200 || !strings.Contains(body, "healthy") {
+		t.Errorf("GET /health = %d %s", res.StatusCode, body)
+	}
+}
+
+func TestRouteTableMiddleware(t *testing.T) {
+	s := newTableServer(t, `{"routes": [
+		{"prefix": "/private", "static": {"body": "secret"},
+		 "auth": {"tokens": ["t0ken"]},
+		 "rate_limit": {"rps": 0.001, "burst": 2},
+		 "cors": {"allow_origins": ["https://app.example.com"], "max_age": 600}}
+	]}`, nil)
+	origin := http.Header{"Origin": {"https://app.example.com"}}
+
+	res, _ := s.do(t, http.MethodGet, "/private", origin)
+	if res.StatusCode != http.StatusUnauthorized || res.Header.Get("Access-Control-Allow-Origin") != "https://app.example.com" {
+		t.Errorf("no token: %d, ACAO %q; want 401 with CORS headers", res.StatusCode, res.Header.Get("Access-Control-Allow-Origin"))
+	}
+
+	res, _ = s.do(t, http.MethodOptions, "/private", http.Header{
+		"Origin":                         {"https://app.example.com"},
+		"Access-Control-Request-Method":  {"GET"},
+		"Access-Control-Request-Headers": {"Authorization"},
+	})
+	if res.StatusCode != http.StatusNoContent || res.Header.Get("Access-Control-Allow-Headers") != "Authorization" || res.Header.Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("preflight = %d %v", res.StatusCode, res.Header)
+	}
+	res, _ = s.do(t, http.MethodOptions, "/private", http.Header{
+		"Origin":                        {"https://evil.example.com"},
+		"Access-Control-Request-Method": {"GET"},
+	})
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("preflight from other origin = %d, want 403", res.StatusCode)
+	}
+
+	authed := http.Header{"Authorization": {"Bearer t0ken"}}
+	for i := 0; i < 2; i++ {
+		if res, body := s.do(t, http.MethodGet, "/private", authed); res.StatusCode != 200 || body != "secret" {
+			t.Fatalf("call %d = %d %s", i, res.StatusCode, body)
+		}
+	}
+	res, _ = s.do(t, http.MethodGet, "/private", authed)
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") == "" {
+		t.Errorf("over the limit = %d, Retry-After %q; want 429", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+}
+
+func TestRouteTableReloadKeepsRateLimits(t *testing.T) {
+	table := func(other string, burst int) string {
+		return fmt.Sprintf(`{"routes": [
+			{"prefix": "/limited", "static": {"body": "ok"}, "rate_limit": {"rps": 0.001, "burst": %d}},
+			{"prefix": "/other", "static": {"body": %q}}
+		]}`, burst, other)
+	}
+	s := newTableServer(t, table("a", 1), nil)
+	status := func() int {
+		res, _ := s.do(t, http.MethodGet, "/limited", nil)
+		return res.StatusCode
+	}
+	if got := status(); got != http.StatusOK {
+		t.Fatalf("first call = %d", got)
+	}
+
+	// Editing another route leaves the spent bucket as it was.
+	s.write(t, table("b", 1))
+	if err := s.table.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got := status(); got != http.StatusTooManyRequests {
+		t.Errorf("after an unrelated edit = %d, want 429", got)
+	}
+
+	// Changing the route's own limit starts a new bucket.
+	s.write(t, table("b", 2))
+	if err := s.table.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got := status(); got != http.StatusOK {
+		t.Errorf("after changing the limit = %d, want 200", got)
+	}
+}
+
+func TestRouteTableReloadKeepsInFlightRequests(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		io.WriteString(w, "slow done")
+	})
+	s := newTableServer(t, `{"routes": [{"prefix": "/slow", "mux": "slow"}]}`, map[string]http.Handler{"slow": slow})
+
+	done := make(chan string)
+	go func() {
+		res, err := http.Get(s.http.URL + "/slow")
+		if err != nil {
+			done <- err.Error()
+			return
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		done <- string(b)
+	}()
+	<-started
+
+	// A broken table is rejected and the old one stays.
+	s.write(t, `{"routes": [{"prefix": "/x", "mux": "missing"}]}`)
+	if err := s.table.reload(); err == nil {
+		t.Error("reload accepted a route to an unknown mux")
+	}
+
+	s.write(t, `{"routes": [{"prefix": "/new", "static": {"body": "new"}}]}`)
+	if err := s.table.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if res, body := s.do(t, http.MethodGet, "/new", nil); res.StatusCode != 200 || body != "new" {
+		t.Errorf("GET /new after reload = %d %s", res.StatusCode, body)
+	}
+	if res, _ := s.do(t, http.MethodGet, "/slow", nil); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET /slow after reload = %d, want 404", res.StatusCode)
+	}
+
+	close(release)
+	select {
+	case body := <-done:
+		if body != "slow done" {
+			t.Errorf("in-flight request got %q", body)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("in-flight request never finished")
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "api/user"
+)
+
+// routedGateway serves the Gin router in front of a clusterRouter with a
+// stable and a canary cluster of one instance each.
+type routedGateway struct {
+	stable, canary *userInstance
+	routes         *clusterRouter
+	client         pb.UserServiceClient
+	http           *httptest.Server
+	path           string
+}
+
+func writeRoutes(t *testing.T, path, rules string, g *routedGateway) {
+	t.Helper()
+	data := fmt.Sprintf(`{
+  "clusters": {"stable": {"addrs": [%q]}, "canary": {"addrs": [%q]}},
+  "rules": [%s],
+  "default": "stable"
+}`, g.stable.addr, g.canary.addr, rules)
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newRoutedGateway serves the route rules. With viaGRPCPort, REST calls reach
+// the clusters through the gateway's gRPC server, as :8081 callers do.
+func newRoutedGateway(t *testing.T, viaGRPCPort bool, rules string) *routedGateway {
+	t.Helper()
+	instances := startInstances(t, 2)
+	g := &routedGateway{stable: instances[0], canary: instances[1], path: filepath.Join(t.TempDir(), "routes.json")}
+	writeRoutes(t, g.path, rules, g)
+
+	routes, err := newClusterRouter(g.path, 10*time.Millisecond, nil)
+	if err != nil {
+		t.Fatalf("newClusterRouter: %v", err)
+	}
+	g.routes = routes
+	g.client = pb.NewUserServiceClient(routes)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var muxConn grpc.ClientConnInterface = routes
+	if viaGRPCPort {
+		lis := bufconn.Listen(1 << 20)
+		go startGRPCServer(ctx, g.client, nil, nil, lis)
+		conn := dialBufconn(t, lis)
+		t.Cleanup(func() { conn.Close() })
+		muxConn = conn
+	}
+	gwMux, err := newGatewayMux(ctx, muxConn, g.client, runtime.WithIncomingHeaderMatcher(routes.headerMatcher))
+	if err != nil {
+		t.Fatalf("newGatewayMux: %v", err)
+	}
+	g.http = httptest.NewServer(newTestRouter(t, ctx, map[string]http.Handler{"user": gwMux}, g.client))
+	t.Cleanup(func() {
+		g.http.Close()
+		cancel()
+		routes.Close()
+	})
+	return g
+}
+
+func (g *routedGateway) get(t *testing.T, header http.Header) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, g.http.URL+"/api/user/123", nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := g.http.Client().Do(req)
+	if err != nil {
+		t.Fatalf("GET /api/user/123: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("GET /api/user/123 = %d", res.StatusCode)
+	}
+}
+
+// served reports which instance handled fn's calls.
+func (g *routedGateway) served(t *testing.T, fn func()) string {
+	t.Helper()
+	s, c := g.stable.calls.Load(), g.canary.calls.Load()
+	fn()
+	switch {
+	case g.stable.calls.Load() > s && g.canary.calls.Load() == c:
+		return "stable"
+	case g.canary.calls.Load() > c && g.stable.calls.Load() == s:
+		return "canary"
+	}
+	return "both"
+}
+
+func unsignedJWT(claims string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"none"}`)) + "." + enc([]byte(claims)) + ".sig"
+}
+
+const canaryRules = `
+    {"header": {"name": "X-Canary", "value": "true"}, "cluster": "canary"},
+    {"claim": {"name": "beta", "value": "true"}, "cluster": "canary"}`
+
+func TestRoutingHeaderAndClaimRules(t *testing.T) {
+	for name, viaGRPCPort := range map[string]bool{"rest": false, "grpc port": true} {
+		t.Run(name, func(t *testing.T) {
+			g := newRoutedGateway(t, viaGRPCPort, canaryRules)
+			cases := []struct {
+				name   string
+				header http.Header
+				want   string
+			}{
+				{"no match", nil, "stable"},
+				{"header", http.Header{"X-Canary": {"true"}}, "canary"},
+				{"other header value", http.Header{"X-Canary": {"false"}}, "stable"},
+				{"claim", http.Header{"Authorization": {"Bearer " + unsignedJWT(`{"sub":"1","beta":true}`)}}, "canary"},
+				{"claim absent", http.Header{"Authorization": {"Bearer " + unsignedJWT(`{"sub":"1"}`)}}, "stable"},
+			}
+			for _, tc := range cases {
+				if got := g.served(t, func() { g.get(t, tc.header) }); got != tc.want {
+					t.Errorf("%s: served by %s, want %s", tc.name, got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRoutingGRPCMetadata(t *testing.T) {
+	g := newRoutedGateway(t, false, canaryRules)
+	ctx := metadata.AppendToOutgoingContext(testContext(t), "x-canary", "true")
+	got := g.served(t, func() {
+		if _, err := g.client.GetUser(ctx, &pb.GetUserRequest{UserId: "123"}); err != nil {
+			t.Fatalf("GetUser: %v", err)
+		}
+	})
+	if got != "canary" {
+		t.Errorf("served by %s, want canary", got)
+	}
+}
+
+func TestRoutingWeightsAndReload(t *testing.T) {
+	g := newRoutedGateway(t, false, `{"weights": {"stable": 0, "canary": 1}}`)
+	ctx := testContext(t)
+	call := func() {
+		if _, err := g.client.GetUser(ctx, &pb.GetUserRequest{UserId: "123"}); err != nil {
+			t.Fatalf("GetUser: %v", err)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if got := g.served(t, call); got != "canary" {
+			t.Fatalf("call %d served by %s with all weight on canary", i, got)
+		}
+	}
+
+	// A broken file keeps the previous rules.
+	if err := os.WriteFile(g.path, []byte(`{"clusters":`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.routes.reload(); err == nil {
+		t.Error("reload accepted invalid JSON")
+	}
+	if got := g.served(t, call); got != "canary" {
+		t.Errorf("after bad reload served by %s, want canary", got)
+	}
+
+	writeRoutes(t, g.path, `{"weights": {"stable": 1, "canary": 0}}`, g)
+	callUntil(t, g.client, "the new weights apply", func() bool {
+		return g.served(t, call) == "stable"
+	})
+
+	stats := expvar.Get("upstream_clusters").String()
+	for _, want := range []string{`"canary": {"errors": `, `"stable": {"errors": `} {
+		if !strings.Contains(stats, want) {
+			t.Errorf("upstream_clusters = %s, missing %s", stats, want)
+		}
+	}
+}
+
+func TestRoutesConfigValidate(t *testing.T) {
+	for _, data := range []string{
+		`{"clusters": {}, "default": "a"}`,
+		`{"clusters": {"a": {"addrs": ["x:1"]}}, "default": "b"}`,
+		`{"clusters": {"a": {"addrs": []}}, "default": "a"}`,
+		`{"clusters": {"a": {"addrs": ["x:1"]}}, "rules": [{"cluster": "a"}], "default": "a"}`,
+		`{"clusters": {"a": {"addrs": ["x:1"]}}, "rules": [{"header": {"name": "h"}, "cluster": "b"}], "default": "a"}`,
+		`{"clusters": {"a": {"addrs": ["x:1"]}}, "rules": [{"weights": {"a": 0}}], "default": "a"}`,
+	} {
+		path := filepath.Join(t.TempDir(), "routes.json")
+		os.WriteFile(path, []byte(data), 0o644)
+		if _, err := newClusterRouter(path, time.Hour, nil); err == nil {
+			t.Errorf("accepted %s", data)
+		}
+	}
+}
+
+// TestRoutingCopyIsCurrent keeps the plain Gin gateway's routing.go in step
+// with this one, the canonical copy.
+func TestRoutingCopyIsCurrent(t *testing.T) {
+	canonical, err := os.ReadFile("routing.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := os.ReadFile("../../../1_gin_grpc_gateway/grpc-architecture/gateway/routing.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(canonical, copied) {
+		t.Error("1_gin_grpc_gateway's routing.go differs; copy this one over it")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"math/rand/v2"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	pb "api/user"
+)
+
+// shadowStats counts mirrored calls, served at /debug/vars under "shadow":
+// sent, matched, diffs, errors (the shadow was unreachable or timed out) and
+// dropped (too many shadow calls already in flight).
+var shadowStats = expvar.NewMap("shadow")
+
+// shadowJSON renders messages on one line for the diff log.
+var shadowJSON = protojson.MarshalOptions{}
+
+// shadowReads are the methods mirrored by default. Writes would change state
+// on the shadow and are only mirrored when asked for.
+var (
+	shadowReads  = []string{pb.UserService_GetUser_FullMethodName, pb.UserService_ListUsers_FullMethodName}
+	shadowWrites = []string{
+		pb.UserService_CreateUser_FullMethodName,
+		pb.UserService_UpdateUser_FullMethodName,
+		pb.UserService_DeleteUser_FullMethodName,
+	}
+)
+
+// shadower duplicates a sample of unary calls to a secondary user-service and
+// compares its answers with the primary's. The caller only ever sees the
+// primary response; the shadow call runs in the background on its own
+// deadline.
+type shadower struct {
+	conn    grpc.ClientConnInterface
+	percent float64
+	methods map[string]bool
+	timeout time.Duration
+	// inflight bounds concurrent shadow calls so a slow shadow cannot pile
+	// up goroutines; calls over the limit are dropped.
+	inflight chan struct{}
+}
+
+func newShadower(conn grpc.ClientConnInterface, percent float64, writes bool) *shadower {
+	s := &shadower{
+		conn:     conn,
+		percent:  percent,
+		methods:  make(map[string]bool),
+		timeout:  5 * time.Second,
+		inflight: make(chan struct{}, 64),
+	}
+	for _, m := range shadowReads {
+		s.methods[m] = true
+	}
+	if writes {
+		for _, m := range shadowWrites {
+			s.methods[m] = true
+		}
+	}
+	for _, key := range []string{"sent", "matched", "diffs", "errors", "dropped"} {
+		shadowStats.Add(key, 0)
+	}
+	return s
+}
+
+// unaryInterceptor mirrors sampled calls after the primary call returns.
+// Calls whose messages are not protos, as with a custom codec, cannot be
+// copied or compared and are not mirrored.
+func (s *shadower) unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	if !s.methods[method] || rand.Float64()*100 >= s.percent {
+		return err
+	}
+	reqMsg, ok := req.(proto.Message)
+	if !ok {
+		return err
+	}
+	replyMsg, ok := reply.(proto.Message)
+	if !ok {
+		return err
+	}
+	s.mirror(ctx, method, reqMsg, replyMsg, err)
+	return err
+}
+
+func (s *shadower) mirror(ctx context.Context, method string, req, reply proto.Message, primaryErr error) {
+	select {
+	case s.inflight <- struct{}{}:
+	default:
+		shadowStats.Add("dropped", 1)
+		return
+	}
+	// Copy what the goroutine needs; the caller owns req and reply.
+	req = proto.Clone(req)
+	var want proto.Message
+	if primaryErr == nil {
+		want = proto.Clone(reply)
+	}
+	md, _ := metadata.FromOutgoingContext(ctx)
+	shadowCtx, cancel := context.WithTimeout(metadata.NewOutgoingContext(context.Background(), md.Copy()), s.timeout)
+
+	go func() {
+		defer func() { <-s.inflight }()
+		defer cancel()
+		shadowStats.Add("sent", 1)
+		got := reply.ProtoReflect().New().Interface()
+		err := s.conn.Invoke(shadowCtx, method, req, got)
+		if code := status.Code(err); (code == codes.Unavailable || code == codes.DeadlineExceeded) && code != status.Code(primaryErr) {
+			shadowStats.Add("errors", 1)
+			asyncLogf("[Shadow] %s failed: %v", method, err)
+			return
+		}
+		if diff := shadowDiff(want, primaryErr, got, err); diff != "" {
+			shadowStats.Add("diffs", 1)
+			asyncLogf("[Shadow] %s differs | Request: %s | %s", method, shadowJSON.Format(req), diff)
+			return
+		}
+		shadowStats.Add("matched", 1)
+	}()
+}
+
+// shadowDiff describes how the shadow's result differs from the primary's,
+// or returns "" when they agree. Errors agree when their codes do.
+func shadowDiff(want proto.Message, wantErr error, got proto.Message, gotErr error) string {
+	switch {
+	case wantErr != nil || gotErr != nil:
+		if status.Code(wantErr) == status.Code(gotErr) {
+			return ""
+		}
+		return "Primary: " + shadowResult(want, wantErr) + " | Shadow: " + shadowResult(got, gotErr)
+	case !proto.Equal(want, got):
+		return "Primary: " + shadowJSON.Format(want) + " | Shadow: " + shadowJSON.Format(got)
+	}
+	return ""
+}
+
+func shadowResult(m proto.Message, err error) string {
+	if err != nil {
+		return status.Code(err).String() + " " + status.Convert(err).Message()
+	}
+	return shadowJSON.Format(m)
+}
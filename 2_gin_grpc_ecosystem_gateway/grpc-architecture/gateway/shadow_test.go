@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+
+	pb "api/user"
+)
+
+// shadowBackend answers GetUser with its own name and counts calls per method.
+type shadowBackend struct {
+	pb.UnimplementedUserServiceServer
+	name string
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (b *shadowBackend) count(method string) {
+	b.mu.Lock()
+	b.calls[method]++
+	b.mu.Unlock()
+}
+
+func (b *shadowBackend) callCount(method string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls[method]
+}
+
+func (b *shadowBackend) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	b.count("GetUser")
+	return &pb.GetUserResponse{Id: req.UserId, Name: b.name}, nil
+}
+
+func (b *shadowBackend) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	b.count("ListUsers")
+	return &pb.ListUsersResponse{Users: []*pb.User{{Id: "1", Name: "same"}}}, nil
+}
+
+func (b *shadowBackend) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
+	b.count("CreateUser")
+	return &pb.CreateUserResponse{Id: "2", Name: req.Name}, nil
+}
+
+func startShadowBackend(t *testing.T, name string) (*shadowBackend, *bufconn.Listener) {
+	t.Helper()
+	b := &shadowBackend{name: name, calls: make(map[string]int)}
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterUserServiceServer(srv, b)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	return b, lis
+}
+
+// shadowedClient dials primary through a shadower that mirrors to shadow.
+func shadowedClient(t *testing.T, percent float64, writes bool) (primary, shadow *shadowBackend, client pb.UserServiceClient) {
+	t.Helper()
+	primary, primaryLis := startShadowBackend(t, "primary")
+	shadow, shadowLis := startShadowBackend(t, "shadow")
+	s := newShadower(dialBufconn(t, shadowLis), percent, writes)
+
+	conn, err := newInProcessConn(primaryLis, grpc.WithChainUnaryInterceptor(s.unaryInterceptor))
+	if err != nil {
+		t.Fatalf("dial bufconn: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return primary, shadow, pb.NewUserServiceClient(conn)
+}
+
+func TestShadowReadsAreMirroredAndCompared(t *testing.T) {
+	primary, shadow, client := shadowedClient(t, 100, false)
+	ctx := testContext(t)
+	diffs, matched := statCount(shadowStats, "diffs"), statCount(shadowStats, "matched")
+
+	got, err := client.GetUser(ctx, &pb.GetUserRequest{UserId: "1"})
+	if err != nil || got.Name != "primary" {
+		t.Fatalf("GetUser = %v, %v; want the primary's answer", got, err)
+	}
+	waitUntil(t, "the GetUser diff is counted", func() bool { return statCount(shadowStats, "diffs") == diffs+1 })
+
+	if _, err := client.ListUsers(ctx, &pb.ListUsersRequest{}); err != nil {
+		t.Fatalf("ListUsers: %v", err)
+	}
+	waitUntil(t, "the ListUsers match is counted", func() bool { return statCount(shadowStats, "matched") == matched+1 })
+
+	if _, err := client.CreateUser(ctx, &pb.CreateUserRequest{Name: "Alice"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if n := primary.callCount("CreateUser"); n != 1 {
+		t.Errorf("primary CreateUser calls = %d, want 1", n)
+	}
+	// Give a mirrored write time to arrive before checking none did.
+	time.Sleep(50 * time.Millisecond)
+	if n := shadow.callCount("CreateUser"); n != 0 {
+		t.Errorf("shadow got %d CreateUser calls with writes excluded", n)
+	}
+}
+
+func TestShadowWritesAndSampling(t *testing.T) {
+	_, shadow, client := shadowedClient(t, 100, true)
+	ctx := testContext(t)
+	if _, err := client.CreateUser(ctx, &pb.CreateUserRequest{Name: "Alice"}); err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	waitUntil(t, "the write is mirrored", func() bool { return shadow.callCount("CreateUser") == 1 })
+
+	_, shadow, client = shadowedClient(t, 0, false)
+	for i := 0; i < 20; i++ {
+		if _, err := client.GetUser(ctx, &pb.GetUserRequest{UserId: "1"}); err != nil {
+			t.Fatalf("GetUser: %v", err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := shadow.callCount("GetUser"); n != 0 {
+		t.Errorf("shadow got %d GetUser calls at 0%%", n)
+	}
+}
+
+func TestShadowSkipsNonProtoMessages(t *testing.T) {
+	s := newShadower(nil, 100, true)
+	sent := statCount(shadowStats, "sent")
+	invoked := false
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		invoked = true
+		return nil
+	}
+	var reply []byte
+	if err := s.unaryInterceptor(testContext(t), pb.UserService_GetUser_FullMethodName, []byte("raw"), &reply, nil, invoker); err != nil || !invoked {
+		t.Fatalf("unaryInterceptor = %v, invoked %v; want the primary call made", err, invoked)
+	}
+	if n := statCount(shadowStats, "sent") - sent; n != 0 {
+		t.Errorf("%d non-proto calls mirrored", n)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/grpc-ecosystem/grpc-gateway/v2/utilities"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+
+	pb "api/user"
+)
+
+// newTranscodingMux builds the grpc-gateway mux from the google.api.http
+// rules in files instead of the generated user.pb.gw.go, so RPCs added to the
+// protos become REST-callable without regenerating the gateway. Requests and
+// replies are dynamic messages sent over conn; path variables, query
+// parameters, bodies, errors and marshalling behave as in generated handlers.
+// Hand-written routes use client, as in newGatewayMux.
+func newTranscodingMux(conn grpc.ClientConnInterface, files *protoregistry.Files, client pb.UserServiceClient, opts ...runtime.ServeMuxOption) (*runtime.ServeMux, error) {
+	mux := runtime.NewServeMux(opts...)
+	var rules []*transcodeRule
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		for i := 0; i < fd.Services().Len(); i++ {
+			sd := fd.Services().Get(i)
+			for j := 0; j < sd.Methods().Len(); j++ {
+				rules = append(rules, methodRules(mux, conn, sd.Methods().Get(j))...)
+			}
+		}
+		return true
+	})
+	for _, t := range rules {
+		if err := mux.HandlePath(t.verb, t.pattern, t.serveHTTP); err != nil {
+			return nil, fmt.Errorf("registering %s %s for %s: %w", t.verb, t.pattern, t.fullMethod, err)
+		}
+		asyncLogf("[Transcoder] %s %s -> %s", t.verb, t.pattern, t.fullMethod)
+	}
+	if err := mux.HandlePath(http.MethodGet, "/users:export", exportUsersHandler(client)); err != nil {
+		return nil, fmt.Errorf("registering export handler: %w", err)
+	}
+	return mux, nil
+}
+
+// transcodeRule serves one HTTP binding of a method.
+type transcodeRule struct {
+	mux        *runtime.ServeMux
+	conn       grpc.ClientConnInterface
+	method     protoreflect.MethodDescriptor
+	fullMethod string
+	verb       string
+	pattern    string
+	// body and responseBody are the HttpRule fields of the same names.
+	body         string
+	responseBody string
+}
+
+// methodRules returns a rule for each binding of md's google.api.http option,
+// additional bindings included. Bidirectional streams are not transcoded.
+func methodRules(mux *runtime.ServeMux, conn grpc.ClientConnInterface, md protoreflect.MethodDescriptor) []*transcodeRule {
+	rule, ok := proto.GetExtension(md.Options(), annotations.E_Http).(*annotations.HttpRule)
+	if !ok || rule == nil {
+		return nil
+	}
+	fullMethod := "/" + string(md.Parent().FullName()) + "/" + string(md.Name())
+	if md.IsStreamingClient() && md.IsStreamingServer() {
+		asyncLogf("[Transcoder] Skipping bidirectional stream %s", fullMethod)
+		return nil
+	}
+	var rules []*transcodeRule
+	for _, b := range append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+		verb, pattern := httpRulePattern(b)
+		if pattern == "" {
+			continue
+		}
+		rules = append(rules, &transcodeRule{
+			mux:          mux,
+			conn:         conn,
+			method:       md,
+			fullMethod:   fullMethod,
+			verb:         verb,
+			pattern:      pattern,
+			body:         b.GetBody(),
+			responseBody: b.GetResponseBody(),
+		})
+	}
+	return rules
+}
+
+func httpRulePattern(r *annotations.HttpRule) (verb, pattern string) {
+	switch p := r.GetPattern().(type) {
+	case *annotations.HttpRule_Get:
+		return http.MethodGet, p.Get
+	case *annotations.HttpRule_Put:
+		return http.MethodPut, p.Put
+	case *annotations.HttpRule_Post:
+		return http.MethodPost, p.Post
+	case *annotations.HttpRule_Delete:
+		return http.MethodDelete, p.Delete
+	case *annotations.HttpRule_Patch:
+		return http.MethodPatch, p.Patch
+	case *annotations.HttpRule_Custom:
+		return p.Custom.GetKind(), p.Custom.GetPath()
+	}
+	return "", ""
+}
+
+func (t *transcodeRule) serveHTTP(w http.ResponseWriter, req *http.Request, pathParams map[string]string) {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	inboundMarshaler, outboundMarshaler := runtime.MarshalerForRequest(t.mux, req)
+	annotatedContext, err := runtime.AnnotateContext(ctx, t.mux, req, t.fullMethod, runtime.WithHTTPPathPattern(t.pattern))
+	if err != nil {
+		runtime.HTTPError(ctx, t.mux, outboundMarshaler, w, req, err)
+		return
+	}
+
+	if t.method.IsStreamingServer() {
+		stream, md, err := t.openStream(annotatedContext, inboundMarshaler, req, pathParams)
+		annotatedContext = runtime.NewServerMetadataContext(annotatedContext, md)
+		if err != nil {
+			runtime.HTTPError(annotatedContext, t.mux, outboundMarshaler, w, req, err)
+			return
+		}
+		runtime.ForwardResponseStream(annotatedContext, t.mux, outboundMarshaler, w, req, func() (proto.Message, error) {
+			out := dynamicpb.NewMessage(t.method.Output())
+			if err := stream.RecvMsg(out); err != nil {
+				return nil, err
+			}
+			return t.reply(out), nil
+		}, t.mux.GetForwardResponseOptions()...)
+		return
+	}
+
+	var resp proto.Message
+	var md runtime.ServerMetadata
+	if t.method.IsStreamingClient() {
+		resp, md, err = t.callClientStream(annotatedContext, inboundMarshaler, req)
+	} else {
+		resp, md, err = t.callUnary(annotatedContext, inboundMarshaler, req, pathParams)
+	}
+	annotatedContext = runtime.NewServerMetadataContext(annotatedContext, md)
+	if err != nil {
+		runtime.HTTPError(annotatedContext, t.mux, outboundMarshaler, w, req, err)
+		return
+	}
+	runtime.ForwardResponseMessage(annotatedContext, t.mux, outboundMarshaler, w, req, t.reply(resp), t.mux.GetForwardResponseOptions()...)
+}
+
+func (t *transcodeRule) callUnary(ctx context.Context, marshaler runtime.Marshaler, req *http.Request, pathParams map[string]string) (proto.Message, runtime.ServerMetadata, error) {
+	var metadata runtime.ServerMetadata
+	in, err := t.request(marshaler, req, pathParams)
+	if err != nil {
+		return nil, metadata, err
+	}
+	out := dynamicpb.NewMessage(t.method.Output())
+	err = t.conn.Invoke(ctx, t.fullMethod, in, out, grpc.Header(&metadata.HeaderMD), grpc.Trailer(&metadata.TrailerMD))
+	return out, metadata, err
+}
+
+func (t *transcodeRule) openStream(ctx context.Context, marshaler runtime.Marshaler, req *http.Request, pathParams map[string]string) (grpc.ClientStream, runtime.ServerMetadata, error) {
+	var metadata runtime.ServerMetadata
+	in, err := t.request(marshaler, req, pathParams)
+	if err != nil {
+		return nil, metadata, err
+	}
+	stream, err := t.conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true}, t.fullMethod)
+	if err != nil {
+		return nil, metadata, err
+	}
+	if err := stream.SendMsg(in); err != nil {
+		return nil, metadata, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, metadata, err
+	}
+	header, err := stream.Header()
+	if err != nil {
+		return nil, metadata, err
+	}
+	metadata.HeaderMD = header
+	return stream, metadata, nil
+}
+
+// callClientStream sends each request object decoded from the body, as the
+// generated handlers do for newline-delimited JSON.
+func (t *transcodeRule) callClientStream(ctx context.Context, marshaler runtime.Marshaler, req *http.Request) (proto.Message, runtime.ServerMetadata, error) {
+	var metadata runtime.ServerMetadata
+	stream, err := t.conn.NewStream(ctx, &grpc.StreamDesc{ClientStreams: true}, t.fullMethod)
+	if err != nil {
+		return nil, metadata, err
+	}
+	dec := marshaler.NewDecoder(req.Body)
+	for {
+		in := dynamicpb.NewMessage(t.method.Input())
+		err = dec.Decode(in)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, metadata, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		if err = stream.SendMsg(in); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, metadata, err
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, metadata, err
+	}
+	header, err := stream.Header()
+	if err != nil {
+		return nil, metadata, err
+	}
+	metadata.HeaderMD = header
+	out := dynamicpb.NewMessage(t.method.Output())
+	err = stream.RecvMsg(out)
+	metadata.TrailerMD = stream.Trailer()
+	return out, metadata, err
+}
+
+// request builds the method's input from the body, the path variables and,
+// unless the whole body maps onto the request, the query string.
+func (t *transcodeRule) request(marshaler runtime.Marshaler, req *http.Request, pathParams map[string]string) (proto.Message, error) {
+	in := dynamicpb.NewMessage(t.method.Input())
+	bound := [][]string{}
+	switch t.body {
+	case "":
+		io.Copy(io.Discard, req.Body)
+	case "*":
+		if err := marshaler.NewDecoder(req.Body).Decode(in); err != nil && !errors.Is(err, io.EOF) {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	default:
+		// The body is a single top-level field.
+		fd := in.Descriptor().Fields().ByName(protoreflect.Name(t.body))
+		if fd == nil {
+			return nil, status.Errorf(codes.Internal, "%s has no body field %q", in.Descriptor().FullName(), t.body)
+		}
+		raw, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		if len(raw) > 0 {
+			wrapped := append(append([]byte(`{"`+fd.JSONName()+`":`), raw...), '}')
+			if err := marshaler.Unmarshal(wrapped, in); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+			}
+		}
+		bound = append(bound, []string{t.body})
+	}
+
+	for name, val := range pathParams {
+		if err := runtime.PopulateFieldFromPath(in, name, val); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "type mismatch, parameter: %s, error: %v", name, err)
+		}
+		bound = append(bound, strings.Split(name, "."))
+	}
+
+	if t.body != "*" {
+		if err := req.ParseForm(); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		if err := runtime.PopulateQueryParameters(in, req.Form, utilities.NewDoubleArray(bound)); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+	return in, nil
+}
+
+// reply narrows out to its response_body field when the rule names one.
+func (t *transcodeRule) reply(out proto.Message) proto.Message {
+	if t.responseBody == "" {
+		return out
+	}
+	return responseBodyMessage{Message: out, field: t.responseBody}
+}
+
+// responseBodyMessage makes ForwardResponseMessage and ForwardResponseStream
+// write a single field, like the wrappers generated for response_body.
+type responseBodyMessage struct {
+	proto.Message
+	field string
+}
+
+func (m responseBodyMessage) XXX_ResponseBody() interface{} {
+	msg := m.ProtoReflect()
+	fd := msg.Descriptor().Fields().ByName(protoreflect.Name(m.field))
+	if fd == nil {
+		return nil
+	}
+	v := msg.Get(fd)
+	switch {
+	case fd.IsList():
+		list := v.List()
+		items := make([]interface{}, list.Len())
+		for i := range items {
+			items[i] = fieldValue(fd, list.Get(i))
+		}
+		return items
+	case fd.IsMap():
+		items := make(map[string]interface{})
+		v.Map().Range(func(k protoreflect.MapKey, v protoreflect.Value) bool {
+			items[k.String()] = fieldValue(fd.MapValue(), v)
+			return true
+		})
+		return items
+	}
+	return fieldValue(fd, v)
+}
+
+func fieldValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+	if fd.Kind() == protoreflect.MessageKind || fd.Kind() == protoreflect.GroupKind {
+		return v.Message().Interface()
+	}
+	return v.Interface()
+}
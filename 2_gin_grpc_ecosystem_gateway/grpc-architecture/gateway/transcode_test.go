@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+
+	pb "api/user"
+)
+
+// writeDescriptorSet writes user.proto and its imports as protoc
+// --include_imports --descriptor_set_out would, after letting edit change
+// the user.proto descriptor.
+func writeDescriptorSet(t *testing.T, edit func(*descriptorpb.FileDescriptorProto)) string {
+	t.Helper()
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := map[string]bool{}
+	var add func(fd protoreflect.FileDescriptor)
+	add = func(fd protoreflect.FileDescriptor) {
+		if seen[fd.Path()] {
+			return
+		}
+		seen[fd.Path()] = true
+		for i := 0; i < fd.Imports().Len(); i++ {
+			add(fd.Imports().Get(i).FileDescriptor)
+		}
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(fd))
+	}
+	add(pb.File_user_user_proto)
+	edit(set.File[len(set.File)-1])
+
+	b, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "user.binpb")
+	if err := os.WriteFile(path, b, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func doTranscodeRequest(t *testing.T, url, method, body string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(method, url, strings.NewReader(body))
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	return res.StatusCode, string(b)
+}
+
+func TestTranscodingMatchesGeneratedHandlers(t *testing.T) {
+	// Each mux gets a user-service of its own, so both see the same users.
+	dynH, genH := newHarness(t, modeRemote), newHarness(t, modeRemote)
+	ctx := context.Background()
+	files, err := loadDescriptors(ctx, writeDescriptorSet(t, func(*descriptorpb.FileDescriptorProto) {}), nil)
+	if err != nil {
+		t.Fatalf("loadDescriptors: %v", err)
+	}
+	dynamic, err := newTranscodingMux(dynH.grpcConn, files, dynH.grpcClient)
+	if err != nil {
+		t.Fatalf("newTranscodingMux: %v", err)
+	}
+	generated, err := newGatewayMux(ctx, genH.grpcConn, genH.grpcClient)
+	if err != nil {
+		t.Fatalf("newGatewayMux: %v", err)
+	}
+	dynSrv, genSrv := httptest.NewServer(dynamic), httptest.NewServer(generated)
+	defer dynSrv.Close()
+	defer genSrv.Close()
+
+	for _, c := range []struct{ method, path, body string }{
+		{http.MethodGet, "/user/123", ""},
+		{http.MethodGet, "/user/999", ""},
+		{http.MethodPost, "/user", `{"name": "Alice", "email": "alice@example.com"}`},
+		{http.MethodPost, "/user", `{"name": `},
+		{http.MethodPatch, "/user/123", `{"name": "Bob"}`},
+		{http.MethodDelete, "/user/123", ""},
+		{http.MethodGet, "/users?page_size=2&name_contains=jo", ""},
+		{http.MethodGet, "/users?page_size=many", ""},
+		{http.MethodPost, "/users:batchCreate", "{\"user\": {\"name\": \"A\"}}\n{\"user\": {\"name\": \"B\"}}\n"},
+		{http.MethodGet, "/nowhere", ""},
+	} {
+		wantCode, want := doTranscodeRequest(t, genSrv.URL+c.path, c.method, c.body)
+		gotCode, got := doTranscodeRequest(t, dynSrv.URL+c.path, c.method, c.body)
+		if gotCode != wantCode || got != want {
+			t.Errorf("%s %s = %d %s\nwant %d %s", c.method, c.path, gotCode, got, wantCode, want)
+		}
+	}
+}
+
+func TestTranscodingNewRules(t *testing.T) {
+	h := newHarness(t, modeRemote)
+	// A binding that exists only in the descriptor set, never generated.
+	path := writeDescriptorSet(t, func(fd *descriptorpb.FileDescriptorProto) {
+		for _, m := range fd.Service[0].Method {
+			if m.GetName() == "GetUser" {
+				rule := proto.GetExtension(m.Options, annotations.E_Http).(*annotations.HttpRule)
+				rule.AdditionalBindings = []*annotations.HttpRule{{
+					Pattern:      &annotations.HttpRule_Get{Get: "/people/{user_id}/name"},
+					ResponseBody: "name",
+				}}
+				proto.SetExtension(m.Options, annotations.E_Http, rule)
+			}
+		}
+	})
+	files, err := loadDescriptors(context.Background(), path, nil)
+	if err != nil {
+		t.Fatalf("loadDescriptors: %v", err)
+	}
+	mux, err := newTranscodingMux(h.grpcConn, files, h.grpcClient)
+	if err != nil {
+		t.Fatalf("newTranscodingMux: %v", err)
+	}
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	if code, body := doTranscodeRequest(t, s.URL+"/people/123/name", http.MethodGet, ""); code != http.StatusOK || body != `"John Doe"` {
+		t.Errorf("GET /people/123/name = %d %s", code, body)
+	}
+}
+
+func TestTranscodingFromReflection(t *testing.T) {
+	h := newHarness(t, modeRemote)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	files, err := loadDescriptors(ctx, "reflection", h.grpcConn)
+	if err != nil {
+		t.Fatalf("loadDescriptors: %v", err)
+	}
+	if _, err := files.FindDescriptorByName("user.UserService.GetUser"); err != nil {
+		t.Fatalf("reflection did not describe GetUser: %v", err)
+	}
+	mux, err := newTranscodingMux(h.grpcConn, files, h.grpcClient)
+	if err != nil {
+		t.Fatalf("newTranscodingMux: %v", err)
+	}
+	s := httptest.NewServer(mux)
+	defer s.Close()
+
+	code, body := doTranscodeRequest(t, s.URL+"/user/123", http.MethodGet, "")
+	if code != http.StatusOK || !strings.Contains(body, `"name":"John Doe"`) {
+		t.Errorf("GET /user/123 = %d %s", code, body)
+	}
+}
+
+func TestProxyServicesForReflection(t *testing.T) {
+	p, err := newGRPCProxy([]string{"/inventory.InventoryService/=localhost:1", "/user.UserService/Audit=localhost:1"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	p.addRoute("/order.OrderService/", nil)
+	got := strings.Join(p.services(), ",")
+	if got != "inventory.InventoryService,order.OrderService" {
+		t.Errorf("services = %s", got)
+	}
+	// Only services with compiled-in protos can be described.
+	info := reflectionServices{srv: grpc.NewServer(), proxied: p.services()}.GetServiceInfo()
+	if _, ok := info["order.OrderService"]; !ok || len(info) != 1 {
+		t.Errorf("service info = %v", info)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiVersion is one version of the REST API on the user mux.
+type apiVersion struct {
+	name string
+	// pathPrefix starts the version's paths in its google.api.http rules.
+	// v1's rules predate versioning and have none.
+	pathPrefix string
+	// deprecated and sunset, when set, are announced on every response in
+	// Deprecation (RFC 9745) and Sunset (RFC 8594) headers.
+	deprecated time.Time
+	sunset     time.Time
+}
+
+// userAPIVersions lists the versions of the user API, oldest first; the first
+// is served on paths without a version.
+func userAPIVersions(cfg config) []apiVersion {
+	return []apiVersion{
+		{name: "v1", deprecated: cfg.apiV1Deprecated, sunset: cfg.apiV1Sunset},
+		{name: "v2", pathPrefix: "/v2"},
+	}
+}
+
+// versionedAPI serves several versions of an API from next. The version comes
+// from the first path segment (/v1/user/123, /v2/users/123), else from an
+// Accept-Version header ("2" or "v2") on unversioned paths, else it is the
+// first of versions. The path is rewritten to the version's own rules before
+// next sees it, and API-Version names the version that answered.
+func versionedAPI(versions []apiVersion, next http.Handler) http.Handler {
+	byName := make(map[string]apiVersion, len(versions))
+	for _, v := range versions {
+		byName[v.name] = v
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := r.URL.Path
+		var v apiVersion
+		if seg, rest := splitVersion(path); seg != "" {
+			var ok bool
+			if v, ok = byName[seg]; !ok {
+				writeJSONError(w, http.StatusNotFound, "unknown API version "+seg)
+				return
+			}
+			if inner, _ := splitVersion(rest); inner != "" && v.pathPrefix == "" {
+				// /v1/v2/users must not reach v2.
+				writeJSONError(w, http.StatusNotFound, "no route for "+path)
+				return
+			}
+			path = v.pathPrefix + rest
+		} else {
+			w.Header().Add("Vary", "Accept-Version")
+			v = versions[0]
+			if h := r.Header.Get("Accept-Version"); h != "" {
+				name := "v" + strings.TrimPrefix(strings.TrimSpace(h), "v")
+				var ok bool
+				if v, ok = byName[name]; !ok {
+					writeJSONError(w, http.StatusBadRequest, "unsupported Accept-Version "+strconv.Quote(h))
+					return
+				}
+			}
+			path = v.pathPrefix + path
+		}
+
+		w.Header().Set("API-Version", v.name)
+		if !v.deprecated.IsZero() {
+			w.Header().Set("Deprecation", "@"+strconv.FormatInt(v.deprecated.Unix(), 10))
+		}
+		if !v.sunset.IsZero() {
+			w.Header().Set("Sunset", v.sunset.UTC().Format(http.TimeFormat))
+		}
+		if path != r.URL.Path {
+			r2 := r.Clone(r.Context())
+			r2.URL.Path, r2.URL.RawPath = path, ""
+			r = r2
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// splitVersion splits "/v2/users" into "v2" and "/users". It returns an empty
+// version for paths that do not start with v and a number.
+func splitVersion(path string) (version, rest string) {
+	seg, rest, _ := strings.Cut(strings.TrimPrefix(path, "/"), "/")
+	if len(seg) < 2 || seg[0] != 'v' {
+		return "", path
+	}
+	if _, err := strconv.Atoi(seg[1:]); err != nil {
+		return "", path
+	}
+	return seg, "/" + rest
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// testAPIVersions are the user API versions the harness serves.
+var testAPIVersions = userAPIVersions(config{
+	apiV1Deprecated: time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC),
+	apiV1Sunset:     time.Date(2027, 5, 1, 0, 0, 0, 0, time.UTC),
+})
+
+func TestAPIVersions(t *testing.T) {
+	forEachMode(t, func(t *testing.T, h *harness) {
+		v1 := `{"id":"123","name":"John Doe","email":"john@example.com"}`
+		v2 := `{"id":"123","displayName":"John Doe","email":"john@example.com"}`
+		for _, c := range []struct {
+			path, acceptVersion string
+			code                int
+			version, body       string
+		}{
+			{"/api/user/123", "", http.StatusOK, "v1", v1},
+			{"/api/v1/user/123", "", http.StatusOK, "v1", v1},
+			{"/api/v2/users/123", "", http.StatusOK, "v2", v2},
+			{"/api/users/123", "2", http.StatusOK, "v2", v2},
+			{"/api/users/123", "v2", http.StatusOK, "v2", v2},
+			{"/api/user/123", "v1", http.StatusOK, "v1", v1},
+			// The version in the path wins over the header.
+			{"/api/v1/user/123", "2", http.StatusOK, "v1", v1},
+			{"/api/v2/user/123", "", http.StatusNotFound, "v2", ""},
+			{"/api/v1/v2/users/123", "", http.StatusNotFound, "", `{"error":"no route for /v1/v2/users/123"}`},
+			{"/api/v3/users/123", "", http.StatusNotFound, "", `{"error":"unknown API version v3"}`},
+			{"/api/users/123", "7", http.StatusBadRequest, "", `{"error":"unsupported Accept-Version \"7\""}`},
+		} {
+			header := http.Header{}
+			if c.acceptVersion != "" {
+				header.Set("Accept-Version", c.acceptVersion)
+			}
+			res, body := h.do(t, http.MethodGet, c.path, "", header)
+			// protojson varies its spacing.
+			var compact bytes.Buffer
+			if json.Compact(&compact, []byte(body)) == nil {
+				body = compact.String()
+			}
+			if res.StatusCode != c.code || res.Header.Get("API-Version") != c.version || (c.body != "" && body != c.body) {
+				t.Errorf("GET %s (Accept-Version %q) = %d %s %s, want %d %s %s",
+					c.path, c.acceptVersion, res.StatusCode, res.Header.Get("API-Version"), body, c.code, c.version, c.body)
+			}
+		}
+	})
+}
+
+func TestAPIDeprecationHeaders(t *testing.T) {
+	h := newHarness(t, modeRemote)
+
+	res, _ := h.do(t, http.MethodGet, "/api/v1/user/123", "", nil)
+	if got := res.Header.Get("Deprecation"); got != "@1793491200" {
+		t.Errorf("v1 Deprecation = %q", got)
+	}
+	if got := res.Header.Get("Sunset"); got != "Sat, 01 May 2027 00:00:00 GMT" {
+		t.Errorf("v1 Sunset = %q", got)
+	}
+	// Errors from a deprecated version carry the headers too.
+	res, _ = h.do(t, http.MethodGet, "/api/user/999", "", nil)
+	if res.StatusCode != http.StatusNotFound || res.Header.Get("Sunset") == "" {
+		t.Errorf("v1 error = %d, Sunset %q", res.StatusCode, res.Header.Get("Sunset"))
+	}
+	if !slices.Contains(res.Header.Values("Vary"), "Accept-Version") {
+		t.Errorf("unversioned path Vary = %q", res.Header.Values("Vary"))
+	}
+
+	res, _ = h.do(t, http.MethodGet, "/api/v2/users/123", "", nil)
+	if res.Header.Get("Deprecation") != "" || res.Header.Get("Sunset") != "" {
+		t.Errorf("v2 is current but got Deprecation %q, Sunset %q", res.Header.Get("Deprecation"), res.Header.Get("Sunset"))
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "api/user"
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// watchContext derives a context for a long-lived watch that ends when either
+// the client goes away or the gateway starts shutting down. http.Server.Shutdown
+// does not cancel in-flight requests, so without this SSE and WebSocket
+// streams would hold shutdown open until its timeout.
+func watchContext(reqCtx context.Context, shutdown <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(reqCtx)
+	go func() {
+		select {
+		case <-shutdown:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// parseEventTypes reads ?type=created&type=deleted (or USER_CREATED) into a
+// WatchUsersRequest filter. Unknown names are ignored.
+func parseEventTypes(values []string) []pb.UserEventType {
+	var types []pb.UserEventType
+	for _, v := range values {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.ToUpper(strings.TrimSpace(name))
+			if !strings.HasPrefix(name, "USER_") {
+				name = "USER_" + name
+			}
+			if t, ok := pb.UserEventType_value[name]; ok {
+				types = append(types, pb.UserEventType(t))
+			}
+		}
+	}
+	return types
+}
+
+// sseEventName maps USER_CREATED to "created" etc.
+func sseEventName(t pb.UserEventType) string {
+	return strings.ToLower(strings.TrimPrefix(t.String(), "USER_"))
+}
+
+// watchUsersSSEHandler relays WatchUsers as Server-Sent Events, one event per
+// user change, named created/updated/deleted.
+func watchUsersSSEHandler(client pb.UserServiceClient, shutdown <-chan struct{}) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := watchContext(c.Request.Context(), shutdown)
+		defer cancel()
+
+		stream, err := client.WatchUsers(ctx, &pb.WatchUsersRequest{
+			Types: parseEventTypes(c.QueryArray("type")),
+		})
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+
+		c.Header("Cache-Control", "no-cache")
+		c.Header("X-Accel-Buffering", "no")
+		c.Stream(func(w io.Writer) bool {
+			ev, err := stream.Recv()
+			if err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					asyncLogf("[SSE] Watch stream ended: %v", err)
+				}
+				return false
+			}
+			data, err := protojson.Marshal(ev)
+			if err != nil {
+				asyncLogf("[SSE] Failed to marshal event: %v", err)
+				return false
+			}
+			c.SSEvent(sseEventName(ev.Type), string(data))
+			return true
+		})
+	}
+}
+
+// watchUsersWSHandler relays WatchUsers over a WebSocket, one JSON text
+// message per user change. Messages from the client are discarded; a close
+// frame or read error ends the watch.
+func watchUsersWSHandler(client pb.UserServiceClient, shutdown <-chan struct{}) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx, cancel := watchContext(c.Request.Context(), shutdown)
+		defer cancel()
+
+		stream, err := client.WatchUsers(ctx, &pb.WatchUsersRequest{
+			Types: parseEventTypes(c.QueryArray("type")),
+		})
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+
+		conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			// Upgrade has already written an HTTP error response.
+			asyncLogf("[WS] Upgrade failed: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		go func() {
+			defer cancel()
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		for {
+			ev, err := stream.Recv()
+			if err != nil {
+				if err != io.EOF && ctx.Err() == nil {
+					asyncLogf("[WS] Watch stream ended: %v", err)
+				}
+				conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+				return
+			}
+			data, err := protojson.Marshal(ev)
+			if err != nil {
+				asyncLogf("[WS] Failed to marshal event: %v", err)
+				return
+			}
+			if err := conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"google.golang.org/protobuf/encoding/protojson"
+
+	pb "api/user"
+)
+
+func TestParseEventTypes(t *testing.T) {
+	got := parseEventTypes([]string{"created, USER_DELETED", "bogus", "Updated"})
+	want := []pb.UserEventType{pb.UserEventType_USER_CREATED, pb.UserEventType_USER_DELETED, pb.UserEventType_USER_UPDATED}
+	if !slices.Equal(got, want) {
+		t.Errorf("parseEventTypes = %v, want %v", got, want)
+	}
+	if got := parseEventTypes(nil); got != nil {
+		t.Errorf("parseEventTypes(nil) = %v, want no filter", got)
+	}
+}
+
+func TestWatchUsersSSE(t *testing.T) {
+	forEachMode(t, func(t *testing.T, h *harness) {
+		req, err := http.NewRequestWithContext(testContext(t), http.MethodGet, h.http.URL+"/events/users?type=created", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The response headers only go out with the first event.
+		stop := h.keepCreatingUsers(t)
+		defer stop()
+		res, err := h.http.Client().Do(req)
+		if err != nil {
+			t.Fatalf("GET /events/users: %v", err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK || !strings.HasPrefix(res.Header.Get("Content-Type"), "text/event-stream") {
+			t.Fatalf("GET /events/users = %d %v", res.StatusCode, res.Header)
+		}
+
+		var event, data string
+		sc := bufio.NewScanner(res.Body)
+		for data == "" && sc.Scan() {
+			name, value, _ := strings.Cut(sc.Text(), ":")
+			switch name {
+			case "event":
+				event = value
+			case "data":
+				data = value
+			}
+		}
+		ev := &pb.UserEvent{}
+		if err := protojson.Unmarshal([]byte(data), ev); err != nil {
+			t.Fatalf("event %q data %q: %v (scan: %v)", event, data, err, sc.Err())
+		}
+		if event != "created" || ev.Type != pb.UserEventType_USER_CREATED || ev.User.GetName() != "Watched" {
+			t.Errorf("event %q = %v", event, ev)
+		}
+
+		// Shutting the gateway down ends the event stream.
+		h.shutdown(t)
+		for sc.Scan() {
+		}
+		if err := sc.Err(); err != nil {
+			t.Errorf("after shutdown: %v, want the stream to end", err)
+		}
+	})
+}
+
+func TestWatchUsersWebSocket(t *testing.T) {
+	h := newHarness(t, modeRemote)
+	conn, res, err := websocket.DefaultDialer.DialContext(testContext(t), "ws"+strings.TrimPrefix(h.http.URL, "http")+"/ws/users?type=created", nil)
+	if err != nil {
+		t.Fatalf("dial /ws/users: %v (%v)", err, res)
+	}
+	defer conn.Close()
+
+	stop := h.keepCreatingUsers(t)
+	_, msg, err := conn.ReadMessage()
+	stop()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	ev := &pb.UserEvent{}
+	if err := protojson.Unmarshal(msg, ev); err != nil || ev.Type != pb.UserEventType_USER_CREATED || ev.User.GetName() != "Watched" {
+		t.Errorf("message %s = %v, %v", msg, ev, err)
+	}
+
+	// Shutting the gateway down ends the watch with a going-away close.
+	h.shutdown(t)
+	for {
+		if _, _, err = conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("after shutdown: %v, want close 1001", err)
+	}
+}
@@ -0,0 +1,20 @@
+module order-service
+
+go 1.24.3
+
+require (
+	api v1.0.0
+	google.golang.org/grpc v1.72.0
+	google.golang.org/protobuf v1.36.5
+)
+
+require google.golang.org/genproto/googleapis/api v0.0.0-20250303144028-a0af3efb3deb // indirect
+
+require (
+	golang.org/x/net v0.35.0 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20250303144028-a0af3efb3deb // indirect
+)
+
+replace api => ../../../api
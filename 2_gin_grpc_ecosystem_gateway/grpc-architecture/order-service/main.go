@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	pb "api/order"
+	userpb "api/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	// Registering gzip lets callers send compressed requests, which are
+	// answered in kind.
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type orderServer struct {
+	pb.UnimplementedOrderServiceServer
+	store orderStore
+	// users is checked so orders can only be placed for existing users.
+	users userpb.UserServiceClient
+}
+
+var logCh = make(chan string, 10000)
+
+func init() {
+	go func() {
+		for msg := range logCh {
+			log.Print(msg)
+		}
+	}()
+}
+
+func asyncLog(v ...interface{}) {
+	msg := fmt.Sprintln(v...)
+	select {
+	case logCh <- msg:
+	default:
+		// Downgrade processing: immediate output (to avoid memory leaks)
+		log.Println(append([]interface{}{"!LOG_OVERFLOW!"}, v...)...)
+	}
+}
+
+func asyncLogf(format string, v ...interface{}) {
+	asyncLog(fmt.Sprintf(format, v...))
+}
+
+// validateNewOrder checks the fields required to place an order.
+func validateNewOrder(req *pb.CreateOrderRequest) error {
+	if strings.TrimSpace(req.UserId) == "" {
+		return errors.New("user_id is required")
+	}
+	if len(req.Items) == 0 {
+		return errors.New("an order needs at least one item")
+	}
+	for i, it := range req.Items {
+		switch {
+		case strings.TrimSpace(it.Sku) == "":
+			return fmt.Errorf("item %d: sku is required", i)
+		case it.Quantity <= 0:
+			return fmt.Errorf("item %d: quantity must be positive", i)
+		case it.UnitPriceCents < 0:
+			return fmt.Errorf("item %d: unit_price_cents must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// checkUser confirms the user exists in user-service. The caller's
+// authorization is passed along so user-service sees who is asking.
+func (s *orderServer) checkUser(ctx context.Context, id string) error {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if auth := md.Get("authorization"); len(auth) > 0 {
+			ctx = metadata.AppendToOutgoingContext(ctx, "authorization", auth[0])
+		}
+	}
+	_, err := s.users.GetUser(ctx, &userpb.GetUserRequest{UserId: id})
+	switch status.Code(err) {
+	case codes.OK:
+		return nil
+	case codes.NotFound:
+		return status.Errorf(codes.FailedPrecondition, "user %q does not exist", id)
+	case codes.Canceled, codes.DeadlineExceeded:
+		return err
+	}
+	return status.Errorf(codes.Unavailable, "checking user %q: %s", id, status.Convert(err).Message())
+}
+
+func (s *orderServer) CreateOrder(ctx context.Context, req *pb.CreateOrderRequest) (*pb.Order, error) {
+	asyncLogf("Received CreateOrder request for user %s with %d items", req.UserId, len(req.Items))
+	if err := validateNewOrder(req); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.checkUser(ctx, req.UserId); err != nil {
+		return nil, err
+	}
+	o := &pb.Order{UserId: req.UserId, Items: req.Items}
+	for _, it := range req.Items {
+		o.TotalCents += int64(it.Quantity) * it.UnitPriceCents
+	}
+	return s.store.create(o), nil
+}
+
+func (s *orderServer) GetOrder(ctx context.Context, req *pb.GetOrderRequest) (*pb.Order, error) {
+	asyncLogf("Received GetOrder request for ID: %s", req.OrderId)
+	o, ok := s.store.get(req.OrderId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "order %q not found", req.OrderId)
+	}
+	return o, nil
+}
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+func (s *orderServer) ListOrdersByUser(ctx context.Context, req *pb.ListOrdersByUserRequest) (*pb.ListOrdersByUserResponse, error) {
+	asyncLogf("Received ListOrdersByUser request for user %s", req.UserId)
+	if strings.TrimSpace(req.UserId) == "" {
+		return nil, status.Error(codes.InvalidArgument, "user_id is required")
+	}
+	size := int(req.PageSize)
+	switch {
+	case size < 0:
+		return nil, status.Error(codes.InvalidArgument, "page_size must not be negative")
+	case size == 0:
+		size = defaultPageSize
+	case size > maxPageSize:
+		size = maxPageSize
+	}
+	before := 0
+	if req.PageToken != "" {
+		n, err := strconv.Atoi(req.PageToken)
+		if err != nil || n <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid page_token %q", req.PageToken)
+		}
+		before = n
+	}
+
+	orders, next := s.store.listByUser(req.UserId, before, size)
+	resp := &pb.ListOrdersByUserResponse{Orders: orders}
+	if next > 0 {
+		resp.NextPageToken = strconv.Itoa(next)
+	}
+	return resp, nil
+}
+
+func newServer(store orderStore, users userpb.UserServiceClient) *grpc.Server {
+	s := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+			start := time.Now()
+			defer func() {
+				asyncLogf("[gRPC] %s | Duration: %v", info.FullMethod, time.Since(start))
+			}()
+			asyncLogf("gRPC call: %s", info.FullMethod)
+			return handler(ctx, req)
+		}),
+	)
+	pb.RegisterOrderServiceServer(s, &orderServer{store: store, users: users})
+	return s
+}
+
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(),
+		syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	addr := getenv("LISTEN_ADDR", ":50054")
+	userAddr := getenv("USER_SERVICE_ADDR", "localhost:50052")
+
+	userConn, err := grpc.NewClient(userAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("failed to create user-service client: %v", err)
+	}
+	defer userConn.Close()
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("failed to listen: %v", err)
+	}
+
+	s := newServer(newMemoryOrderStore(), userpb.NewUserServiceClient(userConn))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		s.GracefulStop()
+		close(logCh)
+	}()
+
+	asyncLogf("Order gRPC service started on %s | User service: %s", lis.Addr(), userAddr)
+	if err := s.Serve(lis); err != nil {
+		asyncLogf("failed to serve: %v", err)
+	}
+	wg.Wait()
+}
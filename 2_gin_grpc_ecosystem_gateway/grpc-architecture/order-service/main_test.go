@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	pb "api/order"
+	userpb "api/user"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// fakeUsers knows user 123 only and records the metadata it was called with.
+type fakeUsers struct {
+	userpb.UnimplementedUserServiceServer
+
+	mu     sync.Mutex
+	lastMD metadata.MD
+}
+
+func (f *fakeUsers) GetUser(ctx context.Context, req *userpb.GetUserRequest) (*userpb.GetUserResponse, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	f.mu.Lock()
+	f.lastMD = md
+	f.mu.Unlock()
+	if req.UserId != "123" {
+		return nil, status.Errorf(codes.NotFound, "user %q not found", req.UserId)
+	}
+	return &userpb.GetUserResponse{Id: "123", Name: "John Doe"}, nil
+}
+
+type testServer struct {
+	client pb.OrderServiceClient
+	users  *fakeUsers
+	// stopUsers takes user-service down.
+	stopUsers func()
+}
+
+func serveBufconn(t *testing.T, srv *grpc.Server) *grpc.ClientConn {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dial bufconn: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func startTestServer(t *testing.T) *testServer {
+	t.Helper()
+	ts := &testServer{users: &fakeUsers{}}
+	userSrv := grpc.NewServer()
+	userpb.RegisterUserServiceServer(userSrv, ts.users)
+	userConn := serveBufconn(t, userSrv)
+	ts.stopUsers = userSrv.Stop
+
+	conn := serveBufconn(t, newServer(newMemoryOrderStore(), userpb.NewUserServiceClient(userConn)))
+	ts.client = pb.NewOrderServiceClient(conn)
+	return ts
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestCreateAndGetOrder(t *testing.T) {
+	ts := startTestServer(t)
+	ctx := metadata.AppendToOutgoingContext(testContext(t), "authorization", "Bearer token")
+
+	created, err := ts.client.CreateOrder(ctx, &pb.CreateOrderRequest{
+		UserId: "123",
+		Items: []*pb.OrderItem{
+			{Sku: "book", Quantity: 2, UnitPriceCents: 1250},
+			{Sku: "pen", Quantity: 1, UnitPriceCents: 199},
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateOrder: %v", err)
+	}
+	if created.Id == "" || created.TotalCents != 2699 || created.CreatedAt == nil {
+		t.Errorf("CreateOrder = %v", created)
+	}
+	if got := ts.users.lastMD.Get("authorization"); len(got) != 1 || got[0] != "Bearer token" {
+		t.Errorf("user-service saw authorization %v", got)
+	}
+
+	got, err := ts.client.GetOrder(ctx, &pb.GetOrderRequest{OrderId: created.Id})
+	if err != nil || got.TotalCents != 2699 || len(got.Items) != 2 {
+		t.Fatalf("GetOrder = %v, %v", got, err)
+	}
+	_, err = ts.client.GetOrder(ctx, &pb.GetOrderRequest{OrderId: "999"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("GetOrder(999) code = %v, want NotFound", status.Code(err))
+	}
+}
+
+func TestCreateOrderValidation(t *testing.T) {
+	ts := startTestServer(t)
+	ctx := testContext(t)
+	item := []*pb.OrderItem{{Sku: "book", Quantity: 1}}
+
+	cases := []struct {
+		name string
+		req  *pb.CreateOrderRequest
+		want codes.Code
+	}{
+		{"no user", &pb.CreateOrderRequest{Items: item}, codes.InvalidArgument},
+		{"no items", &pb.CreateOrderRequest{UserId: "123"}, codes.InvalidArgument},
+		{"zero quantity", &pb.CreateOrderRequest{UserId: "123", Items: []*pb.OrderItem{{Sku: "book"}}}, codes.InvalidArgument},
+		{"unknown user", &pb.CreateOrderRequest{UserId: "999", Items: item}, codes.FailedPrecondition},
+	}
+	for _, tc := range cases {
+		if _, err := ts.client.CreateOrder(ctx, tc.req); status.Code(err) != tc.want {
+			t.Errorf("%s: code = %v, want %v", tc.name, status.Code(err), tc.want)
+		}
+	}
+
+	ts.stopUsers()
+	if _, err := ts.client.CreateOrder(ctx, &pb.CreateOrderRequest{UserId: "123", Items: item}); status.Code(err) != codes.Unavailable {
+		t.Errorf("with user-service down: code = %v, want Unavailable", status.Code(err))
+	}
+}
+
+func TestListOrdersByUser(t *testing.T) {
+	ts := startTestServer(t)
+	ctx := testContext(t)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		o, err := ts.client.CreateOrder(ctx, &pb.CreateOrderRequest{UserId: "123", Items: []*pb.OrderItem{{Sku: "x", Quantity: 1}}})
+		if err != nil {
+			t.Fatalf("CreateOrder: %v", err)
+		}
+		ids = append(ids, o.Id)
+	}
+
+	var got []string
+	token := ""
+	for pages := 0; ; pages++ {
+		resp, err := ts.client.ListOrdersByUser(ctx, &pb.ListOrdersByUserRequest{UserId: "123", PageSize: 2, PageToken: token})
+		if err != nil {
+			t.Fatalf("ListOrdersByUser: %v", err)
+		}
+		for _, o := range resp.Orders {
+			got = append(got, o.Id)
+		}
+		if token = resp.NextPageToken; token == "" {
+			if pages != 2 {
+				t.Errorf("got %d pages, want 3", pages+1)
+			}
+			break
+		}
+	}
+	want := []string{ids[4], ids[3], ids[2], ids[1], ids[0]}
+	if len(got) != len(want) {
+		t.Fatalf("listed %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("listed %v, want newest first %v", got, want)
+		}
+	}
+
+	resp, err := ts.client.ListOrdersByUser(ctx, &pb.ListOrdersByUserRequest{UserId: "456"})
+	if err != nil || len(resp.Orders) != 0 {
+		t.Errorf("ListOrdersByUser(456) = %v, %v", resp, err)
+	}
+	if _, err := ts.client.ListOrdersByUser(ctx, &pb.ListOrdersByUserRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("without user_id: code = %v, want InvalidArgument", status.Code(err))
+	}
+}
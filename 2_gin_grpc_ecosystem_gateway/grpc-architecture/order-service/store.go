@@ -0,0 +1,81 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"sync"
+
+	pb "api/order"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// orderStore persists orders. IDs are assigned by the store and increase with
+// every order, which listByUser relies on for its cursor.
+type orderStore interface {
+	create(o *pb.Order) *pb.Order
+	get(id string) (*pb.Order, bool)
+	// listByUser returns up to limit of the user's orders older than before,
+	// newest first; before <= 0 starts from the newest. next is the cursor
+	// for the following page, or 0 at the end.
+	listByUser(userID string, before, limit int) (orders []*pb.Order, next int)
+}
+
+// memoryOrderStore keeps orders in memory, indexed by user.
+type memoryOrderStore struct {
+	mu     sync.RWMutex
+	orders map[string]*pb.Order
+	// byUser holds each user's order IDs in creation order.
+	byUser map[string][]int
+	nextID int
+}
+
+func newMemoryOrderStore() *memoryOrderStore {
+	return &memoryOrderStore{
+		orders: make(map[string]*pb.Order),
+		byUser: make(map[string][]int),
+		nextID: 1001,
+	}
+}
+
+func (s *memoryOrderStore) create(o *pb.Order) *pb.Order {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	o = proto.Clone(o).(*pb.Order)
+	id := s.nextID
+	s.nextID++
+	o.Id = strconv.Itoa(id)
+	o.CreatedAt = timestamppb.Now()
+	s.orders[o.Id] = o
+	s.byUser[o.UserId] = append(s.byUser[o.UserId], id)
+	return proto.Clone(o).(*pb.Order)
+}
+
+func (s *memoryOrderStore) get(id string) (*pb.Order, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o, ok := s.orders[id]
+	if !ok {
+		return nil, false
+	}
+	return proto.Clone(o).(*pb.Order), true
+}
+
+func (s *memoryOrderStore) listByUser(userID string, before, limit int) ([]*pb.Order, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := s.byUser[userID]
+	end := len(ids)
+	if before > 0 {
+		end, _ = slices.BinarySearch(ids, before)
+	}
+	var out []*pb.Order
+	for i := end - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, proto.Clone(s.orders[strconv.Itoa(ids[i])]).(*pb.Order))
+	}
+	next := 0
+	if n := len(out); n > 0 && end-n > 0 {
+		next = ids[end-n]
+	}
+	return out, next
+}
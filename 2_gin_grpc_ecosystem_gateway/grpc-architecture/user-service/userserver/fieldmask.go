@@ -0,0 +1,124 @@
+package userserver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// fieldMaskKey is the metadata key of the FieldMask a caller, such as the
+// gateway's ?fields= support, sends to ask for a partial response.
+const fieldMaskKey = "x-goog-fieldmask-bin"
+
+// fieldMaskInterceptor prunes unary responses to the caller's FieldMask.
+// Paths use proto field names and may pass through repeated messages, in
+// which case they apply to every element. A path the response type does not
+// have fails the call before the handler runs.
+func fieldMaskInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	vals := md.Get(fieldMaskKey)
+	if len(vals) == 0 {
+		return handler(ctx, req)
+	}
+	var mask fieldmaskpb.FieldMask
+	if err := proto.Unmarshal([]byte(vals[0]), &mask); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid %s: %v", fieldMaskKey, err)
+	}
+	out, err := methodOutput(info.FullMethod)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	tree, err := newMaskTree(out, mask.Paths)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	resp, err := handler(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := resp.(proto.Message); ok {
+		tree.prune(m.ProtoReflect())
+	}
+	return resp, nil
+}
+
+// methodOutput returns the response type of a method such as
+// "/user.UserService/GetUser".
+func methodOutput(fullMethod string) (protoreflect.MessageDescriptor, error) {
+	name := strings.Replace(strings.TrimPrefix(fullMethod, "/"), "/", ".", 1)
+	d, err := protoregistry.GlobalFiles.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("method %s: %w", fullMethod, err)
+	}
+	md, ok := d.(protoreflect.MethodDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a method", fullMethod)
+	}
+	return md.Output(), nil
+}
+
+// maskTree is a FieldMask resolved against a message type: each key keeps a
+// field, and a non-empty subtree keeps only those fields within it.
+type maskTree map[protoreflect.Name]maskTree
+
+func newMaskTree(md protoreflect.MessageDescriptor, paths []string) (maskTree, error) {
+	tree := maskTree{}
+	for _, path := range paths {
+		node, msg := tree, md
+		segs := strings.Split(path, ".")
+		for i, seg := range segs {
+			fd := msg.Fields().ByName(protoreflect.Name(seg))
+			if fd == nil {
+				return nil, fmt.Errorf("field mask path %q: %s has no field %q", path, msg.FullName(), seg)
+			}
+			last := i == len(segs)-1
+			if !last && (fd.Message() == nil || fd.IsMap()) {
+				return nil, fmt.Errorf("field mask path %q: %s is not a message", path, fd.FullName())
+			}
+			sub, ok := node[fd.Name()]
+			if ok && len(sub) == 0 {
+				// The whole field is already kept.
+				break
+			}
+			if last {
+				node[fd.Name()] = maskTree{}
+				break
+			}
+			if !ok {
+				sub = maskTree{}
+				node[fd.Name()] = sub
+			}
+			node, msg = sub, fd.Message()
+		}
+	}
+	return tree, nil
+}
+
+// prune clears the fields of m that t does not keep.
+func (t maskTree) prune(m protoreflect.Message) {
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		sub, ok := t[fd.Name()]
+		switch {
+		case !ok:
+			m.Clear(fd)
+		case len(sub) == 0:
+		case fd.IsList():
+			for i := 0; i < v.List().Len(); i++ {
+				sub.prune(v.List().Get(i).Message())
+			}
+		default:
+			sub.prune(v.Message())
+		}
+		return true
+	})
+}
@@ -0,0 +1,296 @@
+// Package userserver implements user.UserService and user.v2.UserService on
+// an in-memory store. user-service serves it on its own port; the gateway can
+// link it in and serve it in-process.
+package userserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "api/user"
+	pbv2 "api/user/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	// Registering gzip lets callers send compressed requests, which are
+	// answered in kind.
+	_ "google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+)
+
+type userServer struct {
+	pb.UnimplementedUserServiceServer
+	store *userStore
+	// shutdown ends open watch streams so GracefulStop does not block on them.
+	shutdown <-chan struct{}
+}
+
+var logCh = make(chan string, 10000)
+
+func init() {
+	go func() {
+		for msg := range logCh {
+			log.Print(msg)
+		}
+	}()
+}
+
+func asyncLog(v ...interface{}) {
+	msg := fmt.Sprintln(v...)
+	select {
+	case logCh <- msg:
+	default:
+		// Downgrade processing: immediate output (to avoid memory leaks)
+		log.Println(append([]interface{}{"!LOG_OVERFLOW!"}, v...)...)
+	}
+}
+
+func asyncLogf(format string, v ...interface{}) {
+	asyncLog(fmt.Sprintf(format, v...))
+}
+
+// Logf logs through the package's asynchronous log, so the binary serving it
+// keeps one ordered log.
+func Logf(format string, v ...interface{}) {
+	asyncLogf(format, v...)
+}
+
+// CloseLog stops the asynchronous log. Call it once, after the server has
+// stopped.
+func CloseLog() {
+	close(logCh)
+}
+
+func (s *userServer) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.GetUserResponse, error) {
+	asyncLogf("Received GetUser request for ID: %s", req.UserId)
+	u, ok := s.store.get(req.UserId)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "user %q not found", req.UserId)
+	}
+	return &pb.GetUserResponse{
+		Id:    u.Id,
+		Name:  u.Name,
+		Email: u.Email,
+	}, nil
+}
+
+// maxBatchGetIDs caps the IDs one BatchGetUsers call may ask for.
+const maxBatchGetIDs = 500
+
+func (s *userServer) BatchGetUsers(ctx context.Context, req *pb.BatchGetUsersRequest) (*pb.BatchGetUsersResponse, error) {
+	asyncLogf("Received BatchGetUsers request for %d IDs", len(req.UserIds))
+	if len(req.UserIds) > maxBatchGetIDs {
+		return nil, status.Errorf(codes.InvalidArgument, "%d user_ids, more than the limit of %d", len(req.UserIds), maxBatchGetIDs)
+	}
+	resp := &pb.BatchGetUsersResponse{}
+	seen := make(map[string]bool, len(req.UserIds))
+	for _, id := range req.UserIds {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		if u, ok := s.store.get(id); ok {
+			resp.Users = append(resp.Users, u)
+		}
+	}
+	return resp, nil
+}
+
+// validateNewUser checks the fields required to create a user.
+func validateNewUser(name, email string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.New("name is required")
+	}
+	if !strings.Contains(email, "@") {
+		return fmt.Errorf("invalid email %q", email)
+	}
+	return nil
+}
+
+func (s *userServer) CreateUser(ctx context.Context, req *pb.CreateUserRequest) (*pb.CreateUserResponse, error) {
+	asyncLogf("Received CreateUser request: %s, %s", req.Name, req.Email)
+	if err := validateNewUser(req.Name, req.Email); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	u := s.store.create(req.Name, req.Email)
+	return &pb.CreateUserResponse{
+		Id:    u.Id,
+		Name:  u.Name,
+		Email: u.Email,
+	}, nil
+}
+
+// BatchCreateUsers creates users as they arrive on the stream. Invalid items
+// are reported in the per-item results rather than failing the whole batch.
+func (s *userServer) BatchCreateUsers(stream pb.UserService_BatchCreateUsersServer) error {
+	resp := &pb.BatchCreateUsersResponse{}
+	var seq int64
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			asyncLogf("BatchCreateUsers finished: %d created, %d failed", resp.Created, resp.Failed)
+			return stream.SendAndClose(resp)
+		}
+		if err != nil {
+			return err
+		}
+
+		seq++
+		result := &pb.BatchCreateUserResult{Row: req.Row}
+		if result.Row == 0 {
+			result.Row = seq
+		}
+		if err := validateNewUser(req.Name, req.Email); err != nil {
+			result.Error = err.Error()
+			resp.Failed++
+		} else {
+			result.User = s.store.create(req.Name, req.Email)
+			resp.Created++
+		}
+		resp.Results = append(resp.Results, result)
+	}
+}
+
+func (s *userServer) UpdateUser(ctx context.Context, req *pb.UpdateUserRequest) (*pb.UpdateUserResponse, error) {
+	asyncLogf("Received UpdateUser request for ID: %s", req.UserId)
+	u, ok := s.store.update(req.UserId, req.Name, req.Email)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "user %q not found", req.UserId)
+	}
+	return &pb.UpdateUserResponse{
+		Id:    u.Id,
+		Name:  u.Name,
+		Email: u.Email,
+	}, nil
+}
+
+func (s *userServer) DeleteUser(ctx context.Context, req *pb.DeleteUserRequest) (*pb.DeleteUserResponse, error) {
+	asyncLogf("Received DeleteUser request for ID: %s", req.UserId)
+	if !s.store.delete(req.UserId) {
+		return nil, status.Errorf(codes.NotFound, "user %q not found", req.UserId)
+	}
+	return &pb.DeleteUserResponse{}, nil
+}
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+	exportBatchSize = 200
+)
+
+func (s *userServer) ListUsers(ctx context.Context, req *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	asyncLogf("Received ListUsers request: %v", req)
+	after := 0
+	if req.PageToken != "" {
+		var err error
+		if after, err = strconv.Atoi(req.PageToken); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid page_token %q", req.PageToken)
+		}
+	}
+	size := int(req.PageSize)
+	switch {
+	case size <= 0:
+		size = defaultPageSize
+	case size > maxPageSize:
+		size = maxPageSize
+	}
+
+	users, next := s.store.list(userFilter{nameContains: req.NameContains, emailDomain: req.EmailDomain}, after, size)
+	resp := &pb.ListUsersResponse{Users: users}
+	if next > 0 {
+		resp.NextPageToken = strconv.Itoa(next)
+	}
+	return resp, nil
+}
+
+// ExportUsers streams every matching user, reading the store a batch at a
+// time so neither side holds the full result set.
+func (s *userServer) ExportUsers(req *pb.ExportUsersRequest, stream pb.UserService_ExportUsersServer) error {
+	asyncLogf("Received ExportUsers request: %v", req)
+	f := userFilter{nameContains: req.NameContains, emailDomain: req.EmailDomain}
+	after := 0
+	for {
+		users, next := s.store.list(f, after, exportBatchSize)
+		for _, u := range users {
+			if err := stream.Send(u); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		after = next
+	}
+}
+
+func (s *userServer) WatchUsers(req *pb.WatchUsersRequest, stream pb.UserService_WatchUsersServer) error {
+	asyncLogf("Received WatchUsers request for types: %v", req.Types)
+	wanted := make(map[pb.UserEventType]bool, len(req.Types))
+	for _, t := range req.Types {
+		wanted[t] = true
+	}
+
+	events, cancel := s.store.watch()
+	defer cancel()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-s.shutdown:
+			return status.Error(codes.Unavailable, "server shutting down")
+		case ev := <-events:
+			if len(wanted) > 0 && !wanted[ev.Type] {
+				continue
+			}
+			if err := stream.Send(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// NewServer builds the gRPC server on a store seeded with user 123. Closing
+// shutdown ends open watch streams. opts are added to the server's own, so
+// callers may chain further interceptors.
+func NewServer(shutdown <-chan struct{}, opts ...grpc.ServerOption) *grpc.Server {
+	return newServer(newUserStore(), shutdown, opts...)
+}
+
+// newServer builds the gRPC server with its interceptors, both versions of
+// UserService and server reflection registered. Closing shutdown ends open watch streams.
+func newServer(store *userStore, shutdown <-chan struct{}, opts ...grpc.ServerOption) *grpc.Server {
+	s := grpc.NewServer(append([]grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(
+			func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+				start := time.Now()
+				defer func() {
+					asyncLogf("[gRPC] %s | Duration: %v", info.FullMethod, time.Since(start))
+				}()
+				asyncLogf("gRPC call: %s", info.FullMethod)
+				return handler(ctx, req)
+			},
+			fieldMaskInterceptor,
+		),
+		grpc.ChainStreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			start := time.Now()
+			defer func() {
+				asyncLogf("[gRPC] %s | Stream duration: %v", info.FullMethod, time.Since(start))
+			}()
+			asyncLogf("gRPC stream: %s", info.FullMethod)
+			return handler(srv, ss)
+		}),
+	}, opts...)...)
+	v1 := &userServer{store: store, shutdown: shutdown}
+	pb.RegisterUserServiceServer(s, v1)
+	pbv2.RegisterUserServiceServer(s, &userServerV2{v1: v1})
+	// Lets grpcurl and the gateway's transcoder discover the API, HTTP rules
+	// included, without a copy of user.proto.
+	reflection.Register(s)
+	return s
+}
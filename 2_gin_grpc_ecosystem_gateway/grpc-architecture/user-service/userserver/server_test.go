@@ -0,0 +1,411 @@
+package userserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	pb "api/user"
+	pbv2 "api/user/v2"
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+// testServer is a userServer running on an in-memory listener.
+type testServer struct {
+	conn     *grpc.ClientConn
+	client   pb.UserServiceClient
+	store    *userStore
+	shutdown chan struct{}
+	stopped  chan struct{}
+	srv      *grpc.Server
+}
+
+func startTestServer(t *testing.T) *testServer {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	ts := &testServer{
+		store:    newUserStore(),
+		shutdown: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	ts.srv = newServer(ts.store, ts.shutdown)
+	go func() {
+		defer close(ts.stopped)
+		ts.srv.Serve(lis)
+	}()
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("dial bufconn: %v", err)
+	}
+	ts.conn, ts.client = conn, pb.NewUserServiceClient(conn)
+
+	t.Cleanup(func() {
+		conn.Close()
+		ts.stop()
+	})
+	return ts
+}
+
+// waitForWatchers blocks until n watch streams are registered with the store.
+func (ts *testServer) waitForWatchers(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		ts.store.mu.RLock()
+		got := len(ts.store.watchers)
+		ts.store.mu.RUnlock()
+		if got >= n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d watchers registered, want %d", got, n)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// stop mirrors main's shutdown sequence. It is safe to call more than once.
+func (ts *testServer) stop() {
+	select {
+	case <-ts.shutdown:
+	default:
+		close(ts.shutdown)
+	}
+	ts.srv.GracefulStop()
+	<-ts.stopped
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestGetUser(t *testing.T) {
+	ts := startTestServer(t)
+	ctx := testContext(t)
+
+	res, err := ts.client.GetUser(ctx, &pb.GetUserRequest{UserId: "123"})
+	if err != nil {
+		t.Fatalf("GetUser: %v", err)
+	}
+	if res.Id != "123" || res.Name != "John Doe" {
+		t.Errorf("GetUser = %v, want seeded user 123", res)
+	}
+
+	_, err = ts.client.GetUser(ctx, &pb.GetUserRequest{UserId: "nope"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("GetUser(nope) code = %v, want NotFound", status.Code(err))
+	}
+}
+
+func TestBatchGetUsers(t *testing.T) {
+	ts := startTestServer(t)
+	ctx := testContext(t)
+	alice := ts.store.create("Alice", "alice@example.com")
+
+	res, err := ts.client.BatchGetUsers(ctx, &pb.BatchGetUsersRequest{UserIds: []string{alice.Id, "nope", "123", alice.Id}})
+	if err != nil {
+		t.Fatalf("BatchGetUsers: %v", err)
+	}
+	if len(res.Users) != 2 || res.Users[0].Name != "Alice" || res.Users[1].Id != "123" {
+		t.Errorf("BatchGetUsers = %v, want Alice then 123", res.Users)
+	}
+
+	_, err = ts.client.BatchGetUsers(ctx, &pb.BatchGetUsersRequest{UserIds: make([]string, maxBatchGetIDs+1)})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("BatchGetUsers over the limit code = %v, want InvalidArgument", status.Code(err))
+	}
+}
+
+func TestCreateUpdateDeleteUser(t *testing.T) {
+	ts := startTestServer(t)
+	ctx := testContext(t)
+
+	created, err := ts.client.CreateUser(ctx, &pb.CreateUserRequest{Name: "Alice", Email: "alice@example.com"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if created.Id == "" || created.Name != "Alice" {
+		t.Fatalf("CreateUser = %v", created)
+	}
+
+	_, err = ts.client.CreateUser(ctx, &pb.CreateUserRequest{Name: "Bob", Email: "not-an-email"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateUser(bad email) code = %v, want InvalidArgument", status.Code(err))
+	}
+
+	updated, err := ts.client.UpdateUser(ctx, &pb.UpdateUserRequest{UserId: created.Id, Name: "Alice Smith"})
+	if err != nil {
+		t.Fatalf("UpdateUser: %v", err)
+	}
+	if updated.Name != "Alice Smith" || updated.Email != "alice@example.com" {
+		t.Errorf("UpdateUser = %v, want new name and unchanged email", updated)
+	}
+
+	if _, err := ts.client.DeleteUser(ctx, &pb.DeleteUserRequest{UserId: created.Id}); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	_, err = ts.client.GetUser(ctx, &pb.GetUserRequest{UserId: created.Id})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("GetUser after delete code = %v, want NotFound", status.Code(err))
+	}
+}
+
+func TestUserServiceV2(t *testing.T) {
+	ts := startTestServer(t)
+	ctx := testContext(t)
+	client := pbv2.NewUserServiceClient(ts.conn)
+
+	created, err := client.CreateUser(ctx, &pbv2.CreateUserRequest{User: &pbv2.User{DisplayName: "Alice", Email: "alice@example.com"}})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	// Both versions see the same store.
+	v1, err := ts.client.GetUser(ctx, &pb.GetUserRequest{UserId: created.Id})
+	if err != nil || v1.Name != "Alice" {
+		t.Fatalf("v1 GetUser = %v, %v", v1, err)
+	}
+
+	updated, err := client.UpdateUser(ctx, &pbv2.UpdateUserRequest{UserId: created.Id, User: &pbv2.User{DisplayName: "Alice Smith"}})
+	if err != nil || updated.DisplayName != "Alice Smith" || updated.Email != "alice@example.com" {
+		t.Errorf("UpdateUser = %v, %v", updated, err)
+	}
+	list, err := client.ListUsers(ctx, &pbv2.ListUsersRequest{DisplayNameContains: "smith"})
+	if err != nil || len(list.Users) != 1 || list.Users[0].Id != created.Id {
+		t.Errorf("ListUsers = %v, %v", list, err)
+	}
+
+	if _, err := client.CreateUser(ctx, &pbv2.CreateUserRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateUser(empty) code = %v, want InvalidArgument", status.Code(err))
+	}
+	if _, err := client.DeleteUser(ctx, &pbv2.DeleteUserRequest{UserId: created.Id}); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	if _, err := client.GetUser(ctx, &pbv2.GetUserRequest{UserId: created.Id}); status.Code(err) != codes.NotFound {
+		t.Errorf("GetUser after delete code = %v, want NotFound", status.Code(err))
+	}
+}
+
+func TestFieldMask(t *testing.T) {
+	ts := startTestServer(t)
+	withMask := func(paths ...string) context.Context {
+		b, err := proto.Marshal(&fieldmaskpb.FieldMask{Paths: paths})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return metadata.AppendToOutgoingContext(testContext(t), fieldMaskKey, string(b))
+	}
+
+	u, err := ts.client.GetUser(withMask("name"), &pb.GetUserRequest{UserId: "123"})
+	if err != nil || u.Id != "" || u.Name != "John Doe" || u.Email != "" {
+		t.Errorf("GetUser(name) = %v, %v", u, err)
+	}
+
+	// Paths through a repeated message apply to each element.
+	ts.client.CreateUser(testContext(t), &pb.CreateUserRequest{Name: "Alice", Email: "alice@example.com"})
+	list, err := ts.client.ListUsers(withMask("users.email", "next_page_token"), &pb.ListUsersRequest{})
+	if err != nil || len(list.Users) != 2 {
+		t.Fatalf("ListUsers = %v, %v", list, err)
+	}
+	for _, u := range list.Users {
+		if u.Id != "" || u.Name != "" || u.Email == "" {
+			t.Errorf("ListUsers user = %v, want only email", u)
+		}
+	}
+
+	// An unknown path fails before the handler runs.
+	_, err = ts.client.CreateUser(withMask("nickname"), &pb.CreateUserRequest{Name: "Bob", Email: "bob@example.com"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateUser(nickname) code = %v, want InvalidArgument", status.Code(err))
+	}
+	if list, _ := ts.client.ListUsers(testContext(t), &pb.ListUsersRequest{NameContains: "bob"}); len(list.GetUsers()) != 0 {
+		t.Error("CreateUser with an invalid mask created the user")
+	}
+}
+
+func TestListAndExportUsers(t *testing.T) {
+	ts := startTestServer(t)
+	ctx := testContext(t)
+
+	for _, email := range []string{"a@one.com", "b@two.com", "c@one.com"} {
+		if _, err := ts.client.CreateUser(ctx, &pb.CreateUserRequest{Name: "user", Email: email}); err != nil {
+			t.Fatalf("CreateUser: %v", err)
+		}
+	}
+
+	var ids []string
+	token := ""
+	for {
+		res, err := ts.client.ListUsers(ctx, &pb.ListUsersRequest{EmailDomain: "one.com", PageSize: 1, PageToken: token})
+		if err != nil {
+			t.Fatalf("ListUsers: %v", err)
+		}
+		for _, u := range res.Users {
+			ids = append(ids, u.Id)
+		}
+		if token = res.NextPageToken; token == "" {
+			break
+		}
+	}
+	if len(ids) != 2 {
+		t.Errorf("ListUsers(one.com) returned %v, want 2 users", ids)
+	}
+
+	stream, err := ts.client.ExportUsers(ctx, &pb.ExportUsersRequest{})
+	if err != nil {
+		t.Fatalf("ExportUsers: %v", err)
+	}
+	n := 0
+	for {
+		if _, err := stream.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("ExportUsers recv: %v", err)
+		}
+		n++
+	}
+	if n != 4 {
+		t.Errorf("ExportUsers streamed %d users, want 4", n)
+	}
+}
+
+func TestBatchCreateUsers(t *testing.T) {
+	ts := startTestServer(t)
+	ctx := testContext(t)
+
+	stream, err := ts.client.BatchCreateUsers(ctx)
+	if err != nil {
+		t.Fatalf("BatchCreateUsers: %v", err)
+	}
+	for _, req := range []*pb.BatchCreateUsersRequest{
+		{Row: 2, Name: "Ann", Email: "ann@example.com"},
+		{Row: 3, Name: "", Email: "anon@example.com"},
+	} {
+		if err := stream.Send(req); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		t.Fatalf("CloseAndRecv: %v", err)
+	}
+	if res.Created != 1 || res.Failed != 1 || len(res.Results) != 2 {
+		t.Fatalf("BatchCreateUsers = %v, want 1 created and 1 failed", res)
+	}
+	if res.Results[1].Row != 3 || res.Results[1].Error == "" {
+		t.Errorf("result for row 3 = %v, want an error", res.Results[1])
+	}
+}
+
+func TestWatchUsers(t *testing.T) {
+	ts := startTestServer(t)
+	ctx := testContext(t)
+
+	stream, err := ts.client.WatchUsers(ctx, &pb.WatchUsersRequest{
+		Types: []pb.UserEventType{pb.UserEventType_USER_DELETED},
+	})
+	if err != nil {
+		t.Fatalf("WatchUsers: %v", err)
+	}
+	ts.waitForWatchers(t, 1)
+
+	u, err := ts.client.CreateUser(ctx, &pb.CreateUserRequest{Name: "tmp", Email: "tmp@example.com"})
+	if err != nil {
+		t.Fatalf("CreateUser: %v", err)
+	}
+	if _, err := ts.client.DeleteUser(ctx, &pb.DeleteUserRequest{UserId: u.Id}); err != nil {
+		t.Fatalf("DeleteUser: %v", err)
+	}
+	ev, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv: %v", err)
+	}
+	if ev.Type != pb.UserEventType_USER_DELETED || ev.User.GetId() != u.Id {
+		t.Errorf("event = %v, want USER_DELETED for %s only", ev, u.Id)
+	}
+}
+
+func TestShutdownEndsWatchStreams(t *testing.T) {
+	ts := startTestServer(t)
+	ctx := testContext(t)
+
+	stream, err := ts.client.WatchUsers(ctx, &pb.WatchUsersRequest{})
+	if err != nil {
+		t.Fatalf("WatchUsers: %v", err)
+	}
+	ts.waitForWatchers(t, 1)
+
+	done := make(chan struct{})
+	go func() {
+		ts.stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("GracefulStop blocked on an open watch stream")
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("Recv after shutdown code = %v, want Unavailable", status.Code(err))
+	}
+}
+
+func TestReflection(t *testing.T) {
+	ts := startTestServer(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := reflectionpb.NewServerReflectionClient(ts.conn).ServerReflectionInfo(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	})
+	resp, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var services []string
+	for _, s := range resp.GetListServicesResponse().GetService() {
+		services = append(services, s.Name)
+	}
+	if len(services) != 4 || services[2] != "user.UserService" || services[3] != "user.v2.UserService" {
+		t.Errorf("services = %v", services)
+	}
+
+	// The HTTP rules travel with the descriptor.
+	stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: "user.UserService"},
+	})
+	if resp, err = stream.Recv(); err != nil {
+		t.Fatal(err)
+	}
+	var fd descriptorpb.FileDescriptorProto
+	if err := proto.Unmarshal(resp.GetFileDescriptorResponse().GetFileDescriptorProto()[0], &fd); err != nil {
+		t.Fatal(err)
+	}
+	rule := proto.GetExtension(fd.GetService()[0].GetMethod()[0].GetOptions(), annotations.E_Http).(*annotations.HttpRule)
+	if fd.GetService()[0].GetMethod()[0].GetName() != "GetUser" || rule.GetGet() != "/user/{user_id}" {
+		t.Errorf("GetUser rule = %v", rule)
+	}
+}
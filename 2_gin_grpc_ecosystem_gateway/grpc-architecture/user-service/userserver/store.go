@@ -0,0 +1,155 @@
+package userserver
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	pb "api/user"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// watcherBuffer is the number of events a slow watcher may lag behind before
+// further events are dropped for it.
+const watcherBuffer = 64
+
+// userStore keeps users in memory and fans out change events to watchers.
+type userStore struct {
+	mu       sync.RWMutex
+	users    map[string]*pb.User
+	firstID  int
+	nextID   int
+	watchers map[chan *pb.UserEvent]struct{}
+}
+
+func newUserStore() *userStore {
+	return &userStore{
+		users: map[string]*pb.User{
+			"123": {Id: "123", Name: "John Doe", Email: "john@example.com"},
+		},
+		firstID:  123,
+		nextID:   124,
+		watchers: make(map[chan *pb.UserEvent]struct{}),
+	}
+}
+
+func (s *userStore) get(id string) (*pb.User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil, false
+	}
+	return proto.Clone(u).(*pb.User), true
+}
+
+func (s *userStore) create(name, email string) *pb.User {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := &pb.User{Id: strconv.Itoa(s.nextID), Name: name, Email: email}
+	s.nextID++
+	s.users[u.Id] = u
+	s.publish(pb.UserEventType_USER_CREATED, u)
+	return proto.Clone(u).(*pb.User)
+}
+
+func (s *userStore) update(id, name, email string) (*pb.User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return nil, false
+	}
+	if name != "" {
+		u.Name = name
+	}
+	if email != "" {
+		u.Email = email
+	}
+	s.publish(pb.UserEventType_USER_UPDATED, u)
+	return proto.Clone(u).(*pb.User), true
+}
+
+func (s *userStore) delete(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[id]
+	if !ok {
+		return false
+	}
+	delete(s.users, id)
+	s.publish(pb.UserEventType_USER_DELETED, u)
+	return true
+}
+
+// userFilter selects users for listing and export. Zero values match all.
+type userFilter struct {
+	nameContains string
+	emailDomain  string
+}
+
+func (f userFilter) match(u *pb.User) bool {
+	if f.nameContains != "" && !strings.Contains(strings.ToLower(u.Name), strings.ToLower(f.nameContains)) {
+		return false
+	}
+	if f.emailDomain != "" {
+		at := strings.LastIndexByte(u.Email, '@')
+		if at < 0 || !strings.EqualFold(u.Email[at+1:], f.emailDomain) {
+			return false
+		}
+	}
+	return true
+}
+
+// list returns up to limit matching users with an ID greater than after, in
+// ID order, and the cursor to pass as after for the next page (0 when there
+// are no more). IDs are allocated sequentially, so walking the ID range keeps
+// memory bounded by limit however many users are stored.
+func (s *userStore) list(f userFilter, after, limit int) ([]*pb.User, int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	start := max(after+1, s.firstID)
+	var out []*pb.User
+	for id := start; id < s.nextID; id++ {
+		u, ok := s.users[strconv.Itoa(id)]
+		if !ok || !f.match(u) {
+			continue
+		}
+		if len(out) == limit {
+			return out, id - 1
+		}
+		out = append(out, proto.Clone(u).(*pb.User))
+	}
+	return out, 0
+}
+
+// watch registers a new watcher. The returned cancel func must be called to
+// release it.
+func (s *userStore) watch() (<-chan *pb.UserEvent, func()) {
+	ch := make(chan *pb.UserEvent, watcherBuffer)
+	s.mu.Lock()
+	s.watchers[ch] = struct{}{}
+	s.mu.Unlock()
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.watchers, ch)
+		s.mu.Unlock()
+	}
+}
+
+// publish must be called with s.mu held.
+func (s *userStore) publish(typ pb.UserEventType, u *pb.User) {
+	ev := &pb.UserEvent{
+		Type:       typ,
+		User:       proto.Clone(u).(*pb.User),
+		OccurredAt: timestamppb.Now(),
+	}
+	for ch := range s.watchers {
+		select {
+		case ch <- ev:
+		default:
+			asyncLogf("Watcher lagging, dropped %s event for user %s", typ, u.Id)
+		}
+	}
+}
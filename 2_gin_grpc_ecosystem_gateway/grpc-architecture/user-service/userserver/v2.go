@@ -0,0 +1,68 @@
+package userserver
+
+import (
+	"context"
+
+	pb "api/user"
+	pbv2 "api/user/v2"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// userServerV2 serves user.v2.UserService on top of userServer, so both API
+// versions share one store and one set of validation rules.
+type userServerV2 struct {
+	pbv2.UnimplementedUserServiceServer
+	v1 *userServer
+}
+
+func toV2User(id, name, email string) *pbv2.User {
+	return &pbv2.User{Id: id, DisplayName: name, Email: email}
+}
+
+func (s *userServerV2) GetUser(ctx context.Context, req *pbv2.GetUserRequest) (*pbv2.User, error) {
+	u, err := s.v1.GetUser(ctx, &pb.GetUserRequest{UserId: req.UserId})
+	if err != nil {
+		return nil, err
+	}
+	return toV2User(u.Id, u.Name, u.Email), nil
+}
+
+func (s *userServerV2) ListUsers(ctx context.Context, req *pbv2.ListUsersRequest) (*pbv2.ListUsersResponse, error) {
+	resp, err := s.v1.ListUsers(ctx, &pb.ListUsersRequest{
+		NameContains: req.DisplayNameContains,
+		EmailDomain:  req.EmailDomain,
+		PageSize:     req.PageSize,
+		PageToken:    req.PageToken,
+	})
+	if err != nil {
+		return nil, err
+	}
+	out := &pbv2.ListUsersResponse{NextPageToken: resp.NextPageToken}
+	for _, u := range resp.Users {
+		out.Users = append(out.Users, toV2User(u.Id, u.Name, u.Email))
+	}
+	return out, nil
+}
+
+func (s *userServerV2) CreateUser(ctx context.Context, req *pbv2.CreateUserRequest) (*pbv2.User, error) {
+	u, err := s.v1.CreateUser(ctx, &pb.CreateUserRequest{Name: req.User.GetDisplayName(), Email: req.User.GetEmail()})
+	if err != nil {
+		return nil, err
+	}
+	return toV2User(u.Id, u.Name, u.Email), nil
+}
+
+func (s *userServerV2) UpdateUser(ctx context.Context, req *pbv2.UpdateUserRequest) (*pbv2.User, error) {
+	u, err := s.v1.UpdateUser(ctx, &pb.UpdateUserRequest{UserId: req.UserId, Name: req.User.GetDisplayName(), Email: req.User.GetEmail()})
+	if err != nil {
+		return nil, err
+	}
+	return toV2User(u.Id, u.Name, u.Email), nil
+}
+
+func (s *userServerV2) DeleteUser(ctx context.Context, req *pbv2.DeleteUserRequest) (*emptypb.Empty, error) {
+	if _, err := s.v1.DeleteUser(ctx, &pb.DeleteUserRequest{UserId: req.UserId}); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
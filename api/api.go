@@ -0,0 +1,33 @@
+// Package api is the single home of the protos shared by both gateway
+// variants and their services, and of the code generated from them:
+//
+//	api/user              user.UserService (v1) messages and gRPC stubs
+//	api/user/v2           user.v2.UserService messages and gRPC stubs
+//	api/order             order.OrderService messages and gRPC stubs
+//	api/apikey            apikey.ApiKeyAdminService messages and gRPC stubs
+//	api/gateway/user      grpc-gateway handlers for UserService
+//	api/gateway/user/v2   grpc-gateway handlers for user.v2.UserService
+//	api/gateway/order     grpc-gateway handlers for OrderService
+//	api/compat            breaking-change detection between proto versions
+//
+// user/user.proto is version 1 of the user API. It keeps package user rather
+// than user.v1 because renaming the package would change every gRPC method
+// name and break existing clients; new versions get their own package.
+//
+// The grpc-gateway handlers live in their own packages so binaries without a
+// REST mux do not link grpc-gateway. Consumers require this module and point
+// it here with a replace directive. Run go generate in this directory after
+// editing a .proto; it runs cmd/protogen with the plugin versions pinned in
+// go.mod and needs no protoc. go test fails while the generated code is stale
+// or a copy of a proto or its generated code turns up elsewhere in the
+// repository, and while the protos break clients of baseline.binpb, the
+// descriptor set of the last released protos (see cmd/protocompat).
+package api
+
+// Version is the version of the API described by the protos. Bump it with
+// every change to them: the minor version for compatible additions, the major
+// version for anything that breaks existing clients, together with
+// go run ./cmd/protocompat -update.
+const Version = "1.3.0"
+
+//go:generate go run ./cmd/protogen -I=. -I=third_party --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative --grpc-gateway_out=gateway --grpc-gateway_opt=paths=source_relative,standalone=true user/user.proto user/v2/user.proto order/order.proto apikey/apikey.proto
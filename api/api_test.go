@@ -0,0 +1,131 @@
+package api
+
+import (
+	"bytes"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	_ "api/apikey"
+	"api/compat"
+	_ "api/order"
+	_ "api/user"
+	_ "api/user/v2"
+
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+// generateArgs returns the protogen arguments of the //go:generate line in
+// api.go, so the test always runs what go generate runs.
+func generateArgs(t *testing.T) []string {
+	t.Helper()
+	src, err := os.ReadFile("api.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(src), "\n") {
+		if rest, ok := strings.CutPrefix(line, "//go:generate go run ./cmd/protogen "); ok {
+			return strings.Fields(rest)
+		}
+	}
+	t.Fatal("api.go has no //go:generate go run ./cmd/protogen line")
+	return nil
+}
+
+func TestGeneratedCodeIsCurrent(t *testing.T) {
+	// Regenerate from a copy of the protos and compare with what is committed.
+	// protogen runs here, in the module, so go tool finds the pinned plugins.
+	tmp := t.TempDir()
+	args := append([]string{"run", "./cmd/protogen", "-dir=" + tmp}, generateArgs(t)...)
+	var generated []string
+	err := filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch {
+		case strings.HasSuffix(path, ".proto"):
+			b, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Join(tmp, filepath.Dir(path)), 0o755); err != nil {
+				return err
+			}
+			return os.WriteFile(filepath.Join(tmp, path), b, 0o644)
+		case strings.HasSuffix(path, ".pb.go") || strings.HasSuffix(path, ".pb.gw.go"):
+			generated = append(generated, path)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("go", args...).CombinedOutput(); err != nil {
+		t.Fatalf("protogen: %v\n%s", err, out)
+	}
+
+	fresh := map[string]bool{}
+	filepath.WalkDir(tmp, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && !strings.HasSuffix(path, ".proto") {
+			rel, _ := filepath.Rel(tmp, path)
+			fresh[rel] = true
+		}
+		return nil
+	})
+	for _, path := range generated {
+		want, err := os.ReadFile(filepath.Join(tmp, path))
+		if err != nil {
+			t.Errorf("%s is no longer generated; delete it", path)
+			continue
+		}
+		delete(fresh, path)
+		got, _ := os.ReadFile(path)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s is stale; run go generate", path)
+		}
+	}
+	for path := range fresh {
+		t.Errorf("%s is generated but not committed; run go generate", path)
+	}
+}
+
+func TestNoProtoCopies(t *testing.T) {
+	root, err := filepath.Abs("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	here, _ := filepath.Abs(".")
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path == here || d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		name := d.Name()
+		if strings.HasSuffix(name, ".proto") || strings.HasSuffix(name, ".pb.go") || strings.HasSuffix(name, ".pb.gw.go") {
+			rel, _ := filepath.Rel(root, path)
+			t.Errorf("%s: protos and generated code belong in the api module", rel)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompatibleWithBaseline(t *testing.T) {
+	old, err := compat.ReadSet("baseline.binpb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range compat.Compare(old, protoregistry.GlobalFiles) {
+		t.Errorf("%s (see go run ./cmd/protocompat -h)", c)
+	}
+}
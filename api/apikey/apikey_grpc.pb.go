@@ -0,0 +1,245 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: apikey/apikey.proto
+
+package apikey
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	ApiKeyAdminService_IssueKey_FullMethodName  = "/apikey.ApiKeyAdminService/IssueKey"
+	ApiKeyAdminService_GetKey_FullMethodName    = "/apikey.ApiKeyAdminService/GetKey"
+	ApiKeyAdminService_ListKeys_FullMethodName  = "/apikey.ApiKeyAdminService/ListKeys"
+	ApiKeyAdminService_RevokeKey_FullMethodName = "/apikey.ApiKeyAdminService/RevokeKey"
+)
+
+// ApiKeyAdminServiceClient is the client API for ApiKeyAdminService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// ApiKeyAdminService issues and revokes the API keys that machine clients
+// send instead of a JWT. Only the gateway serves it, on its gRPC port, and
+// only to callers whose key has the admin scope.
+type ApiKeyAdminServiceClient interface {
+	IssueKey(ctx context.Context, in *IssueKeyRequest, opts ...grpc.CallOption) (*IssueKeyResponse, error)
+	GetKey(ctx context.Context, in *GetKeyRequest, opts ...grpc.CallOption) (*ApiKey, error)
+	ListKeys(ctx context.Context, in *ListKeysRequest, opts ...grpc.CallOption) (*ListKeysResponse, error)
+	// Revoked keys stop working at once and stay listed.
+	RevokeKey(ctx context.Context, in *RevokeKeyRequest, opts ...grpc.CallOption) (*ApiKey, error)
+}
+
+type apiKeyAdminServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewApiKeyAdminServiceClient(cc grpc.ClientConnInterface) ApiKeyAdminServiceClient {
+	return &apiKeyAdminServiceClient{cc}
+}
+
+func (c *apiKeyAdminServiceClient) IssueKey(ctx context.Context, in *IssueKeyRequest, opts ...grpc.CallOption) (*IssueKeyResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(IssueKeyResponse)
+	err := c.cc.Invoke(ctx, ApiKeyAdminService_IssueKey_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *apiKeyAdminServiceClient) GetKey(ctx context.Context, in *GetKeyRequest, opts ...grpc.CallOption) (*ApiKey, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ApiKey)
+	err := c.cc.Invoke(ctx, ApiKeyAdminService_GetKey_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *apiKeyAdminServiceClient) ListKeys(ctx context.Context, in *ListKeysRequest, opts ...grpc.CallOption) (*ListKeysResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ListKeysResponse)
+	err := c.cc.Invoke(ctx, ApiKeyAdminService_ListKeys_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *apiKeyAdminServiceClient) RevokeKey(ctx context.Context, in *RevokeKeyRequest, opts ...grpc.CallOption) (*ApiKey, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(ApiKey)
+	err := c.cc.Invoke(ctx, ApiKeyAdminService_RevokeKey_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ApiKeyAdminServiceServer is the server API for ApiKeyAdminService service.
+// All implementations must embed UnimplementedApiKeyAdminServiceServer
+// for forward compatibility.
+//
+// ApiKeyAdminService issues and revokes the API keys that machine clients
+// send instead of a JWT. Only the gateway serves it, on its gRPC port, and
+// only to callers whose key has the admin scope.
+type ApiKeyAdminServiceServer interface {
+	IssueKey(context.Context, *IssueKeyRequest) (*IssueKeyResponse, error)
+	GetKey(context.Context, *GetKeyRequest) (*ApiKey, error)
+	ListKeys(context.Context, *ListKeysRequest) (*ListKeysResponse, error)
+	// Revoked keys stop working at once and stay listed.
+	RevokeKey(context.Context, *RevokeKeyRequest) (*ApiKey, error)
+	mustEmbedUnimplementedApiKeyAdminServiceServer()
+}
+
+// UnimplementedApiKeyAdminServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedApiKeyAdminServiceServer struct{}
+
+func (UnimplementedApiKeyAdminServiceServer) IssueKey(context.Context, *IssueKeyRequest) (*IssueKeyResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method IssueKey not implemented")
+}
+func (UnimplementedApiKeyAdminServiceServer) GetKey(context.Context, *GetKeyRequest) (*ApiKey, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetKey not implemented")
+}
+func (UnimplementedApiKeyAdminServiceServer) ListKeys(context.Context, *ListKeysRequest) (*ListKeysResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListKeys not implemented")
+}
+func (UnimplementedApiKeyAdminServiceServer) RevokeKey(context.Context, *RevokeKeyRequest) (*ApiKey, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeKey not implemented")
+}
+func (UnimplementedApiKeyAdminServiceServer) mustEmbedUnimplementedApiKeyAdminServiceServer() {}
+func (UnimplementedApiKeyAdminServiceServer) testEmbeddedByValue()                            {}
+
+// UnsafeApiKeyAdminServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ApiKeyAdminServiceServer will
+// result in compilation errors.
+type UnsafeApiKeyAdminServiceServer interface {
+	mustEmbedUnimplementedApiKeyAdminServiceServer()
+}
+
+func RegisterApiKeyAdminServiceServer(s grpc.ServiceRegistrar, srv ApiKeyAdminServiceServer) {
+	// If the following call pancis, it indicates UnimplementedApiKeyAdminServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&ApiKeyAdminService_ServiceDesc, srv)
+}
+
+func _ApiKeyAdminService_IssueKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(IssueKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ApiKeyAdminServiceServer).IssueKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ApiKeyAdminService_IssueKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ApiKeyAdminServiceServer).IssueKey(ctx, req.(*IssueKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ApiKeyAdminService_GetKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ApiKeyAdminServiceServer).GetKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ApiKeyAdminService_GetKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ApiKeyAdminServiceServer).GetKey(ctx, req.(*GetKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ApiKeyAdminService_ListKeys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListKeysRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ApiKeyAdminServiceServer).ListKeys(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ApiKeyAdminService_ListKeys_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ApiKeyAdminServiceServer).ListKeys(ctx, req.(*ListKeysRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ApiKeyAdminService_RevokeKey_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevokeKeyRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ApiKeyAdminServiceServer).RevokeKey(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ApiKeyAdminService_RevokeKey_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ApiKeyAdminServiceServer).RevokeKey(ctx, req.(*RevokeKeyRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ApiKeyAdminService_ServiceDesc is the grpc.ServiceDesc for ApiKeyAdminService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ApiKeyAdminService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "apikey.ApiKeyAdminService",
+	HandlerType: (*ApiKeyAdminServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "IssueKey",
+			Handler:    _ApiKeyAdminService_IssueKey_Handler,
+		},
+		{
+			MethodName: "GetKey",
+			Handler:    _ApiKeyAdminService_GetKey_Handler,
+		},
+		{
+			MethodName: "ListKeys",
+			Handler:    _ApiKeyAdminService_ListKeys_Handler,
+		},
+		{
+			MethodName: "RevokeKey",
+			Handler:    _ApiKeyAdminService_RevokeKey_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "apikey/apikey.proto",
+}
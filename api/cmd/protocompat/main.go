@@ -0,0 +1,58 @@
+// Command protocompat compares the API protos against the committed baseline
+// descriptor set and lists the changes that would break existing clients:
+//
+//	go run ./cmd/protocompat                        # compiled-in protos vs baseline.binpb
+//	go run ./cmd/protocompat -current new.binpb     # a protoc descriptor set vs baseline.binpb
+//	go run ./cmd/protocompat -update                # make the compiled-in protos the baseline
+//
+// It exits with status 1 when it finds a breaking change. Update the baseline
+// whenever api.Version is bumped; past a breaking change only with a major
+// bump.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"api/apikey"
+	"api/compat"
+	"api/order"
+	"api/user"
+	userv2 "api/user/v2"
+
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+func main() {
+	baseline := flag.String("baseline", "baseline.binpb", "descriptor set of the last released protos")
+	current := flag.String("current", "", "descriptor set to check instead of the compiled-in protos")
+	update := flag.Bool("update", false, "write the compiled-in protos to -baseline and exit")
+	flag.Parse()
+
+	if *update {
+		if err := compat.WriteSet(*baseline, user.File_user_user_proto, userv2.File_user_v2_user_proto, order.File_order_order_proto, apikey.File_apikey_apikey_proto); err != nil {
+			log.Fatalf("writing baseline: %v", err)
+		}
+		return
+	}
+
+	old, err := compat.ReadSet(*baseline)
+	if err != nil {
+		log.Fatalf("reading baseline: %v", err)
+	}
+	files := protoregistry.GlobalFiles
+	if *current != "" {
+		if files, err = compat.ReadSet(*current); err != nil {
+			log.Fatal(err)
+		}
+	}
+	changes := compat.Compare(old, files)
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+	if len(changes) > 0 {
+		os.Exit(1)
+	}
+}
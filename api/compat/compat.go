@@ -0,0 +1,306 @@
+// Package compat reports changes between two versions of the API protos that
+// break existing clients: on the wire, in the JSON mapping served by the
+// gateways, or in the google.api.http bindings.
+package compat
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// Kind says which clients a Change breaks.
+type Kind string
+
+const (
+	// Wire changes break the binary protobuf encoding or gRPC calls.
+	Wire Kind = "wire"
+	// JSON changes keep the binary encoding but break protojson clients.
+	JSON Kind = "json"
+	// HTTP changes break REST clients of the google.api.http bindings.
+	HTTP Kind = "http"
+)
+
+// A Change is one breaking difference found by Compare.
+type Change struct {
+	Kind Kind
+	// Element is the full name of the proto element that changed.
+	Element string
+	Message string
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s: %s", c.Kind, c.Element, c.Message)
+}
+
+// Compare returns the breaking changes from old to new, sorted by element.
+// Every file in old is checked except those under google/, which are
+// dependencies; elements are looked up in new by full name, so moving a
+// message between files is not a change. Additions are never breaking.
+func Compare(old, new *protoregistry.Files) []Change {
+	c := &comparer{new: new}
+	old.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		if strings.HasPrefix(fd.Path(), "google/") {
+			return true
+		}
+		c.messages(fd.Messages())
+		c.enums(fd.Enums())
+		for i := 0; i < fd.Services().Len(); i++ {
+			c.service(fd.Services().Get(i))
+		}
+		return true
+	})
+	sort.SliceStable(c.changes, func(i, j int) bool {
+		if c.changes[i].Element != c.changes[j].Element {
+			return c.changes[i].Element < c.changes[j].Element
+		}
+		return c.changes[i].Message < c.changes[j].Message
+	})
+	return c.changes
+}
+
+type comparer struct {
+	new     *protoregistry.Files
+	changes []Change
+}
+
+func (c *comparer) report(kind Kind, d protoreflect.Descriptor, format string, args ...any) {
+	c.changes = append(c.changes, Change{Kind: kind, Element: string(d.FullName()), Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *comparer) find(name protoreflect.FullName) protoreflect.Descriptor {
+	d, err := c.new.FindDescriptorByName(name)
+	if err != nil {
+		return nil
+	}
+	return d
+}
+
+func (c *comparer) messages(ms protoreflect.MessageDescriptors) {
+	for i := 0; i < ms.Len(); i++ {
+		m := ms.Get(i)
+		if m.IsMapEntry() {
+			continue
+		}
+		nm, ok := c.find(m.FullName()).(protoreflect.MessageDescriptor)
+		if !ok {
+			c.report(Wire, m, "message removed")
+			continue
+		}
+		for j := 0; j < m.Fields().Len(); j++ {
+			c.field(m.Fields().Get(j), nm)
+		}
+		c.messages(m.Messages())
+		c.enums(m.Enums())
+	}
+}
+
+func (c *comparer) field(f protoreflect.FieldDescriptor, nm protoreflect.MessageDescriptor) {
+	nf := nm.Fields().ByNumber(f.Number())
+	if nf == nil {
+		if moved := nm.Fields().ByName(f.Name()); moved != nil {
+			c.report(Wire, f, "field number changed from %d to %d", f.Number(), moved.Number())
+		} else {
+			c.report(Wire, f, "field %d removed", f.Number())
+		}
+		return
+	}
+	if from, to := fieldType(f), fieldType(nf); from != to {
+		c.report(Wire, f, "type changed from %s to %s", from, to)
+	}
+	if f.JSONName() != nf.JSONName() {
+		c.report(JSON, f, "JSON name changed from %q to %q", f.JSONName(), nf.JSONName())
+	}
+}
+
+// fieldType describes a field's type as a .proto file would spell it.
+func fieldType(f protoreflect.FieldDescriptor) string {
+	if f.IsMap() {
+		return fmt.Sprintf("map<%s, %s>", fieldType(f.MapKey()), fieldType(f.MapValue()))
+	}
+	var t string
+	switch f.Kind() {
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		t = string(f.Message().FullName())
+	case protoreflect.EnumKind:
+		t = string(f.Enum().FullName())
+	default:
+		t = f.Kind().String()
+	}
+	if f.IsList() {
+		return "repeated " + t
+	}
+	return t
+}
+
+func (c *comparer) enums(es protoreflect.EnumDescriptors) {
+	for i := 0; i < es.Len(); i++ {
+		e := es.Get(i)
+		ne, ok := c.find(e.FullName()).(protoreflect.EnumDescriptor)
+		if !ok {
+			c.report(Wire, e, "enum removed")
+			continue
+		}
+		for j := 0; j < e.Values().Len(); j++ {
+			v := e.Values().Get(j)
+			nv := ne.Values().ByNumber(v.Number())
+			switch {
+			case nv == nil && ne.Values().ByName(v.Name()) != nil:
+				c.report(Wire, e, "value %s renumbered from %d to %d", v.Name(), v.Number(), ne.Values().ByName(v.Name()).Number())
+			case nv == nil:
+				c.report(Wire, e, "value %s (%d) removed", v.Name(), v.Number())
+			case nv.Name() != v.Name():
+				// protojson writes enum values by name.
+				c.report(JSON, e, "value %d renamed from %s to %s", v.Number(), v.Name(), nv.Name())
+			}
+		}
+	}
+}
+
+func (c *comparer) service(s protoreflect.ServiceDescriptor) {
+	ns, ok := c.find(s.FullName()).(protoreflect.ServiceDescriptor)
+	if !ok {
+		c.report(Wire, s, "service removed")
+		return
+	}
+	for i := 0; i < s.Methods().Len(); i++ {
+		m := s.Methods().Get(i)
+		nm := ns.Methods().ByName(m.Name())
+		if nm == nil {
+			c.report(Wire, m, "method removed")
+			continue
+		}
+		if m.Input().FullName() != nm.Input().FullName() {
+			c.report(Wire, m, "request type changed from %s to %s", m.Input().FullName(), nm.Input().FullName())
+		}
+		if m.Output().FullName() != nm.Output().FullName() {
+			c.report(Wire, m, "response type changed from %s to %s", m.Output().FullName(), nm.Output().FullName())
+		}
+		if from, to := streaming(m), streaming(nm); from != to {
+			c.report(Wire, m, "streaming changed from %s to %s", from, to)
+		}
+		c.bindings(m, nm)
+	}
+}
+
+func streaming(m protoreflect.MethodDescriptor) string {
+	switch {
+	case m.IsStreamingClient() && m.IsStreamingServer():
+		return "bidirectional"
+	case m.IsStreamingClient():
+		return "client"
+	case m.IsStreamingServer():
+		return "server"
+	}
+	return "unary"
+}
+
+// bindings reports http bindings of m that nm no longer has, or whose body
+// or response_body changed.
+func (c *comparer) bindings(m, nm protoreflect.MethodDescriptor) {
+	now := httpRules(nm)
+	for route, rule := range httpRules(m) {
+		nr, ok := now[route]
+		switch {
+		case !ok:
+			c.report(HTTP, m, "binding %s removed", route)
+		case rule.GetBody() != nr.GetBody():
+			c.report(HTTP, m, "binding %s body changed from %q to %q", route, rule.GetBody(), nr.GetBody())
+		case rule.GetResponseBody() != nr.GetResponseBody():
+			c.report(HTTP, m, "binding %s response_body changed from %q to %q", route, rule.GetResponseBody(), nr.GetResponseBody())
+		}
+	}
+}
+
+// httpRules returns m's google.api.http rule and its additional bindings,
+// keyed by "VERB pattern".
+func httpRules(m protoreflect.MethodDescriptor) map[string]*annotations.HttpRule {
+	rules := map[string]*annotations.HttpRule{}
+	opts, ok := m.Options().(*descriptorpb.MethodOptions)
+	if !ok || opts == nil || !proto.HasExtension(opts, annotations.E_Http) {
+		return rules
+	}
+	var add func(*annotations.HttpRule)
+	add = func(r *annotations.HttpRule) {
+		var verb, path string
+		switch p := r.GetPattern().(type) {
+		case *annotations.HttpRule_Get:
+			verb, path = "GET", p.Get
+		case *annotations.HttpRule_Put:
+			verb, path = "PUT", p.Put
+		case *annotations.HttpRule_Post:
+			verb, path = "POST", p.Post
+		case *annotations.HttpRule_Delete:
+			verb, path = "DELETE", p.Delete
+		case *annotations.HttpRule_Patch:
+			verb, path = "PATCH", p.Patch
+		case *annotations.HttpRule_Custom:
+			verb, path = p.Custom.GetKind(), p.Custom.GetPath()
+		}
+		if path != "" {
+			rules[verb+" "+path] = r
+		}
+		for _, b := range r.GetAdditionalBindings() {
+			add(b)
+		}
+	}
+	add(proto.GetExtension(opts, annotations.E_Http).(*annotations.HttpRule))
+	return rules
+}
+
+// ReadSet reads a FileDescriptorSet, as written by WriteSet or by protoc
+// --include_imports --descriptor_set_out.
+func ReadSet(path string) (*protoregistry.Files, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("parsing descriptor set %s: %w", path, err)
+	}
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("descriptor set %s: %w", path, err)
+	}
+	return files, nil
+}
+
+// NewSet returns a FileDescriptorSet of files and everything they import,
+// dependencies first.
+func NewSet(files ...protoreflect.FileDescriptor) *descriptorpb.FileDescriptorSet {
+	set := &descriptorpb.FileDescriptorSet{}
+	seen := map[string]bool{}
+	var add func(fd protoreflect.FileDescriptor)
+	add = func(fd protoreflect.FileDescriptor) {
+		if seen[fd.Path()] {
+			return
+		}
+		seen[fd.Path()] = true
+		for i := 0; i < fd.Imports().Len(); i++ {
+			add(fd.Imports().Get(i).FileDescriptor)
+		}
+		set.File = append(set.File, protodesc.ToFileDescriptorProto(fd))
+	}
+	for _, fd := range files {
+		add(fd)
+	}
+	return set
+}
+
+// WriteSet writes NewSet(files...) to path.
+func WriteSet(path string, files ...protoreflect.FileDescriptor) error {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(NewSet(files...))
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o644)
+}
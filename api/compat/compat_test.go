@@ -0,0 +1,141 @@
+package compat
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"api/user"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+// edited returns user.proto and its imports with edit applied to user.proto.
+func edited(t *testing.T, edit func(*descriptorpb.FileDescriptorProto)) *protoregistry.Files {
+	t.Helper()
+	set := NewSet(user.File_user_user_proto)
+	fd := set.File[len(set.File)-1]
+	edit(fd)
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		t.Fatalf("edited user.proto: %v", err)
+	}
+	return files
+}
+
+func message(fd *descriptorpb.FileDescriptorProto, name string) *descriptorpb.DescriptorProto {
+	for _, m := range fd.MessageType {
+		if m.GetName() == name {
+			return m
+		}
+	}
+	panic("no message " + name)
+}
+
+func method(fd *descriptorpb.FileDescriptorProto, name string) *descriptorpb.MethodDescriptorProto {
+	for _, m := range fd.Service[0].Method {
+		if m.GetName() == name {
+			return m
+		}
+	}
+	panic("no method " + name)
+}
+
+func TestCompare(t *testing.T) {
+	base := edited(t, func(*descriptorpb.FileDescriptorProto) {})
+	cases := []struct {
+		name string
+		edit func(*descriptorpb.FileDescriptorProto)
+		want string
+	}{
+		{"unchanged", func(*descriptorpb.FileDescriptorProto) {}, ""},
+		{"added field", func(fd *descriptorpb.FileDescriptorProto) {
+			m := message(fd, "User")
+			m.Field = append(m.Field, &descriptorpb.FieldDescriptorProto{
+				Name: proto.String("phone"), JsonName: proto.String("phone"), Number: proto.Int32(4),
+				Type: descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			})
+		}, ""},
+		{"removed field", func(fd *descriptorpb.FileDescriptorProto) {
+			m := message(fd, "User")
+			m.Field = m.Field[:2]
+		}, "wire: user.User.email: field 3 removed"},
+		{"renumbered field", func(fd *descriptorpb.FileDescriptorProto) {
+			message(fd, "User").Field[2].Number = proto.Int32(7)
+		}, "wire: user.User.email: field number changed from 3 to 7"},
+		{"changed type", func(fd *descriptorpb.FileDescriptorProto) {
+			message(fd, "ListUsersRequest").Field[2].Type = descriptorpb.FieldDescriptorProto_TYPE_INT64.Enum()
+		}, "wire: user.ListUsersRequest.page_size: type changed from int32 to int64"},
+		{"changed cardinality", func(fd *descriptorpb.FileDescriptorProto) {
+			message(fd, "WatchUsersRequest").Field[0].Label = descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()
+		}, "wire: user.WatchUsersRequest.types: type changed from repeated user.UserEventType to user.UserEventType"},
+		{"renamed field", func(fd *descriptorpb.FileDescriptorProto) {
+			f := message(fd, "User").Field[2]
+			f.Name, f.JsonName = proto.String("mail"), proto.String("mail")
+		}, `json: user.User.email: JSON name changed from "email" to "mail"`},
+		{"removed message", func(fd *descriptorpb.FileDescriptorProto) {
+			fd.MessageType = fd.MessageType[:len(fd.MessageType)-1]
+			m := method(fd, "BatchCreateUsers")
+			m.OutputType = proto.String(".user.User")
+		}, "wire: user.BatchCreateUsersResponse: message removed\n" +
+			"wire: user.UserService.BatchCreateUsers: response type changed from user.BatchCreateUsersResponse to user.User"},
+		{"renamed enum value", func(fd *descriptorpb.FileDescriptorProto) {
+			fd.EnumType[0].Value[1].Name = proto.String("USER_ADDED")
+		}, "json: user.UserEventType: value 1 renamed from USER_CREATED to USER_ADDED"},
+		{"removed method", func(fd *descriptorpb.FileDescriptorProto) {
+			fd.Service[0].Method = fd.Service[0].Method[1:]
+		}, "wire: user.UserService.GetUser: method removed"},
+		{"streaming", func(fd *descriptorpb.FileDescriptorProto) {
+			method(fd, "ExportUsers").ServerStreaming = proto.Bool(false)
+		}, "wire: user.UserService.ExportUsers: streaming changed from server to unary"},
+		{"removed http binding", func(fd *descriptorpb.FileDescriptorProto) {
+			m := method(fd, "GetUser")
+			proto.SetExtension(m.Options, annotations.E_Http, &annotations.HttpRule{
+				Pattern: &annotations.HttpRule_Get{Get: "/users/{user_id}"},
+			})
+		}, "http: user.UserService.GetUser: binding GET /user/{user_id} removed"},
+		{"changed http body", func(fd *descriptorpb.FileDescriptorProto) {
+			m := method(fd, "CreateUser")
+			rule := proto.Clone(proto.GetExtension(m.Options, annotations.E_Http).(*annotations.HttpRule)).(*annotations.HttpRule)
+			rule.Body = "name"
+			proto.SetExtension(m.Options, annotations.E_Http, rule)
+		}, `http: user.UserService.CreateUser: binding POST /user body changed from "*" to "name"`},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var got []string
+			for _, ch := range Compare(base, edited(t, c.edit)) {
+				got = append(got, ch.String())
+			}
+			if g := strings.Join(got, "\n"); g != c.want {
+				t.Errorf("changes:\n%s\nwant:\n%s", g, c.want)
+			}
+		})
+	}
+}
+
+func TestSetRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "user.binpb")
+	if err := WriteSet(path, user.File_user_user_proto); err != nil {
+		t.Fatal(err)
+	}
+	files, err := ReadSet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes := Compare(files, protoregistry.GlobalFiles); len(changes) != 0 {
+		t.Errorf("round trip changed the protos: %v", changes)
+	}
+	d, err := files.FindDescriptorByName("user.UserService.GetUser")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(httpRules(d.(protoreflect.MethodDescriptor))) != 1 {
+		t.Error("http rule of GetUser lost in round trip")
+	}
+}